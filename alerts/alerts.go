@@ -0,0 +1,325 @@
+// Package alerts evaluates the alert rules of the configuration on the
+// stats and tells their webhooks when they fire.
+//
+// user_count rules are evaluated as events are recorded, total_drop rules
+// every alerts interval. Alerts are delivered in the background, retried
+// with backoff and every attempt is logged in webhook_deliveries.
+package alerts
+
+import (
+	"expvar"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/zwirec/http_service_stat/config"
+	"github.com/zwirec/http_service_stat/dbManager"
+)
+
+// webhooks counts the alerts by "<rule>.fired", "<rule>.delivered",
+// "<rule>.failed" or "<rule>.dropped". It is served with the other expvars
+// at /debug/vars.
+var webhooks = expvar.NewMap("alerts_webhooks")
+
+const (
+	queueSize = 1000
+	workers   = 2
+	// firedTTL is how long fired user_count alerts are remembered, past
+	// the end of their day.
+	firedTTL = 48 * time.Hour
+)
+
+// Alert is the body of a webhook. Its ID is the same for every delivery
+// of an alert, receivers can drop the ones they already have.
+type Alert struct {
+	ID     string `json:"id"`
+	Rule   string `json:"rule"`
+	Type   string `json:"type"`
+	Tenant int    `json:"tenant"`
+	Action string `json:"action"`
+	// User, Date and Threshold are set by user_count rules.
+	User      interface{} `json:"user,omitempty"`
+	Date      string      `json:"date,omitempty"`
+	Threshold int64       `json:"threshold,omitempty"`
+	// From, To, Previous and Drop are set by total_drop rules: Count is
+	// the count from From to To, Previous the count of the window before.
+	From     *time.Time `json:"from,omitempty"`
+	To       *time.Time `json:"to,omitempty"`
+	Previous int64      `json:"previous,omitempty"`
+	Drop     float64    `json:"drop,omitempty"`
+	Count    int64      `json:"count"`
+	Time     time.Time  `json:"time"`
+}
+
+type delivery struct {
+	rule  config.AlertRule
+	alert Alert
+}
+
+// Alerter evaluates the alert rules and delivers their webhooks.
+type Alerter struct {
+	dbm    *dbManager.DBManager
+	logger *log.Logger
+	client *http.Client
+	queue  chan delivery
+
+	minBackoff time.Duration
+	maxBackoff time.Duration
+
+	mu   sync.Mutex
+	conf config.Alerts
+	// fired are the IDs of the user_count alerts fired, by when.
+	fired map[string]time.Time
+	// dropping are the total_drop rules whose last evaluation fired.
+	dropping map[string]bool
+}
+
+func New(dbm *dbManager.DBManager, conf *config.Config, logger *log.Logger) *Alerter {
+	a := &Alerter{
+		dbm:        dbm,
+		logger:     logger,
+		client:     &http.Client{},
+		queue:      make(chan delivery, queueSize),
+		minBackoff: time.Second,
+		maxBackoff: time.Minute,
+		fired:      map[string]time.Time{},
+		dropping:   map[string]bool{},
+	}
+	a.SetRules(conf)
+	return a
+}
+
+// SetRules replaces the rules and delivery settings. Alerts already queued
+// are delivered to the URL of the rule they fired for.
+func (a *Alerter) SetRules(conf *config.Config) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	a.conf = conf.Alerts
+}
+
+func (a *Alerter) settings() config.Alerts {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	return a.conf
+}
+
+// Recorded evaluates the user_count rules of tenant on values, an event
+// PutStats has just recorded. Errors are logged, not returned: they must
+// not fail the event.
+func (a *Alerter) Recorded(tenant int, values map[string]interface{}) {
+	var rules []config.AlertRule
+
+	for _, rule := range a.settings().Rules {
+		if rule.Type == config.AlertUserCount && rule.Tenant == tenant && rule.Action == values["action"] {
+			rules = append(rules, rule)
+		}
+	}
+
+	if len(rules) == 0 {
+		return
+	}
+
+	ts, _ := values["ts"].(string)
+
+	dbm := a.dbm.ForTenant(&dbManager.Tenant{ID: tenant})
+
+	cnt, err := dbm.DailyCount(values["user"], values["action"], ts)
+
+	if err != nil {
+		a.logger.Println("alerts:", err)
+		return
+	}
+
+	date := ts
+
+	if t, err := time.Parse(time.RFC3339, ts); err == nil {
+		date = t.UTC().Format("2006-01-02")
+	}
+
+	for _, rule := range rules {
+		if cnt < rule.Threshold {
+			continue
+		}
+
+		id := fmt.Sprintf("%s:%d:%v:%s", rule.Name, tenant, values["user"], date)
+
+		if !a.markFired(id) {
+			continue
+		}
+
+		// Alerts fired before a restart are not told again.
+		if delivered, err := dbm.Delivered(id); err != nil || delivered {
+			if err != nil {
+				a.logger.Println("alerts:", err)
+				a.unmarkFired(id)
+			}
+			continue
+		}
+
+		a.fire(rule, Alert{
+			ID:        id,
+			Rule:      rule.Name,
+			Type:      rule.Type,
+			Tenant:    tenant,
+			Action:    rule.Action,
+			User:      values["user"],
+			Date:      date,
+			Threshold: rule.Threshold,
+			Count:     cnt,
+			Time:      time.Now().UTC(),
+		})
+	}
+}
+
+// markFired records that the alert id fired and reports whether it had not.
+func (a *Alerter) markFired(id string) bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if _, ok := a.fired[id]; ok {
+		return false
+	}
+
+	a.fired[id] = time.Now()
+	return true
+}
+
+func (a *Alerter) unmarkFired(id string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	delete(a.fired, id)
+}
+
+// forgetFired forgets the user_count alerts fired before before, their
+// days are over.
+func (a *Alerter) forgetFired(before time.Time) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	for id, at := range a.fired {
+		if at.Before(before) {
+			delete(a.fired, id)
+		}
+	}
+}
+
+// EvaluateDrops evaluates the total_drop rules on the windows of whole
+// hours ending before now. A rule fires when the drop starts, not again
+// until the count has recovered. It returns the first error met, after
+// evaluating every rule.
+func (a *Alerter) EvaluateDrops(now time.Time) error {
+	var firstErr error
+
+	end := now.UTC().Truncate(time.Hour)
+
+	for _, rule := range a.settings().Rules {
+		if rule.Type != config.AlertTotalDrop {
+			continue
+		}
+
+		dbm := a.dbm.ForTenant(&dbManager.Tenant{ID: rule.Tenant})
+
+		window := rule.Window.Duration
+		from := end.Add(-window)
+
+		current, err := dbm.ActionCount(rule.Action, from, end)
+
+		if err == nil {
+			var previous int64
+
+			if previous, err = dbm.ActionCount(rule.Action, from.Add(-window), from); err == nil {
+				a.evaluateDrop(rule, from, end, current, previous)
+			}
+		}
+
+		if err != nil {
+			a.logger.Printf("alerts: %s: %v", rule.Name, err)
+
+			if firstErr == nil {
+				firstErr = err
+			}
+		}
+	}
+	return firstErr
+}
+
+func (a *Alerter) evaluateDrop(rule config.AlertRule, from, to time.Time, current, previous int64) {
+	dropped := previous > 0 && previous >= rule.MinCount &&
+		float64(current) <= float64(previous)*(1-rule.Drop)
+
+	a.mu.Lock()
+	wasDropping := a.dropping[rule.Name]
+	a.dropping[rule.Name] = dropped
+	a.mu.Unlock()
+
+	if !dropped || wasDropping {
+		return
+	}
+
+	a.fire(rule, Alert{
+		ID:       fmt.Sprintf("%s:%d:%s", rule.Name, rule.Tenant, to.Format(time.RFC3339)),
+		Rule:     rule.Name,
+		Type:     rule.Type,
+		Tenant:   rule.Tenant,
+		Action:   rule.Action,
+		From:     &from,
+		To:       &to,
+		Previous: previous,
+		Drop:     1 - float64(current)/float64(previous),
+		Count:    current,
+		Time:     time.Now().UTC(),
+	})
+}
+
+// fire queues the delivery of alert. When the queue is full the alert is
+// dropped rather than holding up the events.
+func (a *Alerter) fire(rule config.AlertRule, alert Alert) {
+	webhooks.Add(rule.Name+".fired", 1)
+
+	select {
+	case a.queue <- delivery{rule: rule, alert: alert}:
+	default:
+		webhooks.Add(rule.Name+".dropped", 1)
+		a.logger.Printf("alerts: queue full, dropped %s", alert.ID)
+	}
+}
+
+// Run delivers the alerts fired and evaluates the total_drop rules every
+// alerts interval until stop is closed.
+func (a *Alerter) Run(stop <-chan struct{}) {
+	var wg sync.WaitGroup
+
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+
+			for {
+				select {
+				case <-stop:
+					return
+				case d := <-a.queue:
+					a.deliver(d, stop)
+				}
+			}
+		}()
+	}
+
+	for {
+		select {
+		case <-stop:
+			wg.Wait()
+			return
+		case <-time.After(a.settings().Interval.Duration):
+		}
+
+		a.EvaluateDrops(time.Now())
+		a.forgetFired(time.Now().Add(-firedTTL))
+	}
+}
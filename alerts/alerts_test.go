@@ -0,0 +1,170 @@
+package alerts
+
+import (
+	"log"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/zwirec/http_service_stat/config"
+	"github.com/zwirec/http_service_stat/dbManager"
+)
+
+func newAlerter(t *testing.T, rules ...config.AlertRule) (*Alerter, sqlmock.Sqlmock) {
+	db, mock, err := sqlmock.New()
+
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	t.Cleanup(func() { db.Close() })
+
+	conf := config.Default()
+	conf.Alerts.Rules = rules
+
+	a := New(&dbManager.DBManager{DB: db}, conf, log.New(os.Stdout, "", log.LstdFlags))
+	a.minBackoff = time.Millisecond
+	a.maxBackoff = 5 * time.Millisecond
+
+	return a, mock
+}
+
+// queued returns the alerts waiting to be delivered.
+func queued(a *Alerter) []Alert {
+	var alerts []Alert
+
+	for {
+		select {
+		case d := <-a.queue:
+			alerts = append(alerts, d.alert)
+		default:
+			return alerts
+		}
+	}
+}
+
+func TestRecorded(t *testing.T) {
+	a, mock := newAlerter(t, config.AlertRule{
+		Name:      "likes",
+		Type:      config.AlertUserCount,
+		Tenant:    3,
+		Action:    "like",
+		Threshold: 100,
+		URL:       "http://localhost/hook",
+	})
+
+	event := map[string]interface{}{"user": float64(2), "action": "like", "ts": "2012-02-02T10:00:00Z"}
+
+	// Other actions and tenants are not looked at.
+	a.Recorded(3, map[string]interface{}{"user": float64(2), "action": "login", "ts": "2012-02-02"})
+	a.Recorded(0, event)
+
+	mock.ExpectQuery("SELECT cnt FROM stats").WithArgs(float64(2), "like", "2012-02-02T10:00:00Z", 3).WillReturnRows(
+		sqlmock.NewRows([]string{"cnt"}).AddRow(99))
+
+	a.Recorded(3, event)
+
+	if alerts := queued(a); len(alerts) != 0 {
+		t.Errorf("alerts under the threshold: %+v", alerts)
+	}
+
+	mock.ExpectQuery("SELECT cnt FROM stats").WillReturnRows(sqlmock.NewRows([]string{"cnt"}).AddRow(100))
+	mock.ExpectQuery("FROM webhook_deliveries").WithArgs("likes:3:2:2012-02-02", 3).WillReturnRows(
+		sqlmock.NewRows([]string{"exists"}).AddRow(false))
+
+	a.Recorded(3, event)
+
+	alerts := queued(a)
+
+	if len(alerts) != 1 || alerts[0].ID != "likes:3:2:2012-02-02" || alerts[0].Count != 100 ||
+		alerts[0].Date != "2012-02-02" || alerts[0].User != float64(2) {
+		t.Fatalf("alerts at the threshold: %+v", alerts)
+	}
+
+	// The rule fires once a day for a user.
+	mock.ExpectQuery("SELECT cnt FROM stats").WillReturnRows(sqlmock.NewRows([]string{"cnt"}).AddRow(101))
+
+	a.Recorded(3, event)
+
+	if alerts := queued(a); len(alerts) != 0 {
+		t.Errorf("alerts past the threshold: %+v", alerts)
+	}
+
+	// Nor again after a restart, once delivered.
+	a.forgetFired(time.Now().Add(time.Second))
+
+	mock.ExpectQuery("SELECT cnt FROM stats").WillReturnRows(sqlmock.NewRows([]string{"cnt"}).AddRow(102))
+	mock.ExpectQuery("FROM webhook_deliveries").WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(true))
+
+	a.Recorded(3, event)
+
+	if alerts := queued(a); len(alerts) != 0 {
+		t.Errorf("alerts already delivered: %+v", alerts)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatalf("there were unfulfilled expections: %s", err)
+	}
+}
+
+func TestEvaluateDrops(t *testing.T) {
+	a, mock := newAlerter(t, config.AlertRule{
+		Name:     "logins",
+		Type:     config.AlertTotalDrop,
+		Action:   "login",
+		Window:   config.Duration{Duration: 2 * time.Hour},
+		Drop:     0.5,
+		MinCount: 10,
+		URL:      "http://localhost/hook",
+	})
+
+	now := time.Date(2012, 2, 2, 10, 30, 0, 0, time.UTC)
+	end := time.Date(2012, 2, 2, 10, 0, 0, 0, time.UTC)
+
+	expectCounts := func(current, previous int) {
+		mock.ExpectQuery("FROM stats_hourly").WithArgs("login", end.Add(-2*time.Hour), end, 0).WillReturnRows(
+			sqlmock.NewRows([]string{"sum"}).AddRow(current))
+		mock.ExpectQuery("FROM stats_hourly").WithArgs("login", end.Add(-4*time.Hour), end.Add(-2*time.Hour), 0).WillReturnRows(
+			sqlmock.NewRows([]string{"sum"}).AddRow(previous))
+	}
+
+	// Too few logins before to tell.
+	expectCounts(0, 8)
+
+	if err := a.EvaluateDrops(now); err != nil {
+		t.Fatal(err)
+	}
+
+	expectCounts(40, 100)
+
+	if err := a.EvaluateDrops(now); err != nil {
+		t.Fatal(err)
+	}
+
+	alerts := queued(a)
+
+	if len(alerts) != 1 || alerts[0].Count != 40 || alerts[0].Previous != 100 || alerts[0].Drop != 0.6 ||
+		!alerts[0].To.Equal(end) || alerts[0].ID != "logins:0:2012-02-02T10:00:00Z" {
+		t.Fatalf("alerts of a drop: %+v", alerts)
+	}
+
+	// A drop fires once, until the count recovers.
+	expectCounts(30, 100)
+	expectCounts(80, 100)
+	expectCounts(20, 80)
+
+	for i := 0; i < 3; i++ {
+		if err := a.EvaluateDrops(now); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if alerts := queued(a); len(alerts) != 1 || alerts[0].Count != 20 {
+		t.Errorf("alerts of a drop after one, a recovery and another: %+v", alerts)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatalf("there were unfulfilled expections: %s", err)
+	}
+}
@@ -0,0 +1,175 @@
+package alerts
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/zwirec/http_service_stat/dbManager"
+)
+
+// SignatureHeader carries the signature of a webhook body, see Sign.
+const SignatureHeader = "X-Stat-Signature"
+
+// ErrSignature is returned by Verify for bodies that are not signed with
+// the secret or were signed too long ago.
+var ErrSignature = errors.New("alerts: invalid webhook signature")
+
+// Sign returns the SignatureHeader value of body sent at t: "t=" the Unix
+// time, then ",v1=" the hex HMAC-SHA256 with secret of the time, "." and
+// body. The time is signed so that old deliveries cannot be replayed.
+func Sign(secret string, t time.Time, body []byte) string {
+	ts := strconv.FormatInt(t.Unix(), 10)
+	return "t=" + ts + ",v1=" + signature(secret, ts, body)
+}
+
+func signature(secret, ts string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(ts + "."))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Verify checks header, the SignatureHeader of body, against secret for a
+// receiver at now. Signatures older than tolerance are refused.
+func Verify(secret, header string, body []byte, now time.Time, tolerance time.Duration) error {
+	var ts, sig string
+
+	for _, part := range strings.Split(header, ",") {
+		switch {
+		case strings.HasPrefix(part, "t="):
+			ts = part[2:]
+		case strings.HasPrefix(part, "v1="):
+			sig = part[3:]
+		}
+	}
+
+	unix, err := strconv.ParseInt(ts, 10, 64)
+
+	if err != nil || sig == "" {
+		return ErrSignature
+	}
+
+	if age := now.Sub(time.Unix(unix, 0)); age > tolerance || age < -tolerance {
+		return ErrSignature
+	}
+
+	if !hmac.Equal([]byte(sig), []byte(signature(secret, ts, body))) {
+		return ErrSignature
+	}
+	return nil
+}
+
+// statusError is a response other than 2xx.
+type statusError struct {
+	status int
+}
+
+func (e *statusError) Error() string {
+	return "webhook returned " + http.StatusText(e.status) + " (" + strconv.Itoa(e.status) + ")"
+}
+
+// retryable reports whether a delivery failing with err may succeed later:
+// network errors, timeouts, 429 and 5xx responses.
+func retryable(err error) bool {
+	var se *statusError
+
+	if !errors.As(err, &se) {
+		return true
+	}
+	return se.status == http.StatusRequestTimeout || se.status == http.StatusTooManyRequests || se.status >= 500
+}
+
+// deliver posts d until it is accepted, fails for good, max_attempts is
+// reached or stop is closed. Every attempt is logged.
+func (a *Alerter) deliver(d delivery, stop <-chan struct{}) {
+	body, err := json.Marshal(d.alert)
+
+	if err != nil {
+		a.logger.Println("alerts:", err)
+		return
+	}
+
+	dbm := a.dbm.ForTenant(&dbManager.Tenant{ID: d.alert.Tenant})
+
+	for attempt := 1; ; attempt++ {
+		settings := a.settings()
+
+		status, err := a.send(d, body, settings.Timeout.Duration)
+
+		errText := ""
+
+		if err != nil {
+			errText = err.Error()
+		}
+
+		if logErr := dbm.LogDelivery(d.alert.ID, d.rule.Name, d.rule.URL, attempt, status, errText); logErr != nil {
+			a.logger.Println("alerts:", logErr)
+		}
+
+		if err == nil {
+			webhooks.Add(d.rule.Name+".delivered", 1)
+			return
+		}
+
+		if !retryable(err) || attempt >= settings.MaxAttempts {
+			webhooks.Add(d.rule.Name+".failed", 1)
+			a.logger.Printf("alerts: giving up on %s after %d attempts: %v", d.alert.ID, attempt, err)
+			return
+		}
+
+		wait := a.minBackoff << uint(attempt-1)
+
+		if wait > a.maxBackoff || wait <= 0 {
+			wait = a.maxBackoff
+		}
+
+		select {
+		case <-stop:
+			return
+		case <-time.After(wait):
+		}
+	}
+}
+
+// send posts body, the alert of d, signed with the secret of its rule. It
+// returns the status of the response, zero if none came.
+func (a *Alerter) send(d delivery, body []byte, timeout time.Duration) (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, "POST", d.rule.URL, bytes.NewReader(body))
+
+	if err != nil {
+		return 0, err
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Stat-Alert-ID", d.alert.ID)
+	req.Header.Set(SignatureHeader, Sign(d.rule.Secret, time.Now(), body))
+
+	resp, err := a.client.Do(req)
+
+	if err != nil {
+		return 0, err
+	}
+
+	// Drained so that the connection is reused.
+	io.Copy(ioutil.Discard, io.LimitReader(resp.Body, 64<<10))
+	resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return resp.StatusCode, &statusError{status: resp.StatusCode}
+	}
+	return resp.StatusCode, nil
+}
@@ -0,0 +1,141 @@
+package alerts
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/zwirec/http_service_stat/config"
+)
+
+func TestVerify(t *testing.T) {
+	body := []byte(`{"id":"likes:0:2:2012-02-02"}`)
+	now := time.Now()
+
+	header := Sign("secret", now, body)
+
+	if err := Verify("secret", header, body, now.Add(time.Minute), 5*time.Minute); err != nil {
+		t.Errorf("Verify of a signed body: %v", err)
+	}
+
+	for _, c := range []struct {
+		what, secret, header, body string
+		now                        time.Time
+	}{
+		{"another secret", "other", header, string(body), now},
+		{"a changed body", "secret", header, `{"id":"likes:0:3:2012-02-02"}`, now},
+		{"an old signature", "secret", header, string(body), now.Add(time.Hour)},
+		{"no signature", "secret", "", string(body), now},
+	} {
+		if err := Verify(c.secret, c.header, []byte(c.body), c.now, 5*time.Minute); err != ErrSignature {
+			t.Errorf("Verify with %s: got %v want ErrSignature", c.what, err)
+		}
+	}
+}
+
+func TestWebhook(t *testing.T) {
+	var mu sync.Mutex
+	var received []Alert
+
+	responses := []int{http.StatusServiceUnavailable, http.StatusOK, http.StatusBadRequest}
+
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		body, _ := ioutil.ReadAll(req.Body)
+
+		if err := Verify("secret", req.Header.Get(SignatureHeader), body, time.Now(), time.Minute); err != nil {
+			t.Errorf("receiver: %v", err)
+		}
+
+		var alert Alert
+
+		if err := json.Unmarshal(body, &alert); err != nil {
+			t.Errorf("receiver: %v", err)
+		}
+
+		mu.Lock()
+		defer mu.Unlock()
+
+		received = append(received, alert)
+
+		w.WriteHeader(responses[0])
+		responses = responses[1:]
+	}))
+	defer receiver.Close()
+
+	rule := config.AlertRule{
+		Name:      "likes",
+		Type:      config.AlertUserCount,
+		Action:    "like",
+		Threshold: 100,
+		URL:       receiver.URL,
+		Secret:    "secret",
+	}
+
+	a, mock := newAlerter(t, rule)
+
+	// The second alert may be taken by the other worker before the first
+	// is logged.
+	mock.MatchExpectationsInOrder(false)
+
+	// Retried after the 503, logged at each attempt.
+	mock.ExpectExec("INSERT INTO webhook_deliveries").WithArgs(
+		0, "likes:0:2:2012-02-02", "likes", receiver.URL, 1, 503, "webhook returned Service Unavailable (503)").WillReturnResult(
+		sqlmock.NewResult(1, 1))
+	mock.ExpectExec("INSERT INTO webhook_deliveries").WithArgs(
+		0, "likes:0:2:2012-02-02", "likes", receiver.URL, 2, 200, nil).WillReturnResult(
+		sqlmock.NewResult(2, 1))
+	// Not retried after the 400.
+	mock.ExpectExec("INSERT INTO webhook_deliveries").WithArgs(
+		0, "likes:0:3:2012-02-02", "likes", receiver.URL, 1, 400, "webhook returned Bad Request (400)").WillReturnResult(
+		sqlmock.NewResult(3, 1))
+
+	stop := make(chan struct{})
+	done := make(chan struct{})
+
+	go func() {
+		a.Run(stop)
+		close(done)
+	}()
+
+	a.fire(rule, Alert{ID: "likes:0:2:2012-02-02", Rule: "likes", Action: "like", User: 2, Count: 100})
+
+	deadline := time.Now().Add(time.Second)
+	fired := false
+
+	for mock.ExpectationsWereMet() != nil {
+		mu.Lock()
+		n := len(received)
+		mu.Unlock()
+
+		if n == 2 && !fired {
+			fired = true
+			a.fire(rule, Alert{ID: "likes:0:3:2012-02-02", Rule: "likes", Action: "like", User: 3, Count: 100})
+		}
+
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for the deliveries: %v", mock.ExpectationsWereMet())
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	close(stop)
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Run did not return after stop")
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	if len(received) != 3 || received[0].ID != "likes:0:2:2012-02-02" || received[1].ID != received[0].ID ||
+		received[2].User != float64(3) {
+		t.Errorf("received %+v", received)
+	}
+}
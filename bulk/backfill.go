@@ -0,0 +1,373 @@
+package bulk
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/zwirec/http_service_stat/dbManager"
+)
+
+// DayTotal sums up the counters merged for a day.
+type DayTotal struct {
+	Counters int   `json:"counters"`
+	Count    int64 `json:"count"`
+}
+
+// BackfillReport sums up a backfill, resumed runs included.
+type BackfillReport struct {
+	Merged   int                  `json:"merged"`
+	Rejected int                  `json:"rejected"`
+	Days     map[string]*DayTotal `json:"days"`
+}
+
+// Dates returns the days of the report in order.
+func (r *BackfillReport) Dates() []string {
+	dates := make([]string, 0, len(r.Days))
+
+	for date := range r.Days {
+		dates = append(dates, date)
+	}
+
+	sort.Strings(dates)
+	return dates
+}
+
+// checkpoint is the state of a backfill after its last committed chunk.
+type checkpoint struct {
+	Input  string         `json:"input"`
+	Mode   string         `json:"mode"`
+	Line   int            `json:"line"`
+	Done   bool           `json:"done"`
+	Report BackfillReport `json:"report"`
+}
+
+// Backfiller merges historical daily counters read from CSV (with a
+// "user,action,date,count" header) or NDJSON ({"user": ..., "action": ...,
+// "date": "2006-01-02", "count": ...} per line) into the stats of the tenant
+// of DBManager. A day has no hours in the input, so its counters are also
+// put in the hourly stats at midnight UTC: hourly and time zone top stats
+// and total_drop alerts see the history, the hourly ones in that hour.
+type Backfiller struct {
+	DBManager *dbManager.DBManager
+	// ChunkSize is how many counters are merged per transaction.
+	ChunkSize int
+	// Replace makes the counters replace the stored ones instead of being
+	// added to them.
+	Replace bool
+	// Checkpoint, if set, is the file the progress is saved to after every
+	// chunk. A run given the checkpoint of an interrupted one resumes after
+	// its last committed chunk. The line of the last committed chunk is
+	// also saved in the database, in its transaction, so a chunk committed
+	// just before a crash but not in the file yet is not merged again.
+	Checkpoint string
+	// Progress, if set, gets a line after every chunk.
+	Progress io.Writer
+	// Rejected, if set, gets the rejected records and the reasons as CSV.
+	Rejected io.Writer
+}
+
+// ErrBackfillDone is returned if the checkpoint is of a finished backfill.
+var ErrBackfillDone = errors.New("the checkpoint is of a finished backfill")
+
+// errUnregistered is the reason counters of unregistered users are rejected.
+var errUnregistered = errors.New(`"user" is not registered`)
+
+// Resuming reports whether Run will resume the backfill of input from the
+// checkpoint.
+func (b *Backfiller) Resuming(input string) (bool, error) {
+	cp, _, err := b.loadCheckpoint(input)
+	return cp.Line > 0 || cp.Done, err
+}
+
+// Run backfills the counters read from r; input names it in the checkpoint.
+// Invalid records and counters of unregistered users are rejected and the
+// backfill goes on; a database error stops it.
+func (b *Backfiller) Run(r io.Reader, format, input string) (BackfillReport, error) {
+	cp, saved, err := b.loadCheckpoint(input)
+
+	if err != nil {
+		return cp.Report, err
+	}
+
+	if cp.Done {
+		return cp.Report, ErrBackfillDone
+	}
+
+	report := &cp.Report
+
+	// merged is the line the database says was merged up to, which is
+	// past cp.Line if the run stopped between a commit and its checkpoint.
+	merged := 0
+
+	if b.Checkpoint != "" {
+		if saved {
+			merged, err = b.DBManager.BackfillLine(input)
+		} else {
+			// A fresh backfill forgets any earlier one of input, and has
+			// its checkpoint file before it merges anything.
+			if err = b.DBManager.ResetBackfill(input); err == nil {
+				err = b.saveCheckpoint(cp)
+			}
+		}
+
+		if err != nil {
+			return *report, err
+		}
+	}
+
+	tenant := b.DBManager.Tenant
+
+	if tenant == nil {
+		tenant = &dbManager.Tenant{Actions: dbManager.DefaultActions}
+	}
+
+	records, err := newRecordReader(r, format)
+
+	if err != nil {
+		return *report, err
+	}
+
+	rejected := newRejections(b.Rejected)
+
+	if cp.Line > 0 && b.Rejected != nil {
+		// The header is in the file already.
+		rejected = &rejections{w: csv.NewWriter(b.Rejected)}
+	}
+
+	chunk := make([]map[string]interface{}, 0, b.ChunkSize)
+	// chunkRecords are the records of chunk, to reject those of unknown
+	// users.
+	chunkRecords := make([]record, 0, b.ChunkSize)
+	line := cp.Line
+
+	tally := func(c map[string]interface{}) {
+		total := report.Days[c["date"].(string)]
+
+		if total == nil {
+			total = &DayTotal{}
+			report.Days[c["date"].(string)] = total
+		}
+
+		total.Counters++
+		total.Count += c["cnt"].(int64)
+		report.Merged++
+	}
+
+	flush := func() error {
+		if len(chunk) > 0 {
+			var saved *dbManager.BackfillCheckpoint
+
+			if b.Checkpoint != "" {
+				saved = &dbManager.BackfillCheckpoint{Input: input, Line: line}
+			}
+
+			unknown, err := b.DBManager.MergeStats(chunk, b.Replace, saved)
+
+			if err != nil {
+				return err
+			}
+
+			skipped := make(map[int64]bool, len(unknown))
+
+			for _, user := range unknown {
+				skipped[user] = true
+			}
+
+			for i, c := range chunk {
+				if skipped[c["user"].(int64)] {
+					rejected.add(chunkRecords[i], errUnregistered)
+					report.Rejected++
+				} else {
+					tally(c)
+				}
+			}
+		}
+
+		chunk = chunk[:0]
+		chunkRecords = chunkRecords[:0]
+
+		// Rejections are only written along with the checkpoint so that a
+		// resumed run neither repeats nor loses them.
+		if err := rejected.flush(); err != nil {
+			return err
+		}
+
+		cp.Line = line
+
+		if err := b.saveCheckpoint(cp); err != nil {
+			return err
+		}
+
+		if b.Progress != nil {
+			fmt.Fprintf(b.Progress, "backfill: line %d, %d merged, %d rejected\n", line, report.Merged, report.Rejected)
+		}
+		return nil
+	}
+
+	for {
+		rec, err := records.Next()
+
+		if err == io.EOF {
+			break
+		}
+
+		if err != nil {
+			return *report, err
+		}
+
+		if rec.line <= cp.Line {
+			continue
+		}
+
+		line = rec.line
+
+		if rec.err == nil {
+			var counter map[string]interface{}
+
+			if counter, rec.err = validateCounter(rec.values, tenant); rec.err == nil {
+				if rec.line <= merged {
+					// Committed already, only its checkpoint file was lost.
+					// Counters of unregistered users are counted as merged.
+					tally(counter)
+				} else {
+					chunk = append(chunk, counter)
+					chunkRecords = append(chunkRecords, rec)
+				}
+			}
+		}
+
+		if rec.err != nil {
+			rejected.add(rec, rec.err)
+			report.Rejected++
+		}
+
+		if len(chunk) >= b.ChunkSize {
+			if err := flush(); err != nil {
+				return *report, err
+			}
+		}
+	}
+
+	if err := flush(); err != nil {
+		return *report, err
+	}
+
+	cp.Done = true
+	return *report, b.saveCheckpoint(cp)
+}
+
+func (b *Backfiller) mode() string {
+	if b.Replace {
+		return "replace"
+	}
+	return "add"
+}
+
+// loadCheckpoint returns the checkpoint of input and true, or a fresh one
+// and false if there is none.
+func (b *Backfiller) loadCheckpoint(input string) (checkpoint, bool, error) {
+	cp := checkpoint{Input: input, Mode: b.mode(), Report: BackfillReport{Days: map[string]*DayTotal{}}}
+
+	if b.Checkpoint == "" {
+		return cp, false, nil
+	}
+
+	data, err := ioutil.ReadFile(b.Checkpoint)
+
+	if os.IsNotExist(err) {
+		return cp, false, nil
+	}
+
+	if err != nil {
+		return cp, false, err
+	}
+
+	var saved checkpoint
+
+	if err := json.Unmarshal(data, &saved); err != nil {
+		return cp, false, fmt.Errorf("cannot read the checkpoint %s: %s", b.Checkpoint, err)
+	}
+
+	if saved.Input != input || saved.Mode != cp.Mode {
+		return cp, false, fmt.Errorf("the checkpoint %s is of a %s backfill of %s", b.Checkpoint, saved.Mode, saved.Input)
+	}
+
+	if saved.Report.Days == nil {
+		saved.Report.Days = map[string]*DayTotal{}
+	}
+	return saved, true, nil
+}
+
+// saveCheckpoint replaces the checkpoint file atomically.
+func (b *Backfiller) saveCheckpoint(cp checkpoint) error {
+	if b.Checkpoint == "" {
+		return nil
+	}
+
+	data, err := json.Marshal(cp)
+
+	if err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(b.Checkpoint), filepath.Base(b.Checkpoint)+".*")
+
+	if err != nil {
+		return err
+	}
+
+	if _, err = tmp.Write(data); err == nil {
+		err = tmp.Sync()
+	}
+
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+
+	if err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), b.Checkpoint)
+}
+
+// validateCounter checks a record against the catalogue of tenant and
+// converts its fields for MergeStats.
+func validateCounter(values map[string]interface{}, tenant *dbManager.Tenant) (map[string]interface{}, error) {
+	if values["user"] == nil || values["action"] == nil || values["date"] == nil || values["count"] == nil || len(values) != 4 {
+		return nil, errors.New(`missing or unexpected fields (use "user", "action", "date" and "count")`)
+	}
+
+	user, ok := integer(values["user"])
+
+	if !ok || user <= 0 {
+		return nil, errors.New(`"user" must be a positive integer`)
+	}
+
+	if action, _ := values["action"].(string); !tenant.HasAction(action) {
+		return nil, fmt.Errorf(`"action" must be one of %s`, strings.Join(tenant.Actions, ", "))
+	}
+
+	date, _ := values["date"].(string)
+
+	if _, err := time.Parse("2006-01-02", date); err != nil {
+		return nil, errors.New(`"date" must be a date (YYYY-MM-DD)`)
+	}
+
+	count, ok := integer(values["count"])
+
+	if !ok || count < 0 || count > 1<<31-1 {
+		return nil, errors.New(`"count" must be a non-negative 32-bit integer`)
+	}
+
+	return map[string]interface{}{"user": user, "action": values["action"], "date": date, "cnt": count}, nil
+}
@@ -0,0 +1,182 @@
+package bulk
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+const (
+	FormatCSV    = "csv"
+	FormatNDJSON = "ndjson"
+)
+
+// FormatOf guesses the format of filename from its extension.
+func FormatOf(filename string) (string, error) {
+	switch strings.ToLower(filepath.Ext(filename)) {
+	case ".csv":
+		return FormatCSV, nil
+	case ".ndjson", ".jsonl":
+		return FormatNDJSON, nil
+	}
+	return "", fmt.Errorf("cannot tell the format of %s (use -format csv or ndjson)", filename)
+}
+
+// record is an input record, raw is its text for the rejections file.
+type record struct {
+	line   int
+	raw    string
+	values map[string]interface{}
+	err    error
+}
+
+// recordReader reads records of either format as field name to value maps.
+type recordReader interface {
+	// Next returns io.EOF after the last record.
+	Next() (record, error)
+}
+
+func newRecordReader(r io.Reader, format string) (recordReader, error) {
+	switch format {
+	case FormatCSV:
+		cr := csv.NewReader(r)
+		cr.FieldsPerRecord = -1
+		cr.ReuseRecord = true
+
+		header, err := cr.Read()
+
+		if err != nil {
+			return nil, fmt.Errorf("cannot read the CSV header: %s", err)
+		}
+
+		return &csvReader{r: cr, header: append([]string(nil), header...), line: 1}, nil
+	case FormatNDJSON:
+		s := bufio.NewScanner(r)
+		s.Buffer(make([]byte, 64*1024), 1<<20)
+		return &ndjsonReader{s: s}, nil
+	}
+	return nil, fmt.Errorf("unknown format %q (use csv or ndjson)", format)
+}
+
+type csvReader struct {
+	r      *csv.Reader
+	header []string
+	line   int
+}
+
+func (c *csvReader) Next() (record, error) {
+	fields, err := c.r.Read()
+
+	if err == io.EOF {
+		return record{}, err
+	}
+
+	c.line++
+
+	rec := record{line: c.line, raw: strings.Join(fields, ",")}
+
+	if err != nil {
+		if _, ok := err.(*csv.ParseError); !ok {
+			return rec, err
+		}
+		rec.err = err
+		return rec, nil
+	}
+
+	if len(fields) != len(c.header) {
+		rec.err = fmt.Errorf("has %d fields, the header %d", len(fields), len(c.header))
+		return rec, nil
+	}
+
+	rec.values = map[string]interface{}{}
+
+	for i, name := range c.header {
+		if fields[i] != "" {
+			rec.values[name] = fields[i]
+		}
+	}
+	return rec, nil
+}
+
+type ndjsonReader struct {
+	s    *bufio.Scanner
+	line int
+}
+
+func (n *ndjsonReader) Next() (record, error) {
+	for n.s.Scan() {
+		n.line++
+
+		line := bytes.TrimSpace(n.s.Bytes())
+
+		if len(line) == 0 {
+			continue
+		}
+
+		rec := record{line: n.line, raw: string(line)}
+
+		d := json.NewDecoder(bytes.NewReader(line))
+		d.UseNumber()
+
+		if err := d.Decode(&rec.values); err != nil {
+			rec.err = fmt.Errorf("is not a JSON object: %s", err)
+		}
+		return rec, nil
+	}
+
+	if err := n.s.Err(); err != nil {
+		return record{}, err
+	}
+	return record{}, io.EOF
+}
+
+// integer converts a CSV field or JSON value to an integer.
+func integer(v interface{}) (int64, bool) {
+	switch v := v.(type) {
+	case string:
+		n, err := strconv.ParseInt(strings.TrimSpace(v), 10, 64)
+		return n, err == nil
+	case json.Number:
+		n, err := v.Int64()
+		return n, err == nil
+	}
+	return 0, false
+}
+
+// rejections writes the rejected records as CSV: line, reason, record.
+type rejections struct {
+	w *csv.Writer
+	n int
+}
+
+func newRejections(w io.Writer) *rejections {
+	r := &rejections{}
+
+	if w != nil {
+		r.w = csv.NewWriter(w)
+		r.w.Write([]string{"line", "reason", "record"})
+	}
+	return r
+}
+
+func (r *rejections) add(rec record, reason error) {
+	r.n++
+
+	if r.w != nil {
+		r.w.Write([]string{strconv.Itoa(rec.line), reason.Error(), rec.raw})
+	}
+}
+
+func (r *rejections) flush() error {
+	if r.w == nil {
+		return nil
+	}
+	r.w.Flush()
+	return r.w.Error()
+}
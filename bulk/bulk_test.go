@@ -0,0 +1,384 @@
+package bulk
+
+import (
+	"bytes"
+	"database/sql/driver"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/zwirec/http_service_stat/dbManager"
+)
+
+func expectCopyUsers(mock sqlmock.Sqlmock, users ...[]driver.Value) {
+	mock.ExpectBegin()
+	mock.ExpectExec("CREATE TEMP TABLE users_import").WillReturnResult(sqlmock.NewResult(0, 0))
+
+	copy := mock.ExpectPrepare(`COPY "users_import"`)
+
+	for _, user := range users {
+		copy.ExpectExec().WithArgs(user...).WillReturnResult(sqlmock.NewResult(0, 0))
+	}
+
+	copy.ExpectExec().WithArgs().WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec("INSERT INTO users").WillReturnResult(sqlmock.NewResult(0, int64(len(users))))
+	mock.ExpectCommit()
+}
+
+// expectPendingUsers expects the query of the users with queued events
+// after a batch.
+func expectPendingUsers(mock sqlmock.Sqlmock, users ...int64) {
+	rows := sqlmock.NewRows([]string{"user"})
+
+	for _, user := range users {
+		rows.AddRow(user)
+	}
+
+	mock.ExpectQuery("FROM pending_stats").WithArgs(0).WillReturnRows(rows)
+}
+
+func TestImportUsers(t *testing.T) {
+	for _, test := range []struct {
+		format        string
+		rejectedLines [2]string
+		input         string
+	}{
+		{FormatCSV, [2]string{"3,", "4,"}, "sex,id,age\nM,1,20\nF,2\nX,3,30\nF,4,18\nM,5,40\n"},
+		{FormatNDJSON, [2]string{"2,", "3,"}, `{"id": 1, "age": 20, "sex": "M"}
+{"id": "2", "age": "18"
+{"id": 3, "age": 30, "sex": "X"}
+
+{"id": "4", "age": "18", "sex": "F"}
+{"id": 5, "age": 40, "sex": "M"}
+`},
+	} {
+		db, mock, err := sqlmock.New()
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		expectCopyUsers(mock, []driver.Value{1, 20, "M"}, []driver.Value{4, 18, "F"})
+		expectPendingUsers(mock)
+		expectCopyUsers(mock, []driver.Value{5, 40, "M"})
+
+		// User 5 had an event queued.
+		expectPendingUsers(mock, 5)
+		mock.ExpectBegin()
+		mock.ExpectExec("pg_advisory_xact_lock").WithArgs(0, 5).WillReturnResult(sqlmock.NewResult(0, 0))
+		mock.ExpectQuery("DELETE FROM pending_stats").WithArgs(5, 0).WillReturnRows(
+			sqlmock.NewRows([]string{"user", "action", "ts", "event_id"}).AddRow("5", "like", time.Date(2012, 2, 2, 10, 0, 0, 0, time.UTC), nil))
+		mock.ExpectExec("INSERT INTO events").WithArgs("5", "like", "2012-02-02T10:00:00Z", nil, 0).WillReturnResult(
+			sqlmock.NewResult(1, 1))
+		mock.ExpectExec("INSERT INTO stats ").WillReturnResult(sqlmock.NewResult(1, 1))
+		mock.ExpectExec("INSERT INTO stats_hourly").WillReturnResult(sqlmock.NewResult(1, 1))
+		mock.ExpectCommit()
+
+		var progress, rejected bytes.Buffer
+
+		imp := UserImporter{DBManager: &dbManager.DBManager{DB: db}, BatchSize: 2, Progress: &progress, Rejected: &rejected}
+
+		report, err := imp.Import(strings.NewReader(test.input), test.format)
+
+		if err != nil {
+			t.Fatalf("%s: %s", test.format, err)
+		}
+
+		if report.Imported != 3 || report.Rejected != 2 || report.Applied != 1 {
+			t.Errorf("%s: unexpected report %+v", test.format, report)
+		}
+
+		if lines := strings.Split(strings.TrimSpace(rejected.String()), "\n"); len(lines) != 3 ||
+			!strings.HasPrefix(lines[1], test.rejectedLines[0]) || !strings.HasPrefix(lines[2], test.rejectedLines[1]) {
+			t.Errorf("%s: unexpected rejections %q", test.format, rejected.String())
+		}
+
+		if strings.Count(progress.String(), "\n") != 2 {
+			t.Errorf("%s: unexpected progress %q", test.format, progress.String())
+		}
+
+		if err := mock.ExpectationsWereMet(); err != nil {
+			t.Fatalf("%s: there were unfulfilled expections: %s", test.format, err)
+		}
+	}
+}
+
+func TestExportUsers(t *testing.T) {
+	db, mock, err := sqlmock.New()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mock.ExpectQuery("FROM users").WillReturnRows(
+		sqlmock.NewRows([]string{"id", "age", "sex"}).AddRow(1, 20, "M").AddRow(2, nil, nil))
+
+	var out bytes.Buffer
+
+	n, err := ExportUsers(&dbManager.DBManager{DB: db}, &out, FormatNDJSON)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := `{"age":20,"id":1,"sex":"M"}` + "\n" + `{"age":null,"id":2,"sex":null}` + "\n"
+
+	if n != 2 || out.String() != want {
+		t.Errorf("unexpected export of %d users: %q", n, out.String())
+	}
+}
+
+// Users registered by their first event, without age and sex, can be
+// imported back.
+func TestExportImportPlaceholder(t *testing.T) {
+	for _, format := range []string{FormatCSV, FormatNDJSON} {
+		db, mock, err := sqlmock.New()
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		dbm := &dbManager.DBManager{DB: db}
+
+		mock.ExpectQuery("FROM users").WillReturnRows(
+			sqlmock.NewRows([]string{"id", "age", "sex"}).AddRow(1, 20, "M").AddRow(2, nil, nil))
+
+		var out bytes.Buffer
+
+		if _, err := ExportUsers(dbm, &out, format); err != nil {
+			t.Fatalf("%s: %s", format, err)
+		}
+
+		expectCopyUsers(mock, []driver.Value{1, 20, "M"}, []driver.Value{2, nil, nil})
+		expectPendingUsers(mock)
+
+		imp := UserImporter{DBManager: dbm, BatchSize: 10}
+
+		report, err := imp.Import(&out, format)
+
+		if err != nil {
+			t.Fatalf("%s: %s", format, err)
+		}
+
+		if report.Imported != 2 || report.Rejected != 0 {
+			t.Errorf("%s: unexpected report %+v", format, report)
+		}
+
+		if err := mock.ExpectationsWereMet(); err != nil {
+			t.Fatalf("%s: there were unfulfilled expections: %s", format, err)
+		}
+	}
+}
+
+func expectMergeStats(mock sqlmock.Sqlmock, counters ...[]driver.Value) *sqlmock.ExpectedExec {
+	mock.ExpectQuery("SELECT to_regclass").WithArgs("stats_2017_03").
+		WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(true))
+	mock.ExpectBegin()
+	mock.ExpectExec("CREATE TEMP TABLE stats_backfill").WillReturnResult(sqlmock.NewResult(0, 0))
+
+	copy := mock.ExpectPrepare(`COPY "stats_backfill"`)
+
+	for _, counter := range counters {
+		copy.ExpectExec().WithArgs(counter...).WillReturnResult(sqlmock.NewResult(0, 0))
+	}
+
+	copy.ExpectExec().WithArgs().WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectQuery("FROM stats_backfill").WithArgs(0).WillReturnRows(sqlmock.NewRows([]string{"user"}))
+	return mock.ExpectExec("INSERT INTO stats (.+) DO UPDATE SET cnt = stats.cnt [+] EXCLUDED.cnt")
+}
+
+func TestBackfillResumes(t *testing.T) {
+	db, mock, err := sqlmock.New()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir, err := ioutil.TempDir("", "backfill")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	input := "user,action,date,count\n1,login,2017-03-01,5\n2,like,2017-03-01,3\n" +
+		"3,jump,2017-03-02,1\n3,like,2017-03-02,7\n"
+
+	mock.ExpectExec("DELETE FROM backfill_checkpoints").WithArgs(0, "stats.csv").WillReturnResult(sqlmock.NewResult(0, 0))
+	expectMergeStats(mock, []driver.Value{1, "login", "2017-03-01", 5}, []driver.Value{2, "like", "2017-03-01", 3}).
+		WillReturnResult(sqlmock.NewResult(0, 2))
+	mock.ExpectExec("INSERT INTO stats_hourly (.+) DO UPDATE SET cnt = stats_hourly.cnt [+] EXCLUDED.cnt").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("pg_advisory_xact_lock_shared").WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("DELETE FROM leaderboard_days").WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("INSERT INTO backfill_checkpoints").WithArgs(0, "stats.csv", 3).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+	expectMergeStats(mock, []driver.Value{3, "like", "2017-03-02", 7}).
+		WillReturnError(errors.New("connection reset"))
+	mock.ExpectRollback()
+
+	var rejected bytes.Buffer
+
+	b := Backfiller{
+		DBManager:  &dbManager.DBManager{DB: db},
+		ChunkSize:  2,
+		Checkpoint: filepath.Join(dir, "checkpoint"),
+		Rejected:   &rejected,
+	}
+
+	if _, err := b.Run(strings.NewReader(input), FormatCSV, "stats.csv"); err == nil {
+		t.Fatal("the failed chunk was not reported")
+	}
+
+	if resuming, err := b.Resuming("stats.csv"); err != nil || !resuming {
+		t.Fatalf("the backfill does not resume: %v", err)
+	}
+
+	mock.ExpectQuery("FROM backfill_checkpoints").WithArgs(0, "stats.csv").WillReturnRows(
+		sqlmock.NewRows([]string{"line"}).AddRow(3))
+	expectMergeStats(mock, []driver.Value{3, "like", "2017-03-02", 7}).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("INSERT INTO stats_hourly (.+) DO UPDATE SET cnt = stats_hourly.cnt [+] EXCLUDED.cnt").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("pg_advisory_xact_lock_shared").WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("DELETE FROM leaderboard_days").WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("INSERT INTO backfill_checkpoints").WithArgs(0, "stats.csv", 5).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+
+	report, err := b.Run(strings.NewReader(input), FormatCSV, "stats.csv")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if report.Merged != 3 || report.Rejected != 1 ||
+		*report.Days["2017-03-01"] != (DayTotal{Counters: 2, Count: 8}) ||
+		*report.Days["2017-03-02"] != (DayTotal{Counters: 1, Count: 7}) {
+		t.Errorf("unexpected report %+v", report)
+	}
+
+	if lines := strings.Split(strings.TrimSpace(rejected.String()), "\n"); len(lines) != 2 || !strings.HasPrefix(lines[1], "4,") {
+		t.Errorf("unexpected rejections %q", rejected.String())
+	}
+
+	if _, err := b.Run(strings.NewReader(input), FormatCSV, "stats.csv"); err != ErrBackfillDone {
+		t.Errorf("a finished backfill was run again: %v", err)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatalf("there were unfulfilled expections: %s", err)
+	}
+}
+
+func TestBackfillCommittedChunk(t *testing.T) {
+	db, mock, err := sqlmock.New()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir, err := ioutil.TempDir("", "backfill")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	input := "user,action,date,count\n1,login,2017-03-01,5\n2,like,2017-03-01,3\n3,like,2017-03-02,7\n"
+
+	b := Backfiller{
+		DBManager:  &dbManager.DBManager{DB: db},
+		ChunkSize:  2,
+		Checkpoint: filepath.Join(dir, "checkpoint"),
+	}
+
+	// The run stopped after committing its first chunk but before saving
+	// it to the checkpoint file.
+	if err = b.saveCheckpoint(checkpoint{Input: "stats.csv", Mode: "add"}); err != nil {
+		t.Fatal(err)
+	}
+
+	mock.ExpectQuery("FROM backfill_checkpoints").WithArgs(0, "stats.csv").WillReturnRows(
+		sqlmock.NewRows([]string{"line"}).AddRow(3))
+	expectMergeStats(mock, []driver.Value{3, "like", "2017-03-02", 7}).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("INSERT INTO stats_hourly (.+) DO UPDATE SET cnt = stats_hourly.cnt [+] EXCLUDED.cnt").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("pg_advisory_xact_lock_shared").WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("DELETE FROM leaderboard_days").WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("INSERT INTO backfill_checkpoints").WithArgs(0, "stats.csv", 4).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+
+	report, err := b.Run(strings.NewReader(input), FormatCSV, "stats.csv")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if report.Merged != 3 || *report.Days["2017-03-01"] != (DayTotal{Counters: 2, Count: 8}) {
+		t.Errorf("unexpected report %+v", report)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatalf("there were unfulfilled expections: %s", err)
+	}
+}
+
+func TestBackfillUnknownUsers(t *testing.T) {
+	db, mock, err := sqlmock.New()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	input := "user,action,date,count\n1,login,2017-03-01,5\n9,like,2017-03-01,3\n1,like,2017-03-02,7\n"
+
+	mock.ExpectQuery("SELECT to_regclass").WithArgs("stats_2017_03").
+		WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(true))
+	mock.ExpectBegin()
+	mock.ExpectExec("CREATE TEMP TABLE stats_backfill").WillReturnResult(sqlmock.NewResult(0, 0))
+
+	copy := mock.ExpectPrepare(`COPY "stats_backfill"`)
+	copy.ExpectExec().WithArgs(1, "login", "2017-03-01", 5).WillReturnResult(sqlmock.NewResult(0, 0))
+	copy.ExpectExec().WithArgs(9, "like", "2017-03-01", 3).WillReturnResult(sqlmock.NewResult(0, 0))
+	copy.ExpectExec().WithArgs(1, "like", "2017-03-02", 7).WillReturnResult(sqlmock.NewResult(0, 0))
+	copy.ExpectExec().WithArgs().WillReturnResult(sqlmock.NewResult(0, 0))
+
+	mock.ExpectQuery("FROM stats_backfill").WithArgs(0).WillReturnRows(sqlmock.NewRows([]string{"user"}).AddRow(9))
+	mock.ExpectExec("INSERT INTO stats (.+) FROM stats_backfill b\\s+WHERE exists").WillReturnResult(sqlmock.NewResult(0, 2))
+	mock.ExpectExec("INSERT INTO stats_hourly (.+) DO UPDATE SET cnt = stats_hourly.cnt [+] EXCLUDED.cnt").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("pg_advisory_xact_lock_shared").WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("DELETE FROM leaderboard_days").WillReturnResult(sqlmock.NewResult(0, 2))
+	mock.ExpectCommit()
+
+	var rejected bytes.Buffer
+
+	b := Backfiller{DBManager: &dbManager.DBManager{DB: db}, ChunkSize: 10, Rejected: &rejected}
+
+	report, err := b.Run(strings.NewReader(input), FormatCSV, "stats.csv")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if report.Merged != 2 || report.Rejected != 1 || *report.Days["2017-03-01"] != (DayTotal{Counters: 1, Count: 5}) {
+		t.Errorf("unexpected report %+v", report)
+	}
+
+	if lines := strings.Split(strings.TrimSpace(rejected.String()), "\n"); len(lines) != 2 ||
+		!strings.HasPrefix(lines[1], `3,"""user"" is not registered",`) {
+		t.Errorf("unexpected rejections %q", rejected.String())
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatalf("there were unfulfilled expections: %s", err)
+	}
+}
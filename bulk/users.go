@@ -0,0 +1,240 @@
+package bulk
+
+import (
+	"database/sql"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+
+	"github.com/zwirec/http_service_stat/dbManager"
+)
+
+// Report sums up an import.
+type Report struct {
+	Imported int
+	Rejected int
+	// Applied counts the events queued for the users before they were
+	// imported, applied after their batch.
+	Applied int64
+}
+
+// UserImporter upserts users read from CSV (with an "id,age,sex" header)
+// or NDJSON ({"id": ..., "age": ..., "sex": ...} per line). The events
+// queued for the users, under the "queue" unknown user policy, are applied
+// after each batch.
+type UserImporter struct {
+	DBManager *dbManager.DBManager
+	// BatchSize is how many users are copied per transaction.
+	BatchSize int
+	// Progress, if set, gets a line after every batch.
+	Progress io.Writer
+	// Rejected, if set, gets the rejected records and the reasons as CSV.
+	Rejected io.Writer
+}
+
+// Import reads every record of r. Invalid records are rejected and the
+// import goes on; a database error stops it.
+func (imp *UserImporter) Import(r io.Reader, format string) (Report, error) {
+	var report Report
+
+	records, err := newRecordReader(r, format)
+
+	if err != nil {
+		return report, err
+	}
+
+	rejected := newRejections(imp.Rejected)
+	defer rejected.flush()
+
+	batch := make([]map[string]interface{}, 0, imp.BatchSize)
+
+	flush := func() error {
+		if len(batch) == 0 {
+			return nil
+		}
+
+		if _, err := imp.DBManager.CopyUsers(batch); err != nil {
+			return err
+		}
+
+		users, err := imp.DBManager.PendingUsers()
+
+		if err != nil {
+			return err
+		}
+
+		for _, user := range users {
+			applied, err := imp.DBManager.ApplyPendingStats(user)
+
+			if err != nil {
+				return err
+			}
+			report.Applied += applied
+		}
+
+		report.Imported += len(batch)
+		report.Rejected = rejected.n
+		batch = batch[:0]
+
+		if imp.Progress != nil {
+			fmt.Fprintf(imp.Progress, "import-users: %d imported, %d rejected\n", report.Imported, report.Rejected)
+		}
+		return nil
+	}
+
+	for {
+		rec, err := records.Next()
+
+		if err == io.EOF {
+			break
+		}
+
+		if err != nil {
+			return report, err
+		}
+
+		if rec.err != nil {
+			rejected.add(rec, rec.err)
+			continue
+		}
+
+		user, err := validateUser(rec.values)
+
+		if err != nil {
+			rejected.add(rec, err)
+			continue
+		}
+
+		if batch = append(batch, user); len(batch) >= imp.BatchSize {
+			if err := flush(); err != nil {
+				return report, err
+			}
+		}
+	}
+
+	err = flush()
+	report.Rejected = rejected.n
+
+	if err != nil {
+		return report, err
+	}
+	return report, rejected.flush()
+}
+
+var errUserFields = errors.New(`missing or unexpected fields (use "id", "age" and "sex")`)
+
+// validateUser checks a record the way POST /api/users does and converts
+// its fields for CopyUsers. A record with neither age nor sex, as
+// ExportUsers writes the users registered by their first event, is such a
+// user.
+func validateUser(values map[string]interface{}) (map[string]interface{}, error) {
+	for name := range values {
+		if name != "id" && name != "age" && name != "sex" {
+			return nil, errUserFields
+		}
+	}
+
+	if values["id"] == nil {
+		return nil, errUserFields
+	}
+
+	id, ok := integer(values["id"])
+
+	if !ok || id <= 0 {
+		return nil, errors.New(`"id" must be a positive integer`)
+	}
+
+	if blank(values["age"]) && blank(values["sex"]) {
+		return map[string]interface{}{"id": id, "age": nil, "sex": nil}, nil
+	}
+
+	if values["age"] == nil || values["sex"] == nil {
+		return nil, errUserFields
+	}
+
+	age, ok := integer(values["age"])
+
+	if !ok || age < 0 {
+		return nil, errors.New(`"age" must be a non-negative integer`)
+	}
+
+	if sex, _ := values["sex"].(string); sex != "M" && sex != "F" {
+		return nil, errors.New(`"sex" must be "M" or "F"`)
+	}
+
+	return map[string]interface{}{"id": id, "age": age, "sex": values["sex"]}, nil
+}
+
+// blank reports whether a field is missing, null in NDJSON or empty in CSV.
+func blank(v interface{}) bool {
+	return v == nil || v == ""
+}
+
+// ExportUsers writes every user to w and returns how many were written.
+func ExportUsers(dbm *dbManager.DBManager, w io.Writer, format string) (int, error) {
+	if format != FormatCSV && format != FormatNDJSON {
+		return 0, fmt.Errorf("unknown format %q (use csv or ndjson)", format)
+	}
+
+	rows, err := dbm.ExportUsers()
+
+	if err != nil {
+		return 0, err
+	}
+
+	defer rows.Close()
+
+	cw := csv.NewWriter(w)
+	enc := json.NewEncoder(w)
+
+	if format == FormatCSV {
+		cw.Write([]string{"id", "age", "sex"})
+	}
+
+	n := 0
+
+	for rows.Next() {
+		var id int64
+		var age sql.NullInt64
+		var sex sql.NullString
+
+		if err := rows.Scan(&id, &age, &sex); err != nil {
+			return n, err
+		}
+
+		if format == FormatCSV {
+			var ageField string
+
+			if age.Valid {
+				ageField = strconv.FormatInt(age.Int64, 10)
+			}
+			err = cw.Write([]string{strconv.FormatInt(id, 10), ageField, sex.String})
+		} else {
+			user := map[string]interface{}{"id": id, "age": nil, "sex": nil}
+
+			if age.Valid {
+				user["age"] = age.Int64
+			}
+
+			if sex.Valid {
+				user["sex"] = sex.String
+			}
+			err = enc.Encode(user)
+		}
+
+		if err != nil {
+			return n, err
+		}
+		n++
+	}
+
+	if err := rows.Err(); err != nil {
+		return n, err
+	}
+
+	cw.Flush()
+	return n, cw.Error()
+}
@@ -0,0 +1,168 @@
+package cache
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"sync"
+	"time"
+)
+
+// Entry is a cached response body.
+type Entry struct {
+	Body []byte
+	ETag string
+
+	from, to time.Time
+	expires  time.Time
+}
+
+// Cache keeps responses of queries over a time range. Entries expire after
+// a short TTL if the range reaches today and after a long one otherwise,
+// and are dropped as soon as data inside their range is written.
+type Cache struct {
+	mu      sync.Mutex
+	entries map[string]*Entry
+	// gen counts the invalidations, so that responses read before one are
+	// not stored after it.
+	gen        uint64
+	maxEntries int
+	pastTTL    time.Duration
+	todayTTL   time.Duration
+	now        func() time.Time
+}
+
+func New(maxEntries int, pastTTL, todayTTL time.Duration) *Cache {
+	return &Cache{
+		entries:    make(map[string]*Entry),
+		maxEntries: maxEntries,
+		pastTTL:    pastTTL,
+		todayTTL:   todayTTL,
+		now:        time.Now,
+	}
+}
+
+// SetLimits changes the size and TTLs used for entries stored from now on.
+func (c *Cache) SetLimits(maxEntries int, pastTTL, todayTTL time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.maxEntries, c.pastTTL, c.todayTTL = maxEntries, pastTTL, todayTTL
+
+	if maxEntries <= 0 {
+		c.entries = make(map[string]*Entry)
+	}
+}
+
+// Generation returns the current invalidation generation. It is taken
+// before the data of a response is read and given to Put.
+func (c *Cache) Generation() uint64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.gen
+}
+
+// ETag returns the entity tag of body.
+func ETag(body []byte) string {
+	sum := sha256.Sum256(body)
+	return `"` + hex.EncodeToString(sum[:8]) + `"`
+}
+
+// Get returns the live entry stored under key.
+func (c *Cache) Get(key string) (*Entry, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	e, ok := c.entries[key]
+
+	if !ok {
+		return nil, false
+	}
+
+	if !c.now().Before(e.expires) {
+		delete(c.entries, key)
+		return nil, false
+	}
+	return e, true
+}
+
+// Put stores body under key for the data of [from, to), read at the
+// generation gen, and returns the entry. An entry whose data may have been
+// invalidated since is returned without being stored.
+func (c *Cache) Put(key string, from, to time.Time, body []byte, gen uint64) *Entry {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := c.now()
+
+	e := &Entry{Body: body, ETag: ETag(body), from: from, to: to}
+
+	if to.After(now.Add(-24 * time.Hour)) {
+		e.expires = now.Add(c.todayTTL)
+	} else {
+		e.expires = now.Add(c.pastTTL)
+	}
+
+	if c.maxEntries <= 0 || gen != c.gen {
+		return e
+	}
+
+	if _, ok := c.entries[key]; !ok && len(c.entries) >= c.maxEntries {
+		c.evict(now)
+	}
+
+	c.entries[key] = e
+	return e
+}
+
+// evict drops the expired entries, or the one expiring first if none is.
+func (c *Cache) evict(now time.Time) {
+	var first string
+
+	for key, e := range c.entries {
+		if !now.Before(e.expires) {
+			delete(c.entries, key)
+			continue
+		}
+
+		if first == "" || e.expires.Before(c.entries[first].expires) {
+			first = key
+		}
+	}
+
+	if len(c.entries) >= c.maxEntries {
+		delete(c.entries, first)
+	}
+}
+
+// Invalidate drops the entries whose range overlaps the hour of ts: an
+// event is counted in the hourly stats of that hour and the daily stats of
+// its UTC day, so every response that reads either has data in the hour,
+// whatever its interval and time zone.
+func (c *Cache) Invalidate(ts time.Time) {
+	hour := ts.Truncate(time.Hour)
+	c.InvalidateRange(hour, hour.Add(time.Hour))
+}
+
+// InvalidateRange drops the entries whose range overlaps [from, to).
+func (c *Cache) InvalidateRange(from, to time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.gen++
+
+	for key, e := range c.entries {
+		if from.Before(e.to) && e.from.Before(to) {
+			delete(c.entries, key)
+		}
+	}
+}
+
+// Clear drops every entry.
+func (c *Cache) Clear() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.gen++
+	c.entries = make(map[string]*Entry)
+}
@@ -0,0 +1,169 @@
+package cache
+
+import (
+	"testing"
+	"time"
+)
+
+var (
+	now  = time.Date(2012, 2, 2, 12, 0, 0, 0, time.UTC)
+	jan1 = time.Date(2012, 1, 1, 0, 0, 0, 0, time.UTC)
+	jan2 = time.Date(2012, 1, 2, 0, 0, 0, 0, time.UTC)
+	feb1 = time.Date(2012, 2, 1, 0, 0, 0, 0, time.UTC)
+	feb3 = time.Date(2012, 2, 3, 0, 0, 0, 0, time.UTC)
+)
+
+func newCache(maxEntries int) (*Cache, *time.Time) {
+	clock := now
+
+	c := New(maxEntries, time.Hour, time.Minute)
+	c.now = func() time.Time { return clock }
+	return c, &clock
+}
+
+func TestCacheTTL(t *testing.T) {
+	c, clock := newCache(10)
+
+	c.Put("past", jan1, jan2, []byte("a"), c.Generation())
+	c.Put("today", feb1, feb3, []byte("b"), c.Generation())
+
+	*clock = now.Add(time.Minute)
+
+	if _, ok := c.Get("today"); ok {
+		t.Error("entry reaching today outlived its TTL")
+	}
+
+	if _, ok := c.Get("past"); !ok {
+		t.Error("entry of past days expired with the TTL of today")
+	}
+
+	*clock = now.Add(time.Hour)
+
+	if _, ok := c.Get("past"); ok {
+		t.Error("entry of past days outlived its TTL")
+	}
+}
+
+func TestCacheEviction(t *testing.T) {
+	c, clock := newCache(2)
+
+	c.Put("past", jan1, jan2, []byte("a"), c.Generation())
+	c.Put("today", feb1, feb3, []byte("b"), c.Generation())
+
+	// The entry expiring first makes room.
+	c.Put("other", jan1, jan2, []byte("c"), c.Generation())
+
+	if _, ok := c.Get("today"); ok {
+		t.Error("the entry expiring first was not evicted")
+	}
+
+	if _, ok := c.Get("past"); !ok {
+		t.Error("an entry expiring later was evicted")
+	}
+
+	// Expired entries go before live ones.
+	c, clock = newCache(2)
+
+	c.Put("today", feb1, feb3, []byte("a"), c.Generation())
+	*clock = now.Add(time.Minute)
+	c.Put("past", jan1, jan2, []byte("b"), c.Generation())
+	c.Put("other", jan1, jan2, []byte("c"), c.Generation())
+
+	if _, ok := c.Get("past"); !ok {
+		t.Error("a live entry was evicted before an expired one")
+	}
+
+	if _, ok := c.Get("other"); !ok {
+		t.Error("the new entry was not stored")
+	}
+
+	// Replacing an entry evicts nothing.
+	c.Put("other", jan1, jan2, []byte("d"), c.Generation())
+
+	if e, ok := c.Get("past"); !ok || string(e.Body) != "b" {
+		t.Error("replacing an entry evicted another")
+	}
+
+	// Without room nothing is stored.
+	c.SetLimits(0, time.Hour, time.Minute)
+	c.Put("past", jan1, jan2, []byte("e"), c.Generation())
+
+	if _, ok := c.Get("past"); ok {
+		t.Error("entry stored in a cache of size 0")
+	}
+}
+
+func TestCacheInvalidate(t *testing.T) {
+	c, _ := newCache(10)
+
+	c.Put("january", jan1, jan2, []byte("a"), c.Generation())
+	c.Put("february", feb1, feb3, []byte("b"), c.Generation())
+
+	c.Invalidate(time.Date(2012, 2, 2, 10, 0, 0, 0, time.UTC))
+
+	if _, ok := c.Get("february"); ok {
+		t.Error("entry of the day written to was kept")
+	}
+
+	if _, ok := c.Get("january"); !ok {
+		t.Error("entry of other days was dropped")
+	}
+
+	// Only entries with data in the hour written to are dropped.
+	c.Put("january", jan1, jan2, []byte("a"), c.Generation())
+	c.Invalidate(jan2.Add(30 * time.Minute))
+
+	if _, ok := c.Get("january"); !ok {
+		t.Error("entry ending before the hour written to was dropped")
+	}
+
+	// The days of a range in UTC+5 start at 19:00 UTC the day before.
+	c.Put("utc+5", jan1.Add(-5*time.Hour), jan2.Add(-5*time.Hour), []byte("b"), c.Generation())
+	c.Invalidate(time.Date(2011, 12, 31, 19, 59, 0, 0, time.UTC))
+
+	if _, ok := c.Get("utc+5"); ok {
+		t.Error("entry of the hour written to in another time zone was kept")
+	}
+
+	c.InvalidateRange(jan2, feb1)
+
+	if _, ok := c.Get("january"); !ok {
+		t.Error("entry before the range was dropped")
+	}
+
+	// A response read before an invalidation is not stored after it.
+	gen := c.Generation()
+	c.Invalidate(now)
+
+	if e := c.Put("stale", jan1, jan2, []byte("c"), gen); e == nil || string(e.Body) != "c" {
+		t.Error("entry not returned")
+	}
+
+	if _, ok := c.Get("stale"); ok {
+		t.Error("response read before an invalidation was stored")
+	}
+
+	c.Clear()
+
+	if _, ok := c.Get("january"); ok {
+		t.Error("entry kept after Clear")
+	}
+}
+
+func TestETag(t *testing.T) {
+	c, _ := newCache(10)
+
+	e := c.Put("a", jan1, jan2, []byte(`{"items":[]}`), c.Generation())
+
+	if e.ETag != ETag([]byte(`{"items":[]}`)) || len(e.ETag) != 18 || e.ETag[0] != '"' || e.ETag[17] != '"' {
+		t.Errorf("ETag of the entry %s", e.ETag)
+	}
+
+	if ETag([]byte("a")) == ETag([]byte("b")) {
+		t.Error("different bodies have the same ETag")
+	}
+
+	if got, _ := c.Get("a"); got.ETag != e.ETag {
+		t.Errorf("Get returned ETag %s, Put %s", got.ETag, e.ETag)
+	}
+}
@@ -0,0 +1,175 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+// ErrClosed is returned by Batcher.Add after Close.
+var ErrClosed = errors.New("service_stat: batcher closed")
+
+// Batcher collects events in the background and sends them in batches with
+// AddStats: once it has maxBatch of them, or flushInterval after the first
+// one of a batch. Events keep their EventID across retries, so none is
+// counted twice.
+type Batcher struct {
+	c        *Client
+	maxBatch int
+	interval time.Duration
+	onError  func(Event, error)
+
+	queue chan Event
+	// flush asks to send the events queued so far; the channel it carries
+	// is closed once they are sent.
+	flush chan chan struct{}
+	done  chan struct{}
+
+	mu     sync.RWMutex
+	closed bool
+}
+
+// NewBatcher starts collecting the events queued by Add in batches of at
+// most maxBatch (up to 1000), sent at least every flushInterval. onError,
+// if not nil, is called with the events that could not be sent or that the
+// service refused.
+func (c *Client) NewBatcher(maxBatch int, flushInterval time.Duration, onError func(Event, error)) *Batcher {
+	if maxBatch < 1 || maxBatch > 1000 {
+		maxBatch = 1000
+	}
+
+	b := &Batcher{
+		c:        c,
+		maxBatch: maxBatch,
+		interval: flushInterval,
+		onError:  onError,
+		queue:    make(chan Event, maxBatch),
+		flush:    make(chan chan struct{}),
+		done:     make(chan struct{}),
+	}
+
+	go b.run()
+	return b
+}
+
+func (b *Batcher) run() {
+	defer close(b.done)
+
+	var batch []Event
+	var timer *time.Timer
+	var timeout <-chan time.Time
+
+	send := func() {
+		if timer != nil {
+			timer.Stop()
+			timeout = nil
+		}
+
+		if len(batch) > 0 {
+			b.send(batch)
+			batch = nil
+		}
+	}
+
+	add := func(e Event) {
+		if batch = append(batch, e); len(batch) == 1 {
+			timer = time.NewTimer(b.interval)
+			timeout = timer.C
+		}
+
+		if len(batch) >= b.maxBatch {
+			send()
+		}
+	}
+
+	for {
+		select {
+		case e, ok := <-b.queue:
+			if !ok {
+				send()
+				return
+			}
+			add(e)
+		case <-timeout:
+			send()
+		case sent := <-b.flush:
+			// The events Add returned for before Flush are in the queue;
+			// the ones queued later are left for the next batch.
+			for n := len(b.queue); n > 0; n-- {
+				add(<-b.queue)
+			}
+
+			send()
+			close(sent)
+		}
+	}
+}
+
+// send sends batch and reports the events that failed.
+func (b *Batcher) send(batch []Event) {
+	results, err := b.c.AddStats(context.Background(), batch)
+
+	for i, e := range batch {
+		eventErr := err
+
+		if err == nil {
+			eventErr = results[i].Err
+		}
+
+		if eventErr != nil && b.onError != nil {
+			b.onError(e, eventErr)
+		}
+	}
+}
+
+// Add queues e, waiting for room in the queue until ctx is done.
+func (b *Batcher) Add(ctx context.Context, e Event) error {
+	if e.EventID == "" {
+		e.EventID = newEventID()
+	}
+
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	if b.closed {
+		return ErrClosed
+	}
+
+	select {
+	case b.queue <- e:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Flush sends the events queued so far without waiting for the flush
+// interval, and waits until they are sent. Events added meanwhile may go
+// with them or in a later batch; Flush does not wait for those.
+func (b *Batcher) Flush() {
+	sent := make(chan struct{})
+
+	select {
+	case b.flush <- sent:
+		<-sent
+	case <-b.done:
+		// Close has sent everything.
+	}
+}
+
+// Close sends the queued events and stops collecting.
+func (b *Batcher) Close() {
+	b.mu.Lock()
+
+	if b.closed {
+		b.mu.Unlock()
+		return
+	}
+
+	b.closed = true
+	close(b.queue)
+	b.mu.Unlock()
+
+	<-b.done
+}
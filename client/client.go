@@ -0,0 +1,548 @@
+// Package client calls the HTTP API of service_stat.
+package client
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	mathrand "math/rand"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// dateLayout is the layout of the dates of queries.
+const dateLayout = "2006-01-02"
+
+// Error is an answer of the service other than the expected one.
+type Error struct {
+	StatusCode int
+	// Message is the error the service gave, if any.
+	Message string
+}
+
+func (e *Error) Error() string {
+	if e.Message == "" {
+		return fmt.Sprintf("service_stat: %d %s", e.StatusCode, http.StatusText(e.StatusCode))
+	}
+	return fmt.Sprintf("service_stat: %d %s", e.StatusCode, e.Message)
+}
+
+// Client calls the service at BaseURL with APIKey. Requests answered with
+// 429, a 5xx status or not at all are retried with exponential backoff,
+// unless retrying could apply them twice.
+type Client struct {
+	BaseURL    string
+	APIKey     string
+	HTTPClient *http.Client
+	// MaxRetries is how many times a request is retried.
+	MaxRetries int
+	// MinBackoff is the wait before the first retry, doubled for each next
+	// one up to MaxBackoff. A Retry-After from the service takes precedence.
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+}
+
+// New returns a client of the service at baseURL, such as
+// "https://stats.example.com:1234". apiKey may be empty if the service does
+// not require keys.
+func New(baseURL, apiKey string) *Client {
+	return &Client{
+		BaseURL:    strings.TrimRight(baseURL, "/"),
+		APIKey:     apiKey,
+		HTTPClient: http.DefaultClient,
+		MaxRetries: 3,
+		MinBackoff: 100 * time.Millisecond,
+		MaxBackoff: 5 * time.Second,
+	}
+}
+
+// User is a registered user.
+type User struct {
+	ID  int64  `json:"id"`
+	Age int    `json:"age"`
+	Sex string `json:"sex"`
+}
+
+// Event is an action of a user.
+type Event struct {
+	User   int64
+	Action string
+	Time   time.Time
+	// EventID identifies the event so it is counted once however many
+	// times it is sent. AddStat makes one up if it is empty.
+	EventID string
+}
+
+// AddStatResult is what the service did with an event.
+type AddStatResult struct {
+	// Applied is false for events counted already or queued.
+	Applied bool `json:"applied"`
+	// Queued is true for events of users not registered yet.
+	Queued      bool `json:"queued"`
+	UserCreated bool `json:"user_created"`
+}
+
+// BatchResult is what the service did with an event of a batch.
+type BatchResult struct {
+	AddStatResult
+	// Err is the answer the service would have given the event alone if
+	// it refused it, nil otherwise.
+	Err error
+}
+
+// maxBatch is how many events the service takes in one batch.
+const maxBatch = 1000
+
+// TopQuery selects the top Limit users by the count of Action in every
+// bucket of [From, To).
+type TopQuery struct {
+	From   time.Time
+	To     time.Time
+	Action string
+	Limit  int
+	// Interval is "hour", "day", "week" or "month", "day" if empty.
+	Interval string
+	// TZ is the IANA time zone of the buckets, UTC if empty.
+	TZ string
+}
+
+// Bucket is the top users of a day or other interval.
+type Bucket struct {
+	Date string    `json:"date"`
+	Rows []StatRow `json:"rows"`
+}
+
+type StatRow struct {
+	Date time.Time `json:"date"`
+	ID   int64     `json:"id"`
+	Age  *int64    `json:"age"`
+	Sex  *string   `json:"sex"`
+	Cnt  int64     `json:"cnt"`
+}
+
+// Activity is a daily counter of a user.
+type Activity struct {
+	Date   string `json:"date"`
+	Action string `json:"action"`
+	Cnt    int64  `json:"cnt"`
+}
+
+// RetentionTable is the data of a table older than the retention policy
+// allows.
+type RetentionTable struct {
+	Table  string    `json:"table"`
+	Before time.Time `json:"before"`
+	Rows   int64     `json:"rows"`
+}
+
+// APIKey describes an API key of the tenant.
+type APIKey struct {
+	ID        int        `json:"id"`
+	Scopes    []string   `json:"scopes"`
+	CreatedAt time.Time  `json:"created_at"`
+	ExpiresAt *time.Time `json:"expires_at"`
+	RevokedAt *time.Time `json:"revoked_at"`
+}
+
+// NewAPIKey is a created or rotated API key. Key is only ever returned
+// once.
+type NewAPIKey struct {
+	APIKey
+	Key string `json:"key"`
+	// Replaces is the rotated key, if any.
+	Replaces *APIKey `json:"replaces"`
+}
+
+// RegisterUser registers u, or fills in a user created by an event.
+func (c *Client) RegisterUser(ctx context.Context, u User) error {
+	return c.do(ctx, "POST", "/api/users", nil, u, true, nil)
+}
+
+// AddStat records e.
+func (c *Client) AddStat(ctx context.Context, e Event) (*AddStatResult, error) {
+	if e.EventID == "" {
+		e.EventID = newEventID()
+	}
+
+	body := map[string]interface{}{
+		"user":     e.User,
+		"action":   e.Action,
+		"ts":       e.Time.Format(time.RFC3339Nano),
+		"event_id": e.EventID,
+	}
+
+	result := &AddStatResult{}
+
+	if err := c.do(ctx, "POST", "/api/users/stats", nil, body, true, result); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// AddStats records events in one request, at most 1000 of them, and
+// returns what was done with each in order. The service records them one by
+// one: an event refused does not stop the ones after it.
+func (c *Client) AddStats(ctx context.Context, events []Event) ([]BatchResult, error) {
+	if len(events) == 0 || len(events) > maxBatch {
+		return nil, fmt.Errorf("service_stat: a batch must have 1 to %d events", maxBatch)
+	}
+
+	body := make([]map[string]interface{}, len(events))
+
+	for i, e := range events {
+		if e.EventID == "" {
+			e.EventID = newEventID()
+		}
+
+		body[i] = map[string]interface{}{
+			"user":     e.User,
+			"action":   e.Action,
+			"ts":       e.Time.Format(time.RFC3339Nano),
+			"event_id": e.EventID,
+		}
+	}
+
+	var out struct {
+		Results []struct {
+			AddStatResult
+			Status int    `json:"status"`
+			Error  string `json:"error"`
+		} `json:"results"`
+	}
+
+	if err := c.do(ctx, "POST", "/api/users/stats", nil, body, true, &out); err != nil {
+		return nil, err
+	}
+
+	if len(out.Results) != len(events) {
+		return nil, fmt.Errorf("service_stat: %d results for %d events", len(out.Results), len(events))
+	}
+
+	results := make([]BatchResult, len(events))
+
+	for i, r := range out.Results {
+		results[i].AddStatResult = r.AddStatResult
+
+		if r.Status < 200 || r.Status > 299 {
+			results[i].Err = &Error{StatusCode: r.Status, Message: r.Error}
+		}
+	}
+	return results, nil
+}
+
+// TopStats returns the top users of the buckets of q, in bucket order.
+func (c *Client) TopStats(ctx context.Context, q TopQuery) ([]Bucket, error) {
+	query := url.Values{
+		"date1":  {q.From.Format(dateLayout)},
+		"date2":  {q.To.Format(dateLayout)},
+		"action": {q.Action},
+		"limit":  {strconv.Itoa(q.Limit)},
+		"format": {"json"},
+	}
+
+	if q.Interval != "" {
+		query.Set("interval", q.Interval)
+	}
+
+	if q.TZ != "" {
+		query.Set("tz", q.TZ)
+	}
+
+	var top struct {
+		Items []Bucket `json:"items"`
+		Error string   `json:"error"`
+	}
+
+	if err := c.do(ctx, "GET", "/api/users/stats/top", query, nil, true, &top); err != nil {
+		return nil, err
+	}
+
+	if top.Error != "" {
+		return top.Items, &Error{StatusCode: http.StatusOK, Message: top.Error}
+	}
+	return top.Items, nil
+}
+
+// UserActivity returns the daily counters of user in [from, to), by date
+// and action.
+func (c *Client) UserActivity(ctx context.Context, user int64, from, to time.Time) ([]Activity, error) {
+	query := url.Values{
+		"user":  {strconv.FormatInt(user, 10)},
+		"date1": {from.Format(dateLayout)},
+		"date2": {to.Format(dateLayout)},
+	}
+
+	var result struct {
+		Activity []Activity `json:"activity"`
+	}
+
+	if err := c.do(ctx, "GET", "/api/users/activity", query, nil, true, &result); err != nil {
+		return nil, err
+	}
+	return result.Activity, nil
+}
+
+// Actions returns the action catalogue of the tenant.
+func (c *Client) Actions(ctx context.Context) ([]string, error) {
+	var result struct {
+		Actions []string `json:"actions"`
+	}
+
+	if err := c.do(ctx, "GET", "/api/actions", nil, nil, true, &result); err != nil {
+		return nil, err
+	}
+	return result.Actions, nil
+}
+
+// Rollup rebuilds the daily counters of [from, to) from the events log and
+// returns how many it wrote.
+func (c *Client) Rollup(ctx context.Context, from, to time.Time) (int64, error) {
+	query := url.Values{"date1": {from.Format(dateLayout)}, "date2": {to.Format(dateLayout)}}
+
+	var result struct {
+		Rows int64 `json:"rows"`
+	}
+
+	if err := c.do(ctx, "POST", "/api/admin/rollup", query, nil, true, &result); err != nil {
+		return 0, err
+	}
+	return result.Rows, nil
+}
+
+// RetentionPreview returns what Purge would delete.
+func (c *Client) RetentionPreview(ctx context.Context) ([]RetentionTable, error) {
+	return c.retention(ctx, "GET")
+}
+
+// Purge deletes the data older than the retention policy allows.
+func (c *Client) Purge(ctx context.Context) ([]RetentionTable, error) {
+	return c.retention(ctx, "POST")
+}
+
+func (c *Client) retention(ctx context.Context, method string) ([]RetentionTable, error) {
+	var result struct {
+		Tables []RetentionTable `json:"tables"`
+	}
+
+	if err := c.do(ctx, method, "/api/admin/retention", nil, nil, true, &result); err != nil {
+		return nil, err
+	}
+	return result.Tables, nil
+}
+
+// Migrate applies the pending schema migrations and returns their
+// versions. Only the default tenant may run them.
+func (c *Client) Migrate(ctx context.Context) ([]string, error) {
+	var result struct {
+		Applied []string `json:"applied"`
+	}
+
+	if err := c.do(ctx, "POST", "/api/admin/migrations", nil, nil, true, &result); err != nil {
+		return nil, err
+	}
+	return result.Applied, nil
+}
+
+// Health checks the service and its database. It is not retried, so that
+// it reports the state at the time of the call.
+func (c *Client) Health(ctx context.Context) error {
+	return c.do(ctx, "GET", "/health", nil, nil, false, nil)
+}
+
+// APIKeys lists the API keys of the tenant.
+func (c *Client) APIKeys(ctx context.Context) ([]APIKey, error) {
+	var result struct {
+		Keys []APIKey `json:"keys"`
+	}
+
+	if err := c.do(ctx, "GET", "/api/admin/keys", nil, nil, true, &result); err != nil {
+		return nil, err
+	}
+	return result.Keys, nil
+}
+
+// CreateAPIKey creates an API key of the tenant with scopes.
+func (c *Client) CreateAPIKey(ctx context.Context, scopes ...string) (*NewAPIKey, error) {
+	key := &NewAPIKey{}
+
+	query := url.Values{"scopes": {strings.Join(scopes, ",")}}
+
+	if err := c.do(ctx, "POST", "/api/admin/keys", query, nil, false, key); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// RotateAPIKey replaces the API key id with a new one with its scopes.
+func (c *Client) RotateAPIKey(ctx context.Context, id int) (*NewAPIKey, error) {
+	key := &NewAPIKey{}
+
+	if err := c.do(ctx, "POST", "/api/admin/keys/rotate", url.Values{"id": {strconv.Itoa(id)}}, nil, false, key); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// RevokeAPIKey revokes the API key id.
+func (c *Client) RevokeAPIKey(ctx context.Context, id int) (*APIKey, error) {
+	key := &APIKey{}
+
+	if err := c.do(ctx, "POST", "/api/admin/keys/revoke", url.Values{"id": {strconv.Itoa(id)}}, nil, true, key); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// OpenAPI returns the OpenAPI document of the service.
+func (c *Client) OpenAPI(ctx context.Context) (json.RawMessage, error) {
+	var doc json.RawMessage
+
+	if err := c.do(ctx, "GET", "/openapi.json", nil, nil, true, &doc); err != nil {
+		return nil, err
+	}
+	return doc, nil
+}
+
+// do sends a request with body, if not nil, as JSON and decodes the
+// answer into out, if not nil. Requests that are not idempotent are only
+// retried after 429, which the service answers before doing anything.
+func (c *Client) do(ctx context.Context, method, path string, query url.Values, body interface{}, idempotent bool, out interface{}) error {
+	var data []byte
+
+	if body != nil {
+		var err error
+
+		if data, err = json.Marshal(body); err != nil {
+			return err
+		}
+	}
+
+	u := c.BaseURL + path
+
+	if len(query) > 0 {
+		u += "?" + query.Encode()
+	}
+
+	for attempt := 0; ; attempt++ {
+		retryAfter, err := c.send(ctx, method, u, data, out)
+
+		if err == nil {
+			return nil
+		}
+
+		apiErr, ok := err.(*Error)
+
+		retriable := ok && (apiErr.StatusCode == http.StatusTooManyRequests || apiErr.StatusCode >= 500 && idempotent) ||
+			!ok && idempotent && ctx.Err() == nil
+
+		if !retriable || attempt >= c.MaxRetries {
+			return err
+		}
+
+		wait := retryAfter
+
+		if wait < 0 {
+			wait = c.backoff(attempt)
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(wait):
+		}
+	}
+}
+
+// send makes one attempt of a request. It returns the Retry-After of the
+// answer, -1 if it has none.
+func (c *Client) send(ctx context.Context, method, u string, data []byte, out interface{}) (time.Duration, error) {
+	var body io.Reader
+
+	if data != nil {
+		body = bytes.NewReader(data)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, u, body)
+
+	if err != nil {
+		return -1, err
+	}
+
+	if data != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	req.Header.Set("Accept", "application/json")
+
+	if c.APIKey != "" {
+		req.Header.Set("X-API-Key", c.APIKey)
+	}
+
+	resp, err := c.HTTPClient.Do(req)
+
+	if err != nil {
+		return -1, err
+	}
+
+	defer resp.Body.Close()
+
+	retryAfter := time.Duration(-1)
+
+	if seconds, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil && seconds >= 0 {
+		retryAfter = time.Duration(seconds) * time.Second
+	}
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return retryAfter, errorOf(resp)
+	}
+
+	if out == nil {
+		io.Copy(ioutil.Discard, resp.Body)
+		return retryAfter, nil
+	}
+	return retryAfter, json.NewDecoder(resp.Body).Decode(out)
+}
+
+// errorOf reads the error of resp: {"error": ...} or plain text.
+func errorOf(resp *http.Response) error {
+	data, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 4096))
+
+	var body struct {
+		Error string `json:"error"`
+	}
+
+	message := strings.TrimSpace(string(data))
+
+	if json.Unmarshal(data, &body) == nil && body.Error != "" {
+		message = body.Error
+	}
+	return &Error{StatusCode: resp.StatusCode, Message: message}
+}
+
+// backoff returns the wait before retry attempt+1, with jitter.
+func (c *Client) backoff(attempt int) time.Duration {
+	wait := c.MinBackoff << uint(attempt)
+
+	if wait > c.MaxBackoff || wait <= 0 {
+		wait = c.MaxBackoff
+	}
+	return wait/2 + time.Duration(mathrand.Int63n(int64(wait/2)+1))
+}
+
+// newEventID returns a random event ID.
+func newEventID() string {
+	b := make([]byte, 16)
+
+	if _, err := rand.Read(b); err != nil {
+		return strconv.FormatInt(time.Now().UnixNano(), 36) + strconv.FormatInt(mathrand.Int63(), 36)
+	}
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,279 @@
+package client
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/zwirec/http_service_stat/config"
+	"github.com/zwirec/http_service_stat/dbManager"
+	"github.com/zwirec/http_service_stat/requestHandler"
+)
+
+// serve runs the real request handler, on a mocked database, behind an
+// HTTP test server. wrap, if not nil, wraps the handler.
+func serve(t *testing.T, wrap func(http.Handler) http.Handler) (*Client, sqlmock.Sqlmock) {
+	db, mock, err := sqlmock.New()
+
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	conf := config.Default()
+	conf.Auth.RequireAPIKey = false
+	conf.Leaderboard.Size = 0
+
+	rH := requestHandler.New(&dbManager.DBManager{DB: db}, log.New(os.Stdout, "", log.LstdFlags))
+	rH.Configure(conf)
+
+	var handler http.Handler = rH.Handler()
+
+	if wrap != nil {
+		handler = wrap(handler)
+	}
+
+	srv := httptest.NewServer(handler)
+
+	t.Cleanup(srv.Close)
+
+	c := New(srv.URL, "")
+	c.MinBackoff = time.Millisecond
+	c.MaxBackoff = 10 * time.Millisecond
+
+	mock.ExpectQuery("FROM tenants").WithArgs(0).WillReturnRows(
+		sqlmock.NewRows([]string{"name", "daily_events", "max_users", "actions"}).AddRow("default", 0, 0, "{like,login}"))
+	return c, mock
+}
+
+// expectEvent expects an event of user 2 of action on 2012-02-02.
+func expectEvent(mock sqlmock.Sqlmock, action string) {
+	mock.ExpectBegin()
+	mock.ExpectExec("INSERT INTO event_ids (.*)").WithArgs(sqlmock.AnyArg(), float64(86400), 0).WillReturnResult(
+		sqlmock.NewResult(0, 1))
+	mock.ExpectExec("INSERT INTO events (.*)").WithArgs(sqlmock.AnyArg(), action, sqlmock.AnyArg(), sqlmock.AnyArg(), 0).WillReturnResult(
+		sqlmock.NewResult(1, 1))
+	mock.ExpectExec("INSERT INTO stats (.*)").WithArgs(sqlmock.AnyArg(), action, sqlmock.AnyArg(), 0).WillReturnResult(
+		sqlmock.NewResult(1, 1))
+	mock.ExpectExec("INSERT INTO stats_hourly (.*)").WithArgs(sqlmock.AnyArg(), action, sqlmock.AnyArg(), 0).WillReturnResult(
+		sqlmock.NewResult(1, 1))
+	mock.ExpectCommit()
+}
+
+var day = time.Date(2012, 2, 2, 0, 0, 0, 0, time.UTC)
+
+func TestClient(t *testing.T) {
+	c, mock := serve(t, nil)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	mock.ExpectExec("INSERT INTO users").WithArgs(float64(2), float64(30), "M", 0).WillReturnResult(sqlmock.NewResult(1, 1))
+
+	if err := c.RegisterUser(ctx, User{ID: 2, Age: 30, Sex: "M"}); err != nil {
+		t.Fatalf("RegisterUser: %v", err)
+	}
+
+	expectEvent(mock, "like")
+
+	result, err := c.AddStat(ctx, Event{User: 2, Action: "like", Time: day})
+
+	if err != nil {
+		t.Fatalf("AddStat: %v", err)
+	}
+
+	if !result.Applied {
+		t.Errorf("AddStat returned %+v", result)
+	}
+
+	mock.ExpectQuery("FROM stats s, users u").WithArgs("2012-02-02", "2012-02-03", "like", "1", 0).WillReturnRows(
+		sqlmock.NewRows([]string{"date", "id", "age", "sex", "cnt"}).AddRow(day, 2, 30, "M", 1))
+
+	top, err := c.TopStats(ctx, TopQuery{From: day, To: day.AddDate(0, 0, 1), Action: "like", Limit: 1})
+
+	if err != nil {
+		t.Fatalf("TopStats: %v", err)
+	}
+
+	if len(top) != 1 || top[0].Date != "2012-02-02" || len(top[0].Rows) != 1 || top[0].Rows[0].ID != 2 || top[0].Rows[0].Cnt != 1 {
+		t.Errorf("TopStats returned %+v", top)
+	}
+
+	mock.ExpectQuery("FROM stats").WithArgs(int64(2), "2012-02-02", "2012-02-03", 0).WillReturnRows(
+		sqlmock.NewRows([]string{"date", "action", "cnt"}).AddRow(day, "like", 1))
+
+	activity, err := c.UserActivity(ctx, 2, day, day.AddDate(0, 0, 1))
+
+	if err != nil {
+		t.Fatalf("UserActivity: %v", err)
+	}
+
+	if len(activity) != 1 || activity[0] != (Activity{Date: "2012-02-02", Action: "like", Cnt: 1}) {
+		t.Errorf("UserActivity returned %+v", activity)
+	}
+
+	if actions, err := c.Actions(ctx); err != nil || strings.Join(actions, ",") != "like,login" {
+		t.Errorf("Actions returned %v, %v", actions, err)
+	}
+
+	if err := c.Health(ctx); err != nil {
+		t.Errorf("Health: %v", err)
+	}
+
+	_, err = c.AddStat(ctx, Event{User: 2, Action: "purchase", Time: day})
+
+	if apiErr, ok := err.(*Error); !ok || apiErr.StatusCode != http.StatusBadRequest || apiErr.Message == "" {
+		t.Errorf("AddStat of an action not in the catalogue: got %v want a 400 *Error", err)
+	}
+
+	if _, err := c.OpenAPI(ctx); err != nil {
+		t.Errorf("OpenAPI: %v", err)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatalf("there were unfulfilled expections: %s", err)
+	}
+}
+
+func TestClientRetry(t *testing.T) {
+	var attempts int32
+
+	// Every request first fails with 503, then 429.
+	c, mock := serve(t, func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			switch atomic.AddInt32(&attempts, 1) % 3 {
+			case 1:
+				w.WriteHeader(http.StatusServiceUnavailable)
+			case 2:
+				w.Header().Set("Retry-After", "0")
+				w.WriteHeader(http.StatusTooManyRequests)
+			default:
+				h.ServeHTTP(w, req)
+			}
+		})
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	expectEvent(mock, "like")
+
+	if _, err := c.AddStat(ctx, Event{User: 2, Action: "like", Time: day}); err != nil {
+		t.Fatalf("AddStat: %v", err)
+	}
+
+	if attempts != 3 {
+		t.Errorf("AddStat took %d attempts, want 3", attempts)
+	}
+
+	// Creating a key is not retried after a 5xx: it may have been created.
+	atomic.StoreInt32(&attempts, 0)
+
+	_, err := c.CreateAPIKey(ctx, "read")
+
+	if apiErr, ok := err.(*Error); !ok || apiErr.StatusCode != http.StatusServiceUnavailable || attempts != 1 {
+		t.Errorf("CreateAPIKey: got %v after %d attempts, want a 503 *Error after 1", err, attempts)
+	}
+
+	// The retries give up after MaxRetries.
+	atomic.StoreInt32(&attempts, 0)
+	c.MaxRetries = 1
+
+	_, err = c.AddStat(ctx, Event{User: 2, Action: "like", Time: day})
+
+	if apiErr, ok := err.(*Error); !ok || apiErr.StatusCode != http.StatusTooManyRequests || attempts != 2 {
+		t.Errorf("AddStat: got %v after %d attempts, want a 429 *Error after 2", err, attempts)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatalf("there were unfulfilled expections: %s", err)
+	}
+}
+
+func TestBatcher(t *testing.T) {
+	var requests int32
+
+	c, mock := serve(t, func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			atomic.AddInt32(&requests, 1)
+			h.ServeHTTP(w, req)
+		})
+	})
+
+	actions := []string{"like", "login", "like", "login", "like"}
+
+	for _, action := range actions {
+		expectEvent(mock, action)
+	}
+
+	var mu sync.Mutex
+	var failed []Event
+	var errs []error
+
+	b := c.NewBatcher(4, time.Hour, func(e Event, err error) {
+		mu.Lock()
+		failed = append(failed, e)
+		errs = append(errs, err)
+		mu.Unlock()
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	for _, action := range append(actions, "purchase") {
+		if err := b.Add(ctx, Event{User: 2, Action: action, Time: day}); err != nil {
+			t.Fatalf("Add: %v", err)
+		}
+	}
+
+	// A full batch, then the rest on Flush.
+	b.Flush()
+
+	if n := atomic.LoadInt32(&requests); n != 2 {
+		t.Errorf("6 events sent in %d requests, want 2", n)
+	}
+
+	if apiErr, ok := errs[0].(*Error); len(failed) != 1 || failed[0].Action != "purchase" || failed[0].EventID == "" ||
+		!ok || apiErr.StatusCode != http.StatusBadRequest {
+		t.Errorf("events not sent: %+v, %v", failed, errs)
+	}
+
+	b.Close()
+
+	if err := b.Add(ctx, Event{User: 2, Action: "like", Time: day}); err != ErrClosed {
+		t.Errorf("Add after Close: got %v want %v", err, ErrClosed)
+	}
+
+	// Close has sent everything, so Flush has nothing to wait for.
+	b.Flush()
+
+	// A batch that does not fill up is sent after the interval.
+	expectEvent(mock, "login")
+
+	b = c.NewBatcher(4, 10*time.Millisecond, nil)
+	defer b.Close()
+
+	if err := b.Add(ctx, Event{User: 2, Action: "login", Time: day}); err != nil {
+		t.Fatalf("Add: %v", err)
+	}
+
+	for atomic.LoadInt32(&requests) != 3 {
+		if ctx.Err() != nil {
+			t.Fatal("the batch was not sent after the interval")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	b.Flush()
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatalf("there were unfulfilled expections: %s", err)
+	}
+}
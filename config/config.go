@@ -0,0 +1,581 @@
+package config
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"strings"
+	"time"
+)
+
+// Duration is a time.Duration written in configuration files as a string
+// such as "90s" or "24h".
+type Duration struct {
+	time.Duration
+}
+
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var s string
+
+	if err := json.Unmarshal(data, &s); err != nil {
+		return err
+	}
+
+	duration, err := time.ParseDuration(s)
+
+	if err != nil {
+		return err
+	}
+
+	d.Duration = duration
+	return nil
+}
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(d.String())
+}
+
+// Policies for stats of users that are not registered.
+const (
+	// UnknownUserReject refuses the event.
+	UnknownUserReject = "reject"
+	// UnknownUserCreate registers a placeholder user and records the event.
+	UnknownUserCreate = "create"
+	// UnknownUserQueue keeps the event until the user registers.
+	UnknownUserQueue = "queue"
+)
+
+// Log levels.
+const (
+	// LogInfo logs every request and every error.
+	LogInfo = "info"
+	// LogError only logs errors.
+	LogError = "error"
+)
+
+// Retention says how many days of each kind of data are kept. Zero keeps
+// the data forever.
+type Retention struct {
+	StatsDays  int `json:"stats_days"`
+	HourlyDays int `json:"hourly_days"`
+	EventsDays int `json:"events_days"`
+	// DeliveriesDays is how long the log of webhook deliveries is kept.
+	DeliveriesDays int `json:"deliveries_days"`
+	// BatchSize bounds the rows deleted by one statement.
+	BatchSize int `json:"batch_size"`
+	// Interval is how often the purge job runs.
+	Interval Duration `json:"interval"`
+}
+
+// Leaderboard configures the precomputed daily top users.
+type Leaderboard struct {
+	// Size is how many users each leaderboard keeps. Zero disables them.
+	Size int `json:"size"`
+	// RefreshInterval is how often stale leaderboards are recomputed.
+	RefreshInterval Duration `json:"refresh_interval"`
+	// LookbackDays is how far back stale leaderboards are looked for.
+	LookbackDays int `json:"lookback_days"`
+}
+
+// Cache configures the cache of top stats responses.
+type Cache struct {
+	// MaxEntries bounds the cached responses. Zero disables the cache.
+	MaxEntries int `json:"max_entries"`
+	// PastTTL is how long responses about past days are kept.
+	PastTTL Duration `json:"past_ttl"`
+	// TodayTTL is how long responses including today are kept.
+	TodayTTL Duration `json:"today_ttl"`
+}
+
+// Auth configures API key authentication.
+type Auth struct {
+	// RequireAPIKey rejects requests without a key. Otherwise they act for
+	// the default tenant with the ingest and read scopes; the admin routes
+	// always take a key with the admin scope. It is off by default so that
+	// deployments predating API keys keep working; turn it on once clients
+	// send keys.
+	RequireAPIKey bool `json:"require_api_key"`
+	// RotationGrace is how long a rotated key keeps working.
+	RotationGrace Duration `json:"rotation_grace"`
+}
+
+// RateLimit is a token bucket per client: Burst requests at once, then
+// Rate requests per second.
+type RateLimit struct {
+	Rate  float64 `json:"rate"`
+	Burst int     `json:"burst"`
+}
+
+// RateLimits configures the limits of each client.
+type RateLimits struct {
+	// Routes maps URL paths to their limit, per IP address and applied
+	// before API keys are checked; "*" is the limit of the other routes.
+	// Routes without a limit are not limited.
+	Routes map[string]RateLimit `json:"routes"`
+	// DailyEvents caps the events a client, an API key or, for requests
+	// without a key, an IP address, records per UTC day; zero means no cap.
+	DailyEvents int `json:"daily_events"`
+}
+
+// TLS configures HTTPS, which is served if CertFile and KeyFile are set.
+// Both files are read again on SIGHUP.
+type TLS struct {
+	CertFile string `json:"cert_file"`
+	KeyFile  string `json:"key_file"`
+	// MinVersion is the oldest protocol version accepted, "1.2" or "1.3".
+	MinVersion string `json:"min_version"`
+	// ClientCAFile turns on client certificate authentication against the
+	// CAs in it.
+	ClientCAFile string `json:"client_ca_file"`
+	// RequireClientCert rejects clients without a certificate. Otherwise a
+	// certificate is only verified if one is given.
+	RequireClientCert bool `json:"require_client_cert"`
+}
+
+// Server configures the HTTP server. Zero timeouts mean no timeout.
+type Server struct {
+	ReadTimeout       Duration `json:"read_timeout"`
+	ReadHeaderTimeout Duration `json:"read_header_timeout"`
+	WriteTimeout      Duration `json:"write_timeout"`
+	IdleTimeout       Duration `json:"idle_timeout"`
+	// HTTP2 is offered to TLS clients that support it.
+	HTTP2 bool `json:"http2"`
+	TLS   TLS  `json:"tls"`
+}
+
+// GRPC configures the gRPC API, served with the TLS settings of Server.
+type GRPC struct {
+	// Port is the port it is served on, zero turns it off.
+	Port int `json:"port"`
+}
+
+// Types of ingestion sources.
+const (
+	// IngestKafka consumes a Kafka topic in a consumer group.
+	IngestKafka = "kafka"
+	// IngestFile reads a local file, for tests and single hosts.
+	IngestFile = "file"
+)
+
+// IngestSource is a queue events are consumed from, see package ingest.
+type IngestSource struct {
+	// Name identifies the source. Events without an event_id get one made
+	// of it and their offset, so redelivered events are counted once.
+	Name string `json:"name"`
+	// Type is IngestKafka: the messages of Topic on Brokers are AddStat
+	// bodies, consumed in the consumer group Group, which keeps the
+	// committed offsets.
+	// Or IngestFile: Path is a log of AddStat bodies, one JSON object per
+	// line, the committed offset is kept next to it.
+	Type    string   `json:"type"`
+	Brokers []string `json:"brokers"`
+	Topic   string   `json:"topic"`
+	Group   string   `json:"group"`
+	Path    string   `json:"path"`
+	// Tenant is the id of the tenant the events are recorded for.
+	Tenant int `json:"tenant"`
+	// DeadLetters is the file the messages that cannot be recorded are
+	// appended to, with the reason.
+	DeadLetters string `json:"dead_letters"`
+	// BatchSize is how many messages are fetched, and their offsets
+	// committed, at once.
+	BatchSize int `json:"batch_size"`
+}
+
+// Types of alert rules.
+const (
+	// AlertUserCount fires when the daily count of Action of a user
+	// reaches Threshold. It is evaluated as events are recorded.
+	AlertUserCount = "user_count"
+	// AlertTotalDrop fires when the count of Action of every user in the
+	// last Window has fallen by Drop from the Window before. It is
+	// evaluated every Alerts.Interval.
+	AlertTotalDrop = "total_drop"
+)
+
+// AlertRule is a condition on the stats of a tenant and the webhook that
+// is told when it holds, see package alerts.
+type AlertRule struct {
+	Name string `json:"name"`
+	// Type is AlertUserCount or AlertTotalDrop.
+	Type   string `json:"type"`
+	Tenant int    `json:"tenant"`
+	Action string `json:"action"`
+	// Threshold is the daily count of a user_count rule.
+	Threshold int64 `json:"threshold"`
+	// Window is the span, in whole hours, a total_drop rule compares with
+	// the one before it.
+	Window Duration `json:"window"`
+	// Drop is the fraction of the count, between 0 and 1, a total_drop
+	// rule fires at the loss of.
+	Drop float64 `json:"drop"`
+	// MinCount is the count the window before needs for a drop to be
+	// told, so quiet hours do not fire.
+	MinCount int64 `json:"min_count"`
+	// URL receives the alerts as JSON, signed with Secret.
+	URL    string `json:"url"`
+	Secret string `json:"secret"`
+}
+
+// Alerts configures the alert rules and the delivery of their webhooks.
+type Alerts struct {
+	Rules []AlertRule `json:"rules"`
+	// Interval is how often the total_drop rules are evaluated.
+	Interval Duration `json:"interval"`
+	// MaxAttempts bounds the deliveries of an alert.
+	MaxAttempts int `json:"max_attempts"`
+	// Timeout bounds each delivery.
+	Timeout Duration `json:"timeout"`
+}
+
+// Stream configures the live stream of the events recorded.
+type Stream struct {
+	// MaxClients bounds the clients streaming at once, zero turns the
+	// stream off.
+	MaxClients int `json:"max_clients"`
+	// History is how many recent events are kept for the clients that
+	// reconnect.
+	History int `json:"history"`
+	// ClientBuffer is how many events a client may fall behind by before
+	// it is disconnected.
+	ClientBuffer int `json:"client_buffer"`
+	// Heartbeat is how often idle streams get a comment, so that proxies
+	// keep them open.
+	Heartbeat Duration `json:"heartbeat"`
+	// CountsInterval is how often the counters of the streams of counts
+	// are sent.
+	CountsInterval Duration `json:"counts_interval"`
+}
+
+// LiveLeaderboard configures the leaderboards of today clients subscribe
+// to over WebSocket, kept in memory.
+type LiveLeaderboard struct {
+	// Size is how many users each live leaderboard ranks, the largest
+	// limit of a subscription. Zero turns them off.
+	Size int `json:"size"`
+	// MaxClients bounds the clients subscribed at once.
+	MaxClients int `json:"max_clients"`
+	// Interval is the least time between two updates sent to a client.
+	Interval Duration `json:"interval"`
+}
+
+// Config holds the service settings that are not related to the database
+// connection.
+type Config struct {
+	// DedupWindow is how long an event_id is remembered.
+	DedupWindow Duration `json:"dedup_window"`
+	// DedupCacheSize is how many recent event_ids are kept in memory.
+	DedupCacheSize int `json:"dedup_cache_size"`
+	// UnknownUserPolicy is one of the UnknownUser* policies.
+	UnknownUserPolicy string    `json:"unknown_user_policy"`
+	Retention         Retention `json:"retention"`
+	// StatsPartitionsAhead is how many monthly stats partitions are created
+	// in advance.
+	StatsPartitionsAhead int         `json:"stats_partitions_ahead"`
+	Leaderboard          Leaderboard `json:"leaderboard"`
+	Cache                Cache       `json:"cache"`
+	Auth                 Auth        `json:"auth"`
+	RateLimits           RateLimits  `json:"rate_limits"`
+	Server               Server      `json:"server"`
+	GRPC                 GRPC        `json:"grpc"`
+	// Ingest are the queues events are consumed from besides the API.
+	Ingest []IngestSource `json:"ingest"`
+	Alerts Alerts         `json:"alerts"`
+	Stream Stream         `json:"stream"`
+	// LiveLeaderboard is served at /api/stats/leaderboard/live.
+	LiveLeaderboard LiveLeaderboard `json:"live_leaderboard"`
+	// LogLevel is one of the Log* levels.
+	LogLevel string `json:"log_level"`
+}
+
+// LoadDBInfo reads the database connection settings ("engine", "host",
+// "port", "username", "pass" and "dbname") from filename.
+func LoadDBInfo(filename string) (map[string]string, error) {
+	data, err := ioutil.ReadFile(filename)
+
+	if err != nil {
+		return nil, err
+	}
+
+	dbinfo := map[string]string{}
+
+	if err = json.Unmarshal(data, &dbinfo); err != nil {
+		return nil, errors.New("Incorrect configuration file")
+	}
+	return dbinfo, nil
+}
+
+// Default returns the configuration used when no file is given.
+func Default() *Config {
+	return &Config{
+		DedupWindow:       Duration{24 * time.Hour},
+		DedupCacheSize:    10000,
+		UnknownUserPolicy: UnknownUserReject,
+		Retention: Retention{
+			StatsDays:      400,
+			HourlyDays:     90,
+			EventsDays:     30,
+			DeliveriesDays: 30,
+			BatchSize:      1000,
+			Interval:       Duration{time.Hour},
+		},
+		StatsPartitionsAhead: 3,
+		Leaderboard: Leaderboard{
+			Size:            100,
+			RefreshInterval: Duration{5 * time.Minute},
+			LookbackDays:    7,
+		},
+		Cache: Cache{
+			MaxEntries: 1000,
+			PastTTL:    Duration{10 * time.Minute},
+			TodayTTL:   Duration{5 * time.Second},
+		},
+		Auth: Auth{
+			RequireAPIKey: false,
+			RotationGrace: Duration{24 * time.Hour},
+		},
+		RateLimits: RateLimits{
+			Routes: map[string]RateLimit{
+				"/api/users/stats": {Rate: 200, Burst: 400},
+				"*":                {Rate: 20, Burst: 40},
+			},
+		},
+		Server: Server{
+			ReadTimeout:       Duration{30 * time.Second},
+			ReadHeaderTimeout: Duration{5 * time.Second},
+			WriteTimeout:      Duration{time.Minute},
+			IdleTimeout:       Duration{2 * time.Minute},
+			HTTP2:             true,
+			TLS:               TLS{MinVersion: "1.2"},
+		},
+		Alerts: Alerts{
+			Interval:    Duration{5 * time.Minute},
+			MaxAttempts: 5,
+			Timeout:     Duration{10 * time.Second},
+		},
+		Stream: Stream{
+			MaxClients:     100,
+			History:        1000,
+			ClientBuffer:   256,
+			Heartbeat:      Duration{15 * time.Second},
+			CountsInterval: Duration{time.Second},
+		},
+		LiveLeaderboard: LiveLeaderboard{
+			Size:       100,
+			MaxClients: 100,
+			Interval:   Duration{500 * time.Millisecond},
+		},
+		LogLevel: LogInfo,
+	}
+}
+
+// Load reads the configuration from filename on top of the defaults. A
+// missing file is not an error.
+func Load(filename string) (*Config, error) {
+	conf := Default()
+
+	data, err := ioutil.ReadFile(filename)
+
+	if os.IsNotExist(err) {
+		return conf, nil
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	if err = json.Unmarshal(data, conf); err != nil {
+		return nil, errors.New("Incorrect configuration file: " + err.Error())
+	}
+
+	if err = conf.validate(); err != nil {
+		return nil, err
+	}
+	return conf, nil
+}
+
+func (conf *Config) validate() error {
+	if conf.DedupWindow.Duration <= 0 {
+		return errors.New(`"dedup_window" must be positive`)
+	}
+
+	if conf.DedupCacheSize < 0 {
+		return errors.New(`"dedup_cache_size" must not be negative`)
+	}
+
+	switch conf.UnknownUserPolicy {
+	case UnknownUserReject, UnknownUserCreate, UnknownUserQueue:
+	default:
+		return errors.New(`"unknown_user_policy" must be "reject", "create" or "queue"`)
+	}
+
+	r := conf.Retention
+
+	if r.StatsDays < 0 || r.HourlyDays < 0 || r.EventsDays < 0 || r.DeliveriesDays < 0 {
+		return errors.New(`"retention" days must not be negative`)
+	}
+
+	if r.BatchSize <= 0 || r.Interval.Duration <= 0 {
+		return errors.New(`"retention" batch_size and interval must be positive`)
+	}
+
+	if conf.StatsPartitionsAhead < 0 {
+		return errors.New(`"stats_partitions_ahead" must not be negative`)
+	}
+
+	l := conf.Leaderboard
+
+	if l.Size < 0 || l.LookbackDays < 0 || l.RefreshInterval.Duration <= 0 {
+		return errors.New(`"leaderboard" size and lookback_days must not be negative, refresh_interval must be positive`)
+	}
+
+	if c := conf.Cache; c.MaxEntries < 0 || c.PastTTL.Duration < 0 || c.TodayTTL.Duration < 0 {
+		return errors.New(`"cache" settings must not be negative`)
+	}
+
+	if conf.Auth.RotationGrace.Duration < 0 {
+		return errors.New(`"auth" rotation_grace must not be negative`)
+	}
+
+	for route, limit := range conf.RateLimits.Routes {
+		if limit.Rate <= 0 || limit.Burst < 1 {
+			return errors.New(`"rate_limits" of "` + route + `" must have a positive rate and burst`)
+		}
+	}
+
+	if conf.RateLimits.DailyEvents < 0 {
+		return errors.New(`"rate_limits" daily_events must not be negative`)
+	}
+
+	srv := conf.Server
+
+	if srv.ReadTimeout.Duration < 0 || srv.ReadHeaderTimeout.Duration < 0 || srv.WriteTimeout.Duration < 0 || srv.IdleTimeout.Duration < 0 {
+		return errors.New(`"server" timeouts must not be negative`)
+	}
+
+	if (srv.TLS.CertFile == "") != (srv.TLS.KeyFile == "") {
+		return errors.New(`"server" tls needs both cert_file and key_file`)
+	}
+
+	if srv.TLS.ClientCAFile != "" && srv.TLS.CertFile == "" {
+		return errors.New(`"server" tls client_ca_file needs cert_file and key_file`)
+	}
+
+	switch srv.TLS.MinVersion {
+	case "1.2", "1.3":
+	default:
+		return errors.New(`"server" tls min_version must be "1.2" or "1.3"`)
+	}
+
+	if conf.GRPC.Port < 0 || conf.GRPC.Port > 65535 {
+		return errors.New(`"grpc" port must be between 0 and 65535`)
+	}
+
+	names := map[string]bool{}
+
+	for _, src := range conf.Ingest {
+		if src.Name == "" || names[src.Name] {
+			return errors.New(`"ingest" sources need a unique name`)
+		}
+
+		names[src.Name] = true
+
+		switch src.Type {
+		case IngestKafka:
+			if len(src.Brokers) == 0 || src.Topic == "" || src.Group == "" {
+				return errors.New(`"ingest" source "` + src.Name + `" needs brokers, a topic and a group`)
+			}
+		case IngestFile:
+			if src.Path == "" {
+				return errors.New(`"ingest" source "` + src.Name + `" needs a path`)
+			}
+		default:
+			return errors.New(`"ingest" source "` + src.Name + `" must have type "kafka" or "file"`)
+		}
+
+		if src.DeadLetters == "" {
+			return errors.New(`"ingest" source "` + src.Name + `" needs dead_letters`)
+		}
+
+		if src.Tenant < 0 || src.BatchSize <= 0 {
+			return errors.New(`"ingest" source "` + src.Name + `" must have a positive batch_size and a tenant`)
+		}
+	}
+
+	if err := conf.Alerts.validate(); err != nil {
+		return err
+	}
+
+	if st := conf.Stream; st.MaxClients < 0 || st.History < 0 || st.ClientBuffer <= 0 ||
+		st.Heartbeat.Duration <= 0 || st.CountsInterval.Duration <= 0 {
+		return errors.New(`"stream" max_clients and history must not be negative, the other settings must be positive`)
+	}
+
+	if l := conf.LiveLeaderboard; l.Size < 0 || l.MaxClients < 0 || l.Interval.Duration <= 0 {
+		return errors.New(`"live_leaderboard" size and max_clients must not be negative, interval must be positive`)
+	}
+
+	if conf.LogLevel != LogInfo && conf.LogLevel != LogError {
+		return errors.New(`"log_level" must be "info" or "error"`)
+	}
+	return nil
+}
+
+func (a *Alerts) validate() error {
+	if a.Interval.Duration <= 0 || a.MaxAttempts <= 0 || a.Timeout.Duration <= 0 {
+		return errors.New(`"alerts" interval, max_attempts and timeout must be positive`)
+	}
+
+	names := map[string]bool{}
+
+	for _, rule := range a.Rules {
+		if rule.Name == "" || names[rule.Name] {
+			return errors.New(`"alerts" rules need a unique name`)
+		}
+
+		names[rule.Name] = true
+
+		if rule.Action == "" || rule.URL == "" || rule.Tenant < 0 {
+			return errors.New(`"alerts" rule "` + rule.Name + `" needs an action, a url and a tenant`)
+		}
+
+		if !strings.HasPrefix(rule.URL, "http://") && !strings.HasPrefix(rule.URL, "https://") {
+			return errors.New(`"alerts" rule "` + rule.Name + `" url must be http or https`)
+		}
+
+		switch rule.Type {
+		case AlertUserCount:
+			if rule.Threshold <= 0 {
+				return errors.New(`"alerts" rule "` + rule.Name + `" must have a positive threshold`)
+			}
+		case AlertTotalDrop:
+			if w := rule.Window.Duration; w < time.Hour || w%time.Hour != 0 {
+				return errors.New(`"alerts" rule "` + rule.Name + `" window must be whole hours`)
+			}
+
+			if rule.Drop <= 0 || rule.Drop > 1 || rule.MinCount < 0 {
+				return errors.New(`"alerts" rule "` + rule.Name + `" drop must be in (0, 1], min_count not negative`)
+			}
+		default:
+			return errors.New(`"alerts" rule "` + rule.Name + `" must have type "user_count" or "total_drop"`)
+		}
+	}
+	return nil
+}
+
+// Changed returns the names of the top level settings that differ in
+// other.
+func (conf *Config) Changed(other *Config) []string {
+	var changed []string
+
+	a, b := reflect.ValueOf(conf).Elem(), reflect.ValueOf(other).Elem()
+
+	for i := 0; i < a.NumField(); i++ {
+		if !reflect.DeepEqual(a.Field(i).Interface(), b.Field(i).Interface()) {
+			changed = append(changed, strings.Split(a.Type().Field(i).Tag.Get("json"), ",")[0])
+		}
+	}
+	return changed
+}
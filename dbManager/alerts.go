@@ -0,0 +1,63 @@
+package dbManager
+
+import (
+	"database/sql"
+	"time"
+)
+
+// DailyCount returns the count of action of user on the UTC day of ts,
+// as PutStats records it.
+func (dbm *DBManager) DailyCount(user, action interface{}, ts string) (int64, error) {
+	var cnt int64
+
+	err := dbm.DB.QueryRow(`SELECT cnt FROM stats
+WHERE "user" = $1 AND action = $2 AND date = ($3::timestamptz AT TIME ZONE 'UTC')::date AND tenant_id = $4;`,
+		user, action, ts, dbm.tenantID()).Scan(&cnt)
+
+	if err == sql.ErrNoRows {
+		return 0, nil
+	}
+
+	if err != nil {
+		return 0, err
+	}
+	return cnt, nil
+}
+
+// ActionCount returns the count of action of every user in the hours from
+// from to to.
+func (dbm *DBManager) ActionCount(action string, from, to time.Time) (int64, error) {
+	var cnt int64
+
+	err := dbm.DB.QueryRow(`SELECT coalesce(sum(cnt), 0) FROM stats_hourly
+WHERE action = $1 AND hour >= $2 AND hour < $3 AND tenant_id = $4;`,
+		action, from, to, dbm.tenantID()).Scan(&cnt)
+
+	if err != nil {
+		return 0, err
+	}
+	return cnt, nil
+}
+
+// LogDelivery records an attempt to deliver the webhook of an alert.
+// status is zero when no response came, errText empty when the attempt
+// succeeded.
+func (dbm *DBManager) LogDelivery(alertID, rule, url string, attempt, status int, errText string) error {
+	_, err := dbm.DB.Exec(`INSERT INTO webhook_deliveries (tenant_id, alert_id, rule, url, attempt, status, error)
+VALUES ($1, $2, $3, $4, $5, $6, $7);`,
+		dbm.tenantID(), alertID, rule, url, attempt,
+		sql.NullInt64{Int64: int64(status), Valid: status != 0},
+		sql.NullString{String: errText, Valid: errText != ""})
+
+	return err
+}
+
+// Delivered reports whether the webhook of an alert was delivered.
+func (dbm *DBManager) Delivered(alertID string) (bool, error) {
+	var delivered bool
+
+	err := dbm.DB.QueryRow(`SELECT exists(SELECT 1 FROM webhook_deliveries
+WHERE alert_id = $1 AND error IS NULL AND tenant_id = $2);`, alertID, dbm.tenantID()).Scan(&delivered)
+
+	return delivered, err
+}
@@ -0,0 +1,339 @@
+package dbManager
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// CopyUsers upserts users of the tenant in one transaction: they are copied
+// into a temporary table and merged into users from there. Existing users
+// get the age and sex of the copy, unless it has none, as placeholder users
+// do; of users given twice the last one wins.
+// The MaxUsers quota does not apply.
+func (dbm *DBManager) CopyUsers(users []map[string]interface{}) (sql.Result, error) {
+
+	tx, err := dbm.DB.Begin()
+
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = tx.Exec(`CREATE TEMP TABLE users_import
+(
+  n   SERIAL,
+  id  INTEGER,
+  age INTEGER,
+  sex SEX
+) ON COMMIT DROP;`)
+
+	if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+
+	stmt, err := tx.Prepare(pq.CopyIn("users_import", "id", "age", "sex"))
+
+	if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+
+	for _, user := range users {
+		if _, err = stmt.Exec(user["id"], user["age"], user["sex"]); err != nil {
+			stmt.Close()
+			tx.Rollback()
+			return nil, err
+		}
+	}
+
+	if _, err = stmt.Exec(); err != nil {
+		stmt.Close()
+		tx.Rollback()
+		return nil, err
+	}
+
+	if err = stmt.Close(); err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+
+	result, err := tx.Exec(`INSERT INTO users (tenant_id, id, age, sex)
+  SELECT DISTINCT ON (id)
+    $1 :: INTEGER,
+    id,
+    age,
+    sex
+  FROM users_import
+  ORDER BY id, n DESC
+ON CONFLICT ON CONSTRAINT users_pkey
+  DO UPDATE SET age = coalesce(EXCLUDED.age, users.age), sex = coalesce(EXCLUDED.sex, users.sex);`, dbm.tenantID())
+
+	if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+
+	if err = tx.Commit(); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// ExportUsers returns every user of the tenant ordered by id.
+func (dbm *DBManager) ExportUsers() (*sql.Rows, error) {
+
+	rows, err := dbm.DB.Query(`SELECT
+  id,
+  age,
+  cast(sex AS VARCHAR(1))
+FROM users
+WHERE tenant_id = $1
+ORDER BY id;`, dbm.tenantID())
+
+	if err != nil {
+		return nil, err
+	}
+
+	return rows, nil
+}
+
+// BackfillCheckpoint is how far the backfill of Input got: its records up
+// to Line are merged.
+type BackfillCheckpoint struct {
+	Input string
+	Line  int
+}
+
+// BackfillLine returns the line the backfill of input of the tenant got
+// to, 0 if it has not merged anything.
+func (dbm *DBManager) BackfillLine(input string) (int, error) {
+
+	var line int
+
+	err := dbm.DB.QueryRow(`SELECT line
+FROM backfill_checkpoints
+WHERE tenant_id = $1 AND input = $2;`, dbm.tenantID(), input).Scan(&line)
+
+	if err == sql.ErrNoRows {
+		return 0, nil
+	}
+	return line, err
+}
+
+// ResetBackfill forgets how far the backfill of input of the tenant got.
+func (dbm *DBManager) ResetBackfill(input string) error {
+
+	_, err := dbm.DB.Exec(`DELETE FROM backfill_checkpoints
+WHERE tenant_id = $1 AND input = $2;`, dbm.tenantID(), input)
+
+	return err
+}
+
+// MergeStats merges daily counters ("user", "action", "date" and "cnt")
+// into the stats of the tenant in one transaction, adding them to the
+// existing counters or, if replace is set, replacing those. Counters given
+// twice are summed first. The hourly stats get each counter in the midnight
+// (UTC) hour of its day; replaced counters replace every hour of the day.
+// The stats partitions of their months are created as needed. If
+// checkpoint is set, it is saved in the same transaction, so a chunk is
+// merged exactly when its checkpoint is.
+// The counters of users that are not registered are left out; those users
+// are returned.
+func (dbm *DBManager) MergeStats(counters []map[string]interface{}, replace bool, checkpoint *BackfillCheckpoint) ([]int64, error) {
+
+	months := map[string]time.Time{}
+
+	for _, c := range counters {
+		if date, err := time.Parse(layout, fmt.Sprint(c["date"])); err == nil {
+			name, _, _ := statsPartition(date)
+			months[name] = date
+		}
+	}
+
+	for _, month := range months {
+		if _, _, err := dbm.ensureStatsPartition(month); err != nil {
+			return nil, err
+		}
+	}
+
+	tx, err := dbm.DB.Begin()
+
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = tx.Exec(`CREATE TEMP TABLE stats_backfill
+(
+  "user" INTEGER,
+  action TEXT,
+  date   DATE,
+  cnt    INTEGER
+) ON COMMIT DROP;`)
+
+	if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+
+	stmt, err := tx.Prepare(pq.CopyIn("stats_backfill", "user", "action", "date", "cnt"))
+
+	if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+
+	for _, c := range counters {
+		if _, err = stmt.Exec(c["user"], c["action"], c["date"], c["cnt"]); err != nil {
+			stmt.Close()
+			tx.Rollback()
+			return nil, err
+		}
+	}
+
+	if _, err = stmt.Exec(); err != nil {
+		stmt.Close()
+		tx.Rollback()
+		return nil, err
+	}
+
+	if err = stmt.Close(); err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+
+	rows, err := tx.Query(`SELECT DISTINCT "user"
+FROM stats_backfill b
+WHERE NOT exists(SELECT 1
+                 FROM users u
+                 WHERE u.tenant_id = $1 AND u.id = b."user")
+ORDER BY 1;`, dbm.tenantID())
+
+	if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+
+	var unknown []int64
+
+	for rows.Next() {
+		var user int64
+
+		if err = rows.Scan(&user); err != nil {
+			break
+		}
+		unknown = append(unknown, user)
+	}
+
+	if err == nil {
+		err = rows.Err()
+	}
+
+	rows.Close()
+
+	if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+
+	merge := `stats.cnt + EXCLUDED.cnt`
+
+	if replace {
+		merge = `EXCLUDED.cnt`
+	}
+
+	_, err = tx.Exec(`INSERT INTO stats (tenant_id, "user", action, date, cnt)
+  SELECT
+    $1 :: INTEGER,
+    "user",
+    action,
+    date,
+    sum(cnt)
+  FROM stats_backfill b
+  WHERE exists(SELECT 1
+               FROM users u
+               WHERE u.tenant_id = $1 AND u.id = b."user")
+  GROUP BY 1, 2, 3, 4
+ON CONFLICT ON CONSTRAINT user_time_uniq
+  DO UPDATE SET cnt = ` + merge + `;`, dbm.tenantID())
+
+	if isForeignKeyViolation(err) {
+		tx.Rollback()
+		return nil, ErrUnknownUser
+	}
+
+	if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+
+	if replace {
+		_, err = tx.Exec(`DELETE FROM stats_hourly h
+USING stats_backfill b
+WHERE h.tenant_id = $1 AND h."user" = b."user" AND h.action = b.action
+      AND h.hour >= b.date :: TIMESTAMP AT TIME ZONE 'UTC'
+      AND h.hour < (b.date + 1) :: TIMESTAMP AT TIME ZONE 'UTC';`, dbm.tenantID())
+
+		if err != nil {
+			tx.Rollback()
+			return nil, err
+		}
+	}
+
+	_, err = tx.Exec(`INSERT INTO stats_hourly (tenant_id, "user", action, hour, cnt)
+  SELECT
+    $1 :: INTEGER,
+    "user",
+    action,
+    date :: TIMESTAMP AT TIME ZONE 'UTC',
+    sum(cnt)
+  FROM stats_backfill b
+  WHERE exists(SELECT 1
+               FROM users u
+               WHERE u.tenant_id = $1 AND u.id = b."user")
+  GROUP BY 1, 2, 3, 4
+ON CONFLICT ON CONSTRAINT user_hour_uniq
+  DO UPDATE SET cnt = stats_hourly.cnt + EXCLUDED.cnt;`, dbm.tenantID())
+
+	if isForeignKeyViolation(err) {
+		tx.Rollback()
+		return nil, ErrUnknownUser
+	}
+
+	if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+
+	if err = lockLeaderboardDays(tx, `SELECT DISTINCT date FROM stats_backfill`); err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+
+	_, err = tx.Exec(`DELETE FROM leaderboard_days
+  WHERE tenant_id = $1 AND (date, action) IN (SELECT date, action FROM stats_backfill);`, dbm.tenantID())
+
+	if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+
+	if checkpoint != nil {
+		_, err = tx.Exec(`INSERT INTO backfill_checkpoints (tenant_id, input, line)
+VALUES ($1, $2, $3)
+ON CONFLICT ON CONSTRAINT backfill_checkpoints_pkey
+  DO UPDATE SET line = EXCLUDED.line, updated_at = now();`, dbm.tenantID(), checkpoint.Input, checkpoint.Line)
+
+		if err != nil {
+			tx.Rollback()
+			return nil, err
+		}
+	}
+
+	if err = tx.Commit(); err != nil {
+		return nil, err
+	}
+	return unknown, nil
+}
@@ -1,20 +1,42 @@
 package dbManager
 
 import (
-	_ "github.com/lib/pq"
+	"github.com/lib/pq"
 	"fmt"
 	"database/sql"
+	"errors"
 	"net/url"
+	"strconv"
+	"time"
 )
 
+const (
+	layout = "2006-01-02"
+)
+
+// ErrUnknownUser is returned when stats are put for a user that is not
+// registered.
+var ErrUnknownUser = errors.New("dbManager: unknown user")
+
+// ErrUserRegistered is returned by QueueStats when the user of the event
+// got registered since PutStats refused it; the event is to be put again.
+var ErrUserRegistered = errors.New("dbManager: user registered")
+
 type DBInfo map[string]string
 
 type DBManager struct {
 	DB *sql.DB
+	// DedupWindow is how long an event_id passed to PutStats is remembered.
+	DedupWindow time.Duration
+	// LeaderboardSize is how many users the daily leaderboards keep. Zero
+	// disables them.
+	LeaderboardSize int
+	// Tenant scopes the queries, nil is the default tenant. See ForTenant.
+	Tenant *Tenant
 }
 
 func NewDBManager(dbinfo map[string]string) (*DBManager, error) {
-	str := fmt.Sprintf("%s://%s/%s?user=%s&password=%s&port=%s&sslmode=disable",
+	str := fmt.Sprintf("%s://%s/%s?user=%s&password=%s&port=%s&sslmode=disable&timezone=UTC",
 		dbinfo["engine"],
 		dbinfo["host"],
 		dbinfo["dbname"],
@@ -31,13 +53,22 @@ func NewDBManager(dbinfo map[string]string) (*DBManager, error) {
 	return &DBManager{DB: db}, nil
 }
 
+// CreateUser registers a user of the tenant. ErrQuotaExceeded is returned
+// if the tenant has MaxUsers users already.
 func (dbm *DBManager) CreateUser(values map[string]interface{}) (sql.Result, error) {
 
-	result, err := dbm.DB.Exec(`INSERT INTO users VALUES ($1, $2, $3)
-							ON CONFLICT ON CONSTRAINT table_name_pkey DO NOTHING;`,
+	if err := dbm.checkUserQuota(values["id"]); err != nil {
+		return nil, err
+	}
+
+	result, err := dbm.DB.Exec(`INSERT INTO users (id, age, sex, tenant_id) VALUES ($1, $2, $3, $4)
+							ON CONFLICT ON CONSTRAINT users_pkey
+							DO UPDATE SET age = EXCLUDED.age, sex = EXCLUDED.sex
+							WHERE users.age IS NULL AND users.sex IS NULL;`,
 		values["id"],
 		values["age"],
-		values["sex"])
+		values["sex"],
+		dbm.tenantID())
 
 	if err != nil {
 		return nil, err
@@ -46,8 +77,25 @@ func (dbm *DBManager) CreateUser(values map[string]interface{}) (sql.Result, err
 
 }
 
+// GetStats returns the top "limit" users of every bucket in [date1, date2).
+// Buckets are UTC days unless "interval" or "tz" ask for something else, in
+// which case the hourly counters are aggregated in the requested time zone.
 func (dbm *DBManager) GetStats(values url.Values) (*sql.Rows, error) {
 
+	interval, tz := values.Get("interval"), values.Get("tz")
+
+	if (interval == "" || interval == "day") && (tz == "" || tz == "UTC") {
+		return dbm.getDailyStats(values)
+	}
+
+	if interval == "" {
+		interval = "day"
+	}
+
+	if tz == "" {
+		tz = "UTC"
+	}
+
 	rows, err := dbm.DB.Query(`SELECT
   date,
   id,
@@ -61,17 +109,90 @@ FROM (
          OVER (
            PARTITION BY date
            ORDER BY cnt DESC) AS r
-       FROM stats, users
+       FROM (
+              SELECT
+                date_trunc($5, hour AT TIME ZONE $6) AT TIME ZONE $6 AS date,
+                "user",
+                sum(cnt) AS cnt
+              FROM stats_hourly
+              WHERE hour >= $1::timestamp AT TIME ZONE $6
+                    AND hour < $2::timestamp AT TIME ZONE $6
+                    AND action = $3 AND tenant_id = $7
+              GROUP BY 1, 2
+            ) s, users
+       WHERE "user" = id AND tenant_id = $7
+     ) t
+WHERE r <= $4
+ORDER BY date, cnt DESC;`,
+		values["date1"][0],
+		values["date2"][0],
+		values["action"][0],
+		values["limit"][0],
+		interval,
+		tz,
+		dbm.tenantID())
+
+	if err != nil {
+		return nil, err
+	}
+
+	return rows, nil
+}
+
+func (dbm *DBManager) getDailyStats(values url.Values) (*sql.Rows, error) {
+
+	fits, err := dbm.leaderboardFits(values)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if fits {
+		return dbm.getLeaderboardStats(values)
+	}
+
+	rows, err := dbm.DB.Query(`SELECT
+  date,
+  id,
+  age,
+  cast(sex AS VARCHAR(1)),
+  cnt
+FROM (
+       SELECT
+         *,
+         row_number()
+         OVER (
+           PARTITION BY date
+           ORDER BY cnt DESC) AS r
+       FROM stats s, users u
        WHERE date >= $1
              AND date < $2
         AND "user" = id AND action = $3
+        AND s.tenant_id = $5 AND u.tenant_id = $5
      ) t
 WHERE r <= $4
 ORDER BY date, cnt DESC;`,
 		values["date1"][0],
 		values["date2"][0],
 		values["action"][0],
-		values["limit"][0])
+		values["limit"][0],
+		dbm.tenantID())
+
+	if err != nil {
+		return nil, err
+	}
+
+	return rows, nil
+}
+
+// UserActivity returns the daily counters of user in [date1, date2), as
+// date, action and cnt rows ordered by date and action.
+func (dbm *DBManager) UserActivity(user int64, date1, date2 string) (*sql.Rows, error) {
+
+	rows, err := dbm.DB.Query(`SELECT date, action, cnt
+FROM stats
+WHERE "user" = $1 AND date >= $2 AND date < $3 AND tenant_id = $4
+ORDER BY date, action;`, user, date1, date2, dbm.tenantID())
 
 	if err != nil {
 		return nil, err
@@ -80,17 +201,517 @@ ORDER BY date, cnt DESC;`,
 	return rows, nil
 }
 
+// PutStats records a single event in the raw events log and increments
+// the daily and hourly counters for it in the same transaction. If values
+// carry an "event_id" already seen within DedupWindow nothing is written
+// and the result reports no affected rows. ErrUnknownUser is returned if
+// the user is not registered, ErrQuotaExceeded if the tenant has recorded
+// DailyEvents events today.
 func (dbm *DBManager) PutStats(values map[string]interface{}) (sql.Result, error) {
 
-	result, err := dbm.DB.Exec(`INSERT INTO stats ("user", action, date) VALUES ($1, $2, $3)
+	tx, err := dbm.DB.Begin()
+
+	if err != nil {
+		return nil, err
+	}
+
+	result, err := dbm.putStats(tx, values)
+
+	if err == nil {
+		if n, _ := result.RowsAffected(); n > 0 {
+			err = dbm.meterEvent(tx)
+		}
+	}
+
+	if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+
+	if err = tx.Commit(); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+func (dbm *DBManager) putStats(tx *sql.Tx, values map[string]interface{}) (sql.Result, error) {
+
+	if values["event_id"] != nil {
+		result, err := tx.Exec(`INSERT INTO event_ids (event_id, tenant_id) VALUES ($1, $3)
+									  ON CONFLICT ON CONSTRAINT event_ids_pkey
+									  DO UPDATE SET seen_at = now() WHERE event_ids.seen_at < now() - $2 * interval '1 second';`,
+			values["event_id"],
+			dbm.DedupWindow.Seconds(),
+			dbm.tenantID())
+
+		if err != nil {
+			return nil, err
+		}
+
+		if n, err := result.RowsAffected(); err != nil || n == 0 {
+			return result, err
+		}
+	}
+
+	result, err := tx.Exec(`INSERT INTO events ("user", action, ts, event_id, tenant_id) VALUES ($1, $2, $3, $4, $5);`,
+		values["user"],
+		values["action"],
+		values["ts"],
+		values["event_id"],
+		dbm.tenantID())
+
+	if isForeignKeyViolation(err) {
+		return nil, ErrUnknownUser
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = tx.Exec(`INSERT INTO stats ("user", action, date, tenant_id) VALUES ($1, $2, ($3::timestamptz AT TIME ZONE 'UTC')::date, $4)
 									  ON CONFLICT ON CONSTRAINT user_time_uniq
   									  DO UPDATE SET cnt = stats.cnt + 1;`,
 		values["user"],
 		values["action"],
-		values["ts"])
+		values["ts"],
+		dbm.tenantID())
+
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = tx.Exec(`INSERT INTO stats_hourly ("user", action, hour, tenant_id) VALUES ($1, $2, date_trunc('hour', $3::timestamptz), $4)
+									  ON CONFLICT ON CONSTRAINT user_hour_uniq
+  									  DO UPDATE SET cnt = stats_hourly.cnt + 1;`,
+		values["user"],
+		values["action"],
+		values["ts"],
+		dbm.tenantID())
+
+	if err != nil {
+		return nil, err
+	}
+
+	if dbm.LeaderboardSize > 0 {
+		err = lockLeaderboardDays(tx, `SELECT ($1::timestamptz AT TIME ZONE 'UTC')::date`, values["ts"])
+
+		if err != nil {
+			return nil, err
+		}
+
+		_, err = tx.Exec(`DELETE FROM leaderboard_days
+									  WHERE date = ($2::timestamptz AT TIME ZONE 'UTC')::date AND action = $1 AND tenant_id = $3;`,
+			values["action"],
+			values["ts"],
+			dbm.tenantID())
+
+		if err != nil {
+			return nil, err
+		}
+	}
+	return result, nil
+}
+
+// CreatePlaceholderUser registers user without age and sex so that stats
+// can be recorded for it. A later CreateUser fills the missing fields in.
+func (dbm *DBManager) CreatePlaceholderUser(user interface{}) (sql.Result, error) {
+
+	if err := dbm.checkUserQuota(user); err != nil {
+		return nil, err
+	}
+
+	result, err := dbm.DB.Exec(`INSERT INTO users (id, tenant_id) VALUES ($1, $2)
+							ON CONFLICT ON CONSTRAINT users_pkey DO NOTHING;`, user, dbm.tenantID())
+
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// meterEvent counts an event towards the DailyEvents quota of the tenant
+// and returns ErrQuotaExceeded if it is used up.
+func (dbm *DBManager) meterEvent(tx *sql.Tx) error {
+
+	if dbm.Tenant == nil || dbm.Tenant.DailyEvents <= 0 {
+		return nil
+	}
+
+	result, err := tx.Exec(`INSERT INTO tenant_usage (tenant_id, date, events) VALUES ($1, (now() AT TIME ZONE 'UTC')::date, 1)
+									  ON CONFLICT ON CONSTRAINT tenant_usage_pkey
+									  DO UPDATE SET events = tenant_usage.events + 1 WHERE tenant_usage.events < $2;`,
+		dbm.Tenant.ID,
+		dbm.Tenant.DailyEvents)
+
+	if err != nil {
+		return err
+	}
+
+	if n, err := result.RowsAffected(); err != nil || n == 0 {
+		if err == nil {
+			err = ErrQuotaExceeded
+		}
+		return err
+	}
+	return nil
+}
+
+// checkUserQuota returns ErrQuotaExceeded if user is not registered and the
+// tenant has MaxUsers users already.
+func (dbm *DBManager) checkUserQuota(user interface{}) error {
+
+	if dbm.Tenant == nil || dbm.Tenant.MaxUsers <= 0 {
+		return nil
+	}
+
+	var full bool
+
+	err := dbm.DB.QueryRow(`SELECT count(*) >= $2 AND NOT bool_or(id = $3)
+FROM users
+WHERE tenant_id = $1;`, dbm.Tenant.ID, dbm.Tenant.MaxUsers, user).Scan(&full)
+
+	if err != nil {
+		return err
+	}
+
+	if full {
+		return ErrQuotaExceeded
+	}
+	return nil
+}
+
+// QueueStats keeps an event of an unregistered user until ApplyPendingStats
+// is called for that user. Queuing an "event_id" twice is a no-op. Queued
+// events count towards the DailyEvents quota when queued. The user is
+// checked again under the lock ApplyPendingStats takes, so an event is not
+// queued after the queue of its user was applied: ErrUserRegistered is
+// returned instead.
+func (dbm *DBManager) QueueStats(values map[string]interface{}) (sql.Result, error) {
+
+	tx, err := dbm.DB.Begin()
+
+	if err != nil {
+		return nil, err
+	}
+
+	if err = dbm.lockPendingStats(tx, values["user"]); err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+
+	var registered bool
+
+	err = tx.QueryRow(`SELECT exists(SELECT 1 FROM users WHERE id = $1 AND tenant_id = $2);`,
+		values["user"], dbm.tenantID()).Scan(&registered)
+
+	if err == nil && registered {
+		err = ErrUserRegistered
+	}
+
+	if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+
+	result, err := tx.Exec(`INSERT INTO pending_stats ("user", action, ts, event_id, tenant_id) VALUES ($1, $2, $3, $4, $5)
+									  ON CONFLICT DO NOTHING;`,
+		values["user"],
+		values["action"],
+		values["ts"],
+		values["event_id"],
+		dbm.tenantID())
+
+	if err == nil {
+		if n, _ := result.RowsAffected(); n > 0 {
+			err = dbm.meterEvent(tx)
+		}
+	}
 
 	if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+
+	if err = tx.Commit(); err != nil {
 		return nil, err
 	}
 	return result, nil
 }
+
+// ApplyPendingStats records the queued events of user as PutStats would and
+// removes them from the queue. It returns the number of events applied.
+func (dbm *DBManager) ApplyPendingStats(user interface{}) (int64, error) {
+
+	tx, err := dbm.DB.Begin()
+
+	if err != nil {
+		return 0, err
+	}
+
+	if err = dbm.lockPendingStats(tx, user); err != nil {
+		tx.Rollback()
+		return 0, err
+	}
+
+	rows, err := tx.Query(`DELETE FROM pending_stats WHERE "user" = $1 AND tenant_id = $2
+									  RETURNING "user", action, ts, event_id;`, user, dbm.tenantID())
+
+	if err != nil {
+		tx.Rollback()
+		return 0, err
+	}
+
+	var pending []map[string]interface{}
+
+	for rows.Next() {
+		var u, action string
+		var ts time.Time
+		var eventID sql.NullString
+
+		if err := rows.Scan(&u, &action, &ts, &eventID); err != nil {
+			rows.Close()
+			tx.Rollback()
+			return 0, err
+		}
+
+		values := map[string]interface{}{"user": u, "action": action, "ts": ts.Format(time.RFC3339Nano)}
+
+		if eventID.Valid {
+			values["event_id"] = eventID.String
+		}
+
+		pending = append(pending, values)
+	}
+
+	rows.Close()
+
+	if err := rows.Err(); err != nil {
+		tx.Rollback()
+		return 0, err
+	}
+
+	var applied int64
+
+	for _, values := range pending {
+		result, err := dbm.putStats(tx, values)
+
+		if err != nil {
+			tx.Rollback()
+			return 0, err
+		}
+
+		if n, _ := result.RowsAffected(); n > 0 {
+			applied++
+		}
+	}
+
+	if err = tx.Commit(); err != nil {
+		return 0, err
+	}
+	return applied, nil
+}
+
+// PendingUsers returns the registered users of the tenant that have events
+// queued, for ApplyPendingStats.
+func (dbm *DBManager) PendingUsers() ([]int64, error) {
+
+	rows, err := dbm.DB.Query(`SELECT DISTINCT p."user"
+FROM pending_stats p
+WHERE p.tenant_id = $1 AND exists(SELECT 1 FROM users u WHERE u.id = p."user" AND u.tenant_id = p.tenant_id);`,
+		dbm.tenantID())
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	var users []int64
+
+	for rows.Next() {
+		var user int64
+
+		if err := rows.Scan(&user); err != nil {
+			return nil, err
+		}
+		users = append(users, user)
+	}
+	return users, rows.Err()
+}
+
+// lockPendingStats serializes the transactions queuing and applying the
+// events of user until tx ends.
+func (dbm *DBManager) lockPendingStats(tx *sql.Tx, user interface{}) error {
+	_, err := tx.Exec(`SELECT pg_advisory_xact_lock($1, hashtext($2::text));`, dbm.tenantID(), user)
+	return err
+}
+
+// UserID returns the user of an event, as decoded from JSON or a form, as
+// an integer.
+func UserID(v interface{}) (int64, bool) {
+	switch u := v.(type) {
+	case float64:
+		return int64(u), u == float64(int64(u))
+	case int64:
+		return u, true
+	case int:
+		return int64(u), true
+	case string:
+		n, err := strconv.ParseInt(u, 10, 64)
+		return n, err == nil
+	}
+	return 0, false
+}
+
+func isForeignKeyViolation(err error) bool {
+	pqErr, ok := err.(*pq.Error)
+	return ok && pqErr.Code == "23503"
+}
+
+// OldestEvent returns the time of the oldest event of the tenant in the
+// events log, false if it is empty.
+func (dbm *DBManager) OldestEvent() (time.Time, bool, error) {
+
+	var ts pq.NullTime
+
+	err := dbm.DB.QueryRow(`SELECT min(ts) FROM events WHERE tenant_id = $1;`, dbm.tenantID()).Scan(&ts)
+
+	if err != nil {
+		return time.Time{}, false, err
+	}
+	return ts.Time, ts.Valid, nil
+}
+
+// RollupStats rebuilds the daily and hourly counters of the tenant in
+// [date1, date2) (UTC) from the raw events log. The result is the one of
+// the daily insert. Days in the range that have no events end up without
+// counters, so the range must not reach back before the events log.
+func (dbm *DBManager) RollupStats(date1, date2 string) (sql.Result, error) {
+
+	tx, err := dbm.DB.Begin()
+
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = tx.Exec(`DELETE FROM stats WHERE date >= $1 AND date < $2 AND tenant_id = $3;`, date1, date2, dbm.tenantID())
+
+	if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+
+	if dbm.LeaderboardSize > 0 {
+		err = lockLeaderboardDays(tx, `SELECT generate_series($1::date, $2::date - 1, '1 day')`, date1, date2)
+
+		if err != nil {
+			tx.Rollback()
+			return nil, err
+		}
+
+		_, err = tx.Exec(`DELETE FROM leaderboard_days WHERE date >= $1 AND date < $2 AND tenant_id = $3;`, date1, date2, dbm.tenantID())
+
+		if err != nil {
+			tx.Rollback()
+			return nil, err
+		}
+	}
+
+	_, err = tx.Exec(`DELETE FROM stats_hourly
+  WHERE hour >= $1::date AT TIME ZONE 'UTC'
+        AND hour < $2::date AT TIME ZONE 'UTC'
+        AND tenant_id = $3;`, date1, date2, dbm.tenantID())
+
+	if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+
+	_, err = tx.Exec(`INSERT INTO stats_hourly (tenant_id, "user", action, hour, cnt)
+  SELECT
+    tenant_id,
+    "user",
+    action,
+    date_trunc('hour', ts),
+    count(*)
+  FROM events
+  WHERE ts >= $1::date AT TIME ZONE 'UTC'
+        AND ts < $2::date AT TIME ZONE 'UTC'
+        AND tenant_id = $3
+  GROUP BY 1, 2, 3, 4;`, date1, date2, dbm.tenantID())
+
+	if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+
+	result, err := tx.Exec(`INSERT INTO stats (tenant_id, "user", action, date, cnt)
+  SELECT
+    tenant_id,
+    "user",
+    action,
+    (ts AT TIME ZONE 'UTC')::date,
+    count(*)
+  FROM events
+  WHERE ts >= $1::date AT TIME ZONE 'UTC'
+        AND ts < $2::date AT TIME ZONE 'UTC'
+        AND tenant_id = $3
+  GROUP BY 1, 2, 3, 4;`, date1, date2, dbm.tenantID())
+
+	if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+
+	if err = tx.Commit(); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// expiryColumns maps the tables that can be purged to the column their
+// rows expire by. Purges apply to every tenant.
+var expiryColumns = map[string]string{
+	"stats":              "date",
+	"stats_hourly":       "hour",
+	"events":             "ts",
+	"event_ids":          "seen_at",
+	"webhook_deliveries": "sent_at",
+}
+
+// CountExpired returns how many rows of table are older than before.
+func (dbm *DBManager) CountExpired(table string, before time.Time) (int64, error) {
+	column, ok := expiryColumns[table]
+
+	if !ok {
+		return 0, fmt.Errorf("dbManager: %s cannot be purged", table)
+	}
+
+	var n int64
+
+	err := dbm.DB.QueryRow(fmt.Sprintf(`SELECT count(*) FROM %s WHERE %s < $1;`, table, column), before).Scan(&n)
+
+	if err != nil {
+		return 0, err
+	}
+	return n, nil
+}
+
+// PurgeExpired deletes at most limit rows of table older than before and
+// returns how many were deleted.
+func (dbm *DBManager) PurgeExpired(table string, before time.Time, limit int) (int64, error) {
+	column, ok := expiryColumns[table]
+
+	if !ok {
+		return 0, fmt.Errorf("dbManager: %s cannot be purged", table)
+	}
+
+	// ctid is only unique within a partition, hence tableoid.
+	result, err := dbm.DB.Exec(fmt.Sprintf(`DELETE FROM %[1]s
+  WHERE (tableoid, ctid) IN (SELECT tableoid, ctid FROM %[1]s WHERE %[2]s < $1 LIMIT $2);`, table, column), before, limit)
+
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
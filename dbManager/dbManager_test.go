@@ -0,0 +1,136 @@
+package dbManager
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+func TestMigrateSkipsAppliedVersions(t *testing.T) {
+	db, mock, err := sqlmock.New()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dbm := DBManager{DB: db}
+
+	files, err := migrations.ReadDir("migrations")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mock.ExpectExec("CREATE TABLE IF NOT EXISTS schema_migrations").WillReturnResult(sqlmock.NewResult(0, 0))
+
+	var want []string
+
+	for i, f := range files {
+		version := strings.TrimSuffix(f.Name(), ".sql")
+
+		mock.ExpectBegin()
+		mock.ExpectExec("pg_advisory_xact_lock").WillReturnResult(sqlmock.NewResult(0, 0))
+		mock.ExpectQuery("FROM schema_migrations").WithArgs(version).WillReturnRows(
+			sqlmock.NewRows([]string{"exists"}).AddRow(i == 0))
+
+		if i == 0 {
+			mock.ExpectRollback()
+			continue
+		}
+
+		mock.ExpectExec(".+").WillReturnResult(sqlmock.NewResult(0, 0))
+		mock.ExpectExec("INSERT INTO schema_migrations").WithArgs(version).WillReturnResult(sqlmock.NewResult(0, 1))
+		mock.ExpectCommit()
+
+		want = append(want, version)
+	}
+
+	applied, err := dbm.Migrate()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if strings.Join(applied, ",") != strings.Join(want, ",") {
+		t.Errorf("unexpected applied migrations: got %v want %v", applied, want)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatalf("there were unfulfilled expections: %s", err)
+	}
+}
+
+func TestEnsureStatsPartitions(t *testing.T) {
+	db, mock, err := sqlmock.New()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dbm := DBManager{DB: db}
+
+	mock.ExpectQuery("to_regclass").WithArgs("stats_2012_12").WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(true))
+
+	// The rows of January in stats_default are moved into its partition.
+	mock.ExpectQuery("to_regclass").WithArgs("stats_2013_01").WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(false))
+	mock.ExpectBegin()
+	mock.ExpectExec("LOCK TABLE stats_default").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectQuery("to_regclass").WithArgs("stats_2013_01").WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(false))
+	mock.ExpectExec(`CREATE TABLE stats_2013_01 \(LIKE stats`).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(`DELETE FROM stats_default WHERE date >= '2013-01-01' AND date < '2013-02-01' RETURNING \*\)\s+INSERT INTO stats_2013_01`).
+		WillReturnResult(sqlmock.NewResult(0, 3))
+	mock.ExpectExec(`ATTACH PARTITION stats_2013_01\s+FOR VALUES FROM \('2013-01-01'\) TO \('2013-02-01'\)`).WillReturnResult(
+		sqlmock.NewResult(0, 0))
+	mock.ExpectCommit()
+
+	// A month that fails does not stop the next one.
+	mock.ExpectQuery("to_regclass").WithArgs("stats_2013_02").WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(false))
+	mock.ExpectBegin()
+	mock.ExpectExec("LOCK TABLE stats_default").WillReturnError(errors.New("lock timeout"))
+	mock.ExpectRollback()
+	mock.ExpectQuery("to_regclass").WithArgs("stats_2013_03").WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(true))
+
+	created, err := dbm.EnsureStatsPartitions(time.Date(2012, 12, 31, 23, 0, 0, 0, time.UTC), 3)
+
+	if err == nil || !strings.Contains(err.Error(), "stats_2013_02: lock timeout") {
+		t.Errorf("error of the failed month: %v", err)
+	}
+
+	if len(created) != 1 || created[0] != "stats_2013_01" {
+		t.Errorf("unexpected created partitions: %v", created)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatalf("there were unfulfilled expections: %s", err)
+	}
+}
+
+func TestRefreshLeaderboard(t *testing.T) {
+	db, mock, err := sqlmock.New()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dbm := DBManager{DB: db, LeaderboardSize: 10}
+
+	// The day is locked before its stats are read, so that writers of the
+	// day wait for the refresh before invalidating it.
+	mock.ExpectBegin()
+	mock.ExpectExec(`SELECT pg_advisory_xact_lock\(hashtext\('leaderboard ' `).WithArgs("2012-02-02").WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("DELETE FROM leaderboard WHERE date").WithArgs("2012-02-02").WillReturnResult(sqlmock.NewResult(0, 5))
+	mock.ExpectExec("INSERT INTO leaderboard ").WithArgs("2012-02-02", 10).WillReturnResult(sqlmock.NewResult(0, 6))
+	mock.ExpectExec("INSERT INTO leaderboard_days").WithArgs("2012-02-02").WillReturnResult(sqlmock.NewResult(0, 2))
+	mock.ExpectCommit()
+
+	if err := dbm.RefreshLeaderboard(time.Date(2012, 2, 2, 0, 0, 0, 0, time.UTC)); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatalf("there were unfulfilled expections: %s", err)
+	}
+}
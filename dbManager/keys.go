@@ -0,0 +1,218 @@
+package dbManager
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// Scopes of API keys.
+const (
+	// ScopeIngest allows registering users and recording stats.
+	ScopeIngest = "ingest"
+	// ScopeRead allows reading stats.
+	ScopeRead = "read"
+	// ScopeAdmin allows the admin endpoints, key management included.
+	ScopeAdmin = "admin"
+)
+
+// Scopes are all the scopes of API keys.
+var Scopes = []string{ScopeIngest, ScopeRead, ScopeAdmin}
+
+// APIKey is what is known of an API key besides its hash.
+type APIKey struct {
+	ID       int
+	TenantID int
+	Scopes   []string
+	// Hash is the stored hash of the key.
+	Hash      string
+	CreatedAt time.Time
+	// ExpiresAt is set once the key has been rotated.
+	ExpiresAt pq.NullTime
+	RevokedAt pq.NullTime
+}
+
+// HasScope reports whether k grants scope.
+func (k *APIKey) HasScope(scope string) bool {
+	for _, s := range k.Scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// HashAPIKey returns what is stored of key; API keys are random enough for
+// an unsalted hash.
+func HashAPIKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+const apiKeyColumns = `id, tenant_id, scopes, key_hash, created_at, expires_at, revoked_at`
+
+type scanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanAPIKey(row scanner) (*APIKey, error) {
+	k := &APIKey{}
+
+	err := row.Scan(&k.ID, &k.TenantID, pq.Array(&k.Scopes), &k.Hash, &k.CreatedAt, &k.ExpiresAt, &k.RevokedAt)
+
+	if err != nil {
+		return nil, err
+	}
+	return k, nil
+}
+
+// insertAPIKey stores a new key of tenant and returns it; only its hash is
+// stored.
+func insertAPIKey(tx *sql.Tx, tenant int, scopes []string) (*APIKey, string, error) {
+
+	raw := make([]byte, 24)
+
+	if _, err := rand.Read(raw); err != nil {
+		return nil, "", err
+	}
+
+	key := "ss_" + hex.EncodeToString(raw)
+
+	apiKey, err := scanAPIKey(tx.QueryRow(`INSERT INTO api_keys (key_hash, tenant_id, scopes) VALUES ($1, $2, $3)
+									  RETURNING `+apiKeyColumns+`;`, HashAPIKey(key), tenant, pq.Array(scopes)))
+
+	if err != nil {
+		return nil, "", err
+	}
+	return apiKey, key, nil
+}
+
+// Authenticate returns the API key key if it is neither revoked nor
+// expired, ErrUnknownAPIKey otherwise.
+func (dbm *DBManager) Authenticate(key string) (*APIKey, error) {
+
+	apiKey, err := scanAPIKey(dbm.DB.QueryRow(`SELECT `+apiKeyColumns+`
+FROM api_keys
+WHERE key_hash = $1 AND revoked_at IS NULL AND (expires_at IS NULL OR expires_at > now());`, HashAPIKey(key)))
+
+	if err == sql.ErrNoRows {
+		return nil, ErrUnknownAPIKey
+	}
+
+	if err != nil {
+		return nil, err
+	}
+	return apiKey, nil
+}
+
+// CreateAPIKey returns a new API key of the tenant with scopes.
+func (dbm *DBManager) CreateAPIKey(scopes []string) (*APIKey, string, error) {
+
+	tx, err := dbm.DB.Begin()
+
+	if err != nil {
+		return nil, "", err
+	}
+
+	apiKey, key, err := insertAPIKey(tx, dbm.tenantID(), scopes)
+
+	if err != nil {
+		tx.Rollback()
+		return nil, "", err
+	}
+
+	if err = tx.Commit(); err != nil {
+		return nil, "", err
+	}
+	return apiKey, key, nil
+}
+
+// APIKeys returns the API keys of the tenant, revoked and expired ones
+// included.
+func (dbm *DBManager) APIKeys() ([]*APIKey, error) {
+
+	rows, err := dbm.DB.Query(`SELECT `+apiKeyColumns+`
+FROM api_keys
+WHERE tenant_id = $1
+ORDER BY id;`, dbm.tenantID())
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	var keys []*APIKey
+
+	for rows.Next() {
+		k, err := scanAPIKey(rows)
+
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, k)
+	}
+	return keys, rows.Err()
+}
+
+// RotateAPIKey replaces the key id of the tenant by a new one with the
+// same scopes and returns both. The old key keeps working for grace.
+// ErrUnknownAPIKey is returned if the tenant has no such live key.
+func (dbm *DBManager) RotateAPIKey(id int, grace time.Duration) (old, apiKey *APIKey, key string, err error) {
+
+	tx, err := dbm.DB.Begin()
+
+	if err != nil {
+		return nil, nil, "", err
+	}
+
+	old, err = scanAPIKey(tx.QueryRow(`UPDATE api_keys
+  SET expires_at = least(expires_at, now() + $3 * interval '1 second')
+  WHERE id = $1 AND tenant_id = $2 AND revoked_at IS NULL AND (expires_at IS NULL OR expires_at > now())
+  RETURNING `+apiKeyColumns+`;`, id, dbm.tenantID(), grace.Seconds()))
+
+	if err == sql.ErrNoRows {
+		tx.Rollback()
+		return nil, nil, "", ErrUnknownAPIKey
+	}
+
+	if err != nil {
+		tx.Rollback()
+		return nil, nil, "", err
+	}
+
+	apiKey, key, err = insertAPIKey(tx, old.TenantID, old.Scopes)
+
+	if err != nil {
+		tx.Rollback()
+		return nil, nil, "", err
+	}
+
+	if err = tx.Commit(); err != nil {
+		return nil, nil, "", err
+	}
+	return old, apiKey, key, nil
+}
+
+// RevokeAPIKey ends the key id of the tenant at once and returns it.
+// ErrUnknownAPIKey is returned if the tenant has no such key.
+func (dbm *DBManager) RevokeAPIKey(id int) (*APIKey, error) {
+
+	apiKey, err := scanAPIKey(dbm.DB.QueryRow(`UPDATE api_keys
+  SET revoked_at = coalesce(revoked_at, now())
+  WHERE id = $1 AND tenant_id = $2
+  RETURNING `+apiKeyColumns+`;`, id, dbm.tenantID()))
+
+	if err == sql.ErrNoRows {
+		return nil, ErrUnknownAPIKey
+	}
+
+	if err != nil {
+		return nil, err
+	}
+	return apiKey, nil
+}
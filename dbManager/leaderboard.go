@@ -0,0 +1,206 @@
+package dbManager
+
+import (
+	"database/sql"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// leaderboardFits reports whether the daily top of values can be served
+// from the leaderboards: limit is within LeaderboardSize and every day of
+// the range has an up to date leaderboard for the action.
+func (dbm *DBManager) leaderboardFits(values url.Values) (bool, error) {
+
+	limit, err := strconv.Atoi(values.Get("limit"))
+
+	if err != nil || dbm.LeaderboardSize <= 0 || limit > dbm.LeaderboardSize {
+		return false, nil
+	}
+
+	var missing int
+
+	err = dbm.DB.QueryRow(`SELECT count(*)
+FROM generate_series($1::date, $2::date - 1, '1 day') d
+WHERE NOT exists(SELECT 1
+                 FROM leaderboard_days l
+                 WHERE l.date = d AND l.action = $3 AND l.tenant_id = $4);`,
+		values.Get("date1"),
+		values.Get("date2"),
+		values.Get("action"),
+		dbm.tenantID()).Scan(&missing)
+
+	if err != nil {
+		return false, err
+	}
+	return missing == 0, nil
+}
+
+func (dbm *DBManager) getLeaderboardStats(values url.Values) (*sql.Rows, error) {
+
+	rows, err := dbm.DB.Query(`SELECT
+  date,
+  id,
+  age,
+  cast(sex AS VARCHAR(1)),
+  cnt
+FROM leaderboard l, users u
+WHERE date >= $1
+      AND date < $2
+      AND "user" = id AND action = $3 AND rank <= $4
+      AND l.tenant_id = $5 AND u.tenant_id = $5
+ORDER BY date, rank;`,
+		values["date1"][0],
+		values["date2"][0],
+		values["action"][0],
+		values["limit"][0],
+		dbm.tenantID())
+
+	if err != nil {
+		return nil, err
+	}
+
+	return rows, nil
+}
+
+// StaleLeaderboardDays returns the days in [from, before) that have stats
+// without an up to date leaderboard, of any tenant.
+func (dbm *DBManager) StaleLeaderboardDays(from, before time.Time) ([]time.Time, error) {
+
+	rows, err := dbm.DB.Query(`SELECT DISTINCT s.date
+FROM stats s
+  LEFT JOIN leaderboard_days l ON l.tenant_id = s.tenant_id AND l.date = s.date AND l.action = s.action
+WHERE s.date >= $1 AND s.date < $2 AND l.date IS NULL
+ORDER BY s.date;`, from.Format(layout), before.Format(layout))
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	var days []time.Time
+
+	for rows.Next() {
+		var day time.Time
+
+		if err := rows.Scan(&day); err != nil {
+			return nil, err
+		}
+		days = append(days, day)
+	}
+	return days, rows.Err()
+}
+
+// RefreshLeaderboard recomputes the leaderboards of every tenant and action
+// on day.
+func (dbm *DBManager) RefreshLeaderboard(day time.Time) error {
+
+	date := day.Format(layout)
+
+	tx, err := dbm.DB.Begin()
+
+	if err != nil {
+		return err
+	}
+
+	// Writers of the day's stats hold the lock shared until they commit, so
+	// the refresh sees their stats or they invalidate it afterwards.
+	if _, err = tx.Exec(`SELECT pg_advisory_xact_lock(hashtext('leaderboard ' || $1::date::text));`, date); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	if _, err = tx.Exec(`DELETE FROM leaderboard WHERE date = $1;`, date); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	_, err = tx.Exec(`INSERT INTO leaderboard (tenant_id, date, action, rank, "user", cnt)
+  SELECT
+    tenant_id,
+    date,
+    action,
+    r,
+    "user",
+    cnt
+  FROM (
+         SELECT
+           *,
+           row_number()
+           OVER (
+             PARTITION BY tenant_id, action
+             ORDER BY cnt DESC, "user") AS r
+         FROM stats
+         WHERE date = $1
+       ) t
+  WHERE r <= $2;`, date, dbm.LeaderboardSize)
+
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	_, err = tx.Exec(`INSERT INTO leaderboard_days (tenant_id, date, action)
+  SELECT
+    tenant_id,
+    $1,
+    name
+  FROM actions
+  ON CONFLICT ON CONSTRAINT leaderboard_days_pkey
+    DO UPDATE SET refreshed_at = now();`, date)
+
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// lockLeaderboardDays keeps RefreshLeaderboard from recomputing the days
+// the dates query returns until tx ends, waiting for a refresh running
+// already. It is taken before the leaderboard_days rows of those days are
+// deleted, so that the deletion cannot be undone by a refresh that missed
+// the stats written in tx.
+func lockLeaderboardDays(tx *sql.Tx, dates string, args ...interface{}) error {
+	_, err := tx.Exec(`SELECT pg_advisory_xact_lock_shared(hashtext('leaderboard ' || d::date::text))
+FROM (`+dates+`) t(d);`, args...)
+	return err
+}
+
+// PurgeLeaderboards deletes the leaderboards of every tenant of the days
+// before before, whose stats have expired, and returns how many rows of
+// leaderboard were deleted.
+func (dbm *DBManager) PurgeLeaderboards(before time.Time) (int64, error) {
+
+	tx, err := dbm.DB.Begin()
+
+	if err != nil {
+		return 0, err
+	}
+
+	if _, err = tx.Exec(`DELETE FROM leaderboard_days WHERE date < $1;`, before); err != nil {
+		tx.Rollback()
+		return 0, err
+	}
+
+	result, err := tx.Exec(`DELETE FROM leaderboard WHERE date < $1;`, before)
+
+	if err != nil {
+		tx.Rollback()
+		return 0, err
+	}
+
+	if err = tx.Commit(); err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+// DailyCounts returns the user and count of every user with stats of
+// action on date.
+func (dbm *DBManager) DailyCounts(action, date string) (*sql.Rows, error) {
+	return dbm.DB.Query(`SELECT "user", cnt FROM stats
+WHERE action = $1 AND date = $2 AND tenant_id = $3;`, action, date, dbm.tenantID())
+}
@@ -0,0 +1,108 @@
+package dbManager
+
+import (
+	"embed"
+	"path"
+	"sort"
+	"strings"
+)
+
+//go:embed migrations/*.sql
+var migrations embed.FS
+
+// migrationsLock is the pg_advisory_xact_lock key that serializes
+// migrations run by several instances at once.
+const migrationsLock = 7301
+
+// Migrate applies the migrations that have not been applied yet, in
+// order, each in its own transaction. It returns the applied versions.
+func (dbm *DBManager) Migrate() ([]string, error) {
+
+	_, err := dbm.DB.Exec(`CREATE TABLE IF NOT EXISTS schema_migrations
+(
+  version    TEXT NOT NULL
+    CONSTRAINT schema_migrations_pkey
+    PRIMARY KEY,
+  applied_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);`)
+
+	if err != nil {
+		return nil, err
+	}
+
+	files, err := migrations.ReadDir("migrations")
+
+	if err != nil {
+		return nil, err
+	}
+
+	var names []string
+
+	for _, f := range files {
+		names = append(names, f.Name())
+	}
+
+	sort.Strings(names)
+
+	var applied []string
+
+	for _, name := range names {
+		version := strings.TrimSuffix(name, ".sql")
+
+		done, err := dbm.migrate(version, path.Join("migrations", name))
+
+		if err != nil {
+			return applied, err
+		}
+
+		if done {
+			applied = append(applied, version)
+		}
+	}
+	return applied, nil
+}
+
+// migrate applies a single migration unless it has been applied already.
+func (dbm *DBManager) migrate(version, filename string) (bool, error) {
+
+	script, err := migrations.ReadFile(filename)
+
+	if err != nil {
+		return false, err
+	}
+
+	tx, err := dbm.DB.Begin()
+
+	if err != nil {
+		return false, err
+	}
+
+	if _, err = tx.Exec(`SELECT pg_advisory_xact_lock($1);`, migrationsLock); err != nil {
+		tx.Rollback()
+		return false, err
+	}
+
+	var exists bool
+
+	err = tx.QueryRow(`SELECT exists(SELECT 1 FROM schema_migrations WHERE version = $1);`, version).Scan(&exists)
+
+	if err != nil || exists {
+		tx.Rollback()
+		return false, err
+	}
+
+	if _, err = tx.Exec(string(script)); err != nil {
+		tx.Rollback()
+		return false, err
+	}
+
+	if _, err = tx.Exec(`INSERT INTO schema_migrations (version) VALUES ($1);`, version); err != nil {
+		tx.Rollback()
+		return false, err
+	}
+
+	if err = tx.Commit(); err != nil {
+		return false, err
+	}
+	return true, nil
+}
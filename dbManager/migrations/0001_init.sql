@@ -0,0 +1,102 @@
+-- Databases set up by hand from init.sql already have part of this schema,
+-- so every statement tolerates existing objects.
+
+DO $$
+BEGIN
+  CREATE TYPE ACTION AS ENUM ('login', 'logout', 'like', 'commentary');
+  EXCEPTION WHEN duplicate_object THEN NULL;
+END $$;
+
+DO $$
+BEGIN
+  CREATE TYPE SEX AS ENUM ('M', 'F');
+  EXCEPTION WHEN duplicate_object THEN NULL;
+END $$;
+
+CREATE TABLE IF NOT EXISTS users
+(
+  id  SERIAL NOT NULL
+    CONSTRAINT table_name_pkey
+    PRIMARY KEY,
+  age INTEGER,
+  sex SEX
+);
+
+CREATE UNIQUE INDEX IF NOT EXISTS table_name_id_uindex
+  ON users (id);
+
+CREATE INDEX IF NOT EXISTS users_id_age_sex_idx
+  ON users (id, age, sex);
+
+CREATE TABLE IF NOT EXISTS stats
+(
+  "user" INTEGER
+    CONSTRAINT stats_users_id_fk
+    REFERENCES users,
+  action ACTION,
+  date   DATE,
+  cnt    INTEGER DEFAULT 1,
+  CONSTRAINT user_time_uniq
+  UNIQUE ("user", action, date)
+);
+
+CREATE INDEX IF NOT EXISTS stats_time_idx
+  ON stats (date);
+
+CREATE TABLE IF NOT EXISTS events
+(
+  id          BIGSERIAL NOT NULL
+    CONSTRAINT events_pkey
+    PRIMARY KEY,
+  "user"      INTEGER NOT NULL
+    CONSTRAINT events_users_id_fk
+    REFERENCES users,
+  action      ACTION NOT NULL,
+  ts          TIMESTAMPTZ NOT NULL,
+  received_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+  event_id    TEXT
+);
+
+CREATE INDEX IF NOT EXISTS events_ts_idx
+  ON events (ts);
+
+CREATE TABLE IF NOT EXISTS stats_hourly
+(
+  "user" INTEGER NOT NULL
+    CONSTRAINT stats_hourly_users_id_fk
+    REFERENCES users,
+  action ACTION NOT NULL,
+  hour   TIMESTAMPTZ NOT NULL,
+  cnt    INTEGER DEFAULT 1,
+  CONSTRAINT user_hour_uniq
+  UNIQUE ("user", action, hour)
+);
+
+CREATE INDEX IF NOT EXISTS stats_hourly_hour_idx
+  ON stats_hourly (hour);
+
+CREATE TABLE IF NOT EXISTS event_ids
+(
+  event_id TEXT NOT NULL
+    CONSTRAINT event_ids_pkey
+    PRIMARY KEY,
+  seen_at  TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+CREATE INDEX IF NOT EXISTS event_ids_seen_at_idx
+  ON event_ids (seen_at);
+
+CREATE TABLE IF NOT EXISTS pending_stats
+(
+  "user"      INTEGER NOT NULL,
+  action      ACTION NOT NULL,
+  ts          TIMESTAMPTZ NOT NULL,
+  event_id    TEXT,
+  received_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+CREATE INDEX IF NOT EXISTS pending_stats_user_idx
+  ON pending_stats ("user");
+
+CREATE UNIQUE INDEX IF NOT EXISTS pending_stats_event_id_uindex
+  ON pending_stats (event_id);
@@ -0,0 +1,55 @@
+-- Turns stats into a table range-partitioned by month. Partitions are named
+-- stats_YYYY_MM; DBManager.EnsureStatsPartitions creates the upcoming ones
+-- and rows outside every partition land in stats_default.
+
+ALTER TABLE stats
+  RENAME TO stats_unpartitioned;
+
+ALTER TABLE stats_unpartitioned
+  RENAME CONSTRAINT user_time_uniq TO stats_unpartitioned_uniq;
+
+ALTER INDEX stats_time_idx
+  RENAME TO stats_unpartitioned_time_idx;
+
+CREATE TABLE stats
+(
+  "user" INTEGER NOT NULL
+    CONSTRAINT stats_users_id_fk
+    REFERENCES users,
+  action ACTION NOT NULL,
+  date   DATE NOT NULL,
+  cnt    INTEGER DEFAULT 1,
+  CONSTRAINT user_time_uniq
+  UNIQUE ("user", action, date)
+) PARTITION BY RANGE (date);
+
+CREATE INDEX stats_time_idx
+  ON stats (date);
+
+CREATE TABLE stats_default
+  PARTITION OF stats DEFAULT;
+
+DO $$
+DECLARE
+  month DATE;
+BEGIN
+  FOR month IN
+  SELECT DISTINCT date_trunc('month', date)::date
+  FROM stats_unpartitioned
+  WHERE date IS NOT NULL
+  LOOP
+    EXECUTE format('CREATE TABLE %I PARTITION OF stats FOR VALUES FROM (%L) TO (%L)',
+                   'stats_' || to_char(month, 'YYYY_MM'), month, (month + INTERVAL '1 month')::date);
+  END LOOP;
+END $$;
+
+INSERT INTO stats ("user", action, date, cnt)
+  SELECT
+    "user",
+    action,
+    date,
+    cnt
+  FROM stats_unpartitioned
+  WHERE "user" IS NOT NULL AND action IS NOT NULL AND date IS NOT NULL;
+
+DROP TABLE stats_unpartitioned;
@@ -0,0 +1,23 @@
+-- Per-day, per-action top users of stats. A leaderboard_days row means the
+-- leaderboard of that date and action is up to date with stats; it is
+-- removed whenever the stats of that day change.
+
+CREATE TABLE IF NOT EXISTS leaderboard
+(
+  date   DATE NOT NULL,
+  action ACTION NOT NULL,
+  rank   INTEGER NOT NULL,
+  "user" INTEGER NOT NULL,
+  cnt    INTEGER NOT NULL,
+  CONSTRAINT leaderboard_pkey
+  PRIMARY KEY (date, action, rank)
+);
+
+CREATE TABLE IF NOT EXISTS leaderboard_days
+(
+  date         DATE NOT NULL,
+  action       ACTION NOT NULL,
+  refreshed_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+  CONSTRAINT leaderboard_days_pkey
+  PRIMARY KEY (date, action)
+);
@@ -0,0 +1,194 @@
+-- Tenants (projects) sharing the deployment, identified by API key. Every
+-- user and counter belongs to one and user ids are per tenant. Tenant 0
+-- owns the data from before tenants and serves requests without a key.
+-- Actions become per-tenant too: the ACTION type gives way to the names in
+-- the actions catalogue.
+
+CREATE TABLE tenants
+(
+  id           SERIAL NOT NULL
+    CONSTRAINT tenants_pkey
+    PRIMARY KEY,
+  name         TEXT NOT NULL
+    CONSTRAINT tenants_name_key
+    UNIQUE,
+  daily_events INTEGER NOT NULL DEFAULT 0,
+  max_users    INTEGER NOT NULL DEFAULT 0,
+  created_at   TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+INSERT INTO tenants (id, name) VALUES (0, 'default');
+
+CREATE TABLE api_keys
+(
+  key_hash   TEXT NOT NULL
+    CONSTRAINT api_keys_pkey
+    PRIMARY KEY,
+  tenant_id  INTEGER NOT NULL
+    CONSTRAINT api_keys_tenants_id_fk
+    REFERENCES tenants ON DELETE CASCADE,
+  created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+CREATE TABLE actions
+(
+  tenant_id INTEGER NOT NULL
+    CONSTRAINT actions_tenants_id_fk
+    REFERENCES tenants ON DELETE CASCADE,
+  name      TEXT NOT NULL,
+  CONSTRAINT actions_pkey
+  PRIMARY KEY (tenant_id, name)
+);
+
+INSERT INTO actions (tenant_id, name)
+  SELECT
+    0,
+    unnest(enum_range(NULL :: ACTION)) :: TEXT;
+
+CREATE TABLE tenant_usage
+(
+  tenant_id INTEGER NOT NULL
+    CONSTRAINT tenant_usage_tenants_id_fk
+    REFERENCES tenants ON DELETE CASCADE,
+  date      DATE NOT NULL,
+  events    INTEGER NOT NULL DEFAULT 0,
+  CONSTRAINT tenant_usage_pkey
+  PRIMARY KEY (tenant_id, date)
+);
+
+-- users
+
+ALTER TABLE stats
+  DROP CONSTRAINT stats_users_id_fk;
+
+ALTER TABLE events
+  DROP CONSTRAINT events_users_id_fk;
+
+ALTER TABLE stats_hourly
+  DROP CONSTRAINT stats_hourly_users_id_fk;
+
+ALTER TABLE users
+  ADD COLUMN tenant_id INTEGER NOT NULL DEFAULT 0
+  CONSTRAINT users_tenants_id_fk
+  REFERENCES tenants;
+
+ALTER TABLE users
+  DROP CONSTRAINT table_name_pkey;
+
+DROP INDEX IF EXISTS table_name_id_uindex;
+
+DROP INDEX IF EXISTS users_id_age_sex_idx;
+
+ALTER TABLE users
+  ADD CONSTRAINT users_pkey
+  PRIMARY KEY (tenant_id, id);
+
+-- stats
+
+ALTER TABLE stats
+  ADD COLUMN tenant_id INTEGER NOT NULL DEFAULT 0;
+
+ALTER TABLE stats
+  DROP CONSTRAINT user_time_uniq;
+
+ALTER TABLE stats
+  ALTER COLUMN action TYPE TEXT;
+
+ALTER TABLE stats
+  ADD CONSTRAINT user_time_uniq
+  UNIQUE (tenant_id, "user", action, date);
+
+ALTER TABLE stats
+  ADD CONSTRAINT stats_users_id_fk
+  FOREIGN KEY (tenant_id, "user") REFERENCES users (tenant_id, id);
+
+-- events
+
+ALTER TABLE events
+  ADD COLUMN tenant_id INTEGER NOT NULL DEFAULT 0;
+
+ALTER TABLE events
+  ALTER COLUMN action TYPE TEXT;
+
+ALTER TABLE events
+  ADD CONSTRAINT events_users_id_fk
+  FOREIGN KEY (tenant_id, "user") REFERENCES users (tenant_id, id);
+
+-- stats_hourly
+
+ALTER TABLE stats_hourly
+  ADD COLUMN tenant_id INTEGER NOT NULL DEFAULT 0;
+
+ALTER TABLE stats_hourly
+  DROP CONSTRAINT user_hour_uniq;
+
+ALTER TABLE stats_hourly
+  ALTER COLUMN action TYPE TEXT;
+
+ALTER TABLE stats_hourly
+  ADD CONSTRAINT user_hour_uniq
+  UNIQUE (tenant_id, "user", action, hour);
+
+ALTER TABLE stats_hourly
+  ADD CONSTRAINT stats_hourly_users_id_fk
+  FOREIGN KEY (tenant_id, "user") REFERENCES users (tenant_id, id);
+
+-- event_ids
+
+ALTER TABLE event_ids
+  ADD COLUMN tenant_id INTEGER NOT NULL DEFAULT 0;
+
+ALTER TABLE event_ids
+  DROP CONSTRAINT event_ids_pkey;
+
+ALTER TABLE event_ids
+  ADD CONSTRAINT event_ids_pkey
+  PRIMARY KEY (tenant_id, event_id);
+
+-- pending_stats
+
+ALTER TABLE pending_stats
+  ADD COLUMN tenant_id INTEGER NOT NULL DEFAULT 0;
+
+ALTER TABLE pending_stats
+  ALTER COLUMN action TYPE TEXT;
+
+DROP INDEX pending_stats_user_idx;
+
+DROP INDEX pending_stats_event_id_uindex;
+
+CREATE INDEX pending_stats_user_idx
+  ON pending_stats (tenant_id, "user");
+
+CREATE UNIQUE INDEX pending_stats_event_id_uindex
+  ON pending_stats (tenant_id, event_id);
+
+-- leaderboards
+
+ALTER TABLE leaderboard
+  ADD COLUMN tenant_id INTEGER NOT NULL DEFAULT 0;
+
+ALTER TABLE leaderboard
+  DROP CONSTRAINT leaderboard_pkey;
+
+ALTER TABLE leaderboard
+  ALTER COLUMN action TYPE TEXT;
+
+ALTER TABLE leaderboard
+  ADD CONSTRAINT leaderboard_pkey
+  PRIMARY KEY (tenant_id, date, action, rank);
+
+ALTER TABLE leaderboard_days
+  ADD COLUMN tenant_id INTEGER NOT NULL DEFAULT 0;
+
+ALTER TABLE leaderboard_days
+  DROP CONSTRAINT leaderboard_days_pkey;
+
+ALTER TABLE leaderboard_days
+  ALTER COLUMN action TYPE TEXT;
+
+ALTER TABLE leaderboard_days
+  ADD CONSTRAINT leaderboard_days_pkey
+  PRIMARY KEY (tenant_id, date, action);
+
+DROP TYPE ACTION;
@@ -0,0 +1,19 @@
+-- API keys get an id to be managed by, scopes and an end: revoked_at when
+-- revoked, expires_at when rotated. Keys from before keep every scope.
+
+ALTER TABLE api_keys
+  ADD COLUMN id SERIAL NOT NULL
+  CONSTRAINT api_keys_id_key
+  UNIQUE;
+
+ALTER TABLE api_keys
+  ADD COLUMN scopes TEXT [] NOT NULL DEFAULT '{ingest,read,admin}';
+
+ALTER TABLE api_keys
+  ADD COLUMN expires_at TIMESTAMPTZ;
+
+ALTER TABLE api_keys
+  ADD COLUMN revoked_at TIMESTAMPTZ;
+
+CREATE INDEX api_keys_tenant_id_idx
+  ON api_keys (tenant_id);
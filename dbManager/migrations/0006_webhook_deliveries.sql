@@ -0,0 +1,21 @@
+-- Every attempt to deliver an alert webhook: status is the HTTP status of
+-- the response, NULL if none came, error why the attempt failed.
+
+CREATE TABLE IF NOT EXISTS webhook_deliveries
+(
+  id        BIGSERIAL PRIMARY KEY,
+  tenant_id INTEGER     NOT NULL DEFAULT 0,
+  alert_id  TEXT        NOT NULL,
+  rule      TEXT        NOT NULL,
+  url       TEXT        NOT NULL,
+  attempt   INTEGER     NOT NULL,
+  status    INTEGER,
+  error     TEXT,
+  sent_at   TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+CREATE INDEX webhook_deliveries_alert_id_idx
+  ON webhook_deliveries (alert_id);
+
+CREATE INDEX webhook_deliveries_sent_at_idx
+  ON webhook_deliveries (sent_at);
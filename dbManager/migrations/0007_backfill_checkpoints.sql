@@ -0,0 +1,12 @@
+-- How far the backfill of each input got: its records up to line are
+-- merged. The row is updated in the transaction of each merged chunk.
+
+CREATE TABLE IF NOT EXISTS backfill_checkpoints
+(
+  tenant_id  INTEGER     NOT NULL DEFAULT 0,
+  input      TEXT        NOT NULL,
+  line       INTEGER     NOT NULL,
+  updated_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+  CONSTRAINT backfill_checkpoints_pkey
+  PRIMARY KEY (tenant_id, input)
+);
@@ -0,0 +1,159 @@
+package dbManager
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// statsPartition returns the name of the stats partition holding month
+// and the bounds of that partition.
+func statsPartition(month time.Time) (name string, from, to time.Time) {
+	from = time.Date(month.Year(), month.Month(), 1, 0, 0, 0, 0, time.UTC)
+	to = from.AddDate(0, 1, 0)
+	return fmt.Sprintf("stats_%04d_%02d", from.Year(), from.Month()), from, to
+}
+
+// EnsureStatsPartitions creates the monthly stats partitions from the month
+// of now through the given number of months ahead that do not exist yet.
+// A month that fails does not stop the next ones; the errors of the months
+// that failed are returned together.
+func (dbm *DBManager) EnsureStatsPartitions(now time.Time, ahead int) ([]string, error) {
+
+	var created []string
+	var errs []error
+
+	_, month, _ := statsPartition(now)
+
+	for i := 0; i <= ahead; i++ {
+		name, ok, err := dbm.ensureStatsPartition(month.AddDate(0, i, 0))
+
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %v", name, err))
+			continue
+		}
+
+		if ok {
+			created = append(created, name)
+		}
+	}
+	return created, errors.Join(errs...)
+}
+
+// ensureStatsPartition creates the stats partition of month unless it
+// exists and reports whether it did. Rows of the month written before it
+// existed are in stats_default, which would refuse the partition, so the
+// partition is created detached, the rows are moved into it and it is
+// attached in one transaction, stats_default locked throughout.
+func (dbm *DBManager) ensureStatsPartition(month time.Time) (string, bool, error) {
+
+	name, from, to := statsPartition(month)
+
+	var exists bool
+
+	if err := dbm.DB.QueryRow(`SELECT to_regclass($1) IS NOT NULL;`, name).Scan(&exists); err != nil {
+		return name, false, err
+	}
+
+	if exists {
+		return name, false, nil
+	}
+
+	tx, err := dbm.DB.Begin()
+
+	if err != nil {
+		return name, false, err
+	}
+
+	if _, err = tx.Exec(`LOCK TABLE stats_default IN ACCESS EXCLUSIVE MODE;`); err != nil {
+		tx.Rollback()
+		return name, false, err
+	}
+
+	// Another instance may have created it meanwhile.
+	if err = tx.QueryRow(`SELECT to_regclass($1) IS NOT NULL;`, name).Scan(&exists); err != nil || exists {
+		tx.Rollback()
+		return name, false, err
+	}
+
+	for _, query := range []string{
+		fmt.Sprintf(`CREATE TABLE %s (LIKE stats INCLUDING DEFAULTS);`, name),
+		fmt.Sprintf(`WITH moved AS (DELETE FROM stats_default WHERE date >= '%[2]s' AND date < '%[3]s' RETURNING *)
+  INSERT INTO %[1]s SELECT * FROM moved;`, name, from.Format(layout), to.Format(layout)),
+		fmt.Sprintf(`ALTER TABLE stats ATTACH PARTITION %s
+  FOR VALUES FROM ('%s') TO ('%s');`, name, from.Format(layout), to.Format(layout)),
+	} {
+		if _, err = tx.Exec(query); err != nil {
+			tx.Rollback()
+			return name, false, err
+		}
+	}
+
+	if err = tx.Commit(); err != nil {
+		return name, false, err
+	}
+	return name, true, nil
+}
+
+// DropStatsPartitions detaches and drops the monthly stats partitions that
+// end on or before before. It returns the number of rows they held.
+func (dbm *DBManager) DropStatsPartitions(before time.Time) (int64, error) {
+
+	rows, err := dbm.DB.Query(`SELECT c.relname
+FROM pg_inherits i
+  JOIN pg_class c ON c.oid = i.inhrelid
+WHERE i.inhparent = 'stats'::regclass
+ORDER BY c.relname;`)
+
+	if err != nil {
+		return 0, err
+	}
+
+	var expired []string
+
+	for rows.Next() {
+		var name string
+
+		if err := rows.Scan(&name); err != nil {
+			rows.Close()
+			return 0, err
+		}
+
+		month, err := time.Parse("stats_2006_01", name)
+
+		if err != nil {
+			// stats_default and partitions not created by us.
+			continue
+		}
+
+		if _, _, to := statsPartition(month); !to.After(before) {
+			expired = append(expired, name)
+		}
+	}
+
+	rows.Close()
+
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	var removed int64
+
+	for _, name := range expired {
+		var n int64
+
+		if err := dbm.DB.QueryRow(fmt.Sprintf(`SELECT count(*) FROM %s;`, name)).Scan(&n); err != nil {
+			return removed, err
+		}
+
+		if _, err := dbm.DB.Exec(fmt.Sprintf(`ALTER TABLE stats DETACH PARTITION %s;`, name)); err != nil {
+			return removed, err
+		}
+
+		if _, err := dbm.DB.Exec(fmt.Sprintf(`DROP TABLE %s;`, name)); err != nil {
+			return removed, err
+		}
+		removed += n
+	}
+	return removed, nil
+}
@@ -0,0 +1,119 @@
+package dbManager
+
+import (
+	"errors"
+
+	"github.com/lib/pq"
+)
+
+// DefaultActions are the actions of the default tenant, the ones of the
+// ACTION type before tenants. New tenants get them unless told otherwise.
+var DefaultActions = []string{"login", "logout", "like", "commentary"}
+
+var (
+	// ErrUnknownAPIKey is returned for an API key no tenant has.
+	ErrUnknownAPIKey = errors.New("dbManager: unknown API key")
+	// ErrQuotaExceeded is returned when a write would exceed a quota of the
+	// tenant.
+	ErrQuotaExceeded = errors.New("dbManager: tenant quota exceeded")
+)
+
+// Tenant is a project sharing the deployment. Tenant 0 is the default one.
+type Tenant struct {
+	ID   int
+	Name string
+	// Actions is the catalogue of actions stats can be recorded for.
+	Actions []string
+	// DailyEvents caps the events recorded per UTC day, zero means no cap.
+	DailyEvents int
+	// MaxUsers caps the registered users, zero means no cap.
+	MaxUsers int
+}
+
+// HasAction reports whether action is in the catalogue of t.
+func (t *Tenant) HasAction(action string) bool {
+	for _, a := range t.Actions {
+		if a == action {
+			return true
+		}
+	}
+	return false
+}
+
+// ForTenant returns a copy of dbm whose queries are scoped to t. The
+// unscoped manager works on the default tenant.
+func (dbm *DBManager) ForTenant(t *Tenant) *DBManager {
+	scoped := *dbm
+	scoped.Tenant = t
+	return &scoped
+}
+
+func (dbm *DBManager) tenantID() int {
+	if dbm.Tenant == nil {
+		return 0
+	}
+	return dbm.Tenant.ID
+}
+
+// LoadTenant returns the tenant id with its action catalogue.
+func (dbm *DBManager) LoadTenant(id int) (*Tenant, error) {
+
+	t := &Tenant{ID: id}
+
+	err := dbm.DB.QueryRow(`SELECT
+  name,
+  daily_events,
+  max_users,
+  array(SELECT name
+        FROM actions
+        WHERE tenant_id = tenants.id
+        ORDER BY name)
+FROM tenants
+WHERE id = $1;`, id).Scan(&t.Name, &t.DailyEvents, &t.MaxUsers, pq.Array(&t.Actions))
+
+	if err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// CreateTenant registers t (its ID is set) and returns an API key of it
+// with every scope.
+func (dbm *DBManager) CreateTenant(t *Tenant) (*APIKey, string, error) {
+
+	tx, err := dbm.DB.Begin()
+
+	if err != nil {
+		return nil, "", err
+	}
+
+	err = tx.QueryRow(`INSERT INTO tenants (name, daily_events, max_users) VALUES ($1, $2, $3)
+									  RETURNING id;`, t.Name, t.DailyEvents, t.MaxUsers).Scan(&t.ID)
+
+	if err != nil {
+		tx.Rollback()
+		return nil, "", err
+	}
+
+	_, err = tx.Exec(`INSERT INTO actions (tenant_id, name)
+  SELECT DISTINCT
+    $1 :: INTEGER,
+    unnest($2 :: TEXT []);`, t.ID, pq.Array(t.Actions))
+
+	if err != nil {
+		tx.Rollback()
+		return nil, "", err
+	}
+
+	apiKey, key, err := insertAPIKey(tx, t.ID, Scopes)
+
+	if err != nil {
+		tx.Rollback()
+		return nil, "", err
+	}
+
+	if err = tx.Commit(); err != nil {
+		return nil, "", err
+	}
+	return apiKey, key, nil
+}
@@ -0,0 +1,78 @@
+package dedup
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+type entry struct {
+	id   string
+	seen time.Time
+}
+
+// Cache is a size bounded LRU of recently applied event IDs. An ID is
+// forgotten once it is older than the window or pushed out by newer ones.
+type Cache struct {
+	mu     sync.Mutex
+	size   int
+	window time.Duration
+	ll     *list.List
+	items  map[string]*list.Element
+	now    func() time.Time
+}
+
+func NewCache(size int, window time.Duration) *Cache {
+	return &Cache{
+		size:   size,
+		window: window,
+		ll:     list.New(),
+		items:  make(map[string]*list.Element),
+		now:    time.Now,
+	}
+}
+
+// Contains reports whether id was added less than a window ago.
+func (c *Cache) Contains(id string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	el, ok := c.items[id]
+
+	if !ok {
+		return false
+	}
+
+	if c.now().Sub(el.Value.(*entry).seen) >= c.window {
+		c.ll.Remove(el)
+		delete(c.items, id)
+		return false
+	}
+
+	c.ll.MoveToFront(el)
+	return true
+}
+
+// Add remembers id, evicting the least recently used ID if the cache is full.
+func (c *Cache) Add(id string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.size <= 0 {
+		return
+	}
+
+	if el, ok := c.items[id]; ok {
+		el.Value.(*entry).seen = c.now()
+		c.ll.MoveToFront(el)
+		return
+	}
+
+	c.items[id] = c.ll.PushFront(&entry{id: id, seen: c.now()})
+
+	if c.ll.Len() > c.size {
+		oldest := c.ll.Back()
+		c.ll.Remove(oldest)
+		delete(c.items, oldest.Value.(*entry).id)
+	}
+}
@@ -0,0 +1,44 @@
+package dedup
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCacheEvictsOldest(t *testing.T) {
+	c := NewCache(2, time.Hour)
+
+	c.Add("a")
+	c.Add("b")
+	c.Contains("a")
+	c.Add("c")
+
+	if !c.Contains("a") || !c.Contains("c") {
+		t.Fatal("recently used IDs were evicted")
+	}
+
+	if c.Contains("b") {
+		t.Fatal("least recently used ID was not evicted")
+	}
+}
+
+func TestCacheWindow(t *testing.T) {
+	now := time.Date(2012, 2, 2, 0, 0, 0, 0, time.UTC)
+
+	c := NewCache(10, time.Minute)
+	c.now = func() time.Time { return now }
+
+	c.Add("a")
+
+	now = now.Add(59 * time.Second)
+
+	if !c.Contains("a") {
+		t.Fatal("ID forgotten inside the window")
+	}
+
+	now = now.Add(time.Second)
+
+	if c.Contains("a") {
+		t.Fatal("ID remembered outside the window")
+	}
+}
@@ -0,0 +1,162 @@
+package ingest
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// FileSource is a Source reading a log producers append to, one message
+// per line. The offset of a message is the position after its line; the
+// committed one is kept in the file Path+".offset".
+type FileSource struct {
+	Path string
+	// PollInterval is how often the log is checked for new lines once all
+	// of it is read.
+	PollInterval time.Duration
+
+	f *os.File
+	r *bufio.Reader
+	// pos is the position after the last line fetched.
+	pos int64
+	// partial is a line read without its end yet.
+	partial []byte
+}
+
+// OpenFile opens the log at path after its committed offset.
+func OpenFile(path string) (*FileSource, error) {
+	s := &FileSource{Path: path, PollInterval: time.Second}
+
+	data, err := ioutil.ReadFile(s.offsetFile())
+
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	if err == nil {
+		if s.pos, err = strconv.ParseInt(strings.TrimSpace(string(data)), 10, 64); err != nil {
+			return nil, err
+		}
+	}
+
+	if s.f, err = os.Open(path); err != nil {
+		return nil, err
+	}
+
+	if _, err = s.f.Seek(s.pos, io.SeekStart); err != nil {
+		s.f.Close()
+		return nil, err
+	}
+
+	s.r = bufio.NewReader(s.f)
+	return s, nil
+}
+
+func (s *FileSource) offsetFile() string {
+	return s.Path + ".offset"
+}
+
+func (s *FileSource) Fetch(ctx context.Context, max int) ([]Message, error) {
+	for {
+		var batch []Message
+
+		for len(batch) < max {
+			line, err := s.r.ReadBytes('\n')
+
+			if err == io.EOF {
+				// The rest of the line is still being written.
+				s.partial = append(s.partial, line...)
+				break
+			}
+
+			if err != nil {
+				return batch, err
+			}
+
+			if s.partial != nil {
+				line = append(s.partial, line...)
+				s.partial = nil
+			}
+
+			s.pos += int64(len(line))
+
+			if value := bytes.TrimSpace(line); len(value) > 0 {
+				batch = append(batch, Message{Offset: s.pos, Value: value})
+			}
+		}
+
+		if len(batch) > 0 {
+			return batch, nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(s.PollInterval):
+		}
+	}
+}
+
+// Commit writes offset to the offset file, replacing it at once.
+func (s *FileSource) Commit(ctx context.Context, offset int64) error {
+	tmp := s.offsetFile() + ".tmp"
+
+	if err := ioutil.WriteFile(tmp, []byte(strconv.FormatInt(offset, 10)+"\n"), 0666); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.offsetFile())
+}
+
+func (s *FileSource) Close() error {
+	return s.f.Close()
+}
+
+// FileDeadLetters appends dead letters to a file, one JSON object per
+// line with the message, its offset, the reason and the time.
+type FileDeadLetters struct {
+	mu sync.Mutex
+	f  *os.File
+}
+
+func OpenDeadLetters(path string) (*FileDeadLetters, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0666)
+
+	if err != nil {
+		return nil, err
+	}
+	return &FileDeadLetters{f: f}, nil
+}
+
+// Put appends m and syncs the file, so that its offset can be committed.
+func (d *FileDeadLetters) Put(m Message, reason error) error {
+	data, err := json.Marshal(map[string]interface{}{
+		"offset":  m.Offset,
+		"message": string(m.Value),
+		"error":   reason.Error(),
+		"time":    time.Now().UTC(),
+	})
+
+	if err != nil {
+		return err
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if _, err = d.f.Write(append(data, '\n')); err != nil {
+		return err
+	}
+	return d.f.Sync()
+}
+
+func (d *FileDeadLetters) Close() error {
+	return d.f.Close()
+}
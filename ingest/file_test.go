@@ -0,0 +1,142 @@
+package ingest
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFileSource(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ingest")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "events.ndjson")
+
+	if err = ioutil.WriteFile(path, []byte("{\"user\": 1}\n\n{\"user\": 2}\n{\"user\""), 0666); err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := OpenFile(path)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s.PollInterval = time.Millisecond
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	batch, err := s.Fetch(ctx, 10)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Blank lines are skipped, the unfinished last line waits.
+	if len(batch) != 2 || string(batch[0].Value) != `{"user": 1}` || batch[0].Offset != 12 ||
+		string(batch[1].Value) != `{"user": 2}` || batch[1].Offset != 25 {
+		t.Fatalf("Fetch returned %+v", batch)
+	}
+
+	if err = s.Commit(ctx, batch[0].Offset); err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0666)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	f.WriteString(": 3}\n")
+	f.Close()
+
+	if batch, err = s.Fetch(ctx, 10); err != nil || len(batch) != 1 || string(batch[0].Value) != `{"user": 3}` {
+		t.Fatalf("Fetch after the line was finished returned %+v, %v", batch, err)
+	}
+
+	s.Close()
+
+	// A restart resumes after the committed offset.
+	if s, err = OpenFile(path); err != nil {
+		t.Fatal(err)
+	}
+
+	defer s.Close()
+
+	if batch, err = s.Fetch(ctx, 1); err != nil || len(batch) != 1 || string(batch[0].Value) != `{"user": 2}` {
+		t.Fatalf("Fetch after a restart returned %+v, %v", batch, err)
+	}
+
+	if batch, err = s.Fetch(ctx, 10); err != nil || len(batch) != 1 || string(batch[0].Value) != `{"user": 3}` {
+		t.Fatalf("second Fetch after a restart returned %+v, %v", batch, err)
+	}
+
+	// Without new lines Fetch waits until ctx is done.
+	short, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	if batch, err = s.Fetch(short, 10); err != context.DeadlineExceeded {
+		t.Errorf("Fetch at the end of the log returned %+v, %v", batch, err)
+	}
+}
+
+func TestFileDeadLetters(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ingest")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "dead.ndjson")
+
+	d, err := OpenDeadLetters(path)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	d.Put(Message{Offset: 12, Value: []byte("not json")}, errNotObject)
+	d.Put(Message{Offset: 30, Value: []byte(`{"user": 3}`)}, errors.New("invalid"))
+	d.Close()
+
+	data, err := ioutil.ReadFile(path)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+
+	if len(lines) != 2 {
+		t.Fatalf("dead letters file has %d lines", len(lines))
+	}
+
+	var letter struct {
+		Offset  int64  `json:"offset"`
+		Message string `json:"message"`
+		Error   string `json:"error"`
+	}
+
+	if err = json.Unmarshal([]byte(lines[1]), &letter); err != nil {
+		t.Fatal(err)
+	}
+
+	if letter.Offset != 30 || letter.Message != `{"user": 3}` || letter.Error != "invalid" {
+		t.Errorf("dead letter %+v", letter)
+	}
+}
@@ -0,0 +1,267 @@
+// Package ingest records events consumed from queues, for producers that
+// publish them rather than calling the API.
+package ingest
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"expvar"
+	"fmt"
+	"log"
+	"time"
+)
+
+// messages counts the messages of each source by outcome, "<source>.ingested"
+// or "<source>.dead_lettered". It is served with the other expvars at
+// /debug/vars.
+var messages = expvar.NewMap("ingest_messages")
+
+var errNotObject = errors.New("not a JSON object")
+
+// Message is an event read from a source: an AddStat body.
+type Message struct {
+	// Offset orders the messages of a source. Committing it marks this
+	// message and the ones before it as processed.
+	Offset int64
+	// Key, if set, identifies the message when it is delivered again under
+	// another offset. Otherwise the offset does.
+	Key   string
+	Value []byte
+}
+
+// Source is a queue of events, such as a Kafka partition. A consumer that
+// restarts resumes after the last committed offset, so messages fetched
+// but not committed are delivered again.
+type Source interface {
+	// Fetch returns at most max messages following the ones fetched
+	// already, waiting until there is one or ctx is done.
+	Fetch(ctx context.Context, max int) ([]Message, error)
+	// Commit marks the messages up to offset as processed.
+	Commit(ctx context.Context, offset int64) error
+	Close() error
+}
+
+// DeadLetters keeps the messages that cannot be recorded.
+type DeadLetters interface {
+	Put(m Message, reason error) error
+}
+
+// rejection is an error of an event that can never be recorded.
+type rejection struct {
+	err error
+}
+
+func (r rejection) Error() string {
+	return r.err.Error()
+}
+
+// Reject marks err as the reason an event can never be recorded, so the
+// consumer dead-letters it instead of trying again.
+func Reject(err error) error {
+	return rejection{err}
+}
+
+// IsRejected reports whether err was returned by Reject.
+func IsRejected(err error) bool {
+	_, ok := err.(rejection)
+	return ok
+}
+
+// postponement is an error of an event that cannot be recorded before a
+// time.
+type postponement struct {
+	err   error
+	until time.Time
+}
+
+func (p postponement) Error() string {
+	return p.err.Error()
+}
+
+// RetryAt marks err as the reason an event cannot be recorded before t, so
+// the consumer tries it again then rather than backing off, holding back
+// the events after it.
+func RetryAt(err error, t time.Time) error {
+	return postponement{err, t}
+}
+
+// RetryTime returns the time of err if it was returned by RetryAt.
+func RetryTime(err error) (time.Time, bool) {
+	p, ok := err.(postponement)
+	return p.until, ok
+}
+
+// Consumer records the events of Source with Ingest. Offsets are committed
+// once the events up to them are written or dead-lettered.
+type Consumer struct {
+	// Name identifies the source, see config.IngestSource.
+	Name        string
+	Source      Source
+	DeadLetters DeadLetters
+	// Ingest validates and records an event. Errors returned by Reject
+	// dead-letter it, those returned by RetryAt are retried at their time,
+	// the others are retried with a backoff.
+	Ingest    func(values map[string]interface{}) error
+	BatchSize int
+	// MinBackoff is the wait before retrying after an error, doubled for
+	// each next one up to MaxBackoff.
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+	Logger     *log.Logger
+}
+
+// Run consumes the source until stop is closed.
+func (c *Consumer) Run(stop <-chan struct{}) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	go func() {
+		select {
+		case <-stop:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	failures := 0
+
+	for {
+		batch, err := c.Source.Fetch(ctx, c.BatchSize)
+
+		if ctx.Err() != nil {
+			return
+		}
+
+		if err != nil {
+			c.Logger.Printf("ingest %s: %v", c.Name, err)
+
+			failures++
+
+			if !c.wait(ctx, failures) {
+				return
+			}
+			continue
+		}
+
+		failures = 0
+
+		if !c.process(ctx, batch) {
+			return
+		}
+	}
+}
+
+// process records batch, retrying each event until it is written or
+// dead-lettered, and commits its offsets. It returns false if ctx is done
+// first.
+func (c *Consumer) process(ctx context.Context, batch []Message) bool {
+	var done int64 = -1
+
+	for _, m := range batch {
+		for failures := 1; ; failures++ {
+			err := c.handle(m)
+
+			if err == nil {
+				break
+			}
+
+			// Whatever is done needs no retry after a restart.
+			if done >= 0 {
+				c.commit(ctx, done)
+				done = -1
+			}
+
+			if until, ok := RetryTime(err); ok {
+				c.Logger.Printf("ingest %s: offset %d: %v, retrying at %s", c.Name, m.Offset, err, until.Format(time.RFC3339))
+
+				if !c.sleep(ctx, time.Until(until)) {
+					return false
+				}
+
+				failures = 0
+				continue
+			}
+
+			c.Logger.Printf("ingest %s: offset %d: %v", c.Name, m.Offset, err)
+
+			if !c.wait(ctx, failures) {
+				return false
+			}
+		}
+
+		done = m.Offset
+	}
+
+	if done >= 0 {
+		c.commit(ctx, done)
+	}
+	return true
+}
+
+// handle records m or dead-letters it. An error means neither was done.
+func (c *Consumer) handle(m Message) error {
+	var values map[string]interface{}
+
+	if err := json.Unmarshal(m.Value, &values); err != nil || values == nil {
+		return c.deadLetter(m, errNotObject)
+	}
+
+	if values["event_id"] == nil && m.Key != "" {
+		values["event_id"] = c.Name + ":" + m.Key
+	} else if values["event_id"] == nil {
+		values["event_id"] = fmt.Sprintf("%s:%d", c.Name, m.Offset)
+	}
+
+	err := c.Ingest(values)
+
+	if IsRejected(err) {
+		return c.deadLetter(m, err)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	messages.Add(c.Name+".ingested", 1)
+	return nil
+}
+
+func (c *Consumer) deadLetter(m Message, reason error) error {
+	if err := c.DeadLetters.Put(m, reason); err != nil {
+		return err
+	}
+
+	messages.Add(c.Name+".dead_lettered", 1)
+	return nil
+}
+
+// commit commits offset. A failure is only logged: the next commit covers
+// it, and until then a restart delivers the events again, which their
+// event IDs keep from being counted twice.
+func (c *Consumer) commit(ctx context.Context, offset int64) {
+	if err := c.Source.Commit(ctx, offset); err != nil {
+		c.Logger.Printf("ingest %s: commit of offset %d: %v", c.Name, offset, err)
+	}
+}
+
+// wait sleeps before the retry after failures errors in a row. It returns
+// false if ctx is done first.
+func (c *Consumer) wait(ctx context.Context, failures int) bool {
+	wait := c.MinBackoff << uint(failures-1)
+
+	if wait > c.MaxBackoff || wait <= 0 {
+		wait = c.MaxBackoff
+	}
+	return c.sleep(ctx, wait)
+}
+
+// sleep waits for d. It returns false if ctx is done first.
+func (c *Consumer) sleep(ctx context.Context, d time.Duration) bool {
+	select {
+	case <-ctx.Done():
+		return false
+	case <-time.After(d):
+		return true
+	}
+}
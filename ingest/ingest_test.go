@@ -0,0 +1,214 @@
+package ingest
+
+import (
+	"context"
+	"errors"
+	"log"
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+// waitFor polls cond until it holds or a second has passed.
+func waitFor(t *testing.T, what string, cond func() bool) {
+	deadline := time.Now().Add(time.Second)
+
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestConsumer(t *testing.T) {
+	source := NewMemorySource()
+	deadLetters := &MemoryDeadLetters{}
+
+	var mu sync.Mutex
+	var ingested []map[string]interface{}
+	var committedOnFailure []int64
+
+	failures := 2
+
+	c := &Consumer{
+		Name:        "events",
+		Source:      source,
+		DeadLetters: deadLetters,
+		Ingest: func(values map[string]interface{}) error {
+			mu.Lock()
+			defer mu.Unlock()
+
+			switch values["user"] {
+			case float64(3):
+				return Reject(errors.New("invalid"))
+			case float64(4):
+				if failures > 0 {
+					failures--
+					committedOnFailure = append(committedOnFailure, source.Committed())
+					return errors.New("connection reset")
+				}
+			}
+
+			ingested = append(ingested, values)
+			return nil
+		},
+		BatchSize:  10,
+		MinBackoff: time.Millisecond,
+		MaxBackoff: 5 * time.Millisecond,
+		Logger:     log.New(os.Stdout, "", log.LstdFlags),
+	}
+
+	stop := make(chan struct{})
+	done := make(chan struct{})
+
+	go func() {
+		c.Run(stop)
+		close(done)
+	}()
+
+	source.Add(
+		[]byte(`{"user": 1, "action": "like", "ts": "2012-02-02", "event_id": "a"}`),
+		[]byte(`not json`),
+		[]byte(`{"user": 3, "action": "like", "ts": "2012-02-02"}`),
+		[]byte(`{"user": 4, "action": "like", "ts": "2012-02-02"}`),
+	)
+
+	waitFor(t, "offset 4 to be committed", func() bool { return source.Committed() == 4 })
+
+	mu.Lock()
+
+	// The events before the failing one were committed while it was retried,
+	// not past it.
+	if len(committedOnFailure) != 2 || committedOnFailure[0] > 3 || committedOnFailure[1] != 3 {
+		t.Errorf("offsets committed while user 4 failed: %v, want up to 3", committedOnFailure)
+	}
+
+	if len(ingested) != 2 || ingested[0]["event_id"] != "a" || ingested[1]["event_id"] != "events:4" {
+		t.Errorf("ingested %v", ingested)
+	}
+
+	mu.Unlock()
+
+	letters := deadLetters.Letters()
+
+	if len(letters) != 2 || letters[0].Message.Offset != 2 || letters[0].Reason != errNotObject.Error() ||
+		letters[1].Message.Offset != 3 || letters[1].Reason != "invalid" {
+		t.Errorf("dead letters %+v", letters)
+	}
+
+	close(stop)
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Run did not return after stop")
+	}
+}
+
+// A consumer restarted before committing gets the events again, with the
+// same made-up event IDs, so they are counted once.
+func TestConsumerRedelivery(t *testing.T) {
+	source := NewMemorySource()
+
+	source.Add([]byte(`{"user": 1, "action": "like", "ts": "2012-02-02"}`))
+
+	batch, err := source.Fetch(context.Background(), 10)
+
+	if err != nil || len(batch) != 1 {
+		t.Fatalf("Fetch returned %v, %v", batch, err)
+	}
+
+	var ids []interface{}
+
+	c := &Consumer{
+		Name:        "events",
+		Source:      source,
+		DeadLetters: &MemoryDeadLetters{},
+		Ingest: func(values map[string]interface{}) error {
+			ids = append(ids, values["event_id"])
+			return nil
+		},
+		Logger: log.New(os.Stdout, "", log.LstdFlags),
+	}
+
+	if err = c.handle(batch[0]); err != nil {
+		t.Fatal(err)
+	}
+
+	source.Restart()
+
+	if batch, err = source.Fetch(context.Background(), 10); err != nil || len(batch) != 1 {
+		t.Fatalf("Fetch after Restart returned %v, %v", batch, err)
+	}
+
+	if err = c.handle(batch[0]); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(ids) != 2 || ids[0] != ids[1] {
+		t.Errorf("event IDs of the deliveries: %v", ids)
+	}
+}
+
+// An event postponed with RetryAt is tried again at its time, not after the
+// backoff, and is not dead-lettered.
+func TestConsumerRetryAt(t *testing.T) {
+	source := NewMemorySource()
+	deadLetters := &MemoryDeadLetters{}
+
+	var mu sync.Mutex
+	var tries int
+
+	c := &Consumer{
+		Name:        "events",
+		Source:      source,
+		DeadLetters: deadLetters,
+		Ingest: func(values map[string]interface{}) error {
+			mu.Lock()
+			defer mu.Unlock()
+
+			if tries++; tries == 1 {
+				return RetryAt(errors.New("quota exceeded"), time.Now().Add(10*time.Millisecond))
+			}
+			return nil
+		},
+		BatchSize:  10,
+		MinBackoff: time.Hour,
+		MaxBackoff: time.Hour,
+		Logger:     log.New(os.Stdout, "", log.LstdFlags),
+	}
+
+	stop := make(chan struct{})
+	done := make(chan struct{})
+
+	go func() {
+		c.Run(stop)
+		close(done)
+	}()
+
+	source.Add([]byte(`{"user": 1, "action": "like", "ts": "2012-02-02"}`))
+
+	waitFor(t, "offset 1 to be committed", func() bool { return source.Committed() == 1 })
+
+	mu.Lock()
+
+	if tries != 2 {
+		t.Errorf("event tried %d times, want 2", tries)
+	}
+
+	mu.Unlock()
+
+	if letters := deadLetters.Letters(); len(letters) != 0 {
+		t.Errorf("dead letters %+v", letters)
+	}
+
+	close(stop)
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Run did not return after stop")
+	}
+}
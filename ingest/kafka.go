@@ -0,0 +1,109 @@
+package ingest
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+)
+
+// kafkaReader is the part of *kafka.Reader that KafkaSource uses.
+type kafkaReader interface {
+	FetchMessage(ctx context.Context) (kafka.Message, error)
+	CommitMessages(ctx context.Context, msgs ...kafka.Message) error
+	Close() error
+}
+
+// KafkaSource is a Source consuming a Kafka topic as a member of a consumer
+// group. The messages of the partitions assigned to it get offsets of their
+// own, starting at 1, in the order they are fetched; committing one commits
+// the Kafka offsets of the messages up to it to the group. Their key is the
+// topic, partition and Kafka offset, which stay the same when a message is
+// delivered again.
+type KafkaSource struct {
+	// MaxWait is how long Fetch waits for more messages to fill a batch
+	// once it has one.
+	MaxWait time.Duration
+
+	r kafkaReader
+	// pending are the messages fetched but not committed, in order; the
+	// offset of the first is base.
+	pending []kafka.Message
+	base    int64
+}
+
+// OpenKafka joins the consumer group of topic on brokers. It resumes after
+// the offsets the group committed.
+func OpenKafka(brokers []string, topic, group string) (*KafkaSource, error) {
+	conf := kafka.ReaderConfig{Brokers: brokers, Topic: topic, GroupID: group}
+
+	if err := conf.Validate(); err != nil {
+		return nil, err
+	}
+	return newKafkaSource(kafka.NewReader(conf)), nil
+}
+
+func newKafkaSource(r kafkaReader) *KafkaSource {
+	return &KafkaSource{MaxWait: 100 * time.Millisecond, r: r, base: 1}
+}
+
+func (s *KafkaSource) Fetch(ctx context.Context, max int) ([]Message, error) {
+	m, err := s.r.FetchMessage(ctx)
+
+	if err != nil {
+		return nil, err
+	}
+
+	batch := []Message{s.add(m)}
+
+	wait, cancel := context.WithTimeout(ctx, s.MaxWait)
+	defer cancel()
+
+	for len(batch) < max {
+		// An error other than the end of the wait comes again with the
+		// next Fetch.
+		if m, err = s.r.FetchMessage(wait); err != nil {
+			break
+		}
+		batch = append(batch, s.add(m))
+	}
+	return batch, nil
+}
+
+// add keeps m until it is committed and returns it as a Message.
+func (s *KafkaSource) add(m kafka.Message) Message {
+	s.pending = append(s.pending, m)
+
+	return Message{
+		Offset: s.base + int64(len(s.pending)) - 1,
+		Key:    fmt.Sprintf("%s/%d/%d", m.Topic, m.Partition, m.Offset),
+		Value:  m.Value,
+	}
+}
+
+// Commit commits to the group the Kafka offsets of the messages up to
+// offset.
+func (s *KafkaSource) Commit(ctx context.Context, offset int64) error {
+	n := int(offset - s.base + 1)
+
+	if n <= 0 {
+		return nil
+	}
+
+	if n > len(s.pending) {
+		n = len(s.pending)
+	}
+
+	if err := s.r.CommitMessages(ctx, s.pending[:n]...); err != nil {
+		return err
+	}
+
+	s.pending = append([]kafka.Message(nil), s.pending[n:]...)
+	s.base += int64(n)
+	return nil
+}
+
+func (s *KafkaSource) Close() error {
+	return s.r.Close()
+}
@@ -0,0 +1,94 @@
+package ingest
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+)
+
+// fakeReader serves msgs and records the commits.
+type fakeReader struct {
+	msgs      chan kafka.Message
+	committed []int64
+}
+
+func (r *fakeReader) FetchMessage(ctx context.Context) (kafka.Message, error) {
+	select {
+	case m := <-r.msgs:
+		return m, nil
+	case <-ctx.Done():
+		return kafka.Message{}, ctx.Err()
+	}
+}
+
+func (r *fakeReader) CommitMessages(ctx context.Context, msgs ...kafka.Message) error {
+	for _, m := range msgs {
+		r.committed = append(r.committed, m.Offset)
+	}
+	return nil
+}
+
+func (r *fakeReader) Close() error {
+	return nil
+}
+
+func TestKafkaSource(t *testing.T) {
+	r := &fakeReader{msgs: make(chan kafka.Message, 10)}
+
+	for i, partition := range []int{0, 1, 0} {
+		r.msgs <- kafka.Message{Topic: "events", Partition: partition, Offset: int64(40 + i), Value: []byte("{}")}
+	}
+
+	s := newKafkaSource(r)
+	s.MaxWait = 10 * time.Millisecond
+
+	ctx := context.Background()
+
+	batch, err := s.Fetch(ctx, 2)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(batch) != 2 || batch[0].Offset != 1 || batch[1].Offset != 2 || batch[1].Key != "events/1/41" {
+		t.Errorf("first batch %+v", batch)
+	}
+
+	// The batch is not filled past the wait.
+	batch, err = s.Fetch(ctx, 2)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(batch) != 1 || batch[0].Offset != 3 || batch[0].Key != "events/0/42" {
+		t.Errorf("second batch %+v", batch)
+	}
+
+	if err = s.Commit(ctx, 2); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = s.Commit(ctx, 3); err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(r.committed, []int64{40, 41, 42}) {
+		t.Errorf("committed Kafka offsets %v", r.committed)
+	}
+
+	// Nothing is left to commit.
+	if err = s.Commit(ctx, 3); err != nil || len(r.committed) != 3 {
+		t.Errorf("commit again: %v, committed %v", err, r.committed)
+	}
+
+	cancelled, cancel := context.WithCancel(ctx)
+	cancel()
+
+	if _, err = s.Fetch(cancelled, 2); err == nil {
+		t.Error("Fetch did not end with its context")
+	}
+}
@@ -0,0 +1,117 @@
+package ingest
+
+import (
+	"context"
+	"sync"
+)
+
+// MemorySource is a Source kept in memory, for tests. The offset of a
+// message is its position, starting at 1.
+type MemorySource struct {
+	mu        sync.Mutex
+	values    [][]byte
+	fetched   int
+	committed int64
+	// added is closed when messages are added.
+	added chan struct{}
+}
+
+func NewMemorySource() *MemorySource {
+	return &MemorySource{added: make(chan struct{})}
+}
+
+// Add appends messages with values to the queue.
+func (s *MemorySource) Add(values ...[]byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.values = append(s.values, values...)
+
+	close(s.added)
+	s.added = make(chan struct{})
+}
+
+func (s *MemorySource) Fetch(ctx context.Context, max int) ([]Message, error) {
+	for {
+		s.mu.Lock()
+
+		if s.fetched < len(s.values) {
+			var batch []Message
+
+			for ; s.fetched < len(s.values) && len(batch) < max; s.fetched++ {
+				batch = append(batch, Message{Offset: int64(s.fetched + 1), Value: s.values[s.fetched]})
+			}
+
+			s.mu.Unlock()
+			return batch, nil
+		}
+
+		added := s.added
+		s.mu.Unlock()
+
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-added:
+		}
+	}
+}
+
+func (s *MemorySource) Commit(ctx context.Context, offset int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if offset > s.committed {
+		s.committed = offset
+	}
+	return nil
+}
+
+// Committed returns the last committed offset.
+func (s *MemorySource) Committed() int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.committed
+}
+
+// Restart makes the messages after the committed offset be fetched again,
+// as for a consumer that restarts.
+func (s *MemorySource) Restart() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.fetched = int(s.committed)
+}
+
+func (s *MemorySource) Close() error {
+	return nil
+}
+
+// DeadLetter is a message that could not be recorded.
+type DeadLetter struct {
+	Message Message
+	Reason  string
+}
+
+// MemoryDeadLetters keeps dead letters in memory, for tests.
+type MemoryDeadLetters struct {
+	mu      sync.Mutex
+	letters []DeadLetter
+}
+
+func (d *MemoryDeadLetters) Put(m Message, reason error) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.letters = append(d.letters, DeadLetter{Message: m, Reason: reason.Error()})
+	return nil
+}
+
+// Letters returns the dead letters so far.
+func (d *MemoryDeadLetters) Letters() []DeadLetter {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	return append([]DeadLetter(nil), d.letters...)
+}
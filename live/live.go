@@ -0,0 +1,316 @@
+// Package live keeps the leaderboards of today clients subscribe to, updated
+// as events are recorded rather than queried for each client.
+//
+// A leaderboard is read from the daily stats when its first client
+// subscribes and dropped with its last one. In between it follows the
+// events this instance records.
+package live
+
+import (
+	"errors"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/zwirec/http_service_stat/dbManager"
+)
+
+const layout = "2006-01-02"
+
+// ErrTooManyClients is returned by Subscribe when as many clients as
+// allowed are subscribed.
+var ErrTooManyClients = errors.New("live: too many clients")
+
+// Entry is a rank of a leaderboard.
+type Entry struct {
+	Rank int   `json:"rank"`
+	User int64 `json:"user"`
+	Cnt  int64 `json:"cnt"`
+}
+
+// ranksBefore reports whether a ranks before b: by count, then by user.
+func ranksBefore(a, b Entry) bool {
+	return a.Cnt > b.Cnt || a.Cnt == b.Cnt && a.User < b.User
+}
+
+type key struct {
+	tenant int
+	action string
+	date   string
+}
+
+type board struct {
+	// loaded is closed once the counts are read, err is why they could
+	// not be.
+	loaded chan struct{}
+	err    error
+	ready  bool
+	counts map[int64]int64
+	// pending are the events recorded per user until the board is ready.
+	pending map[int64]int64
+	// top are the first users, Rank is not kept.
+	top  []Entry
+	subs map[*Subscription]struct{}
+}
+
+// update sets the count of user to cnt in b.top of size users. It returns
+// the index user has now and whether b.top changed.
+func (b *board) update(user, cnt int64, size int) (int, bool) {
+	i := -1
+
+	for j := range b.top {
+		if b.top[j].User == user {
+			i = j
+			break
+		}
+	}
+
+	e := Entry{User: user, Cnt: cnt}
+
+	switch {
+	case i >= 0:
+		b.top[i] = e
+	case len(b.top) < size:
+		b.top = append(b.top, e)
+		i = len(b.top) - 1
+	case size > 0 && ranksBefore(e, b.top[len(b.top)-1]):
+		i = len(b.top) - 1
+		b.top[i] = e
+	default:
+		return 0, false
+	}
+
+	// Counts only grow, so user only moves up.
+	for ; i > 0 && ranksBefore(b.top[i], b.top[i-1]); i-- {
+		b.top[i], b.top[i-1] = b.top[i-1], b.top[i]
+	}
+	return i, true
+}
+
+// Boards are the live leaderboards.
+type Boards struct {
+	dbm  *dbManager.DBManager
+	size int
+	max  int
+
+	mu      sync.Mutex
+	boards  map[key]*board
+	clients int
+}
+
+// New returns the leaderboards of the stats in dbm ranking size users,
+// with at most max clients.
+func New(dbm *dbManager.DBManager, size, max int) *Boards {
+	return &Boards{dbm: dbm, size: size, max: max, boards: map[key]*board{}}
+}
+
+// Size is the largest limit of a subscription.
+func (b *Boards) Size() int {
+	return b.size
+}
+
+// Subscription is a client of the leaderboard of an action on a day.
+type Subscription struct {
+	// Date is the UTC day of the leaderboard.
+	Date    string
+	boards  *Boards
+	key     key
+	board   *board
+	limit   int
+	changed chan struct{}
+}
+
+// Changed receives when the first limit ranks may have changed.
+func (s *Subscription) Changed() <-chan struct{} {
+	return s.changed
+}
+
+// Top returns the first limit ranks.
+func (s *Subscription) Top() []Entry {
+	s.boards.mu.Lock()
+	defer s.boards.mu.Unlock()
+
+	n := len(s.board.top)
+
+	if n > s.limit {
+		n = s.limit
+	}
+
+	top := make([]Entry, n)
+
+	for i := range top {
+		top[i] = s.board.top[i]
+		top[i].Rank = i + 1
+	}
+	return top
+}
+
+// Subscribe returns a subscription to the first limit users, at most
+// Size, of the leaderboard of action of tenant on the UTC day of now.
+func (b *Boards) Subscribe(tenant int, action string, limit int, now time.Time) (*Subscription, error) {
+	if limit < 1 || limit > b.size {
+		return nil, errors.New("live: limit out of range")
+	}
+
+	k := key{tenant: tenant, action: action, date: now.UTC().Format(layout)}
+
+	b.mu.Lock()
+
+	if b.clients >= b.max {
+		b.mu.Unlock()
+		return nil, ErrTooManyClients
+	}
+
+	bd, ok := b.boards[k]
+
+	if !ok {
+		bd = &board{
+			loaded:  make(chan struct{}),
+			counts:  map[int64]int64{},
+			pending: map[int64]int64{},
+			subs:    map[*Subscription]struct{}{},
+		}
+		b.boards[k] = bd
+	}
+
+	s := &Subscription{Date: k.date, boards: b, key: k, board: bd, limit: limit, changed: make(chan struct{}, 1)}
+	bd.subs[s] = struct{}{}
+	b.clients++
+
+	b.mu.Unlock()
+
+	// The first client reads the leaderboard, the others wait for it.
+	if !ok {
+		b.load(k, bd)
+	}
+
+	<-bd.loaded
+
+	if bd.err != nil {
+		b.Unsubscribe(s)
+		return nil, bd.err
+	}
+	return s, nil
+}
+
+// load reads the counts of bd and adds the events recorded meanwhile. An
+// event committed just before the read, but recorded after the board was
+// created, is counted twice; none is lost.
+func (b *Boards) load(k key, bd *board) {
+	counts := map[int64]int64{}
+
+	rows, err := b.dbm.ForTenant(&dbManager.Tenant{ID: k.tenant}).DailyCounts(k.action, k.date)
+
+	if err == nil {
+		for rows.Next() {
+			var user, cnt int64
+
+			if err = rows.Scan(&user, &cnt); err != nil {
+				break
+			}
+			counts[user] = cnt
+		}
+
+		if err == nil {
+			err = rows.Err()
+		}
+		rows.Close()
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if err != nil {
+		bd.err = err
+
+		if b.boards[k] == bd {
+			delete(b.boards, k)
+		}
+	} else {
+		for user, cnt := range bd.pending {
+			counts[user] += cnt
+		}
+
+		bd.counts = counts
+		bd.pending = nil
+
+		for user, cnt := range counts {
+			bd.top = append(bd.top, Entry{User: user, Cnt: cnt})
+		}
+
+		sort.Slice(bd.top, func(i, j int) bool { return ranksBefore(bd.top[i], bd.top[j]) })
+
+		if len(bd.top) > b.size {
+			bd.top = bd.top[:b.size]
+		}
+		bd.ready = true
+	}
+	close(bd.loaded)
+}
+
+// Unsubscribe ends s. The leaderboard is dropped with its last client.
+func (b *Boards) Unsubscribe(s *Subscription) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if _, ok := s.board.subs[s]; !ok {
+		return
+	}
+
+	delete(s.board.subs, s)
+	b.clients--
+
+	if len(s.board.subs) == 0 && b.boards[s.key] == s.board {
+		delete(b.boards, s.key)
+	}
+}
+
+// Record counts values, an event recorded for tenant, in the leaderboard
+// of its action and day if a client is subscribed to it.
+func (b *Boards) Record(tenant int, values map[string]interface{}) {
+	user, ok := dbManager.UserID(values["user"])
+
+	if !ok {
+		return
+	}
+
+	action, _ := values["action"].(string)
+	ts, _ := values["ts"].(string)
+
+	date := ts
+
+	if t, err := time.Parse(time.RFC3339, ts); err == nil {
+		date = t.UTC().Format(layout)
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	bd := b.boards[key{tenant: tenant, action: action, date: date}]
+
+	if bd == nil {
+		return
+	}
+
+	if !bd.ready {
+		bd.pending[user]++
+		return
+	}
+
+	bd.counts[user]++
+
+	i, changed := bd.update(user, bd.counts[user], b.size)
+
+	if !changed {
+		return
+	}
+
+	for s := range bd.subs {
+		if i < s.limit {
+			select {
+			case s.changed <- struct{}{}:
+			default:
+			}
+		}
+	}
+}
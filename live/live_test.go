@@ -0,0 +1,197 @@
+package live
+
+import (
+	"log"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/zwirec/http_service_stat/dbManager"
+)
+
+func like(user int) map[string]interface{} {
+	return map[string]interface{}{"user": float64(user), "action": "like", "ts": "2012-02-02T10:00:00Z"}
+}
+
+func changed(s *Subscription) bool {
+	select {
+	case <-s.Changed():
+		return true
+	default:
+		return false
+	}
+}
+
+func TestBoards(t *testing.T) {
+	db, mock, err := sqlmock.New()
+
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	b := New(&dbManager.DBManager{DB: db}, 3, 2)
+
+	now := time.Date(2012, 2, 2, 12, 0, 0, 0, time.UTC)
+
+	mock.ExpectQuery("FROM stats").WithArgs("like", "2012-02-02", 3).WillReturnRows(
+		sqlmock.NewRows([]string{"user", "cnt"}).AddRow(1, 5).AddRow(2, 4).AddRow(3, 2).AddRow(4, 1))
+
+	top2, err := b.Subscribe(3, "like", 2, now)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The leaderboard is read once for its clients.
+	top3, err := b.Subscribe(3, "like", 3, now)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = b.Subscribe(3, "like", 4, now); err == nil {
+		t.Errorf("subscription past the size of the leaderboards")
+	}
+
+	want := []Entry{{1, 1, 5}, {2, 2, 4}}
+
+	if got := top2.Top(); !reflect.DeepEqual(got, want) {
+		t.Errorf("Top = %v, want %v", got, want)
+	}
+
+	// Other tenants, actions and days are not counted.
+	b.Record(0, like(4))
+	b.Record(3, map[string]interface{}{"user": float64(4), "action": "login", "ts": "2012-02-02"})
+	b.Record(3, map[string]interface{}{"user": float64(4), "action": "like", "ts": "2012-02-01"})
+
+	// User 4 gets to 2, behind 3 with as many.
+	b.Record(3, like(4))
+
+	if changed(top2) || changed(top3) {
+		t.Errorf("clients told of a change below their ranks")
+	}
+
+	// User 4 gets to 3 and rank 3.
+	b.Record(3, like(4))
+
+	if changed(top2) || !changed(top3) {
+		t.Errorf("user 4 entering rank 3: top 2 told, or top 3 not")
+	}
+
+	want = []Entry{{1, 1, 5}, {2, 2, 4}, {3, 4, 3}}
+
+	if got := top3.Top(); !reflect.DeepEqual(got, want) {
+		t.Errorf("Top = %v, want %v", got, want)
+	}
+
+	// User 3 gets to 3 too and takes rank 3 by id.
+	b.Record(3, map[string]interface{}{"user": "3", "action": "like", "ts": "2012-02-02"})
+
+	want = []Entry{{1, 1, 5}, {2, 2, 4}, {3, 3, 3}}
+
+	if got := top3.Top(); !reflect.DeepEqual(got, want) || changed(top2) || !changed(top3) {
+		t.Errorf("Top = %v, want %v", got, want)
+	}
+
+	// User 4 gets to 5 and overtakes 2.
+	b.Record(3, like(4))
+	b.Record(3, like(4))
+
+	if !changed(top2) {
+		t.Errorf("user 4 moving to rank 2 was not told")
+	}
+
+	want = []Entry{{1, 1, 5}, {2, 4, 5}, {3, 2, 4}}
+
+	if got := top3.Top(); !reflect.DeepEqual(got, want) {
+		t.Errorf("Top = %v, want %v", got, want)
+	}
+
+	if _, err = b.Subscribe(0, "like", 1, now); err == nil {
+		t.Errorf("subscription past max clients")
+	}
+
+	// The leaderboard goes with its last client, and is read again for the
+	// next one.
+	b.Unsubscribe(top2)
+	b.Unsubscribe(top3)
+	b.Unsubscribe(top3)
+
+	b.Record(3, like(4))
+
+	mock.ExpectQuery("FROM stats").WithArgs("like", "2012-02-02", 3).WillReturnRows(
+		sqlmock.NewRows([]string{"user", "cnt"}).AddRow(4, 9))
+
+	top1, err := b.Subscribe(3, "like", 1, now)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got := top1.Top(); !reflect.DeepEqual(got, []Entry{{1, 4, 9}}) {
+		t.Errorf("Top after reading again = %v", got)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatalf("there were unfulfilled expections: %s", err)
+	}
+}
+
+func TestRecordDuringLoad(t *testing.T) {
+	db, mock, err := sqlmock.New()
+
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	b := New(&dbManager.DBManager{DB: db}, 3, 2)
+
+	now := time.Date(2012, 2, 2, 12, 0, 0, 0, time.UTC)
+
+	mock.ExpectQuery("FROM stats").WithArgs("like", "2012-02-02", 3).WillDelayFor(100 * time.Millisecond).WillReturnRows(
+		sqlmock.NewRows([]string{"user", "cnt"}).AddRow(1, 5).AddRow(2, 4))
+
+	subscribed := make(chan *Subscription)
+
+	go func() {
+		s, err := b.Subscribe(3, "like", 3, now)
+
+		if err != nil {
+			t.Error(err)
+		}
+		subscribed <- s
+	}()
+
+	// Wait for the board to be created, then record while it loads.
+	for {
+		b.mu.Lock()
+		_, ok := b.boards[key{tenant: 3, action: "like", date: "2012-02-02"}]
+		b.mu.Unlock()
+
+		if ok {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	b.Record(3, like(2))
+	b.Record(3, like(2))
+	b.Record(3, like(5))
+
+	s := <-subscribed
+
+	if s == nil {
+		t.FailNow()
+	}
+
+	want := []Entry{{1, 2, 6}, {2, 1, 5}, {3, 5, 1}}
+
+	if got := s.Top(); !reflect.DeepEqual(got, want) {
+		t.Errorf("Top = %v, want %v", got, want)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatalf("there were unfulfilled expections: %s", err)
+	}
+}
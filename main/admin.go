@@ -0,0 +1,362 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/zwirec/http_service_stat/client"
+)
+
+const (
+	dateLayout = "2006-01-02"
+	// apiKeyEnv holds the API key of the admin commands, so that it does
+	// not show up in process listings.
+	apiKeyEnv = "SERVICE_STAT_API_KEY"
+)
+
+// apiFlags are the flags shared by the admin commands.
+type apiFlags struct {
+	url     *string
+	format  *string
+	timeout *time.Duration
+}
+
+func addAPIFlags(fs *flag.FlagSet) *apiFlags {
+	return &apiFlags{
+		url:     fs.String("url", "http://localhost:1234", "base URL of the service"),
+		format:  fs.String("format", "table", "output as table, json or csv"),
+		timeout: fs.Duration("timeout", 30*time.Second, "time allowed for the command"),
+	}
+}
+
+// client returns a client of the service and a context bounded by the
+// timeout, or an error for an unknown output format.
+func (f *apiFlags) client() (*client.Client, context.Context, context.CancelFunc, error) {
+	switch *f.format {
+	case "table", "json", "csv":
+	default:
+		return nil, nil, nil, fmt.Errorf("unknown format %q (use table, json or csv)", *f.format)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), *f.timeout)
+	return client.New(*f.url, os.Getenv(apiKeyEnv)), ctx, cancel, nil
+}
+
+// print writes v as JSON, or header and rows as a table or CSV.
+func (f *apiFlags) print(v interface{}, header []string, rows [][]string) error {
+	switch *f.format {
+	case "json":
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(v)
+	case "csv":
+		w := csv.NewWriter(os.Stdout)
+		w.Write(header)
+		w.WriteAll(rows)
+		return w.Error()
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+
+	fmt.Fprintln(w, strings.Join(header, "\t"))
+
+	for _, row := range rows {
+		fmt.Fprintln(w, strings.Join(row, "\t"))
+	}
+	return w.Flush()
+}
+
+// dateRange parses the -date1 and -date2 flags. They default to the last
+// seven days, today included.
+func dateRange(date1, date2 string) (from, to time.Time, err error) {
+	today := time.Now().UTC().Truncate(24 * time.Hour)
+
+	from, to = today.AddDate(0, 0, -6), today.AddDate(0, 0, 1)
+
+	if date1 != "" {
+		if from, err = time.Parse(dateLayout, date1); err != nil {
+			return from, to, fmt.Errorf("invalid -date1 %q (use %s)", date1, dateLayout)
+		}
+	}
+
+	if date2 != "" {
+		if to, err = time.Parse(dateLayout, date2); err != nil {
+			return from, to, fmt.Errorf("invalid -date2 %q (use %s)", date2, dateLayout)
+		}
+	}
+	return from, to, nil
+}
+
+func top(args []string) error {
+	fs := flag.NewFlagSet("top", flag.ExitOnError)
+	api := addAPIFlags(fs)
+	date1 := fs.String("date1", "", "first day (default: six days ago)")
+	date2 := fs.String("date2", "", "day after the last one (default: tomorrow)")
+	limit := fs.Int("limit", 10, "users per bucket")
+	interval := fs.String("interval", "day", "bucket size: hour, day, week or month")
+	tz := fs.String("tz", "UTC", "IANA time zone of the buckets")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: main top [flags] ACTION")
+		fmt.Fprintf(fs.Output(), "Prints the top users by count of ACTION. The API key is read from $%s.\n", apiKeyEnv)
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	if fs.NArg() != 1 || *limit <= 0 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	from, to, err := dateRange(*date1, *date2)
+
+	if err != nil {
+		return err
+	}
+
+	c, ctx, cancel, err := api.client()
+
+	if err != nil {
+		return err
+	}
+
+	defer cancel()
+
+	buckets, err := c.TopStats(ctx, client.TopQuery{From: from, To: to, Action: fs.Arg(0), Limit: *limit, Interval: *interval, TZ: *tz})
+
+	if err != nil {
+		return err
+	}
+
+	var rows [][]string
+
+	for _, b := range buckets {
+		for _, r := range b.Rows {
+			var age, sex string
+
+			if r.Age != nil {
+				age = strconv.FormatInt(*r.Age, 10)
+			}
+
+			if r.Sex != nil {
+				sex = *r.Sex
+			}
+
+			rows = append(rows, []string{b.Date, strconv.FormatInt(r.ID, 10), age, sex, strconv.FormatInt(r.Cnt, 10)})
+		}
+	}
+	return api.print(buckets, []string{"date", "id", "age", "sex", "cnt"}, rows)
+}
+
+func userActivity(args []string) error {
+	fs := flag.NewFlagSet("user-activity", flag.ExitOnError)
+	api := addAPIFlags(fs)
+	date1 := fs.String("date1", "", "first day (default: six days ago)")
+	date2 := fs.String("date2", "", "day after the last one (default: tomorrow)")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: main user-activity [flags] USER")
+		fmt.Fprintf(fs.Output(), "Prints the daily counters of USER. The API key is read from $%s.\n", apiKeyEnv)
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	if fs.NArg() != 1 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	user, err := strconv.ParseInt(fs.Arg(0), 10, 64)
+
+	if err != nil || user <= 0 {
+		return fmt.Errorf("invalid user %q (use the id of a user)", fs.Arg(0))
+	}
+
+	from, to, err := dateRange(*date1, *date2)
+
+	if err != nil {
+		return err
+	}
+
+	c, ctx, cancel, err := api.client()
+
+	if err != nil {
+		return err
+	}
+
+	defer cancel()
+
+	activity, err := c.UserActivity(ctx, user, from, to)
+
+	if err != nil {
+		return err
+	}
+
+	var rows [][]string
+
+	for _, a := range activity {
+		rows = append(rows, []string{a.Date, a.Action, strconv.FormatInt(a.Cnt, 10)})
+	}
+	return api.print(activity, []string{"date", "action", "cnt"}, rows)
+}
+
+func actions(args []string) error {
+	fs := flag.NewFlagSet("actions", flag.ExitOnError)
+	api := addAPIFlags(fs)
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: main actions [flags]")
+		fmt.Fprintf(fs.Output(), "Prints the action catalogue of the tenant. The API key is read from $%s.\n", apiKeyEnv)
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	if fs.NArg() != 0 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	c, ctx, cancel, err := api.client()
+
+	if err != nil {
+		return err
+	}
+
+	defer cancel()
+
+	list, err := c.Actions(ctx)
+
+	if err != nil {
+		return err
+	}
+
+	var rows [][]string
+
+	for _, action := range list {
+		rows = append(rows, []string{action})
+	}
+	return api.print(list, []string{"action"}, rows)
+}
+
+func purge(args []string) error {
+	fs := flag.NewFlagSet("purge", flag.ExitOnError)
+	api := addAPIFlags(fs)
+	dryRun := fs.Bool("dry-run", false, "only print what would be deleted")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: main purge [flags]")
+		fmt.Fprintf(fs.Output(), "Deletes the data older than the retention policy allows. The API key is read from $%s.\n", apiKeyEnv)
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	if fs.NArg() != 0 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	c, ctx, cancel, err := api.client()
+
+	if err != nil {
+		return err
+	}
+
+	defer cancel()
+
+	var tables []client.RetentionTable
+
+	if *dryRun {
+		tables, err = c.RetentionPreview(ctx)
+	} else {
+		tables, err = c.Purge(ctx)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	var rows [][]string
+
+	for _, t := range tables {
+		rows = append(rows, []string{t.Table, t.Before.Format(time.RFC3339), strconv.FormatInt(t.Rows, 10)})
+	}
+	return api.print(tables, []string{"table", "before", "rows"}, rows)
+}
+
+func migrate(args []string) error {
+	fs := flag.NewFlagSet("migrate", flag.ExitOnError)
+	api := addAPIFlags(fs)
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: main migrate [flags]")
+		fmt.Fprintf(fs.Output(), "Applies the pending schema migrations; needs an admin key of the default tenant, read from $%s.\n", apiKeyEnv)
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	if fs.NArg() != 0 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	c, ctx, cancel, err := api.client()
+
+	if err != nil {
+		return err
+	}
+
+	defer cancel()
+
+	applied, err := c.Migrate(ctx)
+
+	if err != nil {
+		return err
+	}
+
+	var rows [][]string
+
+	for _, version := range applied {
+		rows = append(rows, []string{version})
+	}
+
+	fmt.Fprintf(os.Stderr, "migrate: %d applied\n", len(applied))
+	return api.print(applied, []string{"version"}, rows)
+}
+
+func health(args []string) error {
+	fs := flag.NewFlagSet("health", flag.ExitOnError)
+	api := addAPIFlags(fs)
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: main health [flags]")
+		fmt.Fprintln(fs.Output(), "Checks that the service and its database are up; exits with 1 if not.")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	if fs.NArg() != 0 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	c, ctx, cancel, err := api.client()
+
+	if err != nil {
+		return err
+	}
+
+	defer cancel()
+
+	status := "ok"
+
+	if err = c.Health(ctx); err != nil {
+		status = "unavailable"
+	}
+
+	if perr := api.print(map[string]string{"status": status}, []string{"status"}, [][]string{{status}}); perr != nil {
+		return perr
+	}
+	return err
+}
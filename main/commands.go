@@ -0,0 +1,393 @@
+package main
+
+import (
+	"database/sql"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/zwirec/http_service_stat/bulk"
+	"github.com/zwirec/http_service_stat/config"
+	"github.com/zwirec/http_service_stat/dbManager"
+)
+
+// commands are the subcommands of main; without one main runs the service.
+var commands = map[string]func(args []string) error{
+	"import-users":   importUsers,
+	"export-users":   exportUsers,
+	"backfill":       backfill,
+	"create-tenant":  createTenant,
+	"create-api-key": createAPIKey,
+	// The admin commands talk to a running service over its HTTP API.
+	"top":           top,
+	"user-activity": userActivity,
+	"actions":       actions,
+	"purge":         purge,
+	"migrate":       migrate,
+	"health":        health,
+}
+
+func openDB(filename string) (*dbManager.DBManager, error) {
+	dbinfo, err := config.LoadDBInfo(filename)
+
+	if err != nil {
+		return nil, err
+	}
+	return dbManager.NewDBManager(dbinfo)
+}
+
+// openTenantDB returns a DBManager scoped to the tenant id.
+func openTenantDB(filename string, id int) (*dbManager.DBManager, error) {
+	dbm, err := openDB(filename)
+
+	if err != nil {
+		return nil, err
+	}
+
+	tenant, err := dbm.LoadTenant(id)
+
+	if err == sql.ErrNoRows {
+		return nil, fmt.Errorf("there is no tenant %d", id)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+	return dbm.ForTenant(tenant), nil
+}
+
+// formatFlag returns format, or the format of filename if it is empty.
+func formatFlag(format, filename string) (string, error) {
+	if format != "" {
+		return format, nil
+	}
+	return bulk.FormatOf(filename)
+}
+
+func importUsers(args []string) error {
+	fs := flag.NewFlagSet("import-users", flag.ExitOnError)
+	dbConf := fs.String("db-conf", "db_conf.json", "database configuration file")
+	tenant := fs.Int("tenant", 0, "id of the tenant")
+	format := fs.String("format", "", "csv or ndjson (default: from the file extension)")
+	batch := fs.Int("batch", 1000, "users upserted per transaction")
+	errorsFile := fs.String("errors", "", "file listing the rejected rows (default: FILE.rejected.csv)")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: main import-users [flags] FILE")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	if fs.NArg() != 1 || *batch <= 0 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	filename := fs.Arg(0)
+
+	f, err := formatFlag(*format, filename)
+
+	if err != nil {
+		return err
+	}
+
+	in, err := os.Open(filename)
+
+	if err != nil {
+		return err
+	}
+
+	defer in.Close()
+
+	if *errorsFile == "" {
+		*errorsFile = filename + ".rejected.csv"
+	}
+
+	rejected, err := os.Create(*errorsFile)
+
+	if err != nil {
+		return err
+	}
+
+	defer rejected.Close()
+
+	dbm, err := openTenantDB(*dbConf, *tenant)
+
+	if err != nil {
+		return err
+	}
+
+	imp := bulk.UserImporter{DBManager: dbm, BatchSize: *batch, Progress: os.Stderr, Rejected: rejected}
+
+	report, err := imp.Import(in, f)
+
+	fmt.Fprintf(os.Stderr, "import-users: done, %d imported, %d rejected, %d queued events applied", report.Imported, report.Rejected, report.Applied)
+
+	if report.Rejected > 0 {
+		fmt.Fprintf(os.Stderr, " (see %s)", *errorsFile)
+	}
+
+	fmt.Fprintln(os.Stderr)
+	return err
+}
+
+func exportUsers(args []string) error {
+	fs := flag.NewFlagSet("export-users", flag.ExitOnError)
+	dbConf := fs.String("db-conf", "db_conf.json", "database configuration file")
+	tenant := fs.Int("tenant", 0, "id of the tenant")
+	format := fs.String("format", "", "csv or ndjson (default: from the file extension, csv for stdout)")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: main export-users [flags] [FILE]")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	if fs.NArg() > 1 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	var out io.Writer = os.Stdout
+
+	if fs.NArg() == 1 {
+		f, err := formatFlag(*format, fs.Arg(0))
+
+		if err != nil {
+			return err
+		}
+
+		*format = f
+
+		file, err := os.Create(fs.Arg(0))
+
+		if err != nil {
+			return err
+		}
+
+		defer file.Close()
+
+		out = file
+	} else if *format == "" {
+		*format = bulk.FormatCSV
+	}
+
+	dbm, err := openTenantDB(*dbConf, *tenant)
+
+	if err != nil {
+		return err
+	}
+
+	n, err := bulk.ExportUsers(dbm, out, *format)
+
+	fmt.Fprintf(os.Stderr, "export-users: %d exported\n", n)
+	return err
+}
+
+func backfill(args []string) error {
+	fs := flag.NewFlagSet("backfill", flag.ExitOnError)
+	dbConf := fs.String("db-conf", "db_conf.json", "database configuration file")
+	tenant := fs.Int("tenant", 0, "id of the tenant")
+	format := fs.String("format", "", "csv or ndjson (default: from the file extension)")
+	chunk := fs.Int("chunk", 1000, "counters merged per transaction")
+	replace := fs.Bool("replace", false, "replace the stored counters instead of adding to them")
+	checkpoint := fs.String("checkpoint", "", "file the progress is saved to (default: FILE.checkpoint)")
+	restart := fs.Bool("restart", false, "ignore the checkpoint and start over")
+	errorsFile := fs.String("errors", "", "file listing the rejected rows (default: FILE.rejected.csv)")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: main backfill [flags] FILE")
+		fmt.Fprintln(fs.Output(), "FILE has user, action, date and count fields. Hourly stats get each count")
+		fmt.Fprintln(fs.Output(), "in the midnight (UTC) hour of its date.")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	if fs.NArg() != 1 || *chunk <= 0 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	filename := fs.Arg(0)
+
+	f, err := formatFlag(*format, filename)
+
+	if err != nil {
+		return err
+	}
+
+	if *checkpoint == "" {
+		*checkpoint = filename + ".checkpoint"
+	}
+
+	if *errorsFile == "" {
+		*errorsFile = filename + ".rejected.csv"
+	}
+
+	if *restart {
+		if err := os.Remove(*checkpoint); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+
+	in, err := os.Open(filename)
+
+	if err != nil {
+		return err
+	}
+
+	defer in.Close()
+
+	dbm, err := openTenantDB(*dbConf, *tenant)
+
+	if err != nil {
+		return err
+	}
+
+	b := bulk.Backfiller{DBManager: dbm, ChunkSize: *chunk, Replace: *replace, Checkpoint: *checkpoint, Progress: os.Stderr}
+
+	resuming, err := b.Resuming(filename)
+
+	if err != nil {
+		return err
+	}
+
+	flags := os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+
+	if resuming {
+		flags = os.O_WRONLY | os.O_CREATE | os.O_APPEND
+		fmt.Fprintf(os.Stderr, "backfill: resuming from %s\n", *checkpoint)
+	}
+
+	rejected, err := os.OpenFile(*errorsFile, flags, 0666)
+
+	if err != nil {
+		return err
+	}
+
+	defer rejected.Close()
+
+	b.Rejected = rejected
+
+	report, err := b.Run(in, f, filename)
+
+	if err == bulk.ErrBackfillDone {
+		return fmt.Errorf("%s was backfilled already (use -restart to backfill it again)", filename)
+	}
+
+	fmt.Fprintln(os.Stderr, "date        counters  count")
+
+	for _, date := range report.Dates() {
+		total := report.Days[date]
+		fmt.Fprintf(os.Stderr, "%s  %8d  %d\n", date, total.Counters, total.Count)
+	}
+
+	fmt.Fprintf(os.Stderr, "backfill: %d merged, %d rejected", report.Merged, report.Rejected)
+
+	if report.Rejected > 0 {
+		fmt.Fprintf(os.Stderr, " (see %s)", *errorsFile)
+	}
+
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "; run again to resume from %s", *checkpoint)
+	}
+
+	fmt.Fprintln(os.Stderr)
+	return err
+}
+
+func createTenant(args []string) error {
+	fs := flag.NewFlagSet("create-tenant", flag.ExitOnError)
+	dbConf := fs.String("db-conf", "db_conf.json", "database configuration file")
+	actions := fs.String("actions", strings.Join(dbManager.DefaultActions, ","), "comma-separated action catalogue")
+	dailyEvents := fs.Int("daily-events", 0, "events recorded per UTC day (0: no limit)")
+	maxUsers := fs.Int("max-users", 0, "registered users (0: no limit)")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: main create-tenant [flags] NAME")
+		fmt.Fprintln(fs.Output(), "Prints the id of the new tenant and an API key with every scope; the key is not stored.")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	if fs.NArg() != 1 || *dailyEvents < 0 || *maxUsers < 0 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	tenant := &dbManager.Tenant{Name: fs.Arg(0), DailyEvents: *dailyEvents, MaxUsers: *maxUsers}
+
+	for _, action := range strings.Split(*actions, ",") {
+		if action = strings.TrimSpace(action); action != "" {
+			tenant.Actions = append(tenant.Actions, action)
+		}
+	}
+
+	if len(tenant.Actions) == 0 {
+		return fmt.Errorf("a tenant needs at least one action")
+	}
+
+	dbm, err := openDB(*dbConf)
+
+	if err != nil {
+		return err
+	}
+
+	apiKey, key, err := dbm.CreateTenant(tenant)
+
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("tenant %d\napi key %d: %s\n", tenant.ID, apiKey.ID, key)
+	return nil
+}
+
+func createAPIKey(args []string) error {
+	fs := flag.NewFlagSet("create-api-key", flag.ExitOnError)
+	dbConf := fs.String("db-conf", "db_conf.json", "database configuration file")
+	tenant := fs.Int("tenant", 0, "id of the tenant")
+	scopes := fs.String("scopes", strings.Join(dbManager.Scopes, ","), "comma-separated scopes of the key")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: main create-api-key [flags]")
+		fmt.Fprintln(fs.Output(), "Prints the id and the new API key; the key is not stored.")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	if fs.NArg() != 0 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	var list []string
+
+	for _, scope := range strings.Split(*scopes, ",") {
+		if scope = strings.TrimSpace(scope); scope != "" {
+			list = append(list, scope)
+		}
+	}
+
+	for _, scope := range list {
+		if scope != dbManager.ScopeIngest && scope != dbManager.ScopeRead && scope != dbManager.ScopeAdmin {
+			return fmt.Errorf("unknown scope %q (use %s)", scope, strings.Join(dbManager.Scopes, ", "))
+		}
+	}
+
+	if len(list) == 0 {
+		return fmt.Errorf("a key needs at least one scope")
+	}
+
+	dbm, err := openTenantDB(*dbConf, *tenant)
+
+	if err != nil {
+		return err
+	}
+
+	apiKey, key, err := dbm.CreateAPIKey(list)
+
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("api key %d: %s\n", apiKey.ID, key)
+	return nil
+}
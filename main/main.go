@@ -8,6 +8,22 @@ import (
 
 func main() {
 	mainLogger := log.New(os.Stderr, "", log.LstdFlags)
+
+	if len(os.Args) > 1 {
+		command, ok := commands[os.Args[1]]
+
+		if !ok {
+			mainLogger.Printf("unknown command %q", os.Args[1])
+			os.Exit(2)
+		}
+
+		if err := command(os.Args[2:]); err != nil {
+			mainLogger.Println(err)
+			os.Exit(1)
+		}
+		return
+	}
+
 	serv := service.NewService("1234")
 	if err := serv.Run(); err != nil {
 		mainLogger.Println(err)
@@ -0,0 +1,209 @@
+package ratelimit
+
+import (
+	"container/list"
+	"math"
+	"sync"
+	"time"
+)
+
+// maxBuckets is how many clients a Limiter keeps buckets for. Past it the
+// least recently used bucket is dropped, with the full ones, which behave
+// as if they did not exist, used before it.
+const maxBuckets = 10000
+
+type bucket struct {
+	client  string
+	tokens  float64
+	updated time.Time
+}
+
+// Result is the outcome of Limiter.Allow.
+type Result struct {
+	Allowed bool
+	// Limit is the burst of the bucket.
+	Limit int
+	// Remaining is how many requests may be made right away.
+	Remaining int
+	// Reset is how long until the bucket is full again.
+	Reset time.Duration
+	// RetryAfter is how long until the next request is allowed, if this
+	// one was not.
+	RetryAfter time.Duration
+}
+
+// Limiter is a token bucket per client: each holds up to burst tokens and
+// gains rate tokens per second, and a request takes one.
+type Limiter struct {
+	mu      sync.Mutex
+	rate    float64
+	burst   int
+	buckets map[string]*list.Element
+	// lru holds the buckets, the most recently used first.
+	lru *list.List
+	now func() time.Time
+}
+
+func New(rate float64, burst int) *Limiter {
+	return &Limiter{
+		rate:    rate,
+		burst:   burst,
+		buckets: make(map[string]*list.Element),
+		lru:     list.New(),
+		now:     time.Now,
+	}
+}
+
+// SetRate changes the rate and burst, keeping the tokens of the clients.
+func (l *Limiter) SetRate(rate float64, burst int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.rate = rate
+	l.burst = burst
+
+	for _, e := range l.buckets {
+		b := e.Value.(*bucket)
+		b.tokens = math.Min(b.tokens, float64(burst))
+	}
+}
+
+// Allow takes a token from the bucket of client if there is one.
+func (l *Limiter) Allow(client string) Result {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.now()
+
+	var b *bucket
+
+	if e, ok := l.buckets[client]; !ok {
+		if len(l.buckets) >= maxBuckets {
+			l.evict(now)
+		}
+
+		b = &bucket{client: client, tokens: float64(l.burst), updated: now}
+		l.buckets[client] = l.lru.PushFront(b)
+	} else {
+		l.lru.MoveToFront(e)
+
+		b = e.Value.(*bucket)
+		b.tokens = l.refill(b, now)
+		b.updated = now
+	}
+
+	result := Result{Limit: l.burst}
+
+	if b.tokens >= 1 {
+		b.tokens--
+		result.Allowed = true
+	} else {
+		result.RetryAfter = l.wait(1 - b.tokens)
+	}
+
+	result.Remaining = int(b.tokens)
+	result.Reset = l.wait(float64(l.burst) - b.tokens)
+	return result
+}
+
+func (l *Limiter) refill(b *bucket, now time.Time) float64 {
+	return math.Min(float64(l.burst), b.tokens+now.Sub(b.updated).Seconds()*l.rate)
+}
+
+// wait is how long it takes to gain tokens.
+func (l *Limiter) wait(tokens float64) time.Duration {
+	if tokens <= 0 {
+		return 0
+	}
+	return time.Duration(math.Ceil(tokens / l.rate * float64(time.Second)))
+}
+
+// evict drops the least recently used bucket, and then the ones used
+// before the others for as long as they are full.
+func (l *Limiter) evict(now time.Time) {
+	for e := l.lru.Back(); e != nil; e = l.lru.Back() {
+		b := e.Value.(*bucket)
+
+		if len(l.buckets) < maxBuckets && l.refill(b, now) < float64(l.burst) {
+			return
+		}
+
+		l.lru.Remove(e)
+		delete(l.buckets, b.client)
+	}
+}
+
+// Quota counts the events of each client per UTC day.
+type Quota struct {
+	mu    sync.Mutex
+	limit int
+	day   string
+	used  map[string]int
+	now   func() time.Time
+}
+
+// NewQuota returns a quota of limit events per client and day, zero means
+// no limit.
+func NewQuota(limit int) *Quota {
+	return &Quota{
+		limit: limit,
+		used:  make(map[string]int),
+		now:   time.Now,
+	}
+}
+
+// SetLimit changes the limit, keeping what the clients used today.
+func (q *Quota) SetLimit(limit int) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.limit = limit
+}
+
+// Take counts an event of client, unless its quota is used up; then it
+// returns false and how long until the quota is renewed.
+func (q *Quota) Take(client string) (bool, time.Duration) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	now := q.now().UTC()
+	q.rollover(now)
+
+	if q.limit > 0 && q.used[client] >= q.limit {
+		midnight := time.Date(now.Year(), now.Month(), now.Day()+1, 0, 0, 0, 0, time.UTC)
+		return false, midnight.Sub(now)
+	}
+
+	q.used[client]++
+	return true, 0
+}
+
+// Release gives back an event taken for client that was not recorded.
+func (q *Quota) Release(client string) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.rollover(q.now().UTC())
+
+	if q.used[client] > 1 {
+		q.used[client]--
+	} else {
+		delete(q.used, client)
+	}
+}
+
+// Used returns how many events client has recorded today.
+func (q *Quota) Used(client string) int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.rollover(q.now().UTC())
+	return q.used[client]
+}
+
+func (q *Quota) rollover(now time.Time) {
+	if day := now.Format("2006-01-02"); day != q.day {
+		q.day = day
+		q.used = make(map[string]int)
+	}
+}
@@ -0,0 +1,118 @@
+package ratelimit
+
+import (
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestLimiterBurstAndRefill(t *testing.T) {
+	now := time.Date(2012, 2, 2, 0, 0, 0, 0, time.UTC)
+
+	l := New(2, 3)
+	l.now = func() time.Time { return now }
+
+	for i := 0; i < 3; i++ {
+		if r := l.Allow("a"); !r.Allowed || r.Remaining != 2-i {
+			t.Fatalf("request %d of the burst: %+v", i, r)
+		}
+	}
+
+	r := l.Allow("a")
+
+	if r.Allowed || r.RetryAfter != 500*time.Millisecond || r.Reset != 1500*time.Millisecond {
+		t.Fatalf("request over the burst: %+v", r)
+	}
+
+	if !l.Allow("b").Allowed {
+		t.Fatal("clients share a bucket")
+	}
+
+	now = now.Add(500 * time.Millisecond)
+
+	if r = l.Allow("a"); !r.Allowed || r.Remaining != 0 {
+		t.Fatalf("request after refill: %+v", r)
+	}
+}
+
+func TestLimiterSetRate(t *testing.T) {
+	now := time.Date(2012, 2, 2, 0, 0, 0, 0, time.UTC)
+
+	l := New(1, 10)
+	l.now = func() time.Time { return now }
+
+	l.Allow("a")
+	l.SetRate(1, 2)
+
+	if r := l.Allow("a"); !r.Allowed || r.Remaining != 1 || r.Limit != 2 {
+		t.Fatalf("tokens not capped to the new burst: %+v", r)
+	}
+}
+
+func TestLimiterEviction(t *testing.T) {
+	now := time.Date(2012, 2, 2, 0, 0, 0, 0, time.UTC)
+
+	l := New(1, 2)
+	l.now = func() time.Time { return now }
+
+	for i := 0; i < maxBuckets; i++ {
+		l.Allow(strconv.Itoa(i))
+	}
+
+	// Client 0 is used again, so client 1 is the least recently used.
+	l.Allow("0")
+	l.Allow("new")
+
+	if len(l.buckets) != maxBuckets {
+		t.Fatalf("%d buckets kept, want %d", len(l.buckets), maxBuckets)
+	}
+
+	if _, ok := l.buckets["1"]; ok {
+		t.Error("least recently used bucket kept")
+	}
+
+	if r := l.Allow("0"); r.Remaining != 0 {
+		t.Errorf("recently used bucket dropped: %+v", r)
+	}
+
+	// Once full again, the buckets go with the next eviction.
+	now = now.Add(2 * time.Second)
+
+	for i := 0; len(l.buckets) >= maxBuckets; i++ {
+		l.Allow("more" + strconv.Itoa(i))
+	}
+
+	if len(l.buckets) > 3 {
+		t.Errorf("%d buckets kept, full ones not dropped", len(l.buckets))
+	}
+}
+
+func TestQuota(t *testing.T) {
+	now := time.Date(2012, 2, 2, 23, 0, 0, 0, time.UTC)
+
+	q := NewQuota(2)
+	q.now = func() time.Time { return now }
+
+	q.Take("a")
+	q.Take("a")
+
+	if ok, retryAfter := q.Take("a"); ok || retryAfter != time.Hour {
+		t.Fatalf("quota not enforced: %v %v", ok, retryAfter)
+	}
+
+	q.Release("a")
+
+	if ok, _ := q.Take("a"); !ok {
+		t.Fatal("released event still counted")
+	}
+
+	if ok, _ := q.Take("b"); !ok {
+		t.Fatal("clients share a quota")
+	}
+
+	now = now.Add(time.Hour)
+
+	if ok, _ := q.Take("a"); !ok || q.Used("a") != 1 {
+		t.Fatal("quota not renewed at midnight")
+	}
+}
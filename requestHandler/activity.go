@@ -0,0 +1,126 @@
+package requestHandler
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/zwirec/http_service_stat/dbManager"
+)
+
+// activityRow is a daily counter of a user.
+type activityRow struct {
+	Date   string `json:"date"`
+	Action string `json:"action"`
+	Cnt    int64  `json:"cnt"`
+}
+
+// UserActivity returns the daily counters of "user" in [date1, date2).
+func (reqHandler *RequestHandler) UserActivity(w http.ResponseWriter, req *http.Request) {
+	var httpStatus int
+
+	if req.Method == "GET" {
+
+		values, err := url.ParseQuery(req.URL.RawQuery)
+
+		if err != nil {
+			httpStatus = http.StatusBadRequest
+			reqHandler.writeResponse(w, "Incorrect query rows!", httpStatus)
+			reqHandler.logRequest(req, httpStatus)
+			return
+		}
+
+		user, err := validateActivityParams(values)
+
+		if err != nil {
+			httpStatus = http.StatusBadRequest
+			reqHandler.writeResponse(w, err.Error(), httpStatus)
+			reqHandler.logRequest(req, httpStatus)
+			return
+		}
+
+		activity, err := reqHandler.userActivity(tenantOf(req), user, values.Get("date1"), values.Get("date2"))
+
+		if err != nil {
+			httpStatus = http.StatusInternalServerError
+			reqHandler.writeResponse(w, nil, httpStatus)
+			reqHandler.logger.Println(err)
+			reqHandler.logRequest(req, httpStatus)
+			return
+		}
+
+		data, _ := json.Marshal(map[string]interface{}{"user": user, "activity": activity})
+
+		httpStatus = http.StatusOK
+		reqHandler.writeResponse(w, string(data)+"\n", httpStatus)
+		reqHandler.logRequest(req, httpStatus)
+	} else {
+		httpStatus = http.StatusMethodNotAllowed
+		reqHandler.writeResponse(w, nil, httpStatus)
+		reqHandler.logRequest(req, httpStatus)
+	}
+}
+
+// validateActivityParams checks the parameters of GET /api/users/activity,
+// and of the UserActivity RPC, and returns the user.
+func validateActivityParams(values url.Values) (int64, error) {
+	user, err := strconv.ParseInt(values.Get("user"), 10, 64)
+
+	if err != nil || user <= 0 {
+		return 0, errors.New(`Missing or invalid "user" (use the id of a user)`)
+	}
+	return user, validateDateRange(values)
+}
+
+// userActivity reads the daily counters of user in [date1, date2).
+func (reqHandler *RequestHandler) userActivity(tenant *dbManager.Tenant, user int64, date1, date2 string) ([]activityRow, error) {
+	rows, err := reqHandler.DBManager.ForTenant(tenant).UserActivity(user, date1, date2)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	activity := []activityRow{}
+
+	for rows.Next() {
+		var date time.Time
+		var row activityRow
+
+		if err = rows.Scan(&date, &row.Action, &row.Cnt); err != nil {
+			return nil, err
+		}
+
+		row.Date = date.Format(layout)
+		activity = append(activity, row)
+	}
+	return activity, rows.Err()
+}
+
+// Actions returns the action catalogue of the tenant.
+func (reqHandler *RequestHandler) Actions(w http.ResponseWriter, req *http.Request) {
+	var httpStatus int
+
+	if req.Method == "GET" {
+
+		actions := tenantOf(req).Actions
+
+		if actions == nil {
+			actions = []string{}
+		}
+
+		data, _ := json.Marshal(map[string]interface{}{"actions": actions})
+
+		httpStatus = http.StatusOK
+		reqHandler.writeResponse(w, string(data)+"\n", httpStatus)
+		reqHandler.logRequest(req, httpStatus)
+	} else {
+		httpStatus = http.StatusMethodNotAllowed
+		reqHandler.writeResponse(w, nil, httpStatus)
+		reqHandler.logRequest(req, httpStatus)
+	}
+}
@@ -0,0 +1,170 @@
+package requestHandler
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/zwirec/http_service_stat/dbManager"
+)
+
+func TestUserActivity(t *testing.T) {
+	db, mock, err := sqlmock.New()
+
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	dbm := dbManager.DBManager{DB: db}
+
+	rH := RequestHandler{DBManager: &dbm, logger: log.New(os.Stdout, "", log.LstdFlags)}
+
+	handler := http.HandlerFunc(rH.UserActivity)
+
+	for _, query := range []string{"", "user=x&date1=2012-02-02&date2=2012-02-04", "user=2&date1=2012-02-04&date2=2012-02-02"} {
+		rr := httptest.NewRecorder()
+
+		handler.ServeHTTP(rr, httptest.NewRequest("GET", "/api/users/activity?"+query, nil))
+
+		if status := rr.Code; status != http.StatusBadRequest {
+			t.Errorf("handler returned wrong status code for %q: got %v want %v",
+				query, status, http.StatusBadRequest)
+		}
+	}
+
+	day1 := time.Date(2012, 2, 2, 0, 0, 0, 0, time.UTC)
+
+	mock.ExpectQuery("FROM stats").WithArgs(int64(2), "2012-02-02", "2012-02-04", 0).WillReturnRows(
+		sqlmock.NewRows([]string{"date", "action", "cnt"}).AddRow(day1, "like", 3).AddRow(day1.AddDate(0, 0, 1), "login", 1))
+
+	rr := httptest.NewRecorder()
+
+	handler.ServeHTTP(rr, httptest.NewRequest("GET", "/api/users/activity?user=2&date1=2012-02-02&date2=2012-02-04", nil))
+
+	want := `{"activity":[{"date":"2012-02-02","action":"like","cnt":3},{"date":"2012-02-03","action":"login","cnt":1}],"user":2}` + "\n"
+
+	if rr.Code != http.StatusOK || rr.Body.String() != want {
+		t.Errorf("handler returned %d %q", rr.Code, rr.Body.String())
+	}
+
+	mock.ExpectQuery("FROM stats").WithArgs(int64(5), "2012-02-02", "2012-02-04", 0).WillReturnRows(
+		sqlmock.NewRows([]string{"date", "action", "cnt"}))
+
+	rr = httptest.NewRecorder()
+
+	handler.ServeHTTP(rr, httptest.NewRequest("GET", "/api/users/activity?user=5&date1=2012-02-02&date2=2012-02-04", nil))
+
+	if want = `{"activity":[],"user":5}` + "\n"; rr.Code != http.StatusOK || rr.Body.String() != want {
+		t.Errorf("handler returned %d %q", rr.Code, rr.Body.String())
+	}
+
+	mock.ExpectQuery("FROM stats").WillReturnError(fmt.Errorf("connection reset"))
+
+	rr = httptest.NewRecorder()
+
+	handler.ServeHTTP(rr, httptest.NewRequest("GET", "/api/users/activity?user=2&date1=2012-02-02&date2=2012-02-04", nil))
+
+	if status := rr.Code; status != http.StatusInternalServerError {
+		t.Errorf("handler returned wrong status code: got %v want %v", status, http.StatusInternalServerError)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatalf("there were unfulfilled expections: %s", err)
+	}
+}
+
+func TestActions(t *testing.T) {
+	rH := RequestHandler{logger: log.New(os.Stdout, "", log.LstdFlags)}
+
+	tenant := &dbManager.Tenant{ID: 3, Name: "shop", Actions: []string{"like", "purchase"}}
+
+	req := httptest.NewRequest("GET", "/api/actions", nil)
+	req = req.WithContext(context.WithValue(req.Context(), credentialsContextKey{}, &credentials{tenant: tenant}))
+
+	rr := httptest.NewRecorder()
+
+	rH.Actions(rr, req)
+
+	if want := `{"actions":["like","purchase"]}` + "\n"; rr.Code != http.StatusOK || rr.Body.String() != want {
+		t.Errorf("handler returned %d %q", rr.Code, rr.Body.String())
+	}
+}
+
+func TestMigrations(t *testing.T) {
+	db, mock, err := sqlmock.New()
+
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	dbm := dbManager.DBManager{DB: db}
+
+	rH := RequestHandler{DBManager: &dbm, logger: log.New(os.Stdout, "", log.LstdFlags)}
+
+	// Other tenants share the schema but may not change it.
+	req := httptest.NewRequest("POST", "/api/admin/migrations", nil)
+	req = req.WithContext(context.WithValue(req.Context(), credentialsContextKey{}, &credentials{tenant: &dbManager.Tenant{ID: 3}}))
+
+	rr := httptest.NewRecorder()
+
+	rH.Migrations(rr, req)
+
+	if status := rr.Code; status != http.StatusForbidden {
+		t.Errorf("handler returned wrong status code: got %v want %v", status, http.StatusForbidden)
+	}
+
+	mock.ExpectExec("CREATE TABLE IF NOT EXISTS schema_migrations").WillReturnError(fmt.Errorf("permission denied"))
+
+	rr = httptest.NewRecorder()
+
+	rH.Migrations(rr, httptest.NewRequest("POST", "/api/admin/migrations", nil))
+
+	if status := rr.Code; status != http.StatusInternalServerError {
+		t.Errorf("handler returned wrong status code: got %v want %v", status, http.StatusInternalServerError)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatalf("there were unfulfilled expections: %s", err)
+	}
+}
+
+func TestHealth(t *testing.T) {
+	db, mock, err := sqlmock.New(sqlmock.MonitorPingsOption(true))
+
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	dbm := dbManager.DBManager{DB: db}
+
+	rH := RequestHandler{DBManager: &dbm, logger: log.New(os.Stdout, "", log.LstdFlags)}
+
+	mock.ExpectPing()
+	mock.ExpectPing().WillReturnError(fmt.Errorf("connection refused"))
+
+	for _, want := range []struct {
+		status int
+		body   string
+	}{
+		{http.StatusOK, `{"status":"ok"}` + "\n"},
+		{http.StatusServiceUnavailable, `{"status":"unavailable"}` + "\n"},
+	} {
+		rr := httptest.NewRecorder()
+
+		rH.Health(rr, httptest.NewRequest("GET", "/health", nil))
+
+		if rr.Code != want.status || rr.Body.String() != want.body {
+			t.Errorf("handler returned %d %q, want %d %q", rr.Code, rr.Body.String(), want.status, want.body)
+		}
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatalf("there were unfulfilled expections: %s", err)
+	}
+}
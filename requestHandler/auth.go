@@ -0,0 +1,282 @@
+package requestHandler
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/zwirec/http_service_stat/dbManager"
+)
+
+const (
+	// apiKeyHeader carries the API key, as does "Authorization: Bearer".
+	apiKeyHeader = "X-API-Key"
+	// credentialsTTL is how long an authenticated key is trusted without
+	// asking the database again.
+	credentialsTTL = time.Minute
+	// unknownKeyTTL is how long a key the database does not know is
+	// refused without asking it again.
+	unknownKeyTTL = 10 * time.Second
+	// maxUnknownKeys bounds the unknown keys kept, which clients choose.
+	maxUnknownKeys = 10000
+)
+
+// errMissingAPIKey is returned for requests without a key if one is required.
+var errMissingAPIKey = errors.New("API key required")
+
+type credentialsContextKey struct{}
+
+// credentials are what a request is authorized by.
+type credentials struct {
+	tenant *dbManager.Tenant
+	// key is nil for requests without a key.
+	key     *dbManager.APIKey
+	expires time.Time
+}
+
+// allows reports whether the credentials grant scope. Requests without a
+// key are only let in if keys are not required, and then get the ingest and
+// read scopes; the admin scope always takes a key.
+func (c *credentials) allows(scope string) bool {
+	if c.key == nil {
+		return scope != dbManager.ScopeAdmin
+	}
+	return c.key.HasScope(scope)
+}
+
+// defaultTenant is used for requests that did not go through authorize.
+var defaultTenant = &dbManager.Tenant{Name: "default", Actions: dbManager.DefaultActions}
+
+// credentialsCache keeps the credentials of recently seen API keys, and
+// the keys found unknown, by key hash; keys themselves are never kept.
+type credentialsCache struct {
+	mu      sync.Mutex
+	entries map[string]*credentials
+	// unknown are the expiries of the unknown keys.
+	unknown map[string]time.Time
+}
+
+func (c *credentialsCache) get(hash string, now time.Time) (*credentials, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	creds, ok := c.entries[hash]
+
+	if !ok || !now.Before(creds.expires) {
+		return nil, false
+	}
+	return creds, true
+}
+
+func (c *credentialsCache) put(hash string, creds *credentials) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.entries == nil {
+		c.entries = make(map[string]*credentials)
+	}
+	c.entries[hash] = creds
+}
+
+// isUnknown reports whether hash was found unknown less than
+// unknownKeyTTL ago.
+func (c *credentialsCache) isUnknown(hash string, now time.Time) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	expires, ok := c.unknown[hash]
+	return ok && now.Before(expires)
+}
+
+// putUnknown keeps hash as unknown. When maxUnknownKeys are kept the
+// expired ones are dropped, or all of them if none has expired.
+func (c *credentialsCache) putUnknown(hash string, now time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if len(c.unknown) >= maxUnknownKeys {
+		for h, expires := range c.unknown {
+			if !now.Before(expires) {
+				delete(c.unknown, h)
+			}
+		}
+
+		if len(c.unknown) >= maxUnknownKeys {
+			c.unknown = nil
+		}
+	}
+
+	if c.unknown == nil {
+		c.unknown = make(map[string]time.Time)
+	}
+	c.unknown[hash] = now.Add(unknownKeyTTL)
+}
+
+// forget drops the credentials of a key that has been revoked or rotated.
+func (c *credentialsCache) forget(hash string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	delete(c.entries, hash)
+}
+
+// clear drops all credentials, so tenants are read again.
+func (c *credentialsCache) clear() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.entries = nil
+	c.unknown = nil
+}
+
+// apiKeyOf returns the API key of a request, if any.
+func apiKeyOf(req *http.Request) string {
+	if key := req.Header.Get(apiKeyHeader); key != "" {
+		return key
+	}
+
+	if auth := req.Header.Get("Authorization"); len(auth) > 7 && strings.EqualFold(auth[:7], "Bearer ") {
+		return strings.TrimSpace(auth[7:])
+	}
+	return ""
+}
+
+// authenticate returns the credentials of key, or of the default tenant if
+// key is empty and keys are not required.
+func (reqHandler *RequestHandler) authenticate(key string) (*credentials, error) {
+	if key == "" && reqHandler.requireAPIKey {
+		return nil, errMissingAPIKey
+	}
+
+	hash := ""
+
+	if key != "" {
+		hash = dbManager.HashAPIKey(key)
+	}
+
+	now := time.Now()
+
+	if creds, ok := reqHandler.credentials.get(hash, now); ok {
+		return creds, nil
+	}
+
+	if key != "" && reqHandler.credentials.isUnknown(hash, now) {
+		return nil, dbManager.ErrUnknownAPIKey
+	}
+
+	creds := &credentials{expires: now.Add(credentialsTTL)}
+	tenantID := 0
+
+	if key != "" {
+		apiKey, err := reqHandler.DBManager.Authenticate(key)
+
+		if err == dbManager.ErrUnknownAPIKey {
+			reqHandler.credentials.putUnknown(hash, now)
+		}
+
+		if err != nil {
+			return nil, err
+		}
+
+		if apiKey.ExpiresAt.Valid && apiKey.ExpiresAt.Time.Before(creds.expires) {
+			creds.expires = apiKey.ExpiresAt.Time
+		}
+
+		creds.key = apiKey
+		tenantID = apiKey.TenantID
+	}
+
+	tenant, err := reqHandler.DBManager.LoadTenant(tenantID)
+
+	if err != nil {
+		return nil, err
+	}
+
+	creds.tenant = tenant
+	reqHandler.credentials.put(hash, creds)
+	return creds, nil
+}
+
+// authorize lets requests whose API key grants scope through to h, with
+// their tenant in the request context, and answers the others with a JSON
+// error.
+func (reqHandler *RequestHandler) authorize(scope string, h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		var httpStatus int
+
+		creds, err := reqHandler.authenticate(apiKeyOf(req))
+
+		if err == errMissingAPIKey || err == dbManager.ErrUnknownAPIKey {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="service_stat"`)
+
+			httpStatus = http.StatusUnauthorized
+
+			if err == errMissingAPIKey {
+				reqHandler.writeError(w, "API key required", httpStatus)
+			} else {
+				reqHandler.writeError(w, "Invalid, expired or revoked API key", httpStatus)
+			}
+
+			reqHandler.logRequest(req, httpStatus)
+			return
+		}
+
+		if err != nil {
+			httpStatus = http.StatusInternalServerError
+			reqHandler.writeResponse(w, nil, httpStatus)
+			reqHandler.logger.Println(err)
+			reqHandler.logRequest(req, httpStatus)
+			return
+		}
+
+		if !creds.allows(scope) && creds.key == nil {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="service_stat"`)
+
+			httpStatus = http.StatusUnauthorized
+			reqHandler.writeError(w, `API key with the "`+scope+`" scope required`, httpStatus)
+			reqHandler.logRequest(req, httpStatus)
+			return
+		}
+
+		if !creds.allows(scope) {
+			httpStatus = http.StatusForbidden
+			reqHandler.writeError(w, `API key lacks the "`+scope+`" scope`, httpStatus)
+			reqHandler.logRequest(req, httpStatus, fmt.Sprintf("key %d", creds.key.ID))
+			return
+		}
+
+		h(w, req.WithContext(context.WithValue(req.Context(), credentialsContextKey{}, creds)))
+	}
+}
+
+// writeError writes {"error": message}.
+func (reqHandler *RequestHandler) writeError(w http.ResponseWriter, message string, status int) {
+	data, _ := json.Marshal(map[string]string{"error": message})
+
+	w.Header().Set("Content-Type", "application/json")
+	reqHandler.writeResponse(w, string(data)+"\n", status)
+}
+
+// tenantOf returns the tenant a request was made for.
+func tenantOf(req *http.Request) *dbManager.Tenant {
+	return tenantFrom(req.Context())
+}
+
+// tenantFrom returns the tenant of the credentials in ctx.
+func tenantFrom(ctx context.Context) *dbManager.Tenant {
+	if creds, ok := ctx.Value(credentialsContextKey{}).(*credentials); ok {
+		return creds.tenant
+	}
+	return defaultTenant
+}
+
+// dedupKey is the key of eventID of tenant in the in-memory dedup cache.
+func dedupKey(tenant *dbManager.Tenant, eventID string) string {
+	return strconv.Itoa(tenant.ID) + ":" + eventID
+}
@@ -0,0 +1,300 @@
+package requestHandler
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	formatJSON   = "json"
+	formatCSV    = "csv"
+	formatNDJSON = "ndjson"
+
+	// maxBufferedBody bounds the part of a response held in memory.
+	maxBufferedBody = 1 << 20
+	// spillWriteTimeout bounds each write of a streamed response. It
+	// replaces the write timeout of the server, which long exports outlast.
+	spillWriteTimeout = 30 * time.Second
+)
+
+var contentTypes = map[string]string{
+	formatJSON:   "application/json",
+	formatCSV:    "text/csv; charset=utf-8",
+	formatNDJSON: "application/x-ndjson",
+}
+
+// negotiateFormat picks the GetStat output format from the "format"
+// parameter or else from the Accept header. JSON is the default.
+func negotiateFormat(req *http.Request, params url.Values) (string, error) {
+	if format := params.Get("format"); format != "" {
+		if _, ok := contentTypes[format]; !ok {
+			return "", fmt.Errorf(`Incorrect "format" (use "json", "csv" or "ndjson")`)
+		}
+		return format, nil
+	}
+
+	for _, accepted := range strings.Split(req.Header.Get("Accept"), ",") {
+		mediaType, _, err := mime.ParseMediaType(strings.TrimSpace(accepted))
+
+		if err != nil {
+			continue
+		}
+
+		switch mediaType {
+		case "application/json":
+			return formatJSON, nil
+		case "text/csv":
+			return formatCSV, nil
+		case "application/x-ndjson", "application/ndjson":
+			return formatNDJSON, nil
+		}
+	}
+	return formatJSON, nil
+}
+
+// statRow is a row returned by DBManager.GetStats.
+type statRow struct {
+	Date time.Time
+	ID   int64
+	Age  sql.NullInt64
+	Sex  sql.NullString
+	Cnt  int64
+}
+
+func scanStatRow(rows *sql.Rows) (statRow, error) {
+	var r statRow
+	err := rows.Scan(&r.Date, &r.ID, &r.Age, &r.Sex, &r.Cnt)
+	return r, err
+}
+
+// rowEncoder writes rows as they are read from the database.
+type rowEncoder interface {
+	Row(r statRow) error
+	// End finishes the output; err is the error that stopped the rows, if any.
+	End(err error) error
+}
+
+func newRowEncoder(format string, w io.Writer, loc *time.Location, dateLayout string) rowEncoder {
+	switch format {
+	case formatCSV:
+		cw := csv.NewWriter(w)
+		cw.Write([]string{"date", "id", "age", "sex", "cnt"})
+		return &csvEncoder{w: cw, loc: loc, layout: dateLayout}
+	case formatNDJSON:
+		return &ndjsonEncoder{enc: json.NewEncoder(w), loc: loc, layout: dateLayout}
+	}
+	io.WriteString(w, `{"items":[`)
+	return &jsonEncoder{w: w, loc: loc, layout: dateLayout}
+}
+
+// jsonEncoder writes {"items": [{"date": ..., "rows": [...]}, ...]}, one
+// item per bucket. It relies on the rows being ordered by date.
+type jsonEncoder struct {
+	w      io.Writer
+	loc    *time.Location
+	layout string
+	date   string
+}
+
+func (e *jsonEncoder) Row(r statRow) error {
+	row := map[string]interface{}{
+		"date": r.Date,
+		"id":   r.ID,
+		"age":  nil,
+		"sex":  nil,
+		"cnt":  r.Cnt,
+	}
+
+	if r.Age.Valid {
+		row["age"] = r.Age.Int64
+	}
+
+	if r.Sex.Valid {
+		row["sex"] = r.Sex.String
+	}
+
+	data, err := json.Marshal(row)
+
+	if err != nil {
+		return err
+	}
+
+	var prefix string
+
+	if date := r.Date.In(e.loc).Format(e.layout); date != e.date {
+		if e.date != "" {
+			prefix = "]},"
+		}
+
+		key, _ := json.Marshal(date)
+		prefix += `{"date":` + string(key) + `,"rows":[`
+		e.date = date
+	} else {
+		prefix = ","
+	}
+
+	if _, err = io.WriteString(e.w, prefix); err != nil {
+		return err
+	}
+
+	_, err = e.w.Write(data)
+	return err
+}
+
+// End closes the document. A failure is reported in an "error" member next
+// to the items read so far.
+func (e *jsonEncoder) End(err error) error {
+	tail := "]"
+
+	if e.date != "" {
+		tail = "]}]"
+	}
+
+	if err != nil {
+		tail += `,"error":"stats could not be read to the end"`
+	}
+
+	_, werr := io.WriteString(e.w, tail+"}\n")
+	return werr
+}
+
+type csvEncoder struct {
+	w      *csv.Writer
+	loc    *time.Location
+	layout string
+}
+
+func (e *csvEncoder) Row(r statRow) error {
+	var age, sex string
+
+	if r.Age.Valid {
+		age = strconv.FormatInt(r.Age.Int64, 10)
+	}
+
+	if r.Sex.Valid {
+		sex = r.Sex.String
+	}
+
+	return e.w.Write([]string{
+		r.Date.In(e.loc).Format(e.layout),
+		strconv.FormatInt(r.ID, 10),
+		age,
+		sex,
+		strconv.FormatInt(r.Cnt, 10),
+	})
+}
+
+// End flushes the rows; CSV has no way to report a failure in the output.
+func (e *csvEncoder) End(err error) error {
+	e.w.Flush()
+	return e.w.Error()
+}
+
+type ndjsonEncoder struct {
+	enc    *json.Encoder
+	loc    *time.Location
+	layout string
+}
+
+func (e *ndjsonEncoder) Row(r statRow) error {
+	line := map[string]interface{}{
+		"date": r.Date.In(e.loc).Format(e.layout),
+		"id":   r.ID,
+		"age":  nil,
+		"sex":  nil,
+		"cnt":  r.Cnt,
+	}
+
+	if r.Age.Valid {
+		line["age"] = r.Age.Int64
+	}
+
+	if r.Sex.Valid {
+		line["sex"] = r.Sex.String
+	}
+
+	return e.enc.Encode(line)
+}
+
+// End reports a failure as a last line so that clients can tell a
+// truncated export from a complete one.
+func (e *ndjsonEncoder) End(err error) error {
+	if err != nil {
+		return e.enc.Encode(map[string]interface{}{"error": "stats could not be read to the end"})
+	}
+	return nil
+}
+
+// encodeRows writes rows through enc until they are exhausted.
+func encodeRows(rows *sql.Rows, enc rowEncoder) error {
+	for rows.Next() {
+		r, err := scanStatRow(rows)
+
+		if err != nil {
+			enc.End(err)
+			return err
+		}
+
+		if err = enc.Row(r); err != nil {
+			return err
+		}
+	}
+
+	err := rows.Err()
+
+	if endErr := enc.End(err); err == nil {
+		err = endErr
+	}
+	return err
+}
+
+// spillWriter buffers a response up to max bytes so that it can be
+// cached and tagged once complete. Past that it writes the buffer out and
+// streams the rest, keeping memory bounded.
+type spillWriter struct {
+	w           http.ResponseWriter
+	rc          *http.ResponseController
+	contentType string
+	buf         bytes.Buffer
+	max         int
+	spilled     bool
+}
+
+func (s *spillWriter) Write(p []byte) (int, error) {
+	if !s.spilled && s.buf.Len()+len(p) <= s.max {
+		return s.buf.Write(p)
+	}
+
+	s.rc.SetWriteDeadline(time.Now().Add(spillWriteTimeout))
+
+	if !s.spilled {
+		s.spilled = true
+		s.w.Header().Set("Content-Type", s.contentType)
+
+		if _, err := s.w.Write(s.buf.Bytes()); err != nil {
+			return 0, err
+		}
+		s.buf = bytes.Buffer{}
+	}
+	return s.w.Write(p)
+}
+
+// Spilled reports whether the response has been partly written out.
+func (s *spillWriter) Spilled() bool {
+	return s.spilled
+}
+
+// Bytes returns the buffered response if it has not spilled.
+func (s *spillWriter) Bytes() []byte {
+	return s.buf.Bytes()
+}
@@ -0,0 +1,425 @@
+package requestHandler
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/zwirec/http_service_stat/dbManager"
+	"github.com/zwirec/http_service_stat/statspb"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/encoding"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+)
+
+// The gRPC API is the service_stat.Stats service of
+// statspb/service_stat.proto. Its messages are protocol buffers; clients may
+// send them as JSON instead with grpc.CallContentSubtype(GRPCJSONCodec).
+// API keys go in the "x-api-key" or "authorization" (Bearer) metadata.
+const (
+	GRPCService = "service_stat.Stats"
+	// GRPCJSONCodec is the content subtype of the JSON encoding of the
+	// messages.
+	GRPCJSONCodec = "json"
+)
+
+func init() {
+	encoding.RegisterCodec(jsonCodec{})
+}
+
+// jsonCodec encodes the messages as the JSON mapping of protocol buffers,
+// with the field names of the .proto.
+type jsonCodec struct{}
+
+func (jsonCodec) Marshal(v interface{}) ([]byte, error) {
+	m, ok := v.(proto.Message)
+
+	if !ok {
+		return nil, fmt.Errorf("%T is not a protocol buffer message", v)
+	}
+	return protojson.MarshalOptions{UseProtoNames: true}.Marshal(m)
+}
+
+func (jsonCodec) Unmarshal(data []byte, v interface{}) error {
+	m, ok := v.(proto.Message)
+
+	if !ok {
+		return fmt.Errorf("%T is not a protocol buffer message", v)
+	}
+	return protojson.Unmarshal(data, m)
+}
+
+func (jsonCodec) Name() string {
+	return GRPCJSONCodec
+}
+
+// grpcScopes are the API key scopes the methods need.
+var grpcScopes = map[string]string{
+	statspb.Stats_RegisterUser_FullMethodName: dbManager.ScopeIngest,
+	statspb.Stats_AddStat_FullMethodName:      dbManager.ScopeIngest,
+	statspb.Stats_AddStats_FullMethodName:     dbManager.ScopeIngest,
+	statspb.Stats_GetTopStats_FullMethodName:  dbManager.ScopeRead,
+	statspb.Stats_UserActivity_FullMethodName: dbManager.ScopeRead,
+	statspb.Stats_Actions_FullMethodName:      dbManager.ScopeRead,
+}
+
+// statsServer is the statspb.StatsServer of a RequestHandler.
+type statsServer struct {
+	statspb.UnimplementedStatsServer
+
+	reqHandler *RequestHandler
+}
+
+func (s statsServer) RegisterUser(ctx context.Context, req *statspb.RegisterUserRequest) (*statspb.RegisterUserResponse, error) {
+	return s.reqHandler.grpcRegisterUser(ctx, req)
+}
+
+func (s statsServer) AddStat(ctx context.Context, req *statspb.AddStatRequest) (*statspb.AddStatResponse, error) {
+	return s.reqHandler.grpcAddStat(ctx, req)
+}
+
+func (s statsServer) AddStats(stream grpc.ClientStreamingServer[statspb.AddStatRequest, statspb.AddStatsResponse]) error {
+	return s.reqHandler.grpcAddStats(stream)
+}
+
+func (s statsServer) GetTopStats(req *statspb.GetTopStatsRequest, stream grpc.ServerStreamingServer[statspb.StatRow]) error {
+	return s.reqHandler.grpcGetTopStats(req, stream)
+}
+
+func (s statsServer) UserActivity(ctx context.Context, req *statspb.UserActivityRequest) (*statspb.UserActivityResponse, error) {
+	return s.reqHandler.grpcUserActivity(ctx, req)
+}
+
+func (s statsServer) Actions(ctx context.Context, req *statspb.ActionsRequest) (*statspb.ActionsResponse, error) {
+	return &statspb.ActionsResponse{Actions: tenantFrom(ctx).Actions}, nil
+}
+
+// NewGRPCServer returns a gRPC server of the API, sharing the validation,
+// authentication, rate limits and storage of the HTTP one.
+func (reqHandler *RequestHandler) NewGRPCServer(opts ...grpc.ServerOption) *grpc.Server {
+	opts = append(opts,
+		grpc.ChainUnaryInterceptor(func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+			method, _ := grpc.Method(ctx)
+
+			ctx, err := reqHandler.grpcAuthorize(ctx, method)
+
+			var resp interface{}
+
+			if err == nil {
+				resp, err = handler(ctx, req)
+			}
+
+			reqHandler.logCall(ctx, method, err)
+			return resp, err
+		}),
+		grpc.ChainStreamInterceptor(func(srv interface{}, stream grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+			ctx, err := reqHandler.grpcAuthorize(stream.Context(), info.FullMethod)
+
+			if err == nil {
+				err = handler(srv, &authorizedStream{ServerStream: stream, ctx: ctx})
+			}
+
+			reqHandler.logCall(ctx, info.FullMethod, err)
+			return err
+		}),
+	)
+
+	s := grpc.NewServer(opts...)
+	statspb.RegisterStatsServer(s, statsServer{reqHandler: reqHandler})
+	return s
+}
+
+// authorizedStream carries the credentials of a stream in its context.
+type authorizedStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s *authorizedStream) Context() context.Context {
+	return s.ctx
+}
+
+// grpcAuthorize is rateLimit and authorize for gRPC: it returns ctx with
+// the credentials of the call if its client has tokens left and they grant
+// the scope of method.
+func (reqHandler *RequestHandler) grpcAuthorize(ctx context.Context, method string) (context.Context, error) {
+	md, _ := metadata.FromIncomingContext(ctx)
+
+	key := ""
+
+	if keys := md.Get(strings.ToLower(apiKeyHeader)); len(keys) > 0 {
+		key = keys[0]
+	} else if auth := md.Get("authorization"); len(auth) > 0 && len(auth[0]) > 7 && strings.EqualFold(auth[0][:7], "Bearer ") {
+		key = strings.TrimSpace(auth[0][7:])
+	}
+
+	if l := reqHandler.limiter(method); l != nil {
+		result := l.Allow(reqHandler.rateClient(key, peerAddr(ctx)))
+
+		md := metadata.Pairs(
+			"ratelimit-limit", strconv.Itoa(result.Limit),
+			"ratelimit-remaining", strconv.Itoa(result.Remaining),
+			"ratelimit-reset", seconds(result.Reset))
+
+		if !result.Allowed {
+			md.Set("retry-after", seconds(result.RetryAfter))
+			grpc.SetTrailer(ctx, md)
+			return ctx, status.Error(codes.ResourceExhausted, "Rate limit exceeded")
+		}
+
+		grpc.SetHeader(ctx, md)
+	}
+
+	creds, err := reqHandler.authenticate(key)
+
+	if err == errMissingAPIKey {
+		return ctx, status.Error(codes.Unauthenticated, "API key required")
+	}
+
+	if err == dbManager.ErrUnknownAPIKey {
+		return ctx, status.Error(codes.Unauthenticated, "Invalid, expired or revoked API key")
+	}
+
+	if err != nil {
+		reqHandler.logger.Println(err)
+		return ctx, status.Error(codes.Internal, "Internal error")
+	}
+
+	scope, ok := grpcScopes[method]
+
+	if !ok || !creds.allows(scope) {
+		return ctx, status.Errorf(codes.PermissionDenied, `API key lacks the "%s" scope`, scope)
+	}
+
+	return context.WithValue(ctx, credentialsContextKey{}, creds), nil
+}
+
+func peerAddr(ctx context.Context) string {
+	if p, ok := peer.FromContext(ctx); ok {
+		return p.Addr.String()
+	}
+	return ""
+}
+
+// logCall writes the request log line of a gRPC call.
+func (reqHandler *RequestHandler) logCall(ctx context.Context, method string, err error) {
+	if atomic.LoadInt32(&reqHandler.quiet) == 1 {
+		return
+	}
+	reqHandler.logger.Printf(`%s "GRPC %s" %s`, peerAddr(ctx), method, status.Code(err))
+}
+
+func (reqHandler *RequestHandler) grpcRegisterUser(ctx context.Context, req *statspb.RegisterUserRequest) (*statspb.RegisterUserResponse, error) {
+	values := map[string]interface{}{"id": req.Id, "age": req.Age, "sex": req.Sex}
+
+	if err := validatePOSTregisterParams(values); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	err := reqHandler.registerUser(tenantFrom(ctx), values)
+
+	if err == dbManager.ErrQuotaExceeded {
+		return nil, status.Error(codes.ResourceExhausted, "Quota of the tenant exceeded")
+	}
+
+	if err != nil {
+		reqHandler.logger.Println(err)
+		return nil, status.Error(codes.Internal, "Internal error")
+	}
+	return &statspb.RegisterUserResponse{}, nil
+}
+
+func (reqHandler *RequestHandler) grpcAddStat(ctx context.Context, req *statspb.AddStatRequest) (*statspb.AddStatResponse, error) {
+	values := map[string]interface{}{"user": req.User, "action": req.Action, "ts": req.Ts}
+
+	if req.EventId != "" {
+		values["event_id"] = req.EventId
+	}
+
+	tenant := tenantFrom(ctx)
+
+	if err := validatePOSTaddStatParams(values, tenant); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	client := clientFrom(ctx, peerAddr(ctx))
+
+	if reqHandler.eventQuota != nil {
+		if ok, retryAfter := reqHandler.eventQuota.Take(client); !ok {
+			grpc.SetTrailer(ctx, metadata.Pairs("retry-after", seconds(retryAfter)))
+			return nil, status.Error(codes.ResourceExhausted, "Daily event quota exceeded")
+		}
+	}
+
+	response, err := reqHandler.recordEvent(tenant, values)
+
+	resp := &statspb.AddStatResponse{}
+
+	if err == nil {
+		resp.Applied = response["applied"] == true
+		resp.Queued = response["queued"] != nil
+		resp.UserCreated = response["user_created"] != nil
+	}
+
+	if !resp.Applied && !resp.Queued && reqHandler.eventQuota != nil {
+		reqHandler.eventQuota.Release(client)
+	}
+
+	if err == dbManager.ErrUnknownUser {
+		return nil, status.Errorf(codes.FailedPrecondition, "Unknown user %d (register it first)", req.User)
+	}
+
+	if err == dbManager.ErrQuotaExceeded {
+		return nil, status.Error(codes.ResourceExhausted, "Quota of the tenant exceeded")
+	}
+
+	if err != nil {
+		reqHandler.logger.Println(err)
+		return nil, status.Error(codes.Internal, "Internal error")
+	}
+	return resp, nil
+}
+
+// grpcAddStats records the events of a stream one by one. The first
+// refused event ends the stream with its error; the events before it stay
+// recorded.
+func (reqHandler *RequestHandler) grpcAddStats(stream grpc.ClientStreamingServer[statspb.AddStatRequest, statspb.AddStatsResponse]) error {
+	summary := &statspb.AddStatsResponse{}
+
+	for {
+		req, err := stream.Recv()
+
+		if err == io.EOF {
+			return stream.SendAndClose(summary)
+		}
+
+		if err != nil {
+			return err
+		}
+
+		resp, err := reqHandler.grpcAddStat(stream.Context(), req)
+
+		if err != nil {
+			st := status.Convert(err)
+			return status.Errorf(st.Code(), "event %d: %s", summary.Received, st.Message())
+		}
+
+		summary.Received++
+
+		if resp.Applied {
+			summary.Applied++
+		}
+
+		if resp.Queued {
+			summary.Queued++
+		}
+	}
+}
+
+// grpcGetTopStats sends the rows GetStat would return as they are read.
+func (reqHandler *RequestHandler) grpcGetTopStats(req *statspb.GetTopStatsRequest, stream grpc.ServerStreamingServer[statspb.StatRow]) error {
+	values := url.Values{
+		"date1":  {req.Date1},
+		"date2":  {req.Date2},
+		"action": {req.Action},
+		"limit":  {strconv.Itoa(int(req.Limit))},
+	}
+
+	if req.Interval != "" {
+		values.Set("interval", req.Interval)
+	}
+
+	if req.Tz != "" {
+		values.Set("tz", req.Tz)
+	}
+
+	tenant := tenantFrom(stream.Context())
+
+	if err := reqHandler.validateGETParams(values, tenant); err != nil {
+		return status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	loc, _ := time.LoadLocation(values.Get("tz"))
+
+	dateLayout := layout
+
+	if req.Interval == "hour" {
+		dateLayout = time.RFC3339
+	}
+
+	rows, err := reqHandler.DBManager.ForTenant(tenant).GetStats(values)
+
+	if err != nil {
+		reqHandler.logger.Println(err)
+		return status.Error(codes.Internal, "Internal error")
+	}
+
+	defer rows.Close()
+
+	for rows.Next() {
+		r, err := scanStatRow(rows)
+
+		if err != nil {
+			reqHandler.logger.Println(err)
+			return status.Error(codes.Internal, "Internal error")
+		}
+
+		row := &statspb.StatRow{Date: r.Date.In(loc).Format(dateLayout), Id: r.ID, Cnt: r.Cnt}
+
+		if r.Age.Valid {
+			row.Age = &r.Age.Int64
+		}
+
+		if r.Sex.Valid {
+			row.Sex = &r.Sex.String
+		}
+
+		if err = stream.Send(row); err != nil {
+			return err
+		}
+	}
+
+	if err = rows.Err(); err != nil {
+		reqHandler.logger.Println(err)
+		return status.Error(codes.Internal, "Internal error")
+	}
+	return nil
+}
+
+func (reqHandler *RequestHandler) grpcUserActivity(ctx context.Context, req *statspb.UserActivityRequest) (*statspb.UserActivityResponse, error) {
+	values := url.Values{
+		"user":  {strconv.FormatInt(req.User, 10)},
+		"date1": {req.Date1},
+		"date2": {req.Date2},
+	}
+
+	user, err := validateActivityParams(values)
+
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	activity, err := reqHandler.userActivity(tenantFrom(ctx), user, req.Date1, req.Date2)
+
+	if err != nil {
+		reqHandler.logger.Println(err)
+		return nil, status.Error(codes.Internal, "Internal error")
+	}
+
+	resp := &statspb.UserActivityResponse{User: user}
+
+	for _, row := range activity {
+		resp.Activity = append(resp.Activity, &statspb.ActivityRow{Date: row.Date, Action: row.Action, Cnt: row.Cnt})
+	}
+	return resp, nil
+}
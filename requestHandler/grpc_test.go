@@ -0,0 +1,249 @@
+package requestHandler
+
+import (
+	"context"
+	"io"
+	"log"
+	"net"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/zwirec/http_service_stat/dbManager"
+	"github.com/zwirec/http_service_stat/statspb"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+// dialGRPC serves the gRPC API of rH in process and returns a client
+// connection to it, with opts.
+func dialGRPC(t *testing.T, rH *RequestHandler, opts ...grpc.DialOption) *grpc.ClientConn {
+	lis := bufconn.Listen(1 << 20)
+
+	srv := rH.NewGRPCServer()
+
+	go srv.Serve(lis)
+
+	t.Cleanup(srv.Stop)
+
+	opts = append(opts,
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+			return lis.DialContext(ctx)
+		}),
+		grpc.WithTransportCredentials(insecure.NewCredentials()))
+
+	conn, err := grpc.NewClient("passthrough:///bufnet", opts...)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+func TestGRPC(t *testing.T) {
+	db, mock, err := sqlmock.New()
+
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	dbm := dbManager.DBManager{DB: db}
+
+	rH := &RequestHandler{DBManager: &dbm, logger: log.New(os.Stdout, "", log.LstdFlags)}
+
+	client := statspb.NewStatsClient(dialGRPC(t, rH))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	mock.ExpectQuery("FROM tenants").WithArgs(0).WillReturnRows(
+		sqlmock.NewRows([]string{"name", "daily_events", "max_users", "actions"}).AddRow("default", 0, 0, "{like,login}"))
+	mock.ExpectExec("INSERT INTO users").WithArgs(2, 30, "M", 0).WillReturnResult(sqlmock.NewResult(1, 1))
+
+	if _, err = client.RegisterUser(ctx, &statspb.RegisterUserRequest{Id: 2, Age: 30, Sex: "M"}); err != nil {
+		t.Fatalf("RegisterUser: %v", err)
+	}
+
+	// The user is checked as by POST /api/users.
+	for _, user := range []*statspb.RegisterUserRequest{{Id: 0, Age: 30, Sex: "M"}, {Id: 3, Age: -1, Sex: "F"}, {Id: 3, Age: 30, Sex: "X"}} {
+		if _, err = client.RegisterUser(ctx, user); status.Code(err) != codes.InvalidArgument {
+			t.Errorf("RegisterUser of %v: got %v want InvalidArgument", user, err)
+		}
+	}
+
+	_, err = client.AddStat(ctx, &statspb.AddStatRequest{User: 2, Action: "purchase", Ts: "2012-02-02"})
+
+	if status.Code(err) != codes.InvalidArgument {
+		t.Fatalf("AddStat of an action not in the catalogue: got %v want InvalidArgument", err)
+	}
+
+	for _, action := range []string{"like", "login"} {
+		mock.ExpectBegin()
+		mock.ExpectExec("INSERT INTO events (.*)").WithArgs(2, action, "2012-02-02", nil, 0).WillReturnResult(
+			sqlmock.NewResult(1, 1))
+		mock.ExpectExec("INSERT INTO stats (.*)").WithArgs(2, action, "2012-02-02", 0).WillReturnResult(
+			sqlmock.NewResult(1, 1))
+		mock.ExpectExec("INSERT INTO stats_hourly (.*)").WithArgs(2, action, "2012-02-02", 0).WillReturnResult(
+			sqlmock.NewResult(1, 1))
+		mock.ExpectCommit()
+	}
+
+	stream, err := client.AddStats(ctx)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, action := range []string{"like", "login"} {
+		if err = stream.Send(&statspb.AddStatRequest{User: 2, Action: action, Ts: "2012-02-02"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	summary, err := stream.CloseAndRecv()
+
+	if err != nil {
+		t.Fatalf("AddStats: %v", err)
+	}
+
+	if summary.Received != 2 || summary.Applied != 2 {
+		t.Errorf("AddStats returned %v", summary)
+	}
+
+	mock.ExpectQuery("FROM stats s, users u").WithArgs("2012-02-02", "2012-02-03", "like", "1", 0).WillReturnRows(
+		sqlmock.NewRows([]string{"date", "id", "age", "sex", "cnt"}).AddRow(time.Date(2012, 2, 2, 0, 0, 0, 0, time.UTC), 2, 30, "M", 1))
+
+	rows, err := client.GetTopStats(ctx, &statspb.GetTopStatsRequest{Date1: "2012-02-02", Date2: "2012-02-03", Action: "like", Limit: 1})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	row, err := rows.Recv()
+
+	if err != nil {
+		t.Fatalf("GetTopStats: %v", err)
+	}
+
+	if row.Date != "2012-02-02" || row.Id != 2 || row.Cnt != 1 || row.GetSex() != "M" {
+		t.Errorf("GetTopStats returned %v", row)
+	}
+
+	if _, err = rows.Recv(); err != io.EOF {
+		t.Errorf("GetTopStats after the last row: got %v want EOF", err)
+	}
+
+	mock.ExpectQuery("FROM stats").WithArgs(int64(2), "2012-02-02", "2012-02-04", 0).WillReturnRows(
+		sqlmock.NewRows([]string{"date", "action", "cnt"}).AddRow(time.Date(2012, 2, 3, 0, 0, 0, 0, time.UTC), "login", 1))
+
+	activity, err := client.UserActivity(ctx, &statspb.UserActivityRequest{User: 2, Date1: "2012-02-02", Date2: "2012-02-04"})
+
+	if err != nil {
+		t.Fatalf("UserActivity: %v", err)
+	}
+
+	if len(activity.Activity) != 1 || activity.Activity[0].Date != "2012-02-03" || activity.Activity[0].Action != "login" {
+		t.Errorf("UserActivity returned %v", activity)
+	}
+
+	if _, err = client.UserActivity(ctx, &statspb.UserActivityRequest{Date1: "2012-02-02", Date2: "2012-02-04"}); status.Code(err) != codes.InvalidArgument {
+		t.Errorf("UserActivity without a user: got %v want InvalidArgument", err)
+	}
+
+	actions, err := client.Actions(ctx, &statspb.ActionsRequest{})
+
+	if err != nil || !reflect.DeepEqual(actions.Actions, []string{"like", "login"}) {
+		t.Errorf("Actions returned %v, %v", actions, err)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatalf("there were unfulfilled expections: %s", err)
+	}
+}
+
+func TestGRPCAuthorize(t *testing.T) {
+	db, mock, err := sqlmock.New()
+
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	dbm := dbManager.DBManager{DB: db}
+
+	rH := &RequestHandler{DBManager: &dbm, logger: log.New(os.Stdout, "", log.LstdFlags), requireAPIKey: true}
+
+	client := statspb.NewStatsClient(dialGRPC(t, rH))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	_, err = client.AddStat(ctx, &statspb.AddStatRequest{User: 2, Action: "like", Ts: "2012-02-02"})
+
+	if status.Code(err) != codes.Unauthenticated {
+		t.Fatalf("call without an API key: got %v want Unauthenticated", err)
+	}
+
+	mock.ExpectQuery("FROM api_keys").WithArgs(dbManager.HashAPIKey("reader")).WillReturnRows(
+		sqlmock.NewRows(apiKeyColumns).AddRow(4, 3, "{read}", "", time.Now(), nil, nil))
+	mock.ExpectQuery("FROM tenants").WithArgs(3).WillReturnRows(
+		sqlmock.NewRows([]string{"name", "daily_events", "max_users", "actions"}).AddRow("shop", 0, 0, "{like}"))
+
+	ctx = metadata.AppendToOutgoingContext(ctx, "x-api-key", "reader")
+
+	_, err = client.AddStat(ctx, &statspb.AddStatRequest{User: 2, Action: "like", Ts: "2012-02-02"})
+
+	if status.Code(err) != codes.PermissionDenied {
+		t.Fatalf("call with a read-only API key: got %v want PermissionDenied", err)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatalf("there were unfulfilled expections: %s", err)
+	}
+}
+
+// Clients may send the messages as JSON.
+func TestGRPCJSON(t *testing.T) {
+	db, mock, err := sqlmock.New()
+
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	dbm := dbManager.DBManager{DB: db}
+
+	rH := &RequestHandler{DBManager: &dbm, logger: log.New(os.Stdout, "", log.LstdFlags)}
+
+	conn := dialGRPC(t, rH, grpc.WithDefaultCallOptions(grpc.CallContentSubtype(GRPCJSONCodec)))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	mock.ExpectQuery("FROM tenants").WithArgs(0).WillReturnRows(
+		sqlmock.NewRows([]string{"name", "daily_events", "max_users", "actions"}).AddRow("default", 0, 0, "{like}"))
+	mock.ExpectBegin()
+	mock.ExpectExec("INSERT INTO events (.*)").WithArgs(2, "like", "2012-02-02", nil, 0).WillReturnResult(
+		sqlmock.NewResult(1, 1))
+	mock.ExpectExec("INSERT INTO stats (.*)").WithArgs(2, "like", "2012-02-02", 0).WillReturnResult(
+		sqlmock.NewResult(1, 1))
+	mock.ExpectExec("INSERT INTO stats_hourly (.*)").WithArgs(2, "like", "2012-02-02", 0).WillReturnResult(
+		sqlmock.NewResult(1, 1))
+	mock.ExpectCommit()
+
+	resp, err := statspb.NewStatsClient(conn).AddStat(ctx, &statspb.AddStatRequest{User: 2, Action: "like", Ts: "2012-02-02"})
+
+	if err != nil || !resp.Applied {
+		t.Fatalf("AddStat: %v, %v", resp, err)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatalf("there were unfulfilled expections: %s", err)
+	}
+}
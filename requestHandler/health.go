@@ -0,0 +1,41 @@
+package requestHandler
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"time"
+)
+
+// healthTimeout bounds the database check of Health.
+const healthTimeout = 2 * time.Second
+
+// Health answers 200 if the database can be reached, 503 otherwise. It
+// needs no API key, for load balancers and probes.
+func (reqHandler *RequestHandler) Health(w http.ResponseWriter, req *http.Request) {
+	var httpStatus int
+
+	if req.Method == "GET" {
+
+		ctx, cancel := context.WithTimeout(req.Context(), healthTimeout)
+		defer cancel()
+
+		status := "ok"
+		httpStatus = http.StatusOK
+
+		if err := reqHandler.DBManager.DB.PingContext(ctx); err != nil {
+			status = "unavailable"
+			httpStatus = http.StatusServiceUnavailable
+			reqHandler.logger.Println(err)
+		}
+
+		data, _ := json.Marshal(map[string]string{"status": status})
+
+		reqHandler.writeResponse(w, string(data)+"\n", httpStatus)
+		reqHandler.logRequest(req, httpStatus)
+	} else {
+		httpStatus = http.StatusMethodNotAllowed
+		reqHandler.writeResponse(w, nil, httpStatus)
+		reqHandler.logRequest(req, httpStatus)
+	}
+}
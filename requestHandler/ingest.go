@@ -0,0 +1,64 @@
+package requestHandler
+
+import (
+	"database/sql"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/zwirec/http_service_stat/dbManager"
+	"github.com/zwirec/http_service_stat/ingest"
+)
+
+// IngestEvent validates and records an event of tenant id consumed from a
+// queue, as AddStat does. Events that are invalid, of unknown users the
+// policy refuses or of a tenant that does not exist are rejected with
+// ingest.Reject. Events over the quotas of the tenant are retried the next
+// UTC day, when the daily quota resets, with ingest.RetryAt. The other
+// errors are worth retrying at once.
+func (reqHandler *RequestHandler) IngestEvent(tenantID int, values map[string]interface{}) error {
+	tenant, err := reqHandler.tenant(tenantID)
+
+	if err == sql.ErrNoRows {
+		return ingest.Reject(fmt.Errorf("no tenant %d", tenantID))
+	}
+
+	if err != nil {
+		return err
+	}
+
+	if err = validatePOSTaddStatParams(values, tenant); err != nil {
+		return ingest.Reject(err)
+	}
+
+	_, err = reqHandler.recordEvent(tenant, values)
+
+	if err == dbManager.ErrUnknownUser {
+		return ingest.Reject(err)
+	}
+
+	if err == dbManager.ErrQuotaExceeded {
+		return ingest.RetryAt(err, time.Now().UTC().Truncate(24*time.Hour).AddDate(0, 0, 1))
+	}
+	return err
+}
+
+// tenant returns the tenant id, kept with the credentials of API keys
+// under a name no key hash has.
+func (reqHandler *RequestHandler) tenant(id int) (*dbManager.Tenant, error) {
+	name := "tenant:" + strconv.Itoa(id)
+	now := time.Now()
+
+	if creds, ok := reqHandler.credentials.get(name, now); ok {
+		return creds.tenant, nil
+	}
+
+	tenant, err := reqHandler.DBManager.LoadTenant(id)
+
+	if err != nil {
+		return nil, err
+	}
+
+	reqHandler.credentials.put(name, &credentials{tenant: tenant, expires: now.Add(credentialsTTL)})
+	return tenant, nil
+}
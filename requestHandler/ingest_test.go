@@ -0,0 +1,85 @@
+package requestHandler
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/zwirec/http_service_stat/dbManager"
+	"github.com/zwirec/http_service_stat/ingest"
+)
+
+func TestIngestEvent(t *testing.T) {
+	db, mock, err := sqlmock.New()
+
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	dbm := dbManager.DBManager{DB: db}
+
+	rH := RequestHandler{DBManager: &dbm, logger: log.New(os.Stdout, "", log.LstdFlags)}
+
+	// The tenant is read once.
+	mock.ExpectQuery("FROM tenants").WithArgs(3).WillReturnRows(
+		sqlmock.NewRows([]string{"name", "daily_events", "max_users", "actions"}).AddRow("shop", 0, 0, "{like,purchase}"))
+
+	if err = rH.IngestEvent(3, map[string]interface{}{"user": 2, "action": "login", "ts": "2012-02-02"}); !ingest.IsRejected(err) {
+		t.Errorf("event with an action not in the catalogue: got %v want a rejection", err)
+	}
+
+	mock.ExpectBegin()
+	mock.ExpectExec("INSERT INTO events (.*)").WithArgs(2, "purchase", "2012-02-02", nil, 3).WillReturnResult(
+		sqlmock.NewResult(1, 1))
+	mock.ExpectExec("INSERT INTO stats (.*)").WithArgs(2, "purchase", "2012-02-02", 3).WillReturnResult(
+		sqlmock.NewResult(1, 1))
+	mock.ExpectExec("INSERT INTO stats_hourly (.*)").WithArgs(2, "purchase", "2012-02-02", 3).WillReturnResult(
+		sqlmock.NewResult(1, 1))
+	mock.ExpectCommit()
+
+	if err = rH.IngestEvent(3, map[string]interface{}{"user": 2, "action": "purchase", "ts": "2012-02-02"}); err != nil {
+		t.Errorf("IngestEvent: %v", err)
+	}
+
+	// Transient errors are worth retrying.
+	mock.ExpectBegin()
+	mock.ExpectExec("INSERT INTO events (.*)").WillReturnError(fmt.Errorf("connection reset"))
+	mock.ExpectRollback()
+
+	if err = rH.IngestEvent(3, map[string]interface{}{"user": 2, "action": "like", "ts": "2012-02-02"}); err == nil || ingest.IsRejected(err) {
+		t.Errorf("event failing to be written: got %v want an error to retry", err)
+	}
+
+	// Events over the daily quota wait for it to reset.
+	mock.ExpectQuery("FROM tenants").WithArgs(4).WillReturnRows(
+		sqlmock.NewRows([]string{"name", "daily_events", "max_users", "actions"}).AddRow("blog", 100, 0, "{like}"))
+	mock.ExpectBegin()
+	mock.ExpectExec("INSERT INTO events (.*)").WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectExec("INSERT INTO stats (.*)").WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectExec("INSERT INTO stats_hourly (.*)").WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectExec("INSERT INTO tenant_usage (.*)").WithArgs(4, 100).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectRollback()
+
+	err = rH.IngestEvent(4, map[string]interface{}{"user": 2, "action": "like", "ts": "2012-02-02"})
+
+	midnight := time.Now().UTC().Truncate(24*time.Hour).AddDate(0, 0, 1)
+
+	if until, ok := ingest.RetryTime(err); !ok || !until.Equal(midnight) {
+		t.Errorf("event over the quota: got %v want a retry at %s", err, midnight)
+	}
+
+	// A tenant that does not exist would never be read.
+	mock.ExpectQuery("FROM tenants").WithArgs(5).WillReturnError(sql.ErrNoRows)
+
+	if err = rH.IngestEvent(5, map[string]interface{}{"user": 2, "action": "like", "ts": "2012-02-02"}); !ingest.IsRejected(err) {
+		t.Errorf("event of no tenant: got %v want a rejection", err)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatalf("there were unfulfilled expections: %s", err)
+	}
+}
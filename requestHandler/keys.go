@@ -0,0 +1,247 @@
+package requestHandler
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/zwirec/http_service_stat/dbManager"
+)
+
+// apiKeyJSON describes k without any key material.
+func apiKeyJSON(k *dbManager.APIKey) map[string]interface{} {
+	key := map[string]interface{}{
+		"id":         k.ID,
+		"scopes":     k.Scopes,
+		"created_at": k.CreatedAt,
+		"expires_at": nil,
+		"revoked_at": nil,
+	}
+
+	if k.ExpiresAt.Valid {
+		key["expires_at"] = k.ExpiresAt.Time
+	}
+
+	if k.RevokedAt.Valid {
+		key["revoked_at"] = k.RevokedAt.Time
+	}
+	return key
+}
+
+// parseScopes parses a comma-separated list of scopes.
+func parseScopes(list string) ([]string, error) {
+	var scopes []string
+
+	for _, scope := range strings.Split(list, ",") {
+		if scope = strings.TrimSpace(scope); scope == "" {
+			continue
+		}
+
+		valid := false
+
+		for _, s := range dbManager.Scopes {
+			valid = valid || s == scope
+		}
+
+		if !valid {
+			return nil, fmt.Errorf(`Incorrect "scopes" (use a comma-separated list of %s)`, strings.Join(dbManager.Scopes, ", "))
+		}
+		scopes = append(scopes, scope)
+	}
+
+	if len(scopes) == 0 {
+		return nil, fmt.Errorf(`Missing "scopes" (use a comma-separated list of %s)`, strings.Join(dbManager.Scopes, ", "))
+	}
+	return scopes, nil
+}
+
+// APIKeys lists (GET) or creates (POST, with "scopes") the API keys of the
+// tenant. A created key is only ever shown in the response.
+func (reqHandler *RequestHandler) APIKeys(w http.ResponseWriter, req *http.Request) {
+	var httpStatus int
+
+	dbm := reqHandler.DBManager.ForTenant(tenantOf(req))
+
+	if req.Method == "GET" {
+
+		keys, err := dbm.APIKeys()
+
+		if err != nil {
+			httpStatus = http.StatusInternalServerError
+			reqHandler.writeResponse(w, nil, httpStatus)
+			reqHandler.logger.Println(err)
+			reqHandler.logRequest(req, httpStatus)
+			return
+		}
+
+		list := make([]map[string]interface{}, 0, len(keys))
+
+		for _, k := range keys {
+			list = append(list, apiKeyJSON(k))
+		}
+
+		data, _ := json.Marshal(map[string]interface{}{"keys": list})
+
+		httpStatus = http.StatusOK
+		reqHandler.writeResponse(w, string(data)+"\n", httpStatus)
+		reqHandler.logRequest(req, httpStatus)
+	} else if req.Method == "POST" {
+
+		values, err := url.ParseQuery(req.URL.RawQuery)
+
+		if err != nil {
+			httpStatus = http.StatusBadRequest
+			reqHandler.writeResponse(w, "Incorrect query rows!", httpStatus)
+			reqHandler.logRequest(req, httpStatus)
+			return
+		}
+
+		scopes, err := parseScopes(values.Get("scopes"))
+
+		if err != nil {
+			httpStatus = http.StatusBadRequest
+			reqHandler.writeResponse(w, err.Error(), httpStatus)
+			reqHandler.logRequest(req, httpStatus)
+			return
+		}
+
+		apiKey, key, err := dbm.CreateAPIKey(scopes)
+
+		if err != nil {
+			httpStatus = http.StatusInternalServerError
+			reqHandler.writeResponse(w, nil, httpStatus)
+			reqHandler.logger.Println(err)
+			reqHandler.logRequest(req, httpStatus)
+			return
+		}
+
+		response := apiKeyJSON(apiKey)
+		response["key"] = key
+
+		data, _ := json.Marshal(response)
+
+		httpStatus = http.StatusCreated
+		reqHandler.writeResponse(w, string(data)+"\n", httpStatus)
+		reqHandler.logRequest(req, httpStatus, fmt.Sprintf("key %d", apiKey.ID))
+	} else {
+		httpStatus = http.StatusMethodNotAllowed
+		reqHandler.writeResponse(w, nil, httpStatus)
+		reqHandler.logRequest(req, httpStatus)
+	}
+}
+
+// keyID parses the "id" parameter of the key endpoints.
+func keyID(req *http.Request) (int, error) {
+	values, err := url.ParseQuery(req.URL.RawQuery)
+
+	if err != nil {
+		return 0, fmt.Errorf("Incorrect query rows!")
+	}
+
+	id, err := strconv.Atoi(values.Get("id"))
+
+	if err != nil || id <= 0 {
+		return 0, fmt.Errorf(`Missing or invalid "id" (use the id of an API key)`)
+	}
+	return id, nil
+}
+
+// RotateAPIKey replaces the key "id" of the tenant by a new one with the
+// same scopes; the old one keeps working for the rotation grace period.
+func (reqHandler *RequestHandler) RotateAPIKey(w http.ResponseWriter, req *http.Request) {
+	var httpStatus int
+
+	if req.Method == "POST" {
+
+		id, err := keyID(req)
+
+		if err != nil {
+			httpStatus = http.StatusBadRequest
+			reqHandler.writeResponse(w, err.Error(), httpStatus)
+			reqHandler.logRequest(req, httpStatus)
+			return
+		}
+
+		old, apiKey, key, err := reqHandler.DBManager.ForTenant(tenantOf(req)).RotateAPIKey(id, reqHandler.rotationGrace)
+
+		if err == dbManager.ErrUnknownAPIKey {
+			httpStatus = http.StatusNotFound
+			reqHandler.writeError(w, "No such live API key", httpStatus)
+			reqHandler.logRequest(req, httpStatus)
+			return
+		}
+
+		if err != nil {
+			httpStatus = http.StatusInternalServerError
+			reqHandler.writeResponse(w, nil, httpStatus)
+			reqHandler.logger.Println(err)
+			reqHandler.logRequest(req, httpStatus)
+			return
+		}
+
+		reqHandler.credentials.forget(old.Hash)
+
+		response := apiKeyJSON(apiKey)
+		response["key"] = key
+		response["replaces"] = apiKeyJSON(old)
+
+		data, _ := json.Marshal(response)
+
+		httpStatus = http.StatusCreated
+		reqHandler.writeResponse(w, string(data)+"\n", httpStatus)
+		reqHandler.logRequest(req, httpStatus, fmt.Sprintf("key %d rotated to %d", old.ID, apiKey.ID))
+	} else {
+		httpStatus = http.StatusMethodNotAllowed
+		reqHandler.writeResponse(w, nil, httpStatus)
+		reqHandler.logRequest(req, httpStatus)
+	}
+}
+
+// RevokeAPIKey ends the key "id" of the tenant at once.
+func (reqHandler *RequestHandler) RevokeAPIKey(w http.ResponseWriter, req *http.Request) {
+	var httpStatus int
+
+	if req.Method == "POST" {
+
+		id, err := keyID(req)
+
+		if err != nil {
+			httpStatus = http.StatusBadRequest
+			reqHandler.writeResponse(w, err.Error(), httpStatus)
+			reqHandler.logRequest(req, httpStatus)
+			return
+		}
+
+		apiKey, err := reqHandler.DBManager.ForTenant(tenantOf(req)).RevokeAPIKey(id)
+
+		if err == dbManager.ErrUnknownAPIKey {
+			httpStatus = http.StatusNotFound
+			reqHandler.writeError(w, "No such API key", httpStatus)
+			reqHandler.logRequest(req, httpStatus)
+			return
+		}
+
+		if err != nil {
+			httpStatus = http.StatusInternalServerError
+			reqHandler.writeResponse(w, nil, httpStatus)
+			reqHandler.logger.Println(err)
+			reqHandler.logRequest(req, httpStatus)
+			return
+		}
+
+		reqHandler.credentials.forget(apiKey.Hash)
+
+		data, _ := json.Marshal(apiKeyJSON(apiKey))
+
+		httpStatus = http.StatusOK
+		reqHandler.writeResponse(w, string(data)+"\n", httpStatus)
+		reqHandler.logRequest(req, httpStatus, fmt.Sprintf("key %d revoked", apiKey.ID))
+	} else {
+		httpStatus = http.StatusMethodNotAllowed
+		reqHandler.writeResponse(w, nil, httpStatus)
+		reqHandler.logRequest(req, httpStatus)
+	}
+}
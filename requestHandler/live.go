@@ -0,0 +1,225 @@
+package requestHandler
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/zwirec/http_service_stat/live"
+)
+
+const (
+	// liveWriteWait bounds each write to a live leaderboard client.
+	liveWriteWait = 10 * time.Second
+	// livePongWait is how long a client may take to answer a ping.
+	livePongWait = time.Minute
+	// livePingPeriod is how often clients are pinged, and the day of their
+	// leaderboard checked.
+	livePingPeriod = livePongWait * 9 / 10
+)
+
+var upgrader = websocket.Upgrader{}
+
+// leaderboardMessage is a message to a live leaderboard client: the whole
+// leaderboard ("snapshot") or the ranks that changed since the last
+// message ("diff").
+type leaderboardMessage struct {
+	Type  string       `json:"type"`
+	Date  string       `json:"date"`
+	Ranks []live.Entry `json:"ranks"`
+}
+
+// LiveLeaderboard subscribes a client over WebSocket to the leaderboard of
+// today (UTC) of "action", its first "limit" users. The first message is
+// the leaderboard, the next ones the ranks that changed, at most one every
+// live leaderboard interval. Ranks only move up within a day, so diffs
+// never shrink the leaderboard. Shortly after midnight a snapshot of the
+// new day is sent.
+func (reqHandler *RequestHandler) LiveLeaderboard(w http.ResponseWriter, req *http.Request) {
+	var httpStatus int
+
+	if req.Method == "GET" {
+
+		params := req.URL.Query()
+
+		tenant := tenantOf(req)
+
+		action := params.Get("action")
+
+		if !tenant.HasAction(action) {
+			httpStatus = http.StatusBadRequest
+			reqHandler.writeResponse(w, `Incorrect "action" (must be in the catalogue)`+"\n", httpStatus)
+			reqHandler.logRequest(req, httpStatus)
+			return
+		}
+
+		if reqHandler.Live == nil {
+			httpStatus = http.StatusServiceUnavailable
+			reqHandler.writeResponse(w, "Live leaderboards are turned off\n", httpStatus)
+			reqHandler.logRequest(req, httpStatus)
+			return
+		}
+
+		limit, err := strconv.Atoi(params.Get("limit"))
+
+		if err != nil || limit < 1 || limit > reqHandler.Live.Size() {
+			httpStatus = http.StatusBadRequest
+			reqHandler.writeResponse(w, `Incorrect "limit" (use 1 to `+strconv.Itoa(reqHandler.Live.Size())+")\n", httpStatus)
+			reqHandler.logRequest(req, httpStatus)
+			return
+		}
+
+		if !websocket.IsWebSocketUpgrade(req) {
+			httpStatus = http.StatusUpgradeRequired
+			w.Header().Set("Upgrade", "websocket")
+			reqHandler.writeResponse(w, "Use a WebSocket\n", httpStatus)
+			reqHandler.logRequest(req, httpStatus)
+			return
+		}
+
+		sub, err := reqHandler.Live.Subscribe(tenant.ID, action, limit, time.Now())
+
+		if err == live.ErrTooManyClients {
+			httpStatus = http.StatusServiceUnavailable
+			w.Header().Set("Retry-After", "10")
+			reqHandler.writeResponse(w, "Too many clients subscribed\n", httpStatus)
+			reqHandler.logRequest(req, httpStatus)
+			return
+		}
+
+		if err != nil {
+			httpStatus = http.StatusInternalServerError
+			reqHandler.writeResponse(w, nil, httpStatus)
+			reqHandler.logger.Println(err)
+			reqHandler.logRequest(req, httpStatus)
+			return
+		}
+
+		// Upgrade answers the requests it refuses.
+		conn, err := upgrader.Upgrade(w, req, nil)
+
+		if err != nil {
+			reqHandler.Live.Unsubscribe(sub)
+			reqHandler.logRequest(req, http.StatusBadRequest, err.Error())
+			return
+		}
+
+		reqHandler.logRequest(req, http.StatusSwitchingProtocols)
+
+		reqHandler.serveLeaderboard(conn, sub, tenant.ID, action, limit)
+	} else {
+		httpStatus = http.StatusMethodNotAllowed
+		reqHandler.writeResponse(w, nil, httpStatus)
+		reqHandler.logRequest(req, httpStatus)
+		return
+	}
+	return
+}
+
+// serveLeaderboard sends the updates of sub to conn until the client goes
+// away.
+func (reqHandler *RequestHandler) serveLeaderboard(conn *websocket.Conn, sub *live.Subscription, tenant int, action string, limit int) {
+	defer func() {
+		reqHandler.Live.Unsubscribe(sub)
+		conn.Close()
+	}()
+
+	// Clients only send control messages; reading handles them and tells
+	// when the client is gone.
+	gone := make(chan struct{})
+
+	go func() {
+		defer close(gone)
+
+		conn.SetReadLimit(512)
+		conn.SetReadDeadline(time.Now().Add(livePongWait))
+		conn.SetPongHandler(func(string) error {
+			return conn.SetReadDeadline(time.Now().Add(livePongWait))
+		})
+
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}()
+
+	send := func(msg leaderboardMessage) error {
+		conn.SetWriteDeadline(time.Now().Add(liveWriteWait))
+		return conn.WriteJSON(msg)
+	}
+
+	last := sub.Top()
+
+	if err := send(leaderboardMessage{Type: "snapshot", Date: sub.Date, Ranks: last}); err != nil {
+		return
+	}
+
+	interval := reqHandler.liveConf.Interval.Duration
+	lastSent := time.Now()
+
+	ping := time.NewTicker(livePingPeriod)
+	defer ping.Stop()
+
+	// throttle is set while a diff waits for the interval to pass.
+	var throttle <-chan time.Time
+
+	for {
+		select {
+		case <-gone:
+			return
+		case <-sub.Changed():
+			if throttle == nil {
+				throttle = time.After(interval - time.Since(lastSent))
+			}
+		case <-throttle:
+			throttle = nil
+
+			top := sub.Top()
+
+			if ranks := diffRanks(last, top); len(ranks) > 0 {
+				if err := send(leaderboardMessage{Type: "diff", Date: sub.Date, Ranks: ranks}); err != nil {
+					return
+				}
+				lastSent = time.Now()
+			}
+			last = top
+		case <-ping.C:
+			if now := time.Now(); now.UTC().Format(layout) != sub.Date {
+				reqHandler.Live.Unsubscribe(sub)
+
+				next, err := reqHandler.Live.Subscribe(tenant, action, limit, now)
+
+				if err != nil {
+					reqHandler.logger.Println("live leaderboard:", err)
+					return
+				}
+
+				sub = next
+				throttle = nil
+				last = sub.Top()
+
+				if err := send(leaderboardMessage{Type: "snapshot", Date: sub.Date, Ranks: last}); err != nil {
+					return
+				}
+			}
+
+			if err := conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(liveWriteWait)); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// diffRanks returns the ranks of top that are not the same in last.
+func diffRanks(last, top []live.Entry) []live.Entry {
+	var ranks []live.Entry
+
+	for i, e := range top {
+		if i >= len(last) || last[i] != e {
+			ranks = append(ranks, e)
+		}
+	}
+	return ranks
+}
@@ -0,0 +1,132 @@
+package requestHandler
+
+import (
+	"bytes"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/gorilla/websocket"
+	"github.com/zwirec/http_service_stat/config"
+	"github.com/zwirec/http_service_stat/dbManager"
+	"github.com/zwirec/http_service_stat/live"
+)
+
+func TestLiveLeaderboard(t *testing.T) {
+	db, mock, err := sqlmock.New()
+
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	dbm := dbManager.DBManager{DB: db}
+
+	rH := RequestHandler{
+		DBManager: &dbm,
+		logger:    log.New(os.Stdout, "", log.LstdFlags),
+		Live:      live.New(&dbm, 10, 1),
+		liveConf:  config.LiveLeaderboard{Interval: config.Duration{Duration: 10 * time.Millisecond}},
+	}
+
+	for _, test := range []struct {
+		query  string
+		status int
+	}{
+		{"action=purchase&limit=5", http.StatusBadRequest},
+		{"action=like&limit=11", http.StatusBadRequest},
+		{"action=like&limit=5", http.StatusUpgradeRequired},
+	} {
+		rr := httptest.NewRecorder()
+
+		rH.LiveLeaderboard(rr, httptest.NewRequest("GET", "/api/stats/leaderboard/live?"+test.query, nil))
+
+		if rr.Code != test.status {
+			t.Errorf("%s: handler returned %d want %d", test.query, rr.Code, test.status)
+		}
+	}
+
+	srv := httptest.NewServer(http.HandlerFunc(rH.LiveLeaderboard))
+	defer srv.Close()
+
+	url := "ws" + strings.TrimPrefix(srv.URL, "http") + "?action=like&limit=2"
+
+	today := time.Now().UTC().Format(layout)
+
+	mock.ExpectQuery("FROM stats").WithArgs("like", today, 0).WillReturnRows(
+		sqlmock.NewRows([]string{"user", "cnt"}).AddRow(1, 2).AddRow(2, 1))
+
+	conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer conn.Close()
+
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+
+	var msg leaderboardMessage
+
+	if err = conn.ReadJSON(&msg); err != nil {
+		t.Fatal(err)
+	}
+
+	want := leaderboardMessage{Type: "snapshot", Date: today, Ranks: []live.Entry{{Rank: 1, User: 1, Cnt: 2}, {Rank: 2, User: 2, Cnt: 1}}}
+
+	if !reflect.DeepEqual(msg, want) {
+		t.Errorf("first message %+v, want %+v", msg, want)
+	}
+
+	if _, _, err = websocket.DefaultDialer.Dial(url, nil); err == nil {
+		t.Errorf("client past max_clients subscribed")
+	}
+
+	// Events recorded by AddStat update the leaderboard: user 2 overtakes 1.
+	for i := 0; i < 2; i++ {
+		mock.ExpectBegin()
+		mock.ExpectExec("INSERT INTO events (.*)").WillReturnResult(sqlmock.NewResult(1, 1))
+		mock.ExpectExec("INSERT INTO stats (.*)").WillReturnResult(sqlmock.NewResult(1, 1))
+		mock.ExpectExec("INSERT INTO stats_hourly (.*)").WillReturnResult(sqlmock.NewResult(1, 1))
+		mock.ExpectCommit()
+
+		rr := httptest.NewRecorder()
+
+		rH.AddStat(rr, httptest.NewRequest("POST", "/api/users/stats",
+			bytes.NewBufferString(`{"user": 2, "action": "like", "ts": "`+time.Now().UTC().Format(time.RFC3339)+`"}`)))
+
+		if rr.Code != http.StatusOK {
+			t.Fatalf("AddStat returned %d", rr.Code)
+		}
+	}
+
+	// The ranks that changed are sent, coalesced within the interval.
+	want = leaderboardMessage{Type: "diff", Date: today, Ranks: []live.Entry{{Rank: 1, User: 2, Cnt: 3}, {Rank: 2, User: 1, Cnt: 2}}}
+
+	for {
+		msg = leaderboardMessage{}
+
+		if err = conn.ReadJSON(&msg); err != nil {
+			t.Fatal(err)
+		}
+
+		// The first diff may have come between the events.
+		if reflect.DeepEqual(msg, leaderboardMessage{Type: "diff", Date: today, Ranks: []live.Entry{{Rank: 2, User: 2, Cnt: 2}}}) {
+			continue
+		}
+
+		if !reflect.DeepEqual(msg, want) {
+			t.Errorf("diff %+v, want %+v", msg, want)
+		}
+		break
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatalf("there were unfulfilled expections: %s", err)
+	}
+}
@@ -0,0 +1,29 @@
+package requestHandler
+
+import (
+	_ "embed"
+	"net/http"
+)
+
+// openAPI describes the HTTP API. TestOpenAPI checks it against the routes
+// and the request types.
+//
+//go:embed openapi.json
+var openAPI []byte
+
+// OpenAPI serves the OpenAPI document of the HTTP API.
+func (reqHandler *RequestHandler) OpenAPI(w http.ResponseWriter, req *http.Request) {
+	var httpStatus int
+
+	if req.Method == "GET" {
+		w.Header().Set("Content-Type", "application/json")
+
+		httpStatus = http.StatusOK
+		reqHandler.writeResponse(w, string(openAPI), httpStatus)
+		reqHandler.logRequest(req, httpStatus)
+	} else {
+		httpStatus = http.StatusMethodNotAllowed
+		reqHandler.writeResponse(w, nil, httpStatus)
+		reqHandler.logRequest(req, httpStatus)
+	}
+}
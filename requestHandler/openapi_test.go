@@ -0,0 +1,241 @@
+package requestHandler
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/zwirec/http_service_stat/dbManager"
+	"github.com/zwirec/http_service_stat/live"
+	"github.com/zwirec/http_service_stat/statspb"
+	"github.com/zwirec/http_service_stat/stream"
+)
+
+type openAPIParameter struct {
+	Name     string `json:"name"`
+	In       string `json:"in"`
+	Required bool   `json:"required"`
+	Schema   struct {
+		Enum []string `json:"enum"`
+	} `json:"schema"`
+}
+
+type openAPIDocument struct {
+	Paths map[string]map[string]struct {
+		Parameters []openAPIParameter `json:"parameters"`
+	} `json:"paths"`
+	Components struct {
+		Schemas map[string]struct {
+			Required   []string                   `json:"required"`
+			Properties map[string]json.RawMessage `json:"properties"`
+		} `json:"schemas"`
+	} `json:"components"`
+}
+
+// jsonFields returns the JSON names of the fields of v.
+func jsonFields(v interface{}) []string {
+	var names []string
+
+	t := reflect.TypeOf(v)
+
+	if t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+
+	for i := 0; i < t.NumField(); i++ {
+		// Protocol buffer messages keep their state in unexported fields.
+		if t.Field(i).PkgPath != "" {
+			continue
+		}
+		names = append(names, strings.Split(t.Field(i).Tag.Get("json"), ",")[0])
+	}
+
+	sort.Strings(names)
+	return names
+}
+
+func keys(m map[string]json.RawMessage) []string {
+	var names []string
+
+	for name := range m {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+	return names
+}
+
+// checkRequired checks that validate refuses valid without each of the
+// required fields, and only without them.
+func checkRequired(t *testing.T, name string, valid map[string]interface{}, required []string, validate func(map[string]interface{}) error) {
+	if err := validate(valid); err != nil {
+		t.Fatalf("%s: valid example refused: %v", name, err)
+	}
+
+	for field := range valid {
+		params := map[string]interface{}{}
+
+		for k, v := range valid {
+			if k != field {
+				params[k] = v
+			}
+		}
+
+		isRequired := false
+
+		for _, r := range required {
+			isRequired = isRequired || r == field
+		}
+
+		if err := validate(params); (err != nil) != isRequired {
+			t.Errorf("%s: the spec says %q is required: %v, the handler refuses requests without it: %v", name, field, isRequired, err != nil)
+		}
+	}
+}
+
+func TestOpenAPI(t *testing.T) {
+	var doc openAPIDocument
+
+	if err := json.Unmarshal(openAPI, &doc); err != nil {
+		t.Fatalf("openapi.json is not valid JSON: %v", err)
+	}
+
+	rH := RequestHandler{DBManager: &dbManager.DBManager{}, logger: log.New(os.Stdout, "", log.LstdFlags)}
+
+	paths := map[string]http.HandlerFunc{"/openapi.json": rH.OpenAPI, "/health": rH.Health}
+
+	for _, r := range rH.routes() {
+		paths[r.path] = r.handler
+	}
+
+	for path := range doc.Paths {
+		if paths[path] == nil {
+			t.Errorf("%s is in the spec but not served", path)
+		}
+	}
+
+	for path, handler := range paths {
+		operations, ok := doc.Paths[path]
+
+		if !ok {
+			t.Errorf("%s is served but not in the spec", path)
+			continue
+		}
+
+		// The handlers refuse the methods the spec does not have.
+		for _, method := range []string{"GET", "POST", "PUT", "DELETE"} {
+			if _, ok := operations[strings.ToLower(method)]; ok {
+				continue
+			}
+
+			rr := httptest.NewRecorder()
+
+			handler(rr, httptest.NewRequest(method, path, nil))
+
+			if rr.Code != http.StatusMethodNotAllowed {
+				t.Errorf("%s %s is not in the spec but answered %d", method, path, rr.Code)
+			}
+		}
+	}
+
+	schemas := doc.Components.Schemas
+
+	for name, v := range map[string]interface{}{
+		"RegisterUserRequest": &statspb.RegisterUserRequest{},
+		"AddStatRequest":      &statspb.AddStatRequest{},
+		"AddStatResponse":     &statspb.AddStatResponse{},
+		"AddStatResult":       statResult{},
+		"StatRow":             &statspb.StatRow{},
+		"ActivityRow":         activityRow{},
+		"StreamEvent":         stream.Event{},
+		"LeaderboardMessage":  leaderboardMessage{},
+		"LeaderboardEntry":    live.Entry{},
+	} {
+		if got, want := keys(schemas[name].Properties), jsonFields(v); !reflect.DeepEqual(got, want) {
+			t.Errorf("schema %s has properties %v, the handler type %v", name, got, want)
+		}
+	}
+
+	checkRequired(t, "RegisterUserRequest", map[string]interface{}{"id": 1, "age": 20, "sex": "M"},
+		schemas["RegisterUserRequest"].Required, validatePOSTregisterParams)
+
+	checkRequired(t, "AddStatRequest", map[string]interface{}{"user": 1, "action": "like", "ts": "2012-02-02", "event_id": "a"},
+		schemas["AddStatRequest"].Required, func(params map[string]interface{}) error {
+			return validatePOSTaddStatParams(params, defaultTenant)
+		})
+
+	top := doc.Paths["/api/users/stats/top"]["get"].Parameters
+
+	var names, required []string
+
+	valid := map[string]interface{}{
+		"date1": "2012-02-02", "date2": "2012-02-03", "action": "like", "limit": "5",
+		"interval": "hour", "tz": "Europe/Moscow", "format": "csv",
+	}
+
+	for _, p := range top {
+		if p.In != "query" {
+			continue
+		}
+
+		if p.Name != "format" {
+			names = append(names, p.Name)
+		}
+
+		if p.Required {
+			required = append(required, p.Name)
+		}
+
+		for _, value := range p.Schema.Enum {
+			params := url.Values{}
+
+			for k, v := range valid {
+				params.Set(k, v.(string))
+			}
+
+			params.Set(p.Name, value)
+
+			if err := rH.validateGETParams(params, defaultTenant); err != nil {
+				t.Errorf("%s=%s is in the spec but refused: %v", p.Name, value, err)
+			}
+
+			if _, err := negotiateFormat(httptest.NewRequest("GET", "/", nil), params); err != nil {
+				t.Errorf("%s=%s is in the spec but refused: %v", p.Name, value, err)
+			}
+		}
+	}
+
+	sort.Strings(names)
+
+	if want := jsonFields(&statspb.GetTopStatsRequest{}); !reflect.DeepEqual(names, want) {
+		t.Errorf("/api/users/stats/top has parameters %v, GetTopStatsRequest %v", names, want)
+	}
+
+	checkRequired(t, "/api/users/stats/top", valid, required, func(params map[string]interface{}) error {
+		values := url.Values{}
+
+		for k, v := range params {
+			values.Set(k, v.(string))
+		}
+		return rH.validateGETParams(values, defaultTenant)
+	})
+}
+
+func TestOpenAPIServed(t *testing.T) {
+	rH := RequestHandler{logger: log.New(os.Stdout, "", log.LstdFlags)}
+
+	rr := httptest.NewRecorder()
+
+	rH.OpenAPI(rr, httptest.NewRequest("GET", "/openapi.json", nil))
+
+	if rr.Code != http.StatusOK || rr.Header().Get("Content-Type") != "application/json" || rr.Body.Len() != len(openAPI) {
+		t.Errorf("handler returned %d %q with %d bytes", rr.Code, rr.Header().Get("Content-Type"), rr.Body.Len())
+	}
+}
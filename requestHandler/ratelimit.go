@@ -0,0 +1,152 @@
+package requestHandler
+
+import (
+	"context"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/zwirec/http_service_stat/config"
+	"github.com/zwirec/http_service_stat/ratelimit"
+)
+
+// defaultRoute is the rate limit of the routes without one of their own.
+const defaultRoute = "*"
+
+// setRateLimits applies the limits of conf, keeping the buckets of the
+// routes that are still limited.
+func (reqHandler *RequestHandler) setRateLimits(conf config.RateLimits) {
+	reqHandler.limitsMu.Lock()
+	defer reqHandler.limitsMu.Unlock()
+
+	limiters := make(map[string]*ratelimit.Limiter, len(conf.Routes))
+
+	for route, limit := range conf.Routes {
+		if l, ok := reqHandler.limiters[route]; ok {
+			l.SetRate(limit.Rate, limit.Burst)
+			limiters[route] = l
+		} else {
+			limiters[route] = ratelimit.New(limit.Rate, limit.Burst)
+		}
+	}
+
+	reqHandler.limiters = limiters
+
+	if reqHandler.eventQuota == nil {
+		reqHandler.eventQuota = ratelimit.NewQuota(conf.DailyEvents)
+	} else {
+		reqHandler.eventQuota.SetLimit(conf.DailyEvents)
+	}
+}
+
+func (reqHandler *RequestHandler) limiter(route string) *ratelimit.Limiter {
+	reqHandler.limitsMu.RLock()
+	defer reqHandler.limitsMu.RUnlock()
+
+	if l, ok := reqHandler.limiters[route]; ok {
+		return l
+	}
+	return reqHandler.limiters[defaultRoute]
+}
+
+// clientOf identifies who made a request for quotas: its API key, or its
+// IP address if it has none.
+func clientOf(req *http.Request) string {
+	return clientFrom(req.Context(), req.RemoteAddr)
+}
+
+// clientFrom identifies the client of the credentials in ctx, connected
+// from remoteAddr.
+func clientFrom(ctx context.Context, remoteAddr string) string {
+	if creds, ok := ctx.Value(credentialsContextKey{}).(*credentials); ok && creds.key != nil {
+		return "key:" + strconv.Itoa(creds.key.ID)
+	}
+	return addrClient(remoteAddr)
+}
+
+// addrClient identifies a client by the IP address of remoteAddr.
+func addrClient(remoteAddr string) string {
+	host, _, err := net.SplitHostPort(remoteAddr)
+
+	if err != nil {
+		host = remoteAddr
+	}
+	return "ip:" + host
+}
+
+// rateClient identifies who made a request with key from remoteAddr for
+// rate limits: its API key if the key is valid, so that the clients behind
+// one address do not share a bucket, or else its IP address, so that
+// requests without a key or with a bad one are limited too.
+func (reqHandler *RequestHandler) rateClient(key, remoteAddr string) string {
+	if key != "" {
+		if creds, err := reqHandler.authenticate(key); err == nil {
+			return "key:" + strconv.Itoa(creds.key.ID)
+		}
+	}
+	return addrClient(remoteAddr)
+}
+
+// rateLimit lets requests through to h while their client has tokens left
+// in the bucket of route, and answers the others with 429. It comes before
+// authorization, so requests lacking the scope are limited too.
+func (reqHandler *RequestHandler) rateLimit(route string, h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		l := reqHandler.limiter(route)
+
+		if l == nil {
+			h(w, req)
+			return
+		}
+
+		result := l.Allow(reqHandler.rateClient(apiKeyOf(req), req.RemoteAddr))
+
+		w.Header().Set("RateLimit-Limit", strconv.Itoa(result.Limit))
+		w.Header().Set("RateLimit-Remaining", strconv.Itoa(result.Remaining))
+		w.Header().Set("RateLimit-Reset", seconds(result.Reset))
+
+		if !result.Allowed {
+			httpStatus := http.StatusTooManyRequests
+
+			w.Header().Set("Retry-After", seconds(result.RetryAfter))
+			reqHandler.writeError(w, "Rate limit exceeded", httpStatus)
+			reqHandler.logRequest(req, httpStatus)
+			return
+		}
+
+		h(w, req)
+	}
+}
+
+// takeEvent counts an event of the client of req against its daily quota.
+// It returns false, having answered with 429, if the quota is used up.
+func (reqHandler *RequestHandler) takeEvent(w http.ResponseWriter, req *http.Request) bool {
+	if reqHandler.eventQuota == nil {
+		return true
+	}
+
+	ok, retryAfter := reqHandler.eventQuota.Take(clientOf(req))
+
+	if !ok {
+		httpStatus := http.StatusTooManyRequests
+
+		w.Header().Set("Retry-After", seconds(retryAfter))
+		reqHandler.writeError(w, "Daily event quota exceeded", httpStatus)
+		reqHandler.logRequest(req, httpStatus)
+	}
+	return ok
+}
+
+// releaseEvent gives back an event taken by takeEvent that was not recorded.
+func (reqHandler *RequestHandler) releaseEvent(req *http.Request) {
+	if reqHandler.eventQuota != nil {
+		reqHandler.eventQuota.Release(clientOf(req))
+	}
+}
+
+// seconds formats d as whole seconds, rounded up, for the rate limit headers.
+func seconds(d time.Duration) string {
+	return strconv.Itoa(int(math.Ceil(d.Seconds())))
+}
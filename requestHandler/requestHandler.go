@@ -4,22 +4,60 @@ import (
 	"net/http"
 	"encoding/json"
 	"fmt"
-	"sort"
+	"strconv"
+	"strings"
 	"net/url"
+	"github.com/zwirec/http_service_stat/alerts"
+	"github.com/zwirec/http_service_stat/cache"
+	"github.com/zwirec/http_service_stat/config"
 	"github.com/zwirec/http_service_stat/dbManager"
+	"github.com/zwirec/http_service_stat/dedup"
+	"github.com/zwirec/http_service_stat/live"
+	"github.com/zwirec/http_service_stat/ratelimit"
+	"github.com/zwirec/http_service_stat/retention"
+	"github.com/zwirec/http_service_stat/stream"
 	"log"
 	"errors"
 	"time"
 	"os"
+	"sync"
+	"sync/atomic"
 )
 
 const (
-	layout = "2006-01-02"
+	layout           = "2006-01-02"
+	maxEventIDLength = 255
 )
 
 type RequestHandler struct {
 	DBManager *dbManager.DBManager
 	logger    *log.Logger
+	eventIDs  *dedup.Cache
+	// unknownUsers is the config.UnknownUser* policy of AddStat.
+	unknownUsers string
+	Purger       *retention.Purger
+	// Alerts is told of the events recorded, nil turns alerts off.
+	Alerts *alerts.Alerter
+	// Stream is told of the events recorded, nil turns the stream off.
+	Stream     *stream.Hub
+	streamConf config.Stream
+	// Live is told of the events recorded, nil turns live leaderboards off.
+	Live     *live.Boards
+	liveConf config.LiveLeaderboard
+	// topCache keeps GetStat responses, nil disables caching.
+	topCache *cache.Cache
+	// credentials keeps authenticated API keys.
+	credentials   credentialsCache
+	requireAPIKey bool
+	// rotationGrace is how long a rotated API key keeps working.
+	rotationGrace time.Duration
+	// limiters are the rate limits by route.
+	limitsMu sync.RWMutex
+	limiters map[string]*ratelimit.Limiter
+	// eventQuota counts the events of each client today.
+	eventQuota *ratelimit.Quota
+	// quiet turns off the request log, 1 at the "error" log level.
+	quiet int32
 }
 
 func NewHandler(dbinfo map[string]string, logger ... *log.Logger) (*RequestHandler, error) {
@@ -27,25 +65,147 @@ func NewHandler(dbinfo map[string]string, logger ... *log.Logger) (*RequestHandl
 	if err != nil {
 		return nil, err
 	}
-	r := &RequestHandler{}
-	r.DBManager = dbm
 
 	if logger == nil {
-		r.logger = log.New(os.Stdout, "", log.LstdFlags)
+		return New(dbm, log.New(os.Stdout, "", log.LstdFlags)), nil
+	}
+	return New(dbm, logger[0]), nil
+}
+
+// New returns a handler of the data in dbm. Configure it before use.
+func New(dbm *dbManager.DBManager, logger *log.Logger) *RequestHandler {
+	return &RequestHandler{DBManager: dbm, logger: logger}
+}
+
+// Configure applies the service configuration to the handler.
+func (reqHandler *RequestHandler) Configure(conf *config.Config) {
+	reqHandler.DBManager.DedupWindow = conf.DedupWindow.Duration
+	reqHandler.DBManager.LeaderboardSize = conf.Leaderboard.Size
+	reqHandler.eventIDs = dedup.NewCache(conf.DedupCacheSize, conf.DedupWindow.Duration)
+	reqHandler.unknownUsers = conf.UnknownUserPolicy
+	reqHandler.requireAPIKey = conf.Auth.RequireAPIKey
+	reqHandler.rotationGrace = conf.Auth.RotationGrace.Duration
+
+	c := conf.Cache
+
+	if reqHandler.topCache == nil {
+		reqHandler.topCache = cache.New(c.MaxEntries, c.PastTTL.Duration, c.TodayTTL.Duration)
+	}
+
+	if reqHandler.Purger == nil {
+		reqHandler.Purger = retention.NewPurger(reqHandler.DBManager, conf, reqHandler.logger)
+	}
+
+	if reqHandler.Alerts == nil {
+		reqHandler.Alerts = alerts.New(reqHandler.DBManager, conf, reqHandler.logger)
+	}
+
+	st := conf.Stream
+	reqHandler.streamConf = st
+
+	if reqHandler.Stream == nil && st.MaxClients > 0 {
+		reqHandler.Stream = stream.NewHub(st.History, st.ClientBuffer, st.MaxClients)
+	}
+
+	l := conf.LiveLeaderboard
+	reqHandler.liveConf = l
+
+	if reqHandler.Live == nil && l.Size > 0 {
+		reqHandler.Live = live.New(reqHandler.DBManager, l.Size, l.MaxClients)
+	}
+
+	reqHandler.Reload(conf)
+}
+
+// Reloadable are the settings Reload applies; the others need a restart.
+var Reloadable = []string{"log_level", "rate_limits", "cache", "retention", "alerts"}
+
+// Reload applies the settings of conf that can change while requests are
+// served: the log level, rate limits, cache limits, retention policy and
+// alert rules.
+// Tenants, with their action catalogues, are read again from the database.
+func (reqHandler *RequestHandler) Reload(conf *config.Config) {
+	if conf.LogLevel == config.LogError {
+		atomic.StoreInt32(&reqHandler.quiet, 1)
+	} else {
+		atomic.StoreInt32(&reqHandler.quiet, 0)
+	}
+
+	reqHandler.setRateLimits(conf.RateLimits)
+
+	c := conf.Cache
+	reqHandler.topCache.SetLimits(c.MaxEntries, c.PastTTL.Duration, c.TodayTTL.Duration)
+
+	// The purger keeps event IDs for the dedup window in use.
+	policy := *conf
+	policy.DedupWindow = config.Duration{Duration: reqHandler.DBManager.DedupWindow}
+	reqHandler.Purger.SetPolicy(&policy)
+
+	reqHandler.Alerts.SetRules(conf)
+
+	reqHandler.credentials.clear()
+}
+
+// logRequest writes the request log line of req, followed by details,
+// unless only errors are logged.
+func (reqHandler *RequestHandler) logRequest(req *http.Request, httpStatus int, details ...string) {
+	if atomic.LoadInt32(&reqHandler.quiet) == 1 {
+		return
+	}
+
+	if len(details) > 0 {
+		reqHandler.logger.Printf(`%s "%s %s %s %d" %s`, req.RemoteAddr, req.Method, req.URL.Path, req.Proto, httpStatus, strings.Join(details, " "))
 	} else {
-		r.logger = logger[0]
+		reqHandler.logger.Printf(`%s "%s %s %s %d"`, req.RemoteAddr, req.Method, req.URL.Path, req.Proto, httpStatus)
 	}
+}
 
-	return r, nil
+// route is an endpoint of the HTTP API and the scope its API keys need.
+type route struct {
+	path    string
+	scope   string
+	handler http.HandlerFunc
+}
+
+func (reqHandler *RequestHandler) routes() []route {
+	return []route{
+		{"/api/users", dbManager.ScopeIngest, reqHandler.RegisterUsers},
+		{"/api/users/stats", dbManager.ScopeIngest, reqHandler.AddStat},
+		{"/api/users/stats/top", dbManager.ScopeRead, reqHandler.GetStat},
+		{"/api/users/activity", dbManager.ScopeRead, reqHandler.UserActivity},
+		{"/api/actions", dbManager.ScopeRead, reqHandler.Actions},
+		{"/api/stats/stream", dbManager.ScopeRead, reqHandler.StatsStream},
+		{"/api/stats/leaderboard/live", dbManager.ScopeRead, reqHandler.LiveLeaderboard},
+		{"/api/admin/rollup", dbManager.ScopeAdmin, reqHandler.Rollup},
+		{"/api/admin/retention", dbManager.ScopeAdmin, reqHandler.Retention},
+		{"/api/admin/migrations", dbManager.ScopeAdmin, reqHandler.Migrations},
+		{"/api/admin/keys", dbManager.ScopeAdmin, reqHandler.APIKeys},
+		{"/api/admin/keys/rotate", dbManager.ScopeAdmin, reqHandler.RotateAPIKey},
+		{"/api/admin/keys/revoke", dbManager.ScopeAdmin, reqHandler.RevokeAPIKey},
+	}
 }
 
 func (reqHandler *RequestHandler) RegisterHandleFunc() error {
-	http.HandleFunc("/api/users", reqHandler.RegisterUsers)
-	http.HandleFunc("/api/users/stats", reqHandler.AddStat)
-	http.HandleFunc("/api/users/stats/top", reqHandler.GetStat)
+	http.Handle("/", reqHandler.Handler())
 	return nil
 }
 
+// Handler returns a mux serving the HTTP API. Each route is behind its rate
+// limit and then the API key check of its scope; the OpenAPI document and
+// the health check only have the rate limit.
+func (reqHandler *RequestHandler) Handler() *http.ServeMux {
+	mux := http.NewServeMux()
+
+	for _, r := range reqHandler.routes() {
+		mux.HandleFunc(r.path, reqHandler.rateLimit(r.path, reqHandler.authorize(r.scope, r.handler)))
+	}
+
+	mux.HandleFunc("/openapi.json", reqHandler.rateLimit("/openapi.json", reqHandler.OpenAPI))
+	mux.HandleFunc("/health", reqHandler.rateLimit("/health", reqHandler.Health))
+	return mux
+}
+
+// AddStat records an event, or a batch of them sent as a JSON array.
 func (reqHandler *RequestHandler) AddStat(w http.ResponseWriter, req *http.Request) {
 	var httpStatus int
 
@@ -53,42 +213,190 @@ func (reqHandler *RequestHandler) AddStat(w http.ResponseWriter, req *http.Reque
 
 		decoder := json.NewDecoder(req.Body)
 
+		var body json.RawMessage
 		var values map[string]interface{}
 
-		if err := decoder.Decode(&values); err != nil {
+		err := decoder.Decode(&body)
+
+		if err == nil && len(body) > 0 && body[0] == '[' {
+			reqHandler.addStats(w, req, body)
+			return
+		}
+
+		if err == nil {
+			err = json.Unmarshal(body, &values)
+		}
+
+		if err != nil {
 			httpStatus = http.StatusBadRequest
 			reqHandler.writeResponse(w, "Incorrect JSON format!\n Try again\n", httpStatus)
-			reqHandler.logger.Printf(`%s "%s %s %s %d"`, req.RemoteAddr, req.Method, req.URL.Path, req.Proto, httpStatus)
+			reqHandler.logRequest(req, httpStatus)
 			return
 		}
 
-		if err := validatePOSTaddStatParams(values); err != nil {
+		if values["event_id"] == nil && req.Header.Get("Idempotency-Key") != "" {
+			values["event_id"] = req.Header.Get("Idempotency-Key")
+		}
+
+		tenant := tenantOf(req)
+
+		if err := validatePOSTaddStatParams(values, tenant); err != nil {
 			httpStatus = http.StatusBadRequest
 			reqHandler.writeResponse(w, err.Error(), httpStatus)
-			reqHandler.logger.Printf(`%s "%s %s %s %d"`, req.RemoteAddr, req.Method, req.URL.Path, req.Proto, httpStatus)
+			reqHandler.logRequest(req, httpStatus)
 			return
 		}
 
 		defer req.Body.Close()
 
-		_, err := reqHandler.DBManager.PutStats(values)
+		if !reqHandler.takeEvent(w, req) {
+			return
+		}
+
+		counted := false
+
+		defer func() {
+			if !counted {
+				reqHandler.releaseEvent(req)
+			}
+		}()
+
+		response, err := reqHandler.recordEvent(tenant, values)
+
+		if err == dbManager.ErrUnknownUser {
+			httpStatus = http.StatusUnprocessableEntity
+			reqHandler.writeResponse(w, fmt.Sprintf("Unknown user %v (register it via /api/users first)\n", values["user"]), httpStatus)
+			reqHandler.logRequest(req, httpStatus)
+			return
+		}
+
+		if err == dbManager.ErrQuotaExceeded {
+			httpStatus = http.StatusTooManyRequests
+			reqHandler.writeResponse(w, "Quota of the tenant exceeded\n", httpStatus)
+			reqHandler.logRequest(req, httpStatus)
+			return
+		}
 
 		if err != nil {
 			httpStatus = http.StatusInternalServerError
 			reqHandler.writeResponse(w, nil, httpStatus)
-			reqHandler.logger.Printf(`%s "%s %s %s %d"`, req.RemoteAddr, req.Method, req.URL.Path, req.Proto, httpStatus)
+			reqHandler.logger.Println(err)
+			reqHandler.logRequest(req, httpStatus)
 			return
 		}
 
+		httpStatus = http.StatusOK
+
+		if response["queued"] != nil {
+			httpStatus = http.StatusAccepted
+		}
+
+		counted = response["applied"] == true || response["queued"] != nil
+
+		data, _ := json.Marshal(response)
+
+		reqHandler.writeResponse(w, string(data)+"\n", httpStatus)
+		reqHandler.logRequest(req, httpStatus)
 	} else {
 		httpStatus = http.StatusMethodNotAllowed
 		reqHandler.writeResponse(w, nil, httpStatus)
-		reqHandler.logger.Printf(`%s "%s %s %s %d"`, req.RemoteAddr, req.Method, req.URL.Path, req.Proto, httpStatus)
+		reqHandler.logRequest(req, httpStatus)
 		return
 	}
 	return
 }
 
+// maxBatchEvents is how many events a batch sent to AddStat may have.
+const maxBatchEvents = 1000
+
+// statResult is the result of an event of a batch sent to AddStat: the
+// status and response AddStat would have answered for it alone, or the
+// status and error.
+type statResult struct {
+	Status      int    `json:"status"`
+	Applied     bool   `json:"applied"`
+	Queued      bool   `json:"queued,omitempty"`
+	UserCreated bool   `json:"user_created,omitempty"`
+	Error       string `json:"error,omitempty"`
+}
+
+// addStats records the events of body, a JSON array sent to AddStat, one by
+// one, and answers with their results in order. An event refused does not
+// stop the ones after it.
+func (reqHandler *RequestHandler) addStats(w http.ResponseWriter, req *http.Request, body []byte) {
+	var httpStatus int
+
+	var batch []map[string]interface{}
+
+	if err := json.Unmarshal(body, &batch); err != nil {
+		httpStatus = http.StatusBadRequest
+		reqHandler.writeResponse(w, "Incorrect JSON format!\n Try again\n", httpStatus)
+		reqHandler.logRequest(req, httpStatus)
+		return
+	}
+
+	if len(batch) == 0 || len(batch) > maxBatchEvents {
+		httpStatus = http.StatusBadRequest
+		reqHandler.writeResponse(w, fmt.Sprintf("A batch must have 1 to %d events\n", maxBatchEvents), httpStatus)
+		reqHandler.logRequest(req, httpStatus)
+		return
+	}
+
+	tenant := tenantOf(req)
+
+	results := make([]statResult, len(batch))
+
+	for i, values := range batch {
+		results[i] = reqHandler.addBatchedStat(req, tenant, values)
+	}
+
+	data, _ := json.Marshal(map[string]interface{}{"results": results})
+
+	httpStatus = http.StatusOK
+	reqHandler.writeResponse(w, string(data)+"\n", httpStatus)
+	reqHandler.logRequest(req, httpStatus)
+}
+
+// addBatchedStat records values, an event of a batch, as AddStat would.
+func (reqHandler *RequestHandler) addBatchedStat(req *http.Request, tenant *dbManager.Tenant, values map[string]interface{}) statResult {
+	if err := validatePOSTaddStatParams(values, tenant); err != nil {
+		return statResult{Status: http.StatusBadRequest, Error: err.Error()}
+	}
+
+	if reqHandler.eventQuota != nil {
+		if ok, _ := reqHandler.eventQuota.Take(clientOf(req)); !ok {
+			return statResult{Status: http.StatusTooManyRequests, Error: "Daily event quota exceeded"}
+		}
+	}
+
+	response, err := reqHandler.recordEvent(tenant, values)
+
+	result := statResult{Status: http.StatusOK}
+
+	switch {
+	case err == dbManager.ErrUnknownUser:
+		result = statResult{Status: http.StatusUnprocessableEntity, Error: fmt.Sprintf("Unknown user %v (register it via /api/users first)", values["user"])}
+	case err == dbManager.ErrQuotaExceeded:
+		result = statResult{Status: http.StatusTooManyRequests, Error: "Quota of the tenant exceeded"}
+	case err != nil:
+		reqHandler.logger.Println(err)
+		result = statResult{Status: http.StatusInternalServerError, Error: "Internal error"}
+	default:
+		result.Applied = response["applied"] == true
+		result.Queued = response["queued"] != nil
+		result.UserCreated = response["user_created"] != nil
+
+		if result.Queued {
+			result.Status = http.StatusAccepted
+		}
+	}
+
+	if !result.Applied && !result.Queued {
+		reqHandler.releaseEvent(req)
+	}
+	return result
+}
+
 func (reqHandler *RequestHandler) RegisterUsers(w http.ResponseWriter, req *http.Request) {
 	var httpStatus int
 
@@ -103,58 +411,175 @@ func (reqHandler *RequestHandler) RegisterUsers(w http.ResponseWriter, req *http
 		if err != nil {
 			httpStatus = http.StatusBadRequest
 			reqHandler.writeResponse(w, "Incorrect JSON format!\n Try again\n", httpStatus)
-			reqHandler.logger.Printf(`%s "%s %s %s %d"`, req.RemoteAddr, req.Method, req.URL.Path, req.Proto, httpStatus)
+			reqHandler.logRequest(req, httpStatus)
 			return
 		}
 
-		if err := reqHandler.validatePOSTregisterParams(values); err != nil {
+		if err := validatePOSTregisterParams(values); err != nil {
 			httpStatus = http.StatusBadRequest
 			reqHandler.writeResponse(w, err, httpStatus)
-			reqHandler.logger.Printf(`%s "%s %s %s %d"`, req.RemoteAddr, req.Method, req.URL.Path, req.Proto, httpStatus)
-			return
-		}
-
-		if !isValidSex(values["sex"].(string)) {
-			httpStatus = http.StatusBadRequest
-			reqHandler.writeResponse(w, nil, httpStatus)
-			reqHandler.logger.Printf(`%s "%s %s %s %d"`, req.RemoteAddr, req.Method, req.URL.Path, req.Proto, httpStatus)
+			reqHandler.logRequest(req, httpStatus)
 			return
 		}
 
 		defer req.Body.Close()
 
-		_, err = reqHandler.DBManager.CreateUser(values)
+		err = reqHandler.registerUser(tenantOf(req), values)
+
+		if err == dbManager.ErrQuotaExceeded {
+			httpStatus = http.StatusTooManyRequests
+			reqHandler.writeResponse(w, "Quota of the tenant exceeded\n", httpStatus)
+			reqHandler.logRequest(req, httpStatus)
+			return
+		}
 
 		if err != nil {
 			httpStatus = http.StatusInternalServerError
 			reqHandler.writeResponse(w, err.Error(), httpStatus)
-			reqHandler.logger.Printf(`%s "%s %s %s %d"`, req.RemoteAddr, req.Method, req.URL.Path, req.Proto, httpStatus)
+			reqHandler.logRequest(req, httpStatus)
 			return
 		}
 
 		httpStatus = http.StatusOK
 		reqHandler.writeResponse(w, nil, httpStatus)
-		reqHandler.logger.Printf(`%s "%s %s %s %d"`, req.RemoteAddr, req.Method, req.URL.Path, req.Proto, httpStatus)
+		reqHandler.logRequest(req, httpStatus)
 	} else {
 		httpStatus = http.StatusMethodNotAllowed
 		reqHandler.writeResponse(w, nil, httpStatus)
-		reqHandler.logger.Printf(`%s "%s %s %s %d"`, req.RemoteAddr, req.Method, req.URL.Path, req.Proto, httpStatus)
+		reqHandler.logRequest(req, httpStatus)
 		return
 	}
 }
 
-func validatePOSTaddStatParams(params map[string]interface{}) error {
-	if params["user"] == nil || params["action"] == nil || params["ts"] == nil || !isValidStatCategory(params["action"].(string)) {
-		return fmt.Errorf(`Missing one or more parameters or parameters invalid (use "id", "age" and "sex")`)
+// recordEvent records values, a validated event, for tenant following the
+// unknown user policy and returns the AddStat response.
+// dbManager.ErrUnknownUser means the policy refused the event.
+func (reqHandler *RequestHandler) recordEvent(tenant *dbManager.Tenant, values map[string]interface{}) (map[string]interface{}, error) {
+	dbm := reqHandler.DBManager.ForTenant(tenant)
+
+	eventID, _ := values["event_id"].(string)
+
+	response := map[string]interface{}{"applied": true}
+
+	if eventID != "" && reqHandler.eventIDs != nil && reqHandler.eventIDs.Contains(dedupKey(tenant, eventID)) {
+		response["applied"] = false
+		return response, nil
+	}
+
+	result, err := dbm.PutStats(values)
+
+	if err == dbManager.ErrUnknownUser {
+		switch reqHandler.unknownUsers {
+		case config.UnknownUserCreate:
+			if _, err = dbm.CreatePlaceholderUser(values["user"]); err == nil {
+				response["user_created"] = true
+				result, err = dbm.PutStats(values)
+			}
+		case config.UnknownUserQueue:
+			if _, err = dbm.QueueStats(values); err == nil {
+				response["applied"] = false
+				response["queued"] = true
+				return response, nil
+			}
+
+			// The queue of the user was applied meanwhile.
+			if err == dbManager.ErrUserRegistered {
+				result, err = dbm.PutStats(values)
+			}
+		}
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	if n, err := result.RowsAffected(); err == nil && n == 0 {
+		response["applied"] = false
+	}
+
+	if eventID != "" && reqHandler.eventIDs != nil {
+		reqHandler.eventIDs.Add(dedupKey(tenant, eventID))
+	}
+
+	if ts, err := parseTimestamp(values["ts"].(string)); err == nil && reqHandler.topCache != nil && response["applied"] == true {
+		reqHandler.topCache.Invalidate(ts)
+	}
+
+	if reqHandler.Alerts != nil && response["applied"] == true {
+		reqHandler.Alerts.Recorded(tenant.ID, values)
+	}
+
+	if reqHandler.Stream != nil && response["applied"] == true {
+		reqHandler.Stream.Publish(tenant.ID, values)
+	}
+
+	if reqHandler.Live != nil && response["applied"] == true {
+		reqHandler.Live.Record(tenant.ID, values)
+	}
+	return response, nil
+}
+
+// registerUser creates the user of values, validated, for tenant and
+// applies the stats queued for it.
+func (reqHandler *RequestHandler) registerUser(tenant *dbManager.Tenant, values map[string]interface{}) error {
+	dbm := reqHandler.DBManager.ForTenant(tenant)
+
+	if _, err := dbm.CreateUser(values); err != nil {
+		return err
+	}
+
+	if reqHandler.unknownUsers == config.UnknownUserQueue {
+		applied, err := dbm.ApplyPendingStats(values["id"])
+
+		if err != nil {
+			return err
+		}
+
+		if applied > 0 && reqHandler.topCache != nil {
+			reqHandler.topCache.Clear()
+		}
+	}
+	return nil
+}
+
+func validatePOSTaddStatParams(params map[string]interface{}, tenant *dbManager.Tenant) error {
+	if action, ok := params["action"].(string); params["user"] == nil || params["ts"] == nil || !ok || !tenant.HasAction(action) {
+		return fmt.Errorf(`Missing one or more parameters or parameters invalid (use "user", "action" and "ts"; "action" must be in the catalogue)`)
+	}
+
+	if ts, ok := params["ts"].(string); !ok {
+		return fmt.Errorf(`Incorrect "ts" (use %s or RFC 3339)`, layout)
+	} else if _, err := parseTimestamp(ts); err != nil {
+		return fmt.Errorf(`Incorrect "ts" (use %s or RFC 3339)`, layout)
+	}
+
+	if params["event_id"] != nil {
+		if id, ok := params["event_id"].(string); !ok || id == "" || len(id) > maxEventIDLength {
+			return fmt.Errorf(`Incorrect "event_id" (use a non-empty string of at most %d bytes)`, maxEventIDLength)
+		}
 	}
 	return nil
 }
 
-func (reqHanlder *RequestHandler) validatePOSTregisterParams(params map[string]interface{}) error {
+// validatePOSTregisterParams checks the user of POST /api/users and of the
+// RegisterUser RPC: a positive "id", an "age" of at least 0 and a "sex".
+func validatePOSTregisterParams(params map[string]interface{}) error {
 
 	if params["id"] == nil || params["age"] == nil || params["sex"] == nil || len(params) != 3 {
 		return errors.New(`Missing one or more parameters or parameters invalid (use "id", "age" and "sex")`)
 	}
+
+	if id, ok := dbManager.UserID(params["id"]); !ok || id <= 0 {
+		return errors.New(`Incorrect "id" (use a positive integer)`)
+	}
+
+	if age, ok := dbManager.UserID(params["age"]); !ok || age < 0 {
+		return errors.New(`Incorrect "age" (use an integer of at least 0)`)
+	}
+
+	if sex, ok := params["sex"].(string); !ok || !isValidSex(sex) {
+		return errors.New(`Incorrect "sex" (use "M" or "F")`)
+	}
 	return nil
 }
 
@@ -168,98 +593,368 @@ func (reqHandler *RequestHandler) GetStat(w http.ResponseWriter, req *http.Reque
 		if err != nil {
 			httpStatus = http.StatusBadRequest
 			reqHandler.writeResponse(w, "Incorrect query rows!", httpStatus)
-			reqHandler.logger.Printf(`%s "%s %s %s %d"`, req.RemoteAddr, req.Method, req.URL.Path, req.Proto, httpStatus)
+			reqHandler.logRequest(req, httpStatus)
 			return
 		}
 
-		if err = reqHandler.validateGETParams(values); err != nil {
+		tenant := tenantOf(req)
+
+		if err = reqHandler.validateGETParams(values, tenant); err != nil {
+			httpStatus = http.StatusBadRequest
+			reqHandler.writeResponse(w, err.Error(), httpStatus)
+			reqHandler.logRequest(req, httpStatus)
+			return
+		}
+
+		format, err := negotiateFormat(req, values)
+
+		if err != nil {
 			httpStatus = http.StatusBadRequest
 			reqHandler.writeResponse(w, err.Error(), httpStatus)
-			reqHandler.logger.Printf(`%s "%s %s %s %d"`, req.RemoteAddr, req.Method, req.URL.Path, req.Proto, httpStatus)
+			reqHandler.logRequest(req, httpStatus)
 			return
 		}
 
-		result := map[string][]map[string]interface{}{}
+		w.Header().Set("Vary", "Accept")
 
-		rows, err := reqHandler.DBManager.GetStats(values)
+		key := cacheKey(tenant, values, format)
+
+		if reqHandler.topCache != nil {
+			if entry, ok := reqHandler.topCache.Get(key); ok {
+				httpStatus = reqHandler.writeEntry(w, req, entry, format)
+				reqHandler.logRequest(req, httpStatus)
+				return
+			}
+		}
+
+		loc, _ := time.LoadLocation(values.Get("tz"))
+
+		dateLayout := layout
+
+		if values.Get("interval") == "hour" {
+			dateLayout = time.RFC3339
+		}
+
+		// Taken before the read, so that a response missing a write that
+		// invalidates the cache meanwhile is not stored.
+		var gen uint64
+
+		if reqHandler.topCache != nil {
+			gen = reqHandler.topCache.Generation()
+		}
+
+		rows, err := reqHandler.DBManager.ForTenant(tenant).GetStats(values)
 
 		if err != nil {
 			httpStatus = http.StatusInternalServerError
-			reqHandler.writeResponse(w, err, httpStatus)
-			log.Println(err)
-			reqHandler.logger.Printf(`%s "%s %s %s %d"`, req.RemoteAddr, req.Method, req.URL.Path, req.Proto, httpStatus)
+			reqHandler.writeResponse(w, nil, httpStatus)
+			reqHandler.logger.Println(err)
+			reqHandler.logRequest(req, httpStatus)
 			return
 		}
 
-		cols, _ := rows.Columns()
+		defer rows.Close()
 
-		for rows.Next() {
+		sw := &spillWriter{w: w, rc: http.NewResponseController(w), contentType: contentTypes[format], max: maxBufferedBody}
 
-			columns := make([]interface{}, len(cols))
-			columnPointers := make([]interface{}, len(cols))
+		err = encodeRows(rows, newRowEncoder(format, sw, loc, dateLayout))
 
-			for k := 0; k < len(columns); k++ {
-				columnPointers[k] = &columns[k]
+		if sw.Spilled() {
+			// Too late for a status code, the encoder has marked the failure.
+			if err != nil {
+				reqHandler.logger.Println(err)
 			}
 
-			if err := rows.Scan(columnPointers...); err != nil {
-				httpStatus = http.StatusInternalServerError
-				reqHandler.writeResponse(w, nil, httpStatus)
-				reqHandler.logger.Printf(`%s "%s %s %s %d"`, req.RemoteAddr, req.Method, req.URL.Path, req.Proto, httpStatus)
-			}
+			httpStatus = http.StatusOK
+			reqHandler.logRequest(req, httpStatus)
+			return
+		}
+
+		if err != nil {
+			httpStatus = http.StatusInternalServerError
+			reqHandler.writeResponse(w, nil, httpStatus)
+			reqHandler.logger.Println(err)
+			reqHandler.logRequest(req, httpStatus)
+			return
+		}
+
+		body := sw.Bytes()
+
+		entry := &cache.Entry{Body: body, ETag: cache.ETag(body)}
+
+		if reqHandler.topCache != nil {
+			// The days of the range start at midnight in the time zone.
+			from, _ := time.ParseInLocation(layout, values.Get("date1"), loc)
+			to, _ := time.ParseInLocation(layout, values.Get("date2"), loc)
+			entry = reqHandler.topCache.Put(key, from, to, body, gen)
+		}
+
+		httpStatus = reqHandler.writeEntry(w, req, entry, format)
+		reqHandler.logRequest(req, httpStatus)
+	} else {
+		httpStatus = http.StatusMethodNotAllowed
+		reqHandler.writeResponse(w, nil, httpStatus)
+		reqHandler.logRequest(req, httpStatus)
+	}
+}
+
+// Rollup rebuilds the daily counters of the tenant in [date1, date2) from
+// the raw events log. Ranges reaching back before the first day the log
+// has whole are refused, so that counters of purged or backfilled days are
+// not wiped.
+func (reqHandler *RequestHandler) Rollup(w http.ResponseWriter, req *http.Request) {
+	var httpStatus int
 
-			m := make(map[string]interface{})
+	if req.Method == "POST" {
 
-			for i, colName := range cols {
-				val := columnPointers[i].(*interface{})
-				m[colName] = *val
+		values, err := url.ParseQuery(req.URL.RawQuery)
+
+		if err != nil {
+			httpStatus = http.StatusBadRequest
+			reqHandler.writeResponse(w, "Incorrect query rows!", httpStatus)
+			reqHandler.logRequest(req, httpStatus)
+			return
+		}
+
+		if err = validateDateRange(values); err != nil {
+			httpStatus = http.StatusBadRequest
+			reqHandler.writeResponse(w, err.Error(), httpStatus)
+			reqHandler.logRequest(req, httpStatus)
+			return
+		}
+
+		dbm := reqHandler.DBManager.ForTenant(tenantOf(req))
+
+		first, err := reqHandler.eventsLogStart(dbm, time.Now())
+
+		if err != nil {
+			httpStatus = http.StatusInternalServerError
+			reqHandler.writeResponse(w, nil, httpStatus)
+			reqHandler.logger.Println(err)
+			reqHandler.logRequest(req, httpStatus)
+			return
+		}
+
+		if date1, _ := time.Parse(layout, values.Get("date1")); first.IsZero() || date1.Before(first) {
+			httpStatus = http.StatusBadRequest
+
+			if first.IsZero() {
+				reqHandler.writeResponse(w, "No events logged to roll up\n", httpStatus)
+			} else {
+				reqHandler.writeResponse(w, fmt.Sprintf(`"date1" is before the events log (use %s or later)`+"\n", first.Format(layout)), httpStatus)
 			}
 
-			date := m["date"].(time.Time).Format(layout)
+			reqHandler.logRequest(req, httpStatus)
+			return
+		}
+
+		result, err := dbm.RollupStats(values.Get("date1"), values.Get("date2"))
 
-			result[date] = append(result[date], m)
+		if err != nil {
+			httpStatus = http.StatusInternalServerError
+			reqHandler.writeResponse(w, nil, httpStatus)
+			reqHandler.logger.Println(err)
+			reqHandler.logRequest(req, httpStatus)
+			return
+		}
 
+		if reqHandler.topCache != nil {
+			from, _ := time.Parse(layout, values.Get("date1"))
+			to, _ := time.Parse(layout, values.Get("date2"))
+			reqHandler.topCache.InvalidateRange(from, to)
 		}
 
-		rr := []map[string]interface{}{}
+		n, _ := result.RowsAffected()
 
-		var keys []string
+		data, _ := json.Marshal(map[string]interface{}{"rows": n})
 
-		for k := range result {
-			keys = append(keys, k)
+		httpStatus = http.StatusOK
+		reqHandler.writeResponse(w, string(data)+"\n", httpStatus)
+		reqHandler.logRequest(req, httpStatus)
+	} else {
+		httpStatus = http.StatusMethodNotAllowed
+		reqHandler.writeResponse(w, nil, httpStatus)
+		reqHandler.logRequest(req, httpStatus)
+	}
+}
+
+// eventsLogStart returns the first UTC day the events log of dbm has whole
+// at now, zero if the log is empty. That is the events retention cutoff if
+// the log reaches back to it; otherwise the log started during the day of
+// its oldest event, which may be missing events.
+func (reqHandler *RequestHandler) eventsLogStart(dbm *dbManager.DBManager, now time.Time) (time.Time, error) {
+	oldest, ok, err := dbm.OldestEvent()
+
+	if err != nil || !ok {
+		return time.Time{}, err
+	}
+
+	day := oldest.UTC().Truncate(24 * time.Hour)
+
+	if reqHandler.Purger != nil {
+		if cutoff, ok := reqHandler.Purger.Cutoff("events", now); ok && !cutoff.Before(day) {
+			return cutoff, nil
 		}
+	}
+	return day.AddDate(0, 0, 1), nil
+}
 
-		sort.Strings(keys)
+// Migrations applies the schema migrations the database lacks. The schema
+// is shared, so only the default tenant may run them.
+func (reqHandler *RequestHandler) Migrations(w http.ResponseWriter, req *http.Request) {
+	var httpStatus int
 
-		for _, k := range keys {
-			rr = append(rr, map[string]interface{}{"date": k, "rows": result[k]})
+	if req.Method == "POST" {
+
+		if tenantOf(req).ID != defaultTenant.ID {
+			httpStatus = http.StatusForbidden
+			reqHandler.writeError(w, "Migrations are run by the default tenant only", httpStatus)
+			reqHandler.logRequest(req, httpStatus)
+			return
 		}
 
-		responseJSON := map[string]interface{}{}
+		applied, err := reqHandler.DBManager.Migrate()
+
+		if err != nil {
+			httpStatus = http.StatusInternalServerError
+			reqHandler.writeResponse(w, nil, httpStatus)
+			reqHandler.logger.Println(err)
+			reqHandler.logRequest(req, httpStatus)
+			return
+		}
 
-		responseJSON["items"] = rr
+		if applied == nil {
+			applied = []string{}
+		}
 
-		data, _ := json.Marshal(responseJSON)
+		data, _ := json.Marshal(map[string]interface{}{"applied": applied})
 
 		httpStatus = http.StatusOK
+		reqHandler.writeResponse(w, string(data)+"\n", httpStatus)
+		reqHandler.logRequest(req, httpStatus, fmt.Sprintf("%d applied", len(applied)))
+	} else {
+		httpStatus = http.StatusMethodNotAllowed
+		reqHandler.writeResponse(w, nil, httpStatus)
+		reqHandler.logRequest(req, httpStatus)
+	}
+}
+
+// Retention previews (GET) or runs (POST) the purge of expired data.
+func (reqHandler *RequestHandler) Retention(w http.ResponseWriter, req *http.Request) {
+	var httpStatus int
+
+	if req.Method == "GET" || req.Method == "POST" {
+
+		var tables []retention.Table
+		var err error
+
+		if req.Method == "GET" {
+			tables, err = reqHandler.Purger.Preview(time.Now())
+		} else {
+			tables, err = reqHandler.Purger.Purge(time.Now())
+
+			if reqHandler.topCache != nil {
+				reqHandler.topCache.Clear()
+			}
+		}
+
+		if err != nil {
+			httpStatus = http.StatusInternalServerError
+			reqHandler.writeResponse(w, nil, httpStatus)
+			reqHandler.logger.Println(err)
+			reqHandler.logRequest(req, httpStatus)
+			return
+		}
+
+		data, _ := json.Marshal(map[string]interface{}{"tables": tables})
 
+		httpStatus = http.StatusOK
 		reqHandler.writeResponse(w, string(data)+"\n", httpStatus)
-		reqHandler.logger.Printf(`%s "%s %s %s %d"`, req.RemoteAddr, req.Method, req.URL.Path, req.Proto, httpStatus)
+		reqHandler.logRequest(req, httpStatus)
 	} else {
 		httpStatus = http.StatusMethodNotAllowed
 		reqHandler.writeResponse(w, nil, httpStatus)
-		reqHandler.logger.Printf(`%s "%s %s %s %d"`, req.RemoteAddr, req.Method, req.URL.Path, req.Proto, httpStatus)
+		reqHandler.logRequest(req, httpStatus)
+	}
+}
+
+func validateDateRange(params url.Values) error {
+	date1, err := time.Parse(layout, params.Get("date1"))
+
+	if err != nil {
+		return fmt.Errorf(`Missing or invalid "date1" (use %s)`, layout)
+	}
+
+	date2, err := time.Parse(layout, params.Get("date2"))
+
+	if err != nil {
+		return fmt.Errorf(`Missing or invalid "date2" (use %s)`, layout)
+	}
+
+	if !date1.Before(date2) {
+		return fmt.Errorf(`"date1" must be before "date2"`)
+	}
+	return nil
+}
+
+// cacheKey normalizes the GetStat query parameters of tenant.
+func cacheKey(tenant *dbManager.Tenant, params url.Values, format string) string {
+	key := url.Values{"format": {format}, "tenant": {strconv.Itoa(tenant.ID)}}
+
+	for _, name := range []string{"date1", "date2", "action", "limit"} {
+		key.Set(name, params.Get(name))
+	}
+
+	key.Set("interval", "day")
+
+	if params.Get("interval") != "" {
+		key.Set("interval", params.Get("interval"))
+	}
+
+	key.Set("tz", "UTC")
+
+	if params.Get("tz") != "" {
+		key.Set("tz", params.Get("tz"))
+	}
+	return key.Encode()
+}
+
+// writeEntry writes a cached response, or 304 if the client has it already.
+func (reqHandler *RequestHandler) writeEntry(w http.ResponseWriter, req *http.Request, entry *cache.Entry, format string) int {
+	w.Header().Set("ETag", entry.ETag)
+	w.Header().Set("Content-Type", contentTypes[format])
+
+	for _, etag := range strings.Split(req.Header.Get("If-None-Match"), ",") {
+		if etag = strings.TrimSpace(etag); etag == entry.ETag || etag == "*" {
+			reqHandler.writeResponse(w, nil, http.StatusNotModified)
+			return http.StatusNotModified
+		}
 	}
+
+	reqHandler.writeResponse(w, string(entry.Body), http.StatusOK)
+	return http.StatusOK
 }
 
-func (reqHandler *RequestHandler) validateGETParams(params url.Values) error {
+func (reqHandler *RequestHandler) validateGETParams(params url.Values, tenant *dbManager.Tenant) error {
 
 	if params["date1"] == nil || params["date2"] == nil || params["action"] == nil || params["limit"] == nil {
-		return fmt.Errorf("Incorrect number of params (have %d, must 4)", len(params))
+		return fmt.Errorf(`Missing one or more parameters (use "date1", "date2", "action" and "limit")`)
+	}
+
+	if !tenant.HasAction(params["action"][0]) {
+		return fmt.Errorf(`Incorrect "action" (not in the catalogue)`)
+	}
+
+	if limit, err := strconv.Atoi(params["limit"][0]); err != nil || limit <= 0 {
+		return fmt.Errorf(`Incorrect "limit" (use a positive integer)`)
 	}
 
-	if !isValidStatCategory(params["action"][0]) {
-		return fmt.Errorf("Incorrect value(s)")
+	if interval := params.Get("interval"); interval != "" && !isValidInterval(interval) {
+		return fmt.Errorf(`Incorrect "interval" (use "hour", "day", "week" or "month")`)
+	}
+
+	if _, err := time.LoadLocation(params.Get("tz")); err != nil || params.Get("tz") == "Local" {
+		return fmt.Errorf(`Incorrect "tz" (use an IANA time zone name)`)
 	}
 
 	return nil
@@ -277,18 +972,26 @@ func (reqHandler *RequestHandler) writeResponse(w http.ResponseWriter, data inte
 	return nil
 }
 
-func isValidStatCategory(category string) bool {
-	switch category {
+func isValidInterval(interval string) bool {
+	switch interval {
 	case
-		"login",
-		"like",
-		"commentary",
-		"logout":
+		"hour",
+		"day",
+		"week",
+		"month":
 		return true
 	}
 	return false
 }
 
+// parseTimestamp parses an event ts, either a date or an RFC 3339 time.
+func parseTimestamp(ts string) (time.Time, error) {
+	if t, err := time.Parse(layout, ts); err == nil {
+		return t, nil
+	}
+	return time.Parse(time.RFC3339, ts)
+}
+
 func isValidSex(sex string) bool {
 	if !(sex == "M" || sex == "F") {
 		return false
@@ -8,11 +8,14 @@ import (
 	"io/ioutil"
 	"testing"
 	"net/http"
+	"github.com/zwirec/http_service_stat/config"
 	"github.com/zwirec/http_service_stat/dbManager"
 	"github.com/DATA-DOG/go-sqlmock"
-	_"github.com/lib/pq"
+	"github.com/lib/pq"
 	"os"
 	"fmt"
+	"strings"
+	"time"
 )
 
 func TestAddUsers(t *testing.T) {
@@ -55,7 +58,7 @@ func TestAddUsers(t *testing.T) {
 		}
 
 		mock.ExpectExec("INSERT INTO users (.*)").WithArgs(
-			persons_info["id"], persons_info["age"], persons_info["sex"]).WillReturnResult(sqlmock.NewResult(1, 1))
+			persons_info["id"], persons_info["age"], persons_info["sex"], 0).WillReturnResult(sqlmock.NewResult(1, 1))
 
 		req, err := http.NewRequest("POST", "http://localhost:1234/api/users", bytes.NewBuffer(person))
 
@@ -192,7 +195,7 @@ func TestAddUserIntervalServerError(t *testing.T) {
 		if err != nil {
 			t.Fatal(err)
 		}
-		mock.ExpectExec("INSERT INTO users (.*)").WithArgs("2", "18", "M").WillReturnError(
+		mock.ExpectExec("INSERT INTO users (.*)").WithArgs("2", "18", "M", 0).WillReturnError(
 			fmt.Errorf("smth error"))
 		rr := httptest.NewRecorder()
 
@@ -227,6 +230,17 @@ func TestAddStatBadRequest(t *testing.T) {
 			"incorrect_field": "2",
 			"action": "18",
 			"ts": "2012-10-10"
+		}`,
+		`{
+			"user": "2",
+			"action": "like",
+			"ts": "10/10/2012"
+		}`,
+		`{
+			"user": "2",
+			"action": "like",
+			"ts": "2012-10-10",
+			"event_id": 5
 		}`}
 
 	rH := RequestHandler{DBManager: &dbm, logger: log.New(os.Stdout, "", log.LstdFlags)}
@@ -282,8 +296,10 @@ func TestAddStatInternalServerError(t *testing.T) {
 		if err != nil {
 			t.Fatal(err)
 		}
-		mock.ExpectExec("INSERT INTO (.*)").WithArgs("2", "like", "2012-02-02").WillReturnError(
+		mock.ExpectBegin()
+		mock.ExpectExec("INSERT INTO events (.*)").WithArgs("2", "like", "2012-02-02", nil, 0).WillReturnError(
 			fmt.Errorf("smth error"))
+		mock.ExpectRollback()
 		rr := httptest.NewRecorder()
 
 		if err != nil {
@@ -298,8 +314,8 @@ func TestAddStatInternalServerError(t *testing.T) {
 	}
 }
 
-func TestAddStatMethodNotAllowed(t *testing.T) {
-	db, _, err := sqlmock.New()
+func TestAddStatOK(t *testing.T) {
+	db, mock, err := sqlmock.New()
 
 	if err != nil {
 		log.Fatal(err)
@@ -309,31 +325,219 @@ func TestAddStatMethodNotAllowed(t *testing.T) {
 
 	rH := RequestHandler{DBManager: &dbm, logger: log.New(os.Stdout, "", log.LstdFlags)}
 
-	req, err := http.NewRequest("GET", "http://localhost:1234/api/users/stats", nil)
+	handler := http.HandlerFunc(rH.AddStat)
+
+	b := `{
+			"user": "2",
+			"action": "like",
+			"ts": "2012-02-02T10:00:00Z"
+		}`
+
+	req, err := http.NewRequest("POST", "http://localhost:1234/api/users/stats", bytes.NewBuffer([]byte(b)))
 
 	if err != nil {
 		t.Fatal(err)
 	}
 
+	mock.ExpectBegin()
+	mock.ExpectExec("INSERT INTO events (.*)").WithArgs("2", "like", "2012-02-02T10:00:00Z", nil, 0).WillReturnResult(
+		sqlmock.NewResult(1, 1))
+	mock.ExpectExec("INSERT INTO stats (.*)").WithArgs("2", "like", "2012-02-02T10:00:00Z", 0).WillReturnResult(
+		sqlmock.NewResult(1, 1))
+	mock.ExpectExec("INSERT INTO stats_hourly (.*)").WithArgs("2", "like", "2012-02-02T10:00:00Z", 0).WillReturnResult(
+		sqlmock.NewResult(1, 1))
+	mock.ExpectCommit()
+
 	rr := httptest.NewRecorder()
 
+	handler.ServeHTTP(rr, req)
+
+	if status := rr.Code; status != http.StatusOK {
+		t.Errorf("handler returned wrong status code: got %v want %v",
+			status, http.StatusOK)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatalf("there were unfulfilled expections: %s", err)
+	}
+}
+
+func TestAddStatTenant(t *testing.T) {
+	db, mock, err := sqlmock.New()
+
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	handler := http.HandlerFunc(rH.AddStat)
+	dbm := dbManager.DBManager{DB: db}
 
-	handler.ServeHTTP(rr, req)
+	rH := RequestHandler{DBManager: &dbm, logger: log.New(os.Stdout, "", log.LstdFlags)}
 
-	if status := rr.Code; status != http.StatusMethodNotAllowed {
-		t.Errorf("handler returned wrong status code: got %v want %v",
-			status, http.StatusMethodNotAllowed)
+	handler := rH.authorize(dbManager.ScopeIngest, rH.AddStat)
+
+	mock.ExpectQuery("FROM api_keys").WithArgs(dbManager.HashAPIKey("unknown")).WillReturnRows(
+		sqlmock.NewRows(apiKeyColumns))
+	mock.ExpectQuery("FROM api_keys").WithArgs(dbManager.HashAPIKey("key-3")).WillReturnRows(
+		sqlmock.NewRows(apiKeyColumns).AddRow(1, 3, "{ingest}", "", time.Now(), nil, nil))
+	mock.ExpectQuery("FROM tenants").WithArgs(3).WillReturnRows(
+		sqlmock.NewRows([]string{"name", "daily_events", "max_users", "actions"}).AddRow("shop", 100, 0, "{purchase,view}"))
+	mock.ExpectBegin()
+	mock.ExpectExec("INSERT INTO events (.*)").WithArgs("2", "purchase", "2012-02-02", nil, 3).WillReturnResult(
+		sqlmock.NewResult(1, 1))
+	mock.ExpectExec("INSERT INTO stats (.*)").WithArgs("2", "purchase", "2012-02-02", 3).WillReturnResult(
+		sqlmock.NewResult(1, 1))
+	mock.ExpectExec("INSERT INTO stats_hourly (.*)").WithArgs("2", "purchase", "2012-02-02", 3).WillReturnResult(
+		sqlmock.NewResult(1, 1))
+	mock.ExpectExec("INSERT INTO tenant_usage (.*)").WithArgs(3, 100).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectRollback()
+
+	for _, test := range []struct {
+		key    string
+		action string
+		status int
+	}{
+		{"unknown", "like", http.StatusUnauthorized},
+		// Not in the catalogue of the tenant.
+		{"key-3", "like", http.StatusBadRequest},
+		{"key-3", "purchase", http.StatusTooManyRequests},
+	} {
+		b := fmt.Sprintf(`{"user": "2", "action": "%s", "ts": "2012-02-02"}`, test.action)
+
+		req, err := http.NewRequest("POST", "http://localhost:1234/api/users/stats", bytes.NewBuffer([]byte(b)))
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		req.Header.Set("X-API-Key", test.key)
+
+		rr := httptest.NewRecorder()
+
+		handler.ServeHTTP(rr, req)
 
+		if status := rr.Code; status != test.status {
+			t.Errorf("%s %s: handler returned wrong status code: got %v want %v",
+				test.key, test.action, status, test.status)
+		}
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatalf("there were unfulfilled expections: %s", err)
 	}
 }
 
-func TestGetStatMethodNotAllowed(t *testing.T) {
-	db, _, err := sqlmock.New()
+var apiKeyColumns = []string{"id", "tenant_id", "scopes", "key_hash", "created_at", "expires_at", "revoked_at"}
+
+func TestAuthorize(t *testing.T) {
+	db, mock, err := sqlmock.New()
+
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	dbm := dbManager.DBManager{DB: db}
+
+	rH := RequestHandler{DBManager: &dbm, logger: log.New(os.Stdout, "", log.LstdFlags), requireAPIKey: true}
+
+	mock.ExpectQuery("FROM api_keys").WithArgs(dbManager.HashAPIKey("reader")).WillReturnRows(
+		sqlmock.NewRows(apiKeyColumns).AddRow(4, 3, "{read}", "", time.Now(), nil, nil))
+	mock.ExpectQuery("FROM tenants").WithArgs(3).WillReturnRows(
+		sqlmock.NewRows([]string{"name", "daily_events", "max_users", "actions"}).AddRow("shop", 0, 0, "{purchase}"))
+
+	tenantName := func(w http.ResponseWriter, req *http.Request) {
+		fmt.Fprint(w, tenantOf(req).Name)
+	}
+
+	for _, test := range []struct {
+		scope  string
+		header string
+		status int
+		body   string
+	}{
+		{dbManager.ScopeRead, "", http.StatusUnauthorized, "{\"error\":\"API key required\"}\n"},
+		{dbManager.ScopeIngest, "Bearer reader", http.StatusForbidden, "{\"error\":\"API key lacks the \\\"ingest\\\" scope\"}\n"},
+		// Authenticated from the cache this time.
+		{dbManager.ScopeRead, "Bearer reader", http.StatusOK, "shop"},
+	} {
+		req, err := http.NewRequest("GET", "http://localhost:1234/api/users/stats/top", nil)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if test.header != "" {
+			req.Header.Set("Authorization", test.header)
+		}
+
+		rr := httptest.NewRecorder()
+
+		rH.authorize(test.scope, tenantName).ServeHTTP(rr, req)
+
+		if status := rr.Code; status != test.status {
+			t.Errorf("%q: handler returned wrong status code: got %v want %v", test.header, status, test.status)
+		}
+
+		if rr.Body.String() != test.body {
+			t.Errorf("%q: handler returned unexpected body: got %q want %q", test.header, rr.Body.String(), test.body)
+		}
+
+		if test.status == http.StatusUnauthorized && rr.Header().Get("WWW-Authenticate") == "" {
+			t.Errorf("%q: no WWW-Authenticate challenge", test.header)
+		}
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatalf("there were unfulfilled expections: %s", err)
+	}
+}
+
+func TestRateLimit(t *testing.T) {
+	rH := RequestHandler{logger: log.New(os.Stdout, "", log.LstdFlags)}
+
+	rH.setRateLimits(config.RateLimits{Routes: map[string]config.RateLimit{"*": {Rate: 1, Burst: 2}}})
+
+	handler := rH.rateLimit("/api/users/stats/top", func(w http.ResponseWriter, req *http.Request) {})
+
+	for _, test := range []struct {
+		addr       string
+		status     int
+		remaining  string
+		retryAfter string
+	}{
+		{"10.0.0.1:5000", http.StatusOK, "1", ""},
+		{"10.0.0.1:5001", http.StatusOK, "0", ""},
+		{"10.0.0.1:5002", http.StatusTooManyRequests, "0", "1"},
+		{"10.0.0.2:5000", http.StatusOK, "1", ""},
+	} {
+		req, err := http.NewRequest("GET", "http://localhost:1234/api/users/stats/top", nil)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		req.RemoteAddr = test.addr
+
+		rr := httptest.NewRecorder()
+
+		handler.ServeHTTP(rr, req)
+
+		if status := rr.Code; status != test.status {
+			t.Errorf("%s: handler returned wrong status code: got %v want %v", test.addr, status, test.status)
+		}
+
+		if rr.Header().Get("RateLimit-Limit") != "2" || rr.Header().Get("RateLimit-Remaining") != test.remaining {
+			t.Errorf("%s: wrong RateLimit headers: %v", test.addr, rr.Header())
+		}
+
+		if rr.Header().Get("Retry-After") != test.retryAfter {
+			t.Errorf("%s: got Retry-After %q want %q", test.addr, rr.Header().Get("Retry-After"), test.retryAfter)
+		}
+	}
+}
+
+// Clients with keys get a bucket each, whatever their address.
+func TestRateLimitByKey(t *testing.T) {
+	db, mock, err := sqlmock.New()
 
 	if err != nil {
 		log.Fatal(err)
@@ -343,31 +547,194 @@ func TestGetStatMethodNotAllowed(t *testing.T) {
 
 	rH := RequestHandler{DBManager: &dbm, logger: log.New(os.Stdout, "", log.LstdFlags)}
 
-	req, err := http.NewRequest("POST", "http://localhost:1234/api/users/stats/top", nil)
+	rH.setRateLimits(config.RateLimits{Routes: map[string]config.RateLimit{"*": {Rate: 1, Burst: 1}}})
+
+	for id, key := range []string{"a", "b"} {
+		mock.ExpectQuery("FROM api_keys").WithArgs(dbManager.HashAPIKey(key)).WillReturnRows(
+			sqlmock.NewRows(apiKeyColumns).AddRow(id+1, 0, "{read}", dbManager.HashAPIKey(key), time.Now(), nil, nil))
+		mock.ExpectQuery("FROM tenants").WithArgs(0).WillReturnRows(
+			sqlmock.NewRows([]string{"name", "daily_events", "max_users", "actions"}).AddRow("default", 0, 0, "{like}"))
+	}
+
+	handler := rH.rateLimit("/api/users/stats/top", func(w http.ResponseWriter, req *http.Request) {})
+
+	for _, test := range []struct {
+		key    string
+		status int
+	}{
+		{"a", http.StatusOK},
+		{"b", http.StatusOK},
+		{"", http.StatusOK},
+		{"a", http.StatusTooManyRequests},
+		{"", http.StatusTooManyRequests},
+	} {
+		req := httptest.NewRequest("GET", "/api/users/stats/top", nil)
+		req.RemoteAddr = "10.0.0.1:5000"
+
+		if test.key != "" {
+			req.Header.Set(apiKeyHeader, test.key)
+		}
+
+		rr := httptest.NewRecorder()
+
+		handler.ServeHTTP(rr, req)
+
+		if rr.Code != test.status {
+			t.Errorf("request with key %q: got %d want %d", test.key, rr.Code, test.status)
+		}
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatalf("there were unfulfilled expections: %s", err)
+	}
+}
+
+func TestRateLimitBeforeAuth(t *testing.T) {
+	db, mock, err := sqlmock.New()
+
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	dbm := dbManager.DBManager{DB: db}
+
+	rH := RequestHandler{DBManager: &dbm, logger: log.New(os.Stdout, "", log.LstdFlags), requireAPIKey: true}
+
+	rH.setRateLimits(config.RateLimits{Routes: map[string]config.RateLimit{"*": {Rate: 1, Burst: 2}}})
+
+	// The unknown key is looked up once.
+	mock.ExpectQuery("FROM api_keys").WithArgs(dbManager.HashAPIKey("guess")).WillReturnRows(
+		sqlmock.NewRows(apiKeyColumns))
+
+	handler := rH.Handler()
+
+	for _, status := range []int{http.StatusUnauthorized, http.StatusUnauthorized, http.StatusTooManyRequests} {
+		req, err := http.NewRequest("GET", "http://localhost:1234/api/users/stats/top", nil)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		req.RemoteAddr = "10.0.0.1:5000"
+		req.Header.Set(apiKeyHeader, "guess")
+
+		rr := httptest.NewRecorder()
+
+		handler.ServeHTTP(rr, req)
+
+		if rr.Code != status {
+			t.Errorf("handler returned wrong status code: got %v want %v", rr.Code, status)
+		}
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatalf("there were unfulfilled expections: %s", err)
+	}
+}
+
+func TestReload(t *testing.T) {
+	var logged bytes.Buffer
+
+	rH := RequestHandler{DBManager: &dbManager.DBManager{}, logger: log.New(&logged, "", 0)}
+
+	conf := config.Default()
+	conf.LogLevel = config.LogError
+
+	rH.Configure(conf)
+	rH.credentials.put("hash", &credentials{expires: time.Now().Add(time.Hour)})
+
+	req, err := http.NewRequest("GET", "http://localhost:1234/api/users/stats", nil)
 
 	if err != nil {
 		t.Fatal(err)
 	}
 
-	rr := httptest.NewRecorder()
+	req.RemoteAddr = "10.0.0.1:5000"
+
+	rH.AddStat(httptest.NewRecorder(), req)
+
+	if logged.Len() != 0 {
+		t.Fatalf("request logged at the error level: %q", logged.String())
+	}
+
+	reloaded := config.Default()
+	reloaded.RateLimits.Routes = map[string]config.RateLimit{"*": {Rate: 1, Burst: 1}}
+
+	rH.Reload(reloaded)
+
+	rH.AddStat(httptest.NewRecorder(), req)
+
+	if logged.String() != `10.0.0.1:5000 "GET /api/users/stats HTTP/1.1 405"`+"\n" {
+		t.Errorf("request not logged at the info level: %q", logged.String())
+	}
+
+	if l := rH.limiter("/api/users/stats"); l == nil || l.Allow("a").Limit != 1 {
+		t.Error("rate limits not reloaded")
+	}
+
+	if _, ok := rH.credentials.get("hash", time.Now()); ok {
+		t.Error("tenants not read again after a reload")
+	}
+}
+
+func TestAddStatDailyQuota(t *testing.T) {
+	db, mock, err := sqlmock.New()
 
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	handler := http.HandlerFunc(rH.GetStat)
+	dbm := dbManager.DBManager{DB: db}
 
-	handler.ServeHTTP(rr, req)
+	rH := RequestHandler{DBManager: &dbm, logger: log.New(os.Stdout, "", log.LstdFlags)}
 
-	if status := rr.Code; status != http.StatusMethodNotAllowed {
-		t.Errorf("handler returned wrong status code: got %v want %v",
-			status, http.StatusMethodNotAllowed)
+	rH.setRateLimits(config.RateLimits{DailyEvents: 1})
+
+	mock.ExpectBegin()
+	mock.ExpectExec("INSERT INTO events (.*)").WithArgs("2", "like", "2012-02-02", nil, 0).WillReturnError(
+		fmt.Errorf("some error"))
+	mock.ExpectRollback()
+	mock.ExpectBegin()
+	mock.ExpectExec("INSERT INTO events (.*)").WithArgs("2", "like", "2012-02-02", nil, 0).WillReturnResult(
+		sqlmock.NewResult(1, 1))
+	mock.ExpectExec("INSERT INTO stats (.*)").WithArgs("2", "like", "2012-02-02", 0).WillReturnResult(
+		sqlmock.NewResult(1, 1))
+	mock.ExpectExec("INSERT INTO stats_hourly (.*)").WithArgs("2", "like", "2012-02-02", 0).WillReturnResult(
+		sqlmock.NewResult(1, 1))
+	mock.ExpectCommit()
+
+	// The failed event does not count against the quota.
+	for _, status := range []int{http.StatusInternalServerError, http.StatusOK, http.StatusTooManyRequests} {
+		b := `{"user": "2", "action": "like", "ts": "2012-02-02"}`
+
+		req, err := http.NewRequest("POST", "http://localhost:1234/api/users/stats", bytes.NewBuffer([]byte(b)))
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		req.RemoteAddr = "10.0.0.1:5000"
+
+		rr := httptest.NewRecorder()
+
+		rH.AddStat(rr, req)
+
+		if rr.Code != status {
+			t.Errorf("handler returned wrong status code: got %v want %v", rr.Code, status)
+		}
 
+		if status == http.StatusTooManyRequests && rr.Header().Get("Retry-After") == "" {
+			t.Error("no Retry-After once the quota is used up")
+		}
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatalf("there were unfulfilled expections: %s", err)
 	}
 }
 
-func TestGetIncorrectQueryRow(t *testing.T) {
-	db, _, err := sqlmock.New()
+func TestAPIKeys(t *testing.T) {
+	db, mock, err := sqlmock.New()
 
 	if err != nil {
 		log.Fatal(err)
@@ -375,11 +742,20 @@ func TestGetIncorrectQueryRow(t *testing.T) {
 
 	dbm := dbManager.DBManager{DB: db}
 
-	rH := RequestHandler{DBManager: &dbm, logger: log.New(os.Stdout, "", log.LstdFlags)}
+	rH := RequestHandler{DBManager: &dbm, logger: log.New(os.Stdout, "", log.LstdFlags), rotationGrace: time.Hour}
 
-	handler := http.HandlerFunc(rH.GetStat)
+	created := time.Date(2012, 2, 2, 0, 0, 0, 0, time.UTC)
 
-	req, err := http.NewRequest("GET", "http://localhost:1234/api/users/stats/top?fапп a:a1&&", nil)
+	mock.ExpectBegin()
+	mock.ExpectQuery("UPDATE api_keys SET expires_at").WithArgs(5, 0, float64(3600)).WillReturnRows(
+		sqlmock.NewRows(apiKeyColumns).AddRow(5, 0, "{ingest,read}", "old-hash", created, created.Add(time.Hour), nil))
+	mock.ExpectQuery("INSERT INTO api_keys").WithArgs(sqlmock.AnyArg(), 0, sqlmock.AnyArg()).WillReturnRows(
+		sqlmock.NewRows(apiKeyColumns).AddRow(6, 0, "{ingest,read}", "new-hash", created, nil, nil))
+	mock.ExpectCommit()
+	mock.ExpectQuery("UPDATE api_keys SET revoked_at").WithArgs(9, 0).WillReturnRows(
+		sqlmock.NewRows(apiKeyColumns))
+
+	req, err := http.NewRequest("POST", "http://localhost:1234/api/admin/keys/rotate?id=5", nil)
 
 	if err != nil {
 		t.Fatal(err)
@@ -387,21 +763,53 @@ func TestGetIncorrectQueryRow(t *testing.T) {
 
 	rr := httptest.NewRecorder()
 
+	http.HandlerFunc(rH.RotateAPIKey).ServeHTTP(rr, req)
+
+	var rotated struct {
+		ID       int
+		Key      string
+		Scopes   []string
+		Replaces struct {
+			ID        int
+			ExpiresAt *time.Time `json:"expires_at"`
+		}
+	}
+
+	if err := json.Unmarshal(rr.Body.Bytes(), &rotated); err != nil || rr.Code != http.StatusCreated {
+		t.Fatalf("unexpected rotation response: %d %q", rr.Code, rr.Body.String())
+	}
+
+	if rotated.ID != 6 || !strings.HasPrefix(rotated.Key, "ss_") || len(rotated.Scopes) != 2 ||
+		rotated.Replaces.ID != 5 || rotated.Replaces.ExpiresAt == nil {
+		t.Errorf("unexpected rotation response: %q", rr.Body.String())
+	}
+
+	if strings.Contains(rr.Body.String(), "hash") {
+		t.Errorf("rotation response shows key hashes: %q", rr.Body.String())
+	}
+
+	req, err = http.NewRequest("POST", "http://localhost:1234/api/admin/keys/revoke?id=9", nil)
+
 	if err != nil {
-		log.Fatal(err)
+		t.Fatal(err)
 	}
 
-	handler.ServeHTTP(rr, req)
+	rr = httptest.NewRecorder()
 
-	if status := rr.Code; status != http.StatusBadRequest {
-		t.Errorf("handler returned wrong status code: got %v want %v",
-			status, http.StatusBadRequest)
+	http.HandlerFunc(rH.RevokeAPIKey).ServeHTTP(rr, req)
 
+	if rr.Code != http.StatusNotFound {
+		t.Errorf("revoking an unknown key: got %d want %d", rr.Code, http.StatusNotFound)
 	}
 
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatalf("there were unfulfilled expections: %s", err)
+	}
 }
 
-func TestGetOK(t *testing.T) {
+// Without a required key, requests without one may ingest and read but
+// not reach the admin routes.
+func TestKeylessAdmin(t *testing.T) {
 	db, mock, err := sqlmock.New()
 
 	if err != nil {
@@ -412,30 +820,1056 @@ func TestGetOK(t *testing.T) {
 
 	rH := RequestHandler{DBManager: &dbm, logger: log.New(os.Stdout, "", log.LstdFlags)}
 
-	handler := http.HandlerFunc(rH.GetStat)
-
-	req, err := http.NewRequest("GET", "http://localhost:1234/api/users/stats/top?date1=2012-02-02&date2=2012-03-10&action=like&limit=1", nil)
+	mock.ExpectQuery("FROM tenants").WithArgs(0).WillReturnRows(
+		sqlmock.NewRows([]string{"name", "daily_events", "max_users", "actions"}).AddRow("default", 0, 0, "{like}"))
+
+	handler := rH.Handler()
+
+	for _, test := range []struct {
+		method string
+		path   string
+		status int
+	}{
+		{"GET", "/api/actions", http.StatusOK},
+		{"POST", "/api/admin/keys", http.StatusUnauthorized},
+		{"POST", "/api/admin/keys/revoke?id=1", http.StatusUnauthorized},
+		{"POST", "/api/admin/migrations", http.StatusUnauthorized},
+		{"POST", "/api/admin/retention", http.StatusUnauthorized},
+	} {
+		rr := httptest.NewRecorder()
 
-	rows := sqlmock.NewRows(nil)
+		handler.ServeHTTP(rr, httptest.NewRequest(test.method, test.path, nil))
 
-	mock.ExpectQuery("SELECT ").WithArgs(sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg()).WillReturnRows(rows)
+		if rr.Code != test.status {
+			t.Errorf("%s %s without a key: got %d want %d", test.method, test.path, rr.Code, test.status)
+		}
+	}
 
-	if err != nil {
-		t.Fatal(err)
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatalf("there were unfulfilled expections: %s", err)
 	}
+}
 
-	rr := httptest.NewRecorder()
+// A revoked key is refused at once, not when its cached credentials expire.
+func TestRevokedAPIKey(t *testing.T) {
+	db, mock, err := sqlmock.New()
 
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	handler.ServeHTTP(rr, req)
+	dbm := dbManager.DBManager{DB: db}
 
-	if status := rr.Code; status != http.StatusOK {
-		t.Errorf("handler returned wrong status code: got %v want %v",
-			status, http.StatusOK)
+	rH := RequestHandler{DBManager: &dbm, logger: log.New(os.Stdout, "", log.LstdFlags), requireAPIKey: true}
+
+	handler := rH.authorize(dbManager.ScopeRead, func(w http.ResponseWriter, req *http.Request) {})
+
+	get := func() int {
+		req := httptest.NewRequest("GET", "/api/users/stats/top", nil)
+		req.Header.Set("X-API-Key", "reader")
 
+		rr := httptest.NewRecorder()
+
+		handler(rr, req)
+		return rr.Code
+	}
+
+	mock.ExpectQuery("FROM api_keys").WithArgs(dbManager.HashAPIKey("reader")).WillReturnRows(
+		sqlmock.NewRows(apiKeyColumns).AddRow(4, 0, "{read}", dbManager.HashAPIKey("reader"), time.Now(), nil, nil))
+	mock.ExpectQuery("FROM tenants").WithArgs(0).WillReturnRows(
+		sqlmock.NewRows([]string{"name", "daily_events", "max_users", "actions"}).AddRow("default", 0, 0, "{like}"))
+
+	// The second request is authenticated from the cache.
+	for i := 0; i < 2; i++ {
+		if status := get(); status != http.StatusOK {
+			t.Fatalf("request %d with the key: got %d want %d", i, status, http.StatusOK)
+		}
+	}
+
+	mock.ExpectQuery("UPDATE api_keys SET revoked_at").WithArgs(4, 0).WillReturnRows(
+		sqlmock.NewRows(apiKeyColumns).AddRow(4, 0, "{read}", dbManager.HashAPIKey("reader"), time.Now(), nil, time.Now()))
+	mock.ExpectQuery("FROM api_keys").WithArgs(dbManager.HashAPIKey("reader")).WillReturnRows(
+		sqlmock.NewRows(apiKeyColumns))
+
+	rr := httptest.NewRecorder()
+
+	rH.RevokeAPIKey(rr, httptest.NewRequest("POST", "/api/admin/keys/revoke?id=4", nil))
+
+	if rr.Code != http.StatusOK {
+		t.Fatalf("RevokeAPIKey returned %d", rr.Code)
 	}
 
+	if status := get(); status != http.StatusUnauthorized {
+		t.Errorf("request with the revoked key: got %d want %d", status, http.StatusUnauthorized)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatalf("there were unfulfilled expections: %s", err)
+	}
+}
+
+func TestAddStatIdempotent(t *testing.T) {
+	db, mock, err := sqlmock.New()
+
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	dbm := dbManager.DBManager{DB: db}
+
+	rH := RequestHandler{DBManager: &dbm, logger: log.New(os.Stdout, "", log.LstdFlags)}
+	rH.Configure(&config.Config{DedupWindow: config.Duration{Duration: time.Hour}, DedupCacheSize: 10})
+
+	handler := http.HandlerFunc(rH.AddStat)
+
+	b := `{
+			"user": "2",
+			"action": "like",
+			"ts": "2012-02-02"
+		}`
+
+	mock.ExpectBegin()
+	mock.ExpectExec("INSERT INTO event_ids (.*)").WithArgs("key-1", float64(3600), 0).WillReturnResult(
+		sqlmock.NewResult(0, 1))
+	mock.ExpectExec("INSERT INTO events (.*)").WithArgs("2", "like", "2012-02-02", "key-1", 0).WillReturnResult(
+		sqlmock.NewResult(1, 1))
+	mock.ExpectExec("INSERT INTO stats (.*)").WithArgs("2", "like", "2012-02-02", 0).WillReturnResult(
+		sqlmock.NewResult(1, 1))
+	mock.ExpectExec("INSERT INTO stats_hourly (.*)").WithArgs("2", "like", "2012-02-02", 0).WillReturnResult(
+		sqlmock.NewResult(1, 1))
+	mock.ExpectCommit()
+
+	// Seen by the database but not by this instance, e.g. after a restart.
+	mock.ExpectBegin()
+	mock.ExpectExec("INSERT INTO event_ids (.*)").WithArgs("key-2", float64(3600), 0).WillReturnResult(
+		sqlmock.NewResult(0, 0))
+	mock.ExpectCommit()
+
+	for _, test := range []struct {
+		key     string
+		applied bool
+	}{{"key-1", true}, {"key-1", false}, {"key-2", false}} {
+		req, err := http.NewRequest("POST", "http://localhost:1234/api/users/stats", bytes.NewBuffer([]byte(b)))
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		req.Header.Set("Idempotency-Key", test.key)
+
+		rr := httptest.NewRecorder()
+
+		handler.ServeHTTP(rr, req)
+
+		if status := rr.Code; status != http.StatusOK {
+			t.Errorf("handler returned wrong status code: got %v want %v",
+				status, http.StatusOK)
+		}
+
+		if want := fmt.Sprintf("{\"applied\":%t}\n", test.applied); rr.Body.String() != want {
+			t.Errorf("handler returned unexpected body: got %q want %q", rr.Body.String(), want)
+		}
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatalf("there were unfulfilled expections: %s", err)
+	}
+}
+
+func TestAddStatBatch(t *testing.T) {
+	db, mock, err := sqlmock.New()
+
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	dbm := dbManager.DBManager{DB: db}
+
+	rH := RequestHandler{DBManager: &dbm, logger: log.New(os.Stdout, "", log.LstdFlags)}
+
+	handler := http.HandlerFunc(rH.AddStat)
+
+	mock.ExpectBegin()
+	mock.ExpectExec("INSERT INTO events (.*)").WithArgs(float64(2), "like", "2012-02-02", nil, 0).WillReturnResult(
+		sqlmock.NewResult(1, 1))
+	mock.ExpectExec("INSERT INTO stats (.*)").WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectExec("INSERT INTO stats_hourly (.*)").WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectCommit()
+	mock.ExpectBegin()
+	mock.ExpectExec("INSERT INTO events (.*)").WithArgs(float64(7), "login", "2012-02-02", nil, 0).WillReturnError(
+		&pq.Error{Code: "23503"})
+	mock.ExpectRollback()
+
+	for _, test := range []struct {
+		body   string
+		status int
+		want   string
+	}{
+		{`[]`, http.StatusBadRequest, ""},
+		{`[{"user": 2, "action": "like", "ts": "2012-02-02"}, {"user": 2, "action": "purchase", "ts": "2012-02-02"},
+		   {"user": 7, "action": "login", "ts": "2012-02-02"}]`, http.StatusOK,
+			`{"results":[{"status":200,"applied":true},` +
+				`{"status":400,"applied":false,"error":"Missing one or more parameters or parameters invalid (use \"user\", \"action\" and \"ts\"; \"action\" must be in the catalogue)"},` +
+				`{"status":422,"applied":false,"error":"Unknown user 7 (register it via /api/users first)"}]}` + "\n"},
+	} {
+		rr := httptest.NewRecorder()
+
+		handler.ServeHTTP(rr, httptest.NewRequest("POST", "/api/users/stats", strings.NewReader(test.body)))
+
+		if rr.Code != test.status {
+			t.Errorf("%s: handler returned wrong status code: got %v want %v", test.body, rr.Code, test.status)
+		}
+
+		if test.want != "" && rr.Body.String() != test.want {
+			t.Errorf("handler returned unexpected body: got %q want %q", rr.Body.String(), test.want)
+		}
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatalf("there were unfulfilled expections: %s", err)
+	}
+}
+
+func TestAddStatUnknownUser(t *testing.T) {
+	b := `{
+			"user": "7",
+			"action": "login",
+			"ts": "2012-02-02"
+		}`
+
+	unknownUser := &pq.Error{Code: "23503"}
+
+	for _, test := range []struct {
+		policy string
+		expect func(mock sqlmock.Sqlmock)
+		status int
+		body   string
+	}{
+		{config.UnknownUserReject, func(mock sqlmock.Sqlmock) {}, http.StatusUnprocessableEntity, ""},
+		{config.UnknownUserCreate, func(mock sqlmock.Sqlmock) {
+			mock.ExpectExec("INSERT INTO users (.*)").WithArgs("7", 0).WillReturnResult(sqlmock.NewResult(1, 1))
+			mock.ExpectBegin()
+			mock.ExpectExec("INSERT INTO events (.*)").WillReturnResult(sqlmock.NewResult(1, 1))
+			mock.ExpectExec("INSERT INTO stats (.*)").WillReturnResult(sqlmock.NewResult(1, 1))
+			mock.ExpectExec("INSERT INTO stats_hourly (.*)").WillReturnResult(sqlmock.NewResult(1, 1))
+			mock.ExpectCommit()
+		}, http.StatusOK, "{\"applied\":true,\"user_created\":true}\n"},
+		{config.UnknownUserQueue, func(mock sqlmock.Sqlmock) {
+			mock.ExpectBegin()
+			mock.ExpectExec("pg_advisory_xact_lock").WithArgs(0, "7").WillReturnResult(sqlmock.NewResult(0, 0))
+			mock.ExpectQuery("FROM users").WithArgs("7", 0).WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(false))
+			mock.ExpectExec("INSERT INTO pending_stats (.*)").WithArgs("7", "login", "2012-02-02", nil, 0).WillReturnResult(
+				sqlmock.NewResult(1, 1))
+			mock.ExpectCommit()
+		}, http.StatusAccepted, "{\"applied\":false,\"queued\":true}\n"},
+		// The user was registered and its queue applied since the event was
+		// refused: it is put, not queued for good.
+		{config.UnknownUserQueue, func(mock sqlmock.Sqlmock) {
+			mock.ExpectBegin()
+			mock.ExpectExec("pg_advisory_xact_lock").WithArgs(0, "7").WillReturnResult(sqlmock.NewResult(0, 0))
+			mock.ExpectQuery("FROM users").WithArgs("7", 0).WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(true))
+			mock.ExpectRollback()
+			mock.ExpectBegin()
+			mock.ExpectExec("INSERT INTO events (.*)").WillReturnResult(sqlmock.NewResult(1, 1))
+			mock.ExpectExec("INSERT INTO stats (.*)").WillReturnResult(sqlmock.NewResult(1, 1))
+			mock.ExpectExec("INSERT INTO stats_hourly (.*)").WillReturnResult(sqlmock.NewResult(1, 1))
+			mock.ExpectCommit()
+		}, http.StatusOK, "{\"applied\":true}\n"},
+	} {
+		db, mock, err := sqlmock.New()
+
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		dbm := dbManager.DBManager{DB: db}
+
+		rH := RequestHandler{DBManager: &dbm, logger: log.New(os.Stdout, "", log.LstdFlags), unknownUsers: test.policy}
+
+		handler := http.HandlerFunc(rH.AddStat)
+
+		mock.ExpectBegin()
+		mock.ExpectExec("INSERT INTO events (.*)").WithArgs("7", "login", "2012-02-02", nil, 0).WillReturnError(unknownUser)
+		mock.ExpectRollback()
+		test.expect(mock)
+
+		req, err := http.NewRequest("POST", "http://localhost:1234/api/users/stats", bytes.NewBuffer([]byte(b)))
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		rr := httptest.NewRecorder()
+
+		handler.ServeHTTP(rr, req)
+
+		if status := rr.Code; status != test.status {
+			t.Errorf("%s: handler returned wrong status code: got %v want %v",
+				test.policy, status, test.status)
+		}
+
+		if test.body != "" && rr.Body.String() != test.body {
+			t.Errorf("%s: handler returned unexpected body: got %q want %q", test.policy, rr.Body.String(), test.body)
+		}
+
+		if err := mock.ExpectationsWereMet(); err != nil {
+			t.Fatalf("%s: there were unfulfilled expections: %s", test.policy, err)
+		}
+	}
+}
+
+func TestAddUserAppliesPendingStats(t *testing.T) {
+	db, mock, err := sqlmock.New()
+
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	dbm := dbManager.DBManager{DB: db}
+
+	rH := RequestHandler{DBManager: &dbm, logger: log.New(os.Stdout, "", log.LstdFlags), unknownUsers: config.UnknownUserQueue}
+
+	handler := http.HandlerFunc(rH.RegisterUsers)
+
+	ts := time.Date(2012, 2, 2, 10, 0, 0, 0, time.UTC)
+
+	mock.ExpectExec("INSERT INTO users (.*)").WithArgs("7", "30", "F", 0).WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectBegin()
+	mock.ExpectExec("pg_advisory_xact_lock").WithArgs(0, "7").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectQuery("DELETE FROM pending_stats (.*)").WithArgs("7", 0).WillReturnRows(
+		sqlmock.NewRows([]string{"user", "action", "ts", "event_id"}).AddRow("7", "login", ts, nil))
+	mock.ExpectExec("INSERT INTO events (.*)").WithArgs("7", "login", "2012-02-02T10:00:00Z", nil, 0).WillReturnResult(
+		sqlmock.NewResult(1, 1))
+	mock.ExpectExec("INSERT INTO stats (.*)").WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectExec("INSERT INTO stats_hourly (.*)").WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectCommit()
+
+	req, err := http.NewRequest("POST", "http://localhost:1234/api/users", bytes.NewBuffer([]byte(`{"id": "7", "age": "30", "sex": "F"}`)))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rr := httptest.NewRecorder()
+
+	handler.ServeHTTP(rr, req)
+
+	if status := rr.Code; status != http.StatusOK {
+		t.Errorf("handler returned wrong status code: got %v want %v",
+			status, http.StatusOK)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatalf("there were unfulfilled expections: %s", err)
+	}
+}
+
+func TestAddStatMethodNotAllowed(t *testing.T) {
+	db, _, err := sqlmock.New()
+
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	dbm := dbManager.DBManager{DB: db}
+
+	rH := RequestHandler{DBManager: &dbm, logger: log.New(os.Stdout, "", log.LstdFlags)}
+
+	req, err := http.NewRequest("GET", "http://localhost:1234/api/users/stats", nil)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rr := httptest.NewRecorder()
+
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	handler := http.HandlerFunc(rH.AddStat)
+
+	handler.ServeHTTP(rr, req)
+
+	if status := rr.Code; status != http.StatusMethodNotAllowed {
+		t.Errorf("handler returned wrong status code: got %v want %v",
+			status, http.StatusMethodNotAllowed)
+
+	}
+}
+
+func TestGetStatMethodNotAllowed(t *testing.T) {
+	db, _, err := sqlmock.New()
+
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	dbm := dbManager.DBManager{DB: db}
+
+	rH := RequestHandler{DBManager: &dbm, logger: log.New(os.Stdout, "", log.LstdFlags)}
+
+	req, err := http.NewRequest("POST", "http://localhost:1234/api/users/stats/top", nil)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rr := httptest.NewRecorder()
+
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	handler := http.HandlerFunc(rH.GetStat)
+
+	handler.ServeHTTP(rr, req)
+
+	if status := rr.Code; status != http.StatusMethodNotAllowed {
+		t.Errorf("handler returned wrong status code: got %v want %v",
+			status, http.StatusMethodNotAllowed)
+
+	}
+}
+
+func TestGetIncorrectQueryRow(t *testing.T) {
+	db, _, err := sqlmock.New()
+
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	dbm := dbManager.DBManager{DB: db}
+
+	rH := RequestHandler{DBManager: &dbm, logger: log.New(os.Stdout, "", log.LstdFlags)}
+
+	handler := http.HandlerFunc(rH.GetStat)
+
+	req, err := http.NewRequest("GET", "http://localhost:1234/api/users/stats/top?fапп a:a1&&", nil)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rr := httptest.NewRecorder()
+
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	handler.ServeHTTP(rr, req)
+
+	if status := rr.Code; status != http.StatusBadRequest {
+		t.Errorf("handler returned wrong status code: got %v want %v",
+			status, http.StatusBadRequest)
+
+	}
+
+}
+
+func TestGetOK(t *testing.T) {
+	db, mock, err := sqlmock.New()
+
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	dbm := dbManager.DBManager{DB: db}
+
+	rH := RequestHandler{DBManager: &dbm, logger: log.New(os.Stdout, "", log.LstdFlags)}
+
+	handler := http.HandlerFunc(rH.GetStat)
+
+	req, err := http.NewRequest("GET", "http://localhost:1234/api/users/stats/top?date1=2012-02-02&date2=2012-03-10&action=like&limit=1", nil)
+
+	rows := sqlmock.NewRows(nil)
+
+	mock.ExpectQuery("SELECT ").WithArgs(sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(), 0).WillReturnRows(rows)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rr := httptest.NewRecorder()
+
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	handler.ServeHTTP(rr, req)
+
+	if status := rr.Code; status != http.StatusOK {
+		t.Errorf("handler returned wrong status code: got %v want %v",
+			status, http.StatusOK)
+
+	}
+
+}
+
+func TestGetHourly(t *testing.T) {
+	db, mock, err := sqlmock.New()
+
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	dbm := dbManager.DBManager{DB: db}
+
+	rH := RequestHandler{DBManager: &dbm, logger: log.New(os.Stdout, "", log.LstdFlags)}
+
+	handler := http.HandlerFunc(rH.GetStat)
+
+	for _, query := range []string{"interval=minute", "tz=Mars/Olympus", "tz=Local"} {
+		req, err := http.NewRequest("GET", "http://localhost:1234/api/users/stats/top?date1=2012-02-02&date2=2012-02-03&action=login&limit=1&"+query, nil)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		rr := httptest.NewRecorder()
+
+		handler.ServeHTTP(rr, req)
+
+		if status := rr.Code; status != http.StatusBadRequest {
+			t.Errorf("handler returned wrong status code for %q: got %v want %v",
+				query, status, http.StatusBadRequest)
+		}
+	}
+
+	hour := time.Date(2012, 2, 2, 8, 0, 0, 0, time.UTC)
+
+	rows := sqlmock.NewRows([]string{"date", "id", "age", "sex", "cnt"}).AddRow(hour, 1, 20, "M", 5)
+
+	mock.ExpectQuery("FROM stats_hourly").WithArgs("2012-02-02", "2012-02-03", "login", "1", "hour", "Europe/Moscow", 0).WillReturnRows(rows)
+
+	req, err := http.NewRequest("GET", "http://localhost:1234/api/users/stats/top?date1=2012-02-02&date2=2012-02-03&action=login&limit=1&interval=hour&tz=Europe/Moscow", nil)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rr := httptest.NewRecorder()
+
+	handler.ServeHTTP(rr, req)
+
+	if status := rr.Code; status != http.StatusOK {
+		t.Errorf("handler returned wrong status code: got %v want %v",
+			status, http.StatusOK)
+	}
+
+	if body := rr.Body.String(); !strings.Contains(body, `"date":"2012-02-02T12:00:00+04:00"`) {
+		t.Errorf("handler returned unexpected body: got %q", body)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatalf("there were unfulfilled expections: %s", err)
+	}
+}
+
+func TestGetLeaderboard(t *testing.T) {
+	db, mock, err := sqlmock.New()
+
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	dbm := dbManager.DBManager{DB: db, LeaderboardSize: 10}
+
+	rH := RequestHandler{DBManager: &dbm, logger: log.New(os.Stdout, "", log.LstdFlags)}
+
+	handler := http.HandlerFunc(rH.GetStat)
+
+	columns := []string{"date", "id", "age", "sex", "cnt"}
+
+	// Up to date leaderboards.
+	mock.ExpectQuery("FROM leaderboard_days").WithArgs("2012-02-02", "2012-02-04", "like", 0).WillReturnRows(
+		sqlmock.NewRows([]string{"count"}).AddRow(0))
+	mock.ExpectQuery("FROM leaderboard l, users u").WithArgs("2012-02-02", "2012-02-04", "like", "2", 0).WillReturnRows(
+		sqlmock.NewRows(columns))
+
+	// A day is stale.
+	mock.ExpectQuery("FROM leaderboard_days").WithArgs("2012-02-02", "2012-02-04", "like", 0).WillReturnRows(
+		sqlmock.NewRows([]string{"count"}).AddRow(1))
+	mock.ExpectQuery("FROM stats s, users u").WithArgs("2012-02-02", "2012-02-04", "like", "2", 0).WillReturnRows(
+		sqlmock.NewRows(columns))
+
+	// The limit does not fit.
+	mock.ExpectQuery("FROM stats s, users u").WithArgs("2012-02-02", "2012-02-04", "like", "11", 0).WillReturnRows(
+		sqlmock.NewRows(columns))
+
+	for _, limit := range []string{"2", "2", "11"} {
+		req, err := http.NewRequest("GET", "http://localhost:1234/api/users/stats/top?date1=2012-02-02&date2=2012-02-04&action=like&limit="+limit, nil)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		rr := httptest.NewRecorder()
+
+		handler.ServeHTTP(rr, req)
+
+		if status := rr.Code; status != http.StatusOK {
+			t.Errorf("handler returned wrong status code: got %v want %v",
+				status, http.StatusOK)
+		}
+	}
+
+	req, err := http.NewRequest("GET", "http://localhost:1234/api/users/stats/top?date1=2012-02-02&date2=2012-02-04&action=like&limit=ten", nil)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rr := httptest.NewRecorder()
+
+	handler.ServeHTTP(rr, req)
+
+	if status := rr.Code; status != http.StatusBadRequest {
+		t.Errorf("handler returned wrong status code: got %v want %v",
+			status, http.StatusBadRequest)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatalf("there were unfulfilled expections: %s", err)
+	}
+}
+
+func TestGetCached(t *testing.T) {
+	db, mock, err := sqlmock.New()
+
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	dbm := dbManager.DBManager{DB: db}
+
+	rH := RequestHandler{DBManager: &dbm, logger: log.New(os.Stdout, "", log.LstdFlags)}
+
+	conf := config.Default()
+	conf.Leaderboard.Size = 0
+	rH.Configure(conf)
+
+	columns := []string{"date", "id", "age", "sex", "cnt"}
+	day := time.Date(2012, 2, 2, 0, 0, 0, 0, time.UTC)
+
+	get := func(etag string) *httptest.ResponseRecorder {
+		req, err := http.NewRequest("GET", "http://localhost:1234/api/users/stats/top?limit=1&action=like&date1=2012-02-02&date2=2012-02-03", nil)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if etag != "" {
+			req.Header.Set("If-None-Match", etag)
+		}
+
+		rr := httptest.NewRecorder()
+		http.HandlerFunc(rH.GetStat).ServeHTTP(rr, req)
+		return rr
+	}
+
+	mock.ExpectQuery("FROM stats s, users u").WillReturnRows(sqlmock.NewRows(columns).AddRow(day, 1, 20, "M", 5))
+
+	first := get("")
+	etag := first.Header().Get("ETag")
+
+	if first.Code != http.StatusOK || etag == "" {
+		t.Fatalf("unexpected first response: %d, ETag %q", first.Code, etag)
+	}
+
+	if second := get(""); second.Code != http.StatusOK || second.Body.String() != first.Body.String() {
+		t.Errorf("unexpected cached response: %d %q", second.Code, second.Body.String())
+	}
+
+	if rr := get(etag); rr.Code != http.StatusNotModified {
+		t.Errorf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusNotModified)
+	}
+
+	mock.ExpectBegin()
+	mock.ExpectExec("INSERT INTO events (.*)").WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectExec("INSERT INTO stats (.*)").WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectExec("INSERT INTO stats_hourly (.*)").WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectCommit()
+
+	req, err := http.NewRequest("POST", "http://localhost:1234/api/users/stats", bytes.NewBuffer([]byte(`{"user": "1", "action": "like", "ts": "2012-02-02T12:00:00Z"}`)))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	http.HandlerFunc(rH.AddStat).ServeHTTP(httptest.NewRecorder(), req)
+
+	mock.ExpectQuery("FROM stats s, users u").WillReturnRows(sqlmock.NewRows(columns).AddRow(day, 1, 20, "M", 6))
+
+	if rr := get(etag); rr.Code != http.StatusOK || rr.Header().Get("ETag") == etag {
+		t.Errorf("stale response after a write: %d, ETag %q", rr.Code, rr.Header().Get("ETag"))
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatalf("there were unfulfilled expections: %s", err)
+	}
+}
+
+func TestGetFormats(t *testing.T) {
+	db, mock, err := sqlmock.New()
+
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	dbm := dbManager.DBManager{DB: db}
+
+	rH := RequestHandler{DBManager: &dbm, logger: log.New(os.Stdout, "", log.LstdFlags)}
+
+	handler := http.HandlerFunc(rH.GetStat)
+
+	columns := []string{"date", "id", "age", "sex", "cnt"}
+	day := time.Date(2012, 2, 2, 0, 0, 0, 0, time.UTC)
+
+	for _, test := range []struct {
+		query       string
+		accept      string
+		contentType string
+		body        string
+	}{
+		{"&format=csv", "application/json", "text/csv; charset=utf-8",
+			"date,id,age,sex,cnt\n2012-02-02,1,20,M,5\n2012-02-02,7,,,3\n"},
+		{"", "application/x-ndjson", "application/x-ndjson",
+			`{"age":20,"cnt":5,"date":"2012-02-02","id":1,"sex":"M"}` + "\n" +
+				`{"age":null,"cnt":3,"date":"2012-02-02","id":7,"sex":null}` + "\n"},
+	} {
+		mock.ExpectQuery("FROM stats s, users u").WillReturnRows(
+			sqlmock.NewRows(columns).AddRow(day, 1, 20, "M", 5).AddRow(day, 7, nil, nil, 3))
+
+		req, err := http.NewRequest("GET", "http://localhost:1234/api/users/stats/top?date1=2012-02-02&date2=2012-02-03&action=like&limit=2"+test.query, nil)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		req.Header.Set("Accept", test.accept)
+
+		rr := httptest.NewRecorder()
+
+		handler.ServeHTTP(rr, req)
+
+		if status := rr.Code; status != http.StatusOK {
+			t.Errorf("handler returned wrong status code: got %v want %v",
+				status, http.StatusOK)
+		}
+
+		if contentType := rr.Header().Get("Content-Type"); contentType != test.contentType {
+			t.Errorf("handler returned wrong Content-Type: got %q want %q", contentType, test.contentType)
+		}
+
+		if body := rr.Body.String(); body != test.body {
+			t.Errorf("handler returned unexpected body: got %q want %q", body, test.body)
+		}
+	}
+
+	req, err := http.NewRequest("GET", "http://localhost:1234/api/users/stats/top?date1=2012-02-02&date2=2012-02-03&action=like&limit=2&format=xml", nil)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rr := httptest.NewRecorder()
+
+	handler.ServeHTTP(rr, req)
+
+	if status := rr.Code; status != http.StatusBadRequest {
+		t.Errorf("handler returned wrong status code: got %v want %v",
+			status, http.StatusBadRequest)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatalf("there were unfulfilled expections: %s", err)
+	}
+}
+
+func TestGetStreaming(t *testing.T) {
+	db, mock, err := sqlmock.New()
+
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	dbm := dbManager.DBManager{DB: db}
+
+	rH := RequestHandler{DBManager: &dbm, logger: log.New(os.Stdout, "", log.LstdFlags)}
+
+	handler := http.HandlerFunc(rH.GetStat)
+
+	columns := []string{"date", "id", "age", "sex", "cnt"}
+	day1 := time.Date(2012, 2, 2, 0, 0, 0, 0, time.UTC)
+	day2 := day1.AddDate(0, 0, 1)
+
+	get := func() *httptest.ResponseRecorder {
+		req, err := http.NewRequest("GET", "http://localhost:1234/api/users/stats/top?date1=2012-02-02&date2=2012-02-04&action=like&limit=2", nil)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		return rr
+	}
+
+	mock.ExpectQuery("FROM stats s, users u").WillReturnRows(sqlmock.NewRows(columns).
+		AddRow(day1, 1, 20, "M", 5).AddRow(day1, 2, 18, "F", 4).AddRow(day2, 1, 20, "M", 7))
+
+	want := `{"items":[` +
+		`{"date":"2012-02-02","rows":[{"age":20,"cnt":5,"date":"2012-02-02T00:00:00Z","id":1,"sex":"M"},` +
+		`{"age":18,"cnt":4,"date":"2012-02-02T00:00:00Z","id":2,"sex":"F"}]},` +
+		`{"date":"2012-02-03","rows":[{"age":20,"cnt":7,"date":"2012-02-03T00:00:00Z","id":1,"sex":"M"}]}]}` + "\n"
+
+	if rr := get(); rr.Code != http.StatusOK || rr.Body.String() != want || rr.Header().Get("Content-Type") != "application/json" {
+		t.Errorf("unexpected response: %d %q %q", rr.Code, rr.Header().Get("Content-Type"), rr.Body.String())
+	}
+
+	// A failure before anything is written out is reported with a status code.
+	mock.ExpectQuery("FROM stats s, users u").WillReturnRows(sqlmock.NewRows(columns).
+		AddRow(day1, 1, 20, "M", 5).RowError(0, fmt.Errorf("connection reset")))
+
+	if rr := get(); rr.Code != http.StatusInternalServerError {
+		t.Errorf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusInternalServerError)
+	}
+
+	// Past the buffer the response is streamed and a failure ends the document.
+	rows := sqlmock.NewRows(columns)
+
+	n := maxBufferedBody/50 + 1
+
+	for i := 0; i < n; i++ {
+		rows.AddRow(day1, i, 20, "M", n-i)
+	}
+
+	rows.AddRow(day2, 1, 20, "M", 1).RowError(n, fmt.Errorf("connection reset"))
+
+	mock.ExpectQuery("FROM stats s, users u").WillReturnRows(rows)
+
+	rr := get()
+
+	var response struct {
+		Items []struct {
+			Rows []map[string]interface{}
+		}
+		Error string
+	}
+
+	if err := json.Unmarshal(rr.Body.Bytes(), &response); err != nil {
+		t.Fatalf("streamed response is not JSON: %s", err)
+	}
+
+	if rr.Code != http.StatusOK || len(response.Items) != 1 || len(response.Items[0].Rows) != n || response.Error == "" {
+		t.Errorf("unexpected streamed response: %d, %d items, error %q", rr.Code, len(response.Items), response.Error)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatalf("there were unfulfilled expections: %s", err)
+	}
+}
+
+func TestRollup(t *testing.T) {
+	db, mock, err := sqlmock.New()
+
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	dbm := dbManager.DBManager{DB: db}
+
+	rH := RequestHandler{DBManager: &dbm, logger: log.New(os.Stdout, "", log.LstdFlags)}
+
+	handler := http.HandlerFunc(rH.Rollup)
+
+	for _, query := range []string{"", "date1=2012-02-02", "date1=2012-03-10&date2=2012-02-02"} {
+		req, err := http.NewRequest("POST", "http://localhost:1234/api/admin/rollup?"+query, nil)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		rr := httptest.NewRecorder()
+
+		handler.ServeHTTP(rr, req)
+
+		if status := rr.Code; status != http.StatusBadRequest {
+			t.Errorf("handler returned wrong status code for %q: got %v want %v",
+				query, status, http.StatusBadRequest)
+		}
+	}
+
+	// The log starts during 2012-02-01, or is empty.
+	mock.ExpectQuery("SELECT min[(]ts[)] FROM events").WithArgs(0).WillReturnRows(
+		sqlmock.NewRows([]string{"min"}).AddRow(time.Date(2012, 2, 1, 10, 0, 0, 0, time.UTC)))
+	mock.ExpectQuery("SELECT min[(]ts[)] FROM events").WithArgs(0).WillReturnRows(
+		sqlmock.NewRows([]string{"min"}).AddRow(nil))
+
+	for _, query := range []string{"date1=2012-02-01&date2=2012-03-10", "date1=2012-02-02&date2=2012-03-10"} {
+		req, err := http.NewRequest("POST", "http://localhost:1234/api/admin/rollup?"+query, nil)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		rr := httptest.NewRecorder()
+
+		handler.ServeHTTP(rr, req)
+
+		if status := rr.Code; status != http.StatusBadRequest {
+			t.Errorf("handler returned wrong status code for %q before the log: got %v want %v",
+				query, status, http.StatusBadRequest)
+		}
+	}
+
+	mock.ExpectQuery("SELECT min[(]ts[)] FROM events").WithArgs(0).WillReturnRows(
+		sqlmock.NewRows([]string{"min"}).AddRow(time.Date(2012, 2, 1, 10, 0, 0, 0, time.UTC)))
+	mock.ExpectBegin()
+	mock.ExpectExec("DELETE FROM stats (.*)").WithArgs("2012-02-02", "2012-03-10", 0).WillReturnResult(
+		sqlmock.NewResult(0, 3))
+	mock.ExpectExec("DELETE FROM stats_hourly (.*)").WithArgs("2012-02-02", "2012-03-10", 0).WillReturnResult(
+		sqlmock.NewResult(0, 5))
+	mock.ExpectExec("INSERT INTO stats_hourly (.*)").WithArgs("2012-02-02", "2012-03-10", 0).WillReturnResult(
+		sqlmock.NewResult(0, 6))
+	mock.ExpectExec("INSERT INTO stats (.*)").WithArgs("2012-02-02", "2012-03-10", 0).WillReturnResult(
+		sqlmock.NewResult(0, 4))
+	mock.ExpectCommit()
+
+	req, err := http.NewRequest("POST", "http://localhost:1234/api/admin/rollup?date1=2012-02-02&date2=2012-03-10", nil)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rr := httptest.NewRecorder()
+
+	handler.ServeHTTP(rr, req)
+
+	if status := rr.Code; status != http.StatusOK {
+		t.Errorf("handler returned wrong status code: got %v want %v",
+			status, http.StatusOK)
+	}
+
+	if body := rr.Body.String(); body != "{\"rows\":4}\n" {
+		t.Errorf("handler returned unexpected body: got %q", body)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatalf("there were unfulfilled expections: %s", err)
+	}
+}
+
+func TestRetention(t *testing.T) {
+	db, mock, err := sqlmock.New()
+
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	dbm := dbManager.DBManager{DB: db}
+
+	rH := RequestHandler{DBManager: &dbm, logger: log.New(os.Stdout, "", log.LstdFlags)}
+
+	conf := config.Default()
+	conf.Retention.BatchSize = 2
+	conf.Retention.HourlyDays = 0
+	conf.Retention.DeliveriesDays = 0
+	rH.Configure(conf)
+
+	handler := http.HandlerFunc(rH.Retention)
+
+	mock.ExpectQuery(`SELECT count\(\*\) FROM stats WHERE date < \$1`).WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(3))
+	mock.ExpectQuery(`SELECT count\(\*\) FROM events WHERE ts < \$1`).WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(0))
+	mock.ExpectQuery(`SELECT count\(\*\) FROM event_ids WHERE seen_at < \$1`).WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(1))
+
+	req, err := http.NewRequest("GET", "http://localhost:1234/api/admin/retention", nil)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rr := httptest.NewRecorder()
+
+	handler.ServeHTTP(rr, req)
+
+	if status := rr.Code; status != http.StatusOK {
+		t.Errorf("handler returned wrong status code: got %v want %v",
+			status, http.StatusOK)
+	}
+
+	if body := rr.Body.String(); !strings.Contains(body, `"table":"stats",`) || !strings.Contains(body, `"rows":3`) {
+		t.Errorf("handler returned unexpected body: got %q", body)
+	}
+
+	current := time.Now().UTC().Format("stats_2006_01")
+
+	mock.ExpectQuery("FROM pg_inherits").WillReturnRows(
+		sqlmock.NewRows([]string{"relname"}).AddRow("stats_2011_01").AddRow(current).AddRow("stats_default"))
+	mock.ExpectQuery("SELECT count(.*) FROM stats_2011_01").WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(10))
+	mock.ExpectExec("ALTER TABLE stats DETACH PARTITION stats_2011_01").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec("DROP TABLE stats_2011_01").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectBegin()
+	mock.ExpectExec("DELETE FROM leaderboard_days").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec("DELETE FROM leaderboard ").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectCommit()
+	mock.ExpectExec("DELETE FROM stats (.*)").WithArgs(sqlmock.AnyArg(), 2).WillReturnResult(sqlmock.NewResult(0, 2))
+	mock.ExpectExec("DELETE FROM stats (.*)").WithArgs(sqlmock.AnyArg(), 2).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("DELETE FROM events (.*)").WithArgs(sqlmock.AnyArg(), 2).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec("DELETE FROM event_ids (.*)").WithArgs(sqlmock.AnyArg(), 2).WillReturnResult(sqlmock.NewResult(0, 1))
+
+	req, err = http.NewRequest("POST", "http://localhost:1234/api/admin/retention", nil)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rr = httptest.NewRecorder()
+
+	handler.ServeHTTP(rr, req)
+
+	if status := rr.Code; status != http.StatusOK {
+		t.Errorf("handler returned wrong status code: got %v want %v",
+			status, http.StatusOK)
+	}
+
+	if body := rr.Body.String(); !strings.Contains(body, `"rows":13`) {
+		t.Errorf("handler returned unexpected body: got %q", body)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatalf("there were unfulfilled expections: %s", err)
+	}
+}
+
+func TestSpillWriterDeadline(t *testing.T) {
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		sw := &spillWriter{w: w, rc: http.NewResponseController(w), contentType: "text/csv; charset=utf-8", max: 4}
+
+		// The export outlasts the write timeout of the server.
+		for i := 0; i < 6; i++ {
+			time.Sleep(50 * time.Millisecond)
+			fmt.Fprintf(sw, "row %d\n", i)
+			http.NewResponseController(w).Flush()
+		}
+	}))
+
+	srv.Config.WriteTimeout = 100 * time.Millisecond
+	srv.Start()
+	defer srv.Close()
+
+	resp, err := http.Get(srv.URL)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+
+	if err != nil || strings.Count(string(body), "row") != 6 {
+		t.Errorf("export cut off by the write timeout: %q %v", body, err)
+	}
 }
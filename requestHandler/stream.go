@@ -0,0 +1,295 @@
+package requestHandler
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/zwirec/http_service_stat/dbManager"
+	"github.com/zwirec/http_service_stat/stream"
+)
+
+const (
+	streamEvents = "events"
+	streamCounts = "counts"
+
+	// streamRetry is the reconnection delay told to clients, in
+	// milliseconds.
+	streamRetry = 1000
+	// streamWriteTimeout bounds each write to a client, so that a stalled
+	// one does not hold its stream forever.
+	streamWriteTimeout = 30 * time.Second
+)
+
+// StatsStream streams the events recorded for the tenant as Server-Sent
+// Events: each event ("mode=events") or, every counts interval, how many
+// events of each action were recorded ("mode=counts"). "action" and
+// "user", which can be repeated, filter the events.
+//
+// Clients reconnecting with Last-Event-ID get the kept events they missed,
+// a "reset" event first if some are no longer kept. Clients falling behind
+// get a "lagged" event and the stream ends; they reconnect to catch up.
+func (reqHandler *RequestHandler) StatsStream(w http.ResponseWriter, req *http.Request) {
+	var httpStatus int
+
+	if req.Method == "GET" {
+
+		tenant := tenantOf(req)
+
+		filter, mode, err := parseStreamParams(req.URL.Query(), tenant)
+
+		if err != nil {
+			httpStatus = http.StatusBadRequest
+			reqHandler.writeResponse(w, err.Error()+"\n", httpStatus)
+			reqHandler.logRequest(req, httpStatus)
+			return
+		}
+
+		var lastID uint64
+
+		resume := req.Header.Get("Last-Event-ID") != ""
+
+		if resume {
+			if lastID, err = strconv.ParseUint(req.Header.Get("Last-Event-ID"), 10, 64); err != nil {
+				httpStatus = http.StatusBadRequest
+				reqHandler.writeResponse(w, "Incorrect Last-Event-ID\n", httpStatus)
+				reqHandler.logRequest(req, httpStatus)
+				return
+			}
+		}
+
+		if reqHandler.Stream == nil {
+			httpStatus = http.StatusServiceUnavailable
+			reqHandler.writeResponse(w, "The stream is turned off\n", httpStatus)
+			reqHandler.logRequest(req, httpStatus)
+			return
+		}
+
+		sub, err := reqHandler.Stream.Subscribe(filter, lastID, resume)
+
+		if err != nil {
+			httpStatus = http.StatusServiceUnavailable
+			w.Header().Set("Retry-After", "10")
+			reqHandler.writeResponse(w, "Too many clients streaming\n", httpStatus)
+			reqHandler.logRequest(req, httpStatus)
+			return
+		}
+
+		defer reqHandler.Stream.Unsubscribe(sub)
+
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+		// Proxies must not buffer the stream.
+		w.Header().Set("X-Accel-Buffering", "no")
+
+		httpStatus = http.StatusOK
+		w.WriteHeader(httpStatus)
+		reqHandler.logRequest(req, httpStatus, "mode="+mode)
+
+		sse := &sseWriter{w: w, rc: http.NewResponseController(w)}
+
+		if mode == streamCounts {
+			err = reqHandler.streamCounts(req.Context(), sse, sub)
+		} else {
+			err = reqHandler.streamEvents(req.Context(), sse, sub)
+		}
+
+		if err != nil && req.Context().Err() == nil {
+			reqHandler.logger.Println("stream:", err)
+		}
+	} else {
+		httpStatus = http.StatusMethodNotAllowed
+		reqHandler.writeResponse(w, nil, httpStatus)
+		reqHandler.logRequest(req, httpStatus)
+		return
+	}
+	return
+}
+
+// parseStreamParams returns the filter and mode of the StatsStream
+// parameters params.
+func parseStreamParams(params url.Values, tenant *dbManager.Tenant) (stream.Filter, string, error) {
+	filter := stream.Filter{Tenant: tenant.ID}
+
+	mode := params.Get("mode")
+
+	switch mode {
+	case "":
+		mode = streamEvents
+	case streamEvents, streamCounts:
+	default:
+		return filter, "", fmt.Errorf(`Incorrect "mode" (use "events" or "counts")`)
+	}
+
+	for _, action := range params["action"] {
+		if !tenant.HasAction(action) {
+			return filter, "", fmt.Errorf(`Incorrect "action" (must be in the catalogue)`)
+		}
+		filter.Actions = append(filter.Actions, action)
+	}
+
+	for _, user := range params["user"] {
+		id, err := strconv.ParseInt(user, 10, 64)
+
+		if err != nil {
+			return filter, "", fmt.Errorf(`Incorrect "user" (use an integer)`)
+		}
+		filter.Users = append(filter.Users, id)
+	}
+	return filter, mode, nil
+}
+
+func (reqHandler *RequestHandler) streamEvents(ctx context.Context, sse *sseWriter, sub *stream.Subscription) error {
+	if err := sse.start(sub); err != nil {
+		return err
+	}
+
+	for _, e := range sub.Replay {
+		if err := sse.send(e.ID, "event", e); err != nil {
+			return err
+		}
+	}
+
+	heartbeat := time.NewTicker(reqHandler.streamConf.Heartbeat.Duration)
+	defer heartbeat.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case e, ok := <-sub.Events():
+			if !ok {
+				return sse.end(sub)
+			}
+
+			if err := sse.send(e.ID, "event", e); err != nil {
+				return err
+			}
+		case <-heartbeat.C:
+			if err := sse.comment("keepalive"); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+func (reqHandler *RequestHandler) streamCounts(ctx context.Context, sse *sseWriter, sub *stream.Subscription) error {
+	if err := sse.start(sub); err != nil {
+		return err
+	}
+
+	counts := map[string]int64{}
+
+	var lastID uint64
+
+	for _, e := range sub.Replay {
+		counts[e.Action]++
+		lastID = e.ID
+	}
+
+	// flush sends the counts since the last ones, with the ID of the last
+	// event counted, so that clients reconnecting get the events after it.
+	flush := func() error {
+		if len(counts) == 0 {
+			return nil
+		}
+
+		err := sse.send(lastID, "counts", map[string]interface{}{"counts": counts})
+		counts = map[string]int64{}
+		return err
+	}
+
+	tick := time.NewTicker(reqHandler.streamConf.CountsInterval.Duration)
+	defer tick.Stop()
+
+	heartbeat := time.NewTicker(reqHandler.streamConf.Heartbeat.Duration)
+	defer heartbeat.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case e, ok := <-sub.Events():
+			if !ok {
+				if err := flush(); err != nil {
+					return err
+				}
+				return sse.end(sub)
+			}
+
+			counts[e.Action]++
+			lastID = e.ID
+		case <-tick.C:
+			if err := flush(); err != nil {
+				return err
+			}
+		case <-heartbeat.C:
+			if err := sse.comment("keepalive"); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// sseWriter writes Server-Sent Events, flushing each one.
+type sseWriter struct {
+	w  http.ResponseWriter
+	rc *http.ResponseController
+}
+
+// start tells the reconnection delay and, if some of the events the
+// client missed are no longer kept, sends a "reset" event.
+func (sse *sseWriter) start(sub *stream.Subscription) error {
+	if err := sse.write(fmt.Sprintf("retry: %d\n\n", streamRetry)); err != nil {
+		return err
+	}
+
+	if sub.Missed {
+		return sse.send(0, "reset", map[string]string{"reason": "events after Last-Event-ID are no longer kept"})
+	}
+	return nil
+}
+
+// end sends a "lagged" event if the stream ended because the client fell
+// behind.
+func (sse *sseWriter) end(sub *stream.Subscription) error {
+	if sub.Lagged() {
+		return sse.send(0, "lagged", map[string]string{"reason": "the client fell behind, reconnect with Last-Event-ID"})
+	}
+	return nil
+}
+
+// send writes an event of type event with data as JSON. id is left out
+// when zero.
+func (sse *sseWriter) send(id uint64, event string, data interface{}) error {
+	b, err := json.Marshal(data)
+
+	if err != nil {
+		return err
+	}
+
+	msg := "event: " + event + "\ndata: " + string(b) + "\n\n"
+
+	if id != 0 {
+		msg = "id: " + strconv.FormatUint(id, 10) + "\n" + msg
+	}
+	return sse.write(msg)
+}
+
+func (sse *sseWriter) comment(text string) error {
+	return sse.write(": " + text + "\n\n")
+}
+
+func (sse *sseWriter) write(msg string) error {
+	// Replaces the write timeout of the server, which would end the stream.
+	sse.rc.SetWriteDeadline(time.Now().Add(streamWriteTimeout))
+
+	if _, err := fmt.Fprint(sse.w, msg); err != nil {
+		return err
+	}
+	return sse.rc.Flush()
+}
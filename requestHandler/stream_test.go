@@ -0,0 +1,222 @@
+package requestHandler
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/zwirec/http_service_stat/config"
+	"github.com/zwirec/http_service_stat/dbManager"
+	"github.com/zwirec/http_service_stat/stream"
+)
+
+type sseEvent struct {
+	id, event, data string
+}
+
+// readEvent returns the next event of r, skipping comments and fields
+// other than id, event and data.
+func readEvent(t *testing.T, r *bufio.Reader) sseEvent {
+	var e sseEvent
+
+	for {
+		line, err := r.ReadString('\n')
+
+		if err != nil {
+			t.Fatalf("reading the stream: %v", err)
+		}
+
+		line = strings.TrimSuffix(line, "\n")
+
+		switch {
+		case line == "" && e.event != "":
+			return e
+		case strings.HasPrefix(line, "id: "):
+			e.id = line[4:]
+		case strings.HasPrefix(line, "event: "):
+			e.event = line[7:]
+		case strings.HasPrefix(line, "data: "):
+			e.data = line[6:]
+		}
+	}
+}
+
+func openStream(t *testing.T, url, lastID string) (*http.Response, *bufio.Reader) {
+	req, err := http.NewRequest("GET", url, nil)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if lastID != "" {
+		req.Header.Set("Last-Event-ID", lastID)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != "text/event-stream" {
+		t.Fatalf("stream returned %d %q", resp.StatusCode, resp.Header.Get("Content-Type"))
+	}
+	return resp, bufio.NewReader(resp.Body)
+}
+
+func TestStatsStream(t *testing.T) {
+	db, mock, err := sqlmock.New()
+
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	dbm := dbManager.DBManager{DB: db}
+
+	rH := RequestHandler{
+		DBManager: &dbm,
+		logger:    log.New(os.Stdout, "", log.LstdFlags),
+		Stream:    stream.NewHub(10, 10, 2),
+		streamConf: config.Stream{
+			Heartbeat:      config.Duration{Duration: time.Minute},
+			CountsInterval: config.Duration{Duration: 10 * time.Millisecond},
+		},
+	}
+
+	for _, query := range []string{"mode=all", "action=purchase", "user=a"} {
+		rr := httptest.NewRecorder()
+
+		rH.StatsStream(rr, httptest.NewRequest("GET", "/api/stats/stream?"+query, nil))
+
+		if rr.Code != http.StatusBadRequest {
+			t.Errorf("%s: handler returned %d want %d", query, rr.Code, http.StatusBadRequest)
+		}
+	}
+
+	srv := httptest.NewServer(http.HandlerFunc(rH.StatsStream))
+	defer srv.Close()
+
+	resp, r := openStream(t, srv.URL+"?action=like&user=2", "")
+	defer resp.Body.Close()
+
+	rH.Stream.Publish(0, map[string]interface{}{"user": float64(3), "action": "like", "ts": "2012-02-02"})
+	rH.Stream.Publish(0, map[string]interface{}{"user": float64(2), "action": "login", "ts": "2012-02-02"})
+
+	// Events recorded by AddStat are streamed.
+	mock.ExpectBegin()
+	mock.ExpectExec("INSERT INTO events (.*)").WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectExec("INSERT INTO stats (.*)").WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectExec("INSERT INTO stats_hourly (.*)").WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectCommit()
+
+	rr := httptest.NewRecorder()
+
+	rH.AddStat(rr, httptest.NewRequest("POST", "/api/users/stats",
+		bytes.NewBufferString(`{"user": 2, "action": "like", "ts": "2012-02-02T10:00:00Z"}`)))
+
+	if rr.Code != http.StatusOK {
+		t.Fatalf("AddStat returned %d", rr.Code)
+	}
+
+	e := readEvent(t, r)
+
+	var got stream.Event
+
+	if err = json.Unmarshal([]byte(e.data), &got); err != nil {
+		t.Fatal(err)
+	}
+
+	if e.event != "event" || e.id != strconv.FormatUint(got.ID, 10) || got.User != 2 || got.Action != "like" ||
+		got.TS != "2012-02-02T10:00:00Z" {
+		t.Errorf("stream sent %+v", e)
+	}
+
+	// Reconnecting clients get the events they missed, here counted.
+	resumed, r := openStream(t, srv.URL+"?mode=counts", strconv.FormatUint(got.ID-3, 10))
+	defer resumed.Body.Close()
+
+	if e := readEvent(t, r); e.event != "counts" || e.id != strconv.FormatUint(got.ID, 10) ||
+		e.data != `{"counts":{"like":2,"login":1}}` {
+		t.Errorf("counts stream sent %+v", e)
+	}
+
+	// Clients past max_clients are refused.
+	rr = httptest.NewRecorder()
+
+	rH.StatsStream(rr, httptest.NewRequest("GET", "/api/stats/stream", nil))
+
+	if rr.Code != http.StatusServiceUnavailable {
+		t.Errorf("third client: handler returned %d want %d", rr.Code, http.StatusServiceUnavailable)
+	}
+
+	// Streams end on shutdown.
+	rH.Stream.Close()
+
+	if _, err = io.Copy(io.Discard, resp.Body); err != nil {
+		t.Errorf("stream did not end: %v", err)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatalf("there were unfulfilled expections: %s", err)
+	}
+}
+
+func TestStatsStreamLagged(t *testing.T) {
+	rH := RequestHandler{
+		DBManager: &dbManager.DBManager{},
+		logger:    log.New(os.Stdout, "", log.LstdFlags),
+		Stream:    stream.NewHub(10, 1, 1),
+		streamConf: config.Stream{
+			Heartbeat:      config.Duration{Duration: time.Minute},
+			CountsInterval: config.Duration{Duration: time.Second},
+		},
+	}
+
+	srv := httptest.NewServer(http.HandlerFunc(rH.StatsStream))
+	defer srv.Close()
+
+	resp, r := openStream(t, srv.URL, "")
+	defer resp.Body.Close()
+
+	// Events are published faster than they are streamed until the buffer
+	// of one event overflows.
+	stop := make(chan struct{})
+	defer close(stop)
+
+	go func() {
+		for i := 0; ; i++ {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			rH.Stream.Publish(0, map[string]interface{}{"user": float64(i), "action": "like", "ts": "2012-02-02"})
+		}
+	}()
+
+	for {
+		e := readEvent(t, r)
+
+		if e.event == "lagged" {
+			break
+		}
+
+		if e.event != "event" {
+			t.Fatalf("stream sent %+v", e)
+		}
+	}
+
+	if _, err := io.Copy(io.Discard, resp.Body); err != nil {
+		t.Errorf("stream did not end after lagging: %v", err)
+	}
+}
@@ -0,0 +1,183 @@
+package retention
+
+import (
+	"expvar"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/zwirec/http_service_stat/config"
+	"github.com/zwirec/http_service_stat/dbManager"
+)
+
+// removed counts the rows deleted by purges per table. It is served with
+// the other expvars at /debug/vars.
+var removed = expvar.NewMap("retention_rows_removed")
+
+// Table is the outcome of a purge, or of its preview, for one table.
+type Table struct {
+	Table  string    `json:"table"`
+	Before time.Time `json:"before"`
+	Rows   int64     `json:"rows"`
+}
+
+// Purger deletes the rows that are older than the retention policy allows.
+type Purger struct {
+	dbm    *dbManager.DBManager
+	logger *log.Logger
+
+	mu          sync.Mutex
+	policy      config.Retention
+	dedupWindow time.Duration
+	running     sync.Mutex
+}
+
+func NewPurger(dbm *dbManager.DBManager, conf *config.Config, logger *log.Logger) *Purger {
+	p := &Purger{dbm: dbm, logger: logger}
+	p.SetPolicy(conf)
+	return p
+}
+
+// SetPolicy replaces the retention policy. It takes effect with the next purge.
+func (p *Purger) SetPolicy(conf *config.Config) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.policy = conf.Retention
+	p.dedupWindow = conf.DedupWindow.Duration
+}
+
+// cutoffs returns the tables to purge and the time their rows expire at.
+func (p *Purger) cutoffs(now time.Time) []Table {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	today := now.UTC().Truncate(24 * time.Hour)
+
+	var tables []Table
+
+	for _, t := range []struct {
+		table string
+		days  int
+	}{
+		{"stats", p.policy.StatsDays},
+		{"stats_hourly", p.policy.HourlyDays},
+		{"events", p.policy.EventsDays},
+		{"webhook_deliveries", p.policy.DeliveriesDays},
+	} {
+		if t.days > 0 {
+			tables = append(tables, Table{Table: t.table, Before: today.AddDate(0, 0, -t.days)})
+		}
+	}
+
+	return append(tables, Table{Table: "event_ids", Before: now.Add(-p.dedupWindow)})
+}
+
+// Cutoff returns the time the rows of table expire before at now, false
+// if they do not expire.
+func (p *Purger) Cutoff(table string, now time.Time) (time.Time, bool) {
+	for _, t := range p.cutoffs(now) {
+		if t.Table == table {
+			return t.Before, true
+		}
+	}
+	return time.Time{}, false
+}
+
+func (p *Purger) batchSize() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return p.policy.BatchSize
+}
+
+func (p *Purger) interval() time.Duration {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return p.policy.Interval.Duration
+}
+
+// Preview returns how many rows a purge at now would delete.
+func (p *Purger) Preview(now time.Time) ([]Table, error) {
+	tables := p.cutoffs(now)
+
+	for i := range tables {
+		n, err := p.dbm.CountExpired(tables[i].Table, tables[i].Before)
+
+		if err != nil {
+			return nil, err
+		}
+		tables[i].Rows = n
+	}
+	return tables, nil
+}
+
+// Purge deletes the rows expired at now and returns how many were deleted.
+// Whole expired stats partitions are dropped, the other rows are deleted in
+// batches. Concurrent calls run one after another.
+func (p *Purger) Purge(now time.Time) ([]Table, error) {
+	p.running.Lock()
+	defer p.running.Unlock()
+
+	tables := p.cutoffs(now)
+	batch := p.batchSize()
+
+	for i := range tables {
+		if tables[i].Table == "stats" {
+			n, err := p.dbm.DropStatsPartitions(tables[i].Before)
+
+			tables[i].Rows += n
+			removed.Add(tables[i].Table, n)
+
+			if err != nil {
+				return tables, err
+			}
+
+			// The leaderboards of the purged days would outlive their stats.
+			n, err = p.dbm.PurgeLeaderboards(tables[i].Before)
+
+			removed.Add("leaderboard", n)
+
+			if err != nil {
+				return tables, err
+			}
+		}
+
+		for {
+			n, err := p.dbm.PurgeExpired(tables[i].Table, tables[i].Before, batch)
+
+			tables[i].Rows += n
+			removed.Add(tables[i].Table, n)
+
+			if err != nil {
+				return tables, err
+			}
+
+			if n < int64(batch) {
+				break
+			}
+		}
+
+		if tables[i].Rows > 0 {
+			p.logger.Printf("retention: removed %d rows from %s older than %s",
+				tables[i].Rows, tables[i].Table, tables[i].Before.Format(time.RFC3339))
+		}
+	}
+	return tables, nil
+}
+
+// Run purges every policy interval until stop is closed.
+func (p *Purger) Run(stop <-chan struct{}) {
+	for {
+		select {
+		case <-stop:
+			return
+		case <-time.After(p.interval()):
+		}
+
+		if _, err := p.Purge(time.Now()); err != nil {
+			p.logger.Println("retention:", err)
+		}
+	}
+}
@@ -0,0 +1,114 @@
+package retention
+
+import (
+	"log"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/zwirec/http_service_stat/config"
+	"github.com/zwirec/http_service_stat/dbManager"
+)
+
+var now = time.Date(2012, 2, 2, 12, 0, 0, 0, time.UTC)
+
+func newPurger(t *testing.T) (*Purger, sqlmock.Sqlmock) {
+	db, mock, err := sqlmock.New()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	conf := config.Default()
+	conf.Retention = config.Retention{StatsDays: 30, EventsDays: 7, BatchSize: 2}
+	conf.DedupWindow = config.Duration{Duration: 24 * time.Hour}
+
+	return NewPurger(&dbManager.DBManager{DB: db}, conf, log.New(os.Stdout, "", log.LstdFlags)), mock
+}
+
+func TestCutoffs(t *testing.T) {
+	p, _ := newPurger(t)
+
+	// Tables kept for ever are not purged; event_ids always are.
+	want := []Table{
+		{Table: "stats", Before: time.Date(2012, 1, 3, 0, 0, 0, 0, time.UTC)},
+		{Table: "events", Before: time.Date(2012, 1, 26, 0, 0, 0, 0, time.UTC)},
+		{Table: "event_ids", Before: now.Add(-24 * time.Hour)},
+	}
+
+	if got := p.cutoffs(now); !reflect.DeepEqual(got, want) {
+		t.Errorf("cutoffs = %v, want %v", got, want)
+	}
+
+	if before, ok := p.Cutoff("events", now); !ok || !before.Equal(want[1].Before) {
+		t.Errorf("Cutoff(events) = %s, %t", before, ok)
+	}
+
+	if _, ok := p.Cutoff("stats_hourly", now); ok {
+		t.Error("stats_hourly expires with hourly_days 0")
+	}
+}
+
+func TestPurge(t *testing.T) {
+	p, mock := newPurger(t)
+
+	stats := time.Date(2012, 1, 3, 0, 0, 0, 0, time.UTC)
+	events := time.Date(2012, 1, 26, 0, 0, 0, 0, time.UTC)
+
+	mock.ExpectQuery("FROM pg_inherits").WillReturnRows(sqlmock.NewRows([]string{"relname"}).AddRow("stats_default"))
+	mock.ExpectBegin()
+	mock.ExpectExec("DELETE FROM leaderboard_days WHERE date <").WithArgs(stats).WillReturnResult(sqlmock.NewResult(0, 4))
+	mock.ExpectExec("DELETE FROM leaderboard WHERE date <").WithArgs(stats).WillReturnResult(sqlmock.NewResult(0, 40))
+	mock.ExpectCommit()
+
+	// Rows are deleted in batches until one is not full.
+	mock.ExpectExec(`DELETE FROM stats\s`).WithArgs(stats, 2).WillReturnResult(sqlmock.NewResult(0, 2))
+	mock.ExpectExec(`DELETE FROM stats\s`).WithArgs(stats, 2).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(`DELETE FROM events\s`).WithArgs(events, 2).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(`DELETE FROM event_ids\s`).WithArgs(now.Add(-24*time.Hour), 2).WillReturnResult(sqlmock.NewResult(0, 2))
+	mock.ExpectExec(`DELETE FROM event_ids\s`).WithArgs(now.Add(-24*time.Hour), 2).WillReturnResult(sqlmock.NewResult(0, 0))
+
+	tables, err := p.Purge(now)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []Table{
+		{Table: "stats", Before: stats, Rows: 3},
+		{Table: "events", Before: events},
+		{Table: "event_ids", Before: now.Add(-24 * time.Hour), Rows: 2},
+	}
+
+	if !reflect.DeepEqual(tables, want) {
+		t.Errorf("Purge = %v, want %v", tables, want)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatalf("there were unfulfilled expections: %s", err)
+	}
+}
+
+func TestPreview(t *testing.T) {
+	p, mock := newPurger(t)
+
+	for _, n := range []int64{5, 0, 1} {
+		mock.ExpectQuery("SELECT count").WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(n))
+	}
+
+	tables, err := p.Preview(now)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(tables) != 3 || tables[0].Rows != 5 || tables[1].Rows != 0 || tables[2].Rows != 1 {
+		t.Errorf("Preview = %v", tables)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatalf("there were unfulfilled expections: %s", err)
+	}
+}
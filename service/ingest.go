@@ -0,0 +1,74 @@
+package service
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/zwirec/http_service_stat/config"
+	"github.com/zwirec/http_service_stat/ingest"
+)
+
+// startIngest starts consuming the ingestion sources of the configuration.
+func (s *Service) startIngest() error {
+	for _, src := range s.currentConf().Ingest {
+		consumer, err := s.newConsumer(src)
+
+		if err != nil {
+			return err
+		}
+
+		go consumer.Run(s.stop)
+
+		if src.Type == config.IngestKafka {
+			log.Printf("Consuming %s from the topic %s in the group %s", src.Name, src.Topic, src.Group)
+		} else {
+			log.Printf("Consuming %s from %s", src.Name, src.Path)
+		}
+	}
+	return nil
+}
+
+func (s *Service) newConsumer(src config.IngestSource) (*ingest.Consumer, error) {
+	if _, err := s.rH.DBManager.LoadTenant(src.Tenant); err == sql.ErrNoRows {
+		return nil, fmt.Errorf("ingest source %s: no tenant %d", src.Name, src.Tenant)
+	} else if err != nil {
+		return nil, err
+	}
+
+	var source ingest.Source
+	var err error
+
+	if src.Type == config.IngestKafka {
+		source, err = ingest.OpenKafka(src.Brokers, src.Topic, src.Group)
+	} else {
+		source, err = ingest.OpenFile(src.Path)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	deadLetters, err := ingest.OpenDeadLetters(src.DeadLetters)
+
+	if err != nil {
+		source.Close()
+		return nil, err
+	}
+
+	tenant := src.Tenant
+
+	return &ingest.Consumer{
+		Name:        src.Name,
+		Source:      source,
+		DeadLetters: deadLetters,
+		Ingest: func(values map[string]interface{}) error {
+			return s.rH.IngestEvent(tenant, values)
+		},
+		BatchSize:  src.BatchSize,
+		MinBackoff: time.Second,
+		MaxBackoff: time.Minute,
+		Logger:     log.Default(),
+	}, nil
+}
@@ -1,21 +1,27 @@
 package service
 
 import (
-	"encoding/json"
+	"crypto/tls"
 	"errors"
 	_ "github.com/lib/pq"
-	"io/ioutil"
 	"log"
+	"net"
 	"net/http"
 	"os"
 	"os/signal"
 	"sync"
 	"syscall"
+	"time"
+	"strconv"
+	"github.com/zwirec/http_service_stat/config"
 	"github.com/zwirec/http_service_stat/requestHandler"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
 )
 
 const (
-	filename_conf = "db_conf.json"
+	filename_conf         = "db_conf.json"
+	filename_service_conf = "service_conf.json"
 )
 
 type dbInfo map[string]string
@@ -24,7 +30,16 @@ type Service struct {
 	port   string
 	srv    *http.Server
 	dbinfo dbInfo
+	// mu guards conf, which a reload replaces.
+	mu     sync.Mutex
+	conf   *config.Config
 	rH     *requestHandler.RequestHandler
+	// cert is the certificate served over TLS, nil without TLS.
+	cert *certificate
+	// grpcSrv serves the gRPC API, nil if it is turned off.
+	grpcSrv *grpc.Server
+	// stop is closed when the service shuts down to stop background jobs.
+	stop chan struct{}
 }
 
 func NewService(port string) *Service {
@@ -37,6 +52,7 @@ func NewService(port string) *Service {
 			"pass":     "",
 			"dbname":   "",
 		},
+		stop: make(chan struct{}),
 	}
 }
 func (s *Service) Run() (err error) {
@@ -55,21 +71,66 @@ func (s *Service) Run() (err error) {
 		return err
 	}
 
+	conf, err := config.Load(filename_service_conf)
+
+	if err != nil {
+		return err
+	}
+
+	s.setConf(conf)
+
 	s.rH, err = requestHandler.NewHandler(s.dbinfo)
 
 	if err != nil {
 		return err
 	}
 
+	s.rH.Configure(conf)
+
+	applied, err := s.rH.DBManager.Migrate()
+
+	if err != nil {
+		return err
+	}
+
+	for _, version := range applied {
+		log.Println("Applied migration", version)
+	}
+
+	s.ensurePartitions()
+
+	if err = s.configureServer(); err != nil {
+		return err
+	}
+
 	s.rH.RegisterHandleFunc()
 
+	if err = s.serveGRPC(); err != nil {
+		return err
+	}
+
+	if err = s.startIngest(); err != nil {
+		return err
+	}
+
+	go s.rH.Purger.Run(s.stop)
+	go s.rH.Alerts.Run(s.stop)
+	go s.maintainPartitions()
+	go s.refreshLeaderboards()
+
 	s.signalProcessing()
 
 	var wg sync.WaitGroup
 	wg.Add(1)
 
 	go func() {
-		if err = s.srv.ListenAndServe(); err != nil {
+		if s.srv.TLSConfig != nil {
+			err = s.srv.ListenAndServeTLS("", "")
+		} else {
+			err = s.srv.ListenAndServe()
+		}
+
+		if err != nil {
 			wg.Done()
 		}
 	}()
@@ -78,36 +139,222 @@ func (s *Service) Run() (err error) {
 	return err
 }
 
+// configureServer applies the timeouts, HTTP/2 and TLS settings.
+func (s *Service) configureServer() error {
+	conf := s.currentConf().Server
 
-func (s *Service) parseConfFile(filename string) error {
-	data, err := ioutil.ReadFile(filename)
+	s.srv.ReadTimeout = conf.ReadTimeout.Duration
+	s.srv.ReadHeaderTimeout = conf.ReadHeaderTimeout.Duration
+	s.srv.WriteTimeout = conf.WriteTimeout.Duration
+	s.srv.IdleTimeout = conf.IdleTimeout.Duration
+
+	if !conf.HTTP2 {
+		// A non-nil empty map turns off the HTTP/2 the server would set up.
+		s.srv.TLSNextProto = map[string]func(*http.Server, *tls.Conn, http.Handler){}
+	}
+
+	if conf.TLS.CertFile == "" {
+		return nil
+	}
+
+	cert, err := loadCertificate(conf.TLS.CertFile, conf.TLS.KeyFile)
 
 	if err != nil {
 		return err
 	}
-	err = json.Unmarshal([]byte(data), &s.dbinfo)
+
+	s.cert = cert
+	s.srv.TLSConfig, err = tlsConfig(conf.TLS, cert)
+	return err
+}
+
+// serveGRPC starts serving the gRPC API if it has a port.
+func (s *Service) serveGRPC() error {
+	conf := s.currentConf().GRPC
+
+	if conf.Port == 0 {
+		return nil
+	}
+
+	lis, err := net.Listen("tcp", ":"+strconv.Itoa(conf.Port))
 
 	if err != nil {
-		return errors.New("Incorrect configuration file")
+		return err
+	}
+
+	var opts []grpc.ServerOption
+
+	if s.srv.TLSConfig != nil {
+		opts = append(opts, grpc.Creds(credentials.NewTLS(s.srv.TLSConfig)))
+	}
+
+	s.grpcSrv = s.rH.NewGRPCServer(opts...)
+
+	go func() {
+		if err := s.grpcSrv.Serve(lis); err != nil {
+			log.Println(err)
+		}
+	}()
+	return nil
+}
+
+// ensurePartitions creates the stats partitions needed in the coming
+// months. The months that fail are logged and tried again the next day.
+func (s *Service) ensurePartitions() {
+	created, err := s.rH.DBManager.EnsureStatsPartitions(time.Now(), s.currentConf().StatsPartitionsAhead)
+
+	for _, name := range created {
+		log.Println("Created partition", name)
+	}
+
+	if err != nil {
+		log.Println("Creating stats partitions:", err)
+	}
+}
+
+func (s *Service) maintainPartitions() {
+	for {
+		select {
+		case <-s.stop:
+			return
+		case <-time.After(24 * time.Hour):
+		}
+
+		s.ensurePartitions()
+	}
+}
+
+// refreshLeaderboards recomputes the stale leaderboards of the closed days
+// within the lookback window.
+func (s *Service) refreshLeaderboards() {
+	for {
+		conf := s.currentConf().Leaderboard
+
+		select {
+		case <-s.stop:
+			return
+		case <-time.After(conf.RefreshInterval.Duration):
+		}
+
+		if conf.Size <= 0 {
+			continue
+		}
+
+		today := time.Now().UTC().Truncate(24 * time.Hour)
+
+		days, err := s.rH.DBManager.StaleLeaderboardDays(today.AddDate(0, 0, -conf.LookbackDays), today)
+
+		if err != nil {
+			log.Println(err)
+			continue
+		}
+
+		for _, day := range days {
+			if err := s.rH.DBManager.RefreshLeaderboard(day); err != nil {
+				log.Println(err)
+			}
+		}
+	}
+}
+
+func (s *Service) parseConfFile(filename string) error {
+	dbinfo, err := config.LoadDBInfo(filename)
+
+	if err != nil {
+		return err
+	}
+
+	for k, v := range dbinfo {
+		s.dbinfo[k] = v
 	}
 	return nil
 }
 
 func (s *Service) signalProcessing() {
-	c := make(chan os.Signal)
-	signal.Notify(c, syscall.SIGINT)
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, syscall.SIGINT, syscall.SIGHUP)
 	go s.handler(c)
 }
 
-func (s Service) handler(c chan os.Signal) {
-	for {
-		<-c
+func (s *Service) handler(c chan os.Signal) {
+	for sig := range c {
+		if sig == syscall.SIGHUP {
+			s.reload()
+			continue
+		}
+
 		log.Print("Gracefully stopping...")
+		close(s.stop)
+
+		if s.grpcSrv != nil {
+			s.grpcSrv.GracefulStop()
+		}
+
+		// Streaming responses would hold the shutdown.
+		if s.rH.Stream != nil {
+			s.rH.Stream.Close()
+		}
+
 		s.srv.Shutdown(nil)
 		os.Exit(0)
 	}
 }
 
+// reload reads the configuration file and the TLS certificate again. The
+// settings requestHandler.Reloadable lists take effect at once, the others
+// after a restart. An invalid file or certificate keeps the current one.
+func (s *Service) reload() {
+	conf, err := config.Load(filename_service_conf)
+
+	if err != nil {
+		log.Println("Keeping the current configuration:", err)
+	} else {
+		for _, name := range s.currentConf().Changed(conf) {
+			if !isReloadable(name) {
+				log.Printf("Setting %q changed, it takes effect after a restart", name)
+			}
+		}
+
+		s.setConf(conf)
+		s.rH.Reload(conf)
+		log.Println("Reloaded configuration")
+	}
+
+	if s.cert == nil {
+		return
+	}
+
+	if err := s.cert.reload(); err != nil {
+		log.Println("Keeping the current certificate:", err)
+		return
+	}
+	log.Println("Reloaded certificate", s.cert.certFile)
+}
+
+// currentConf returns the configuration last loaded.
+func (s *Service) currentConf() *config.Config {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.conf
+}
+
+func (s *Service) setConf(conf *config.Config) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.conf = conf
+}
+
+func isReloadable(name string) bool {
+	for _, reloadable := range requestHandler.Reloadable {
+		if name == reloadable {
+			return true
+		}
+	}
+	return false
+}
+
 func (s *Service) validatePOSTregisterParams(params map[string]interface{}) error {
 
 	if params["id"] == nil || params["age"] == nil || params["sex"] == nil || len(params) != 3 {
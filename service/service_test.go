@@ -0,0 +1,74 @@
+package service
+
+import (
+	"bytes"
+	"io/ioutil"
+	"log"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/zwirec/http_service_stat/config"
+	"github.com/zwirec/http_service_stat/dbManager"
+	"github.com/zwirec/http_service_stat/requestHandler"
+)
+
+func TestReload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "service")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	wd, err := os.Getwd()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.Chdir(wd)
+
+	var logged bytes.Buffer
+
+	log.SetOutput(&logged)
+	defer log.SetOutput(os.Stderr)
+
+	conf := config.Default()
+
+	s := &Service{conf: conf, rH: requestHandler.New(&dbManager.DBManager{}, log.New(ioutil.Discard, "", 0))}
+	s.rH.Configure(conf)
+
+	err = ioutil.WriteFile(filename_service_conf, []byte(`{"leaderboard": {"size": 10, "lookback_days": 3, "refresh_interval": "1m"}}`), 0600)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s.reload()
+
+	if !strings.Contains(logged.String(), `Setting "leaderboard" changed`) {
+		t.Errorf("change of a setting needing a restart not logged: %q", logged.String())
+	}
+
+	if l := s.currentConf().Leaderboard; l.LookbackDays != 3 {
+		t.Errorf("reloaded configuration not kept: %+v", l)
+	}
+
+	// A second reload compares with the first one.
+	logged.Reset()
+	s.reload()
+
+	if strings.Contains(logged.String(), "changed") {
+		t.Errorf("unchanged setting logged as changed: %q", logged.String())
+	}
+
+	if l := s.currentConf().Leaderboard; l.LookbackDays != 3 {
+		t.Errorf("reloaded configuration not kept: %+v", l)
+	}
+}
@@ -0,0 +1,86 @@
+package service
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io/ioutil"
+	"sync"
+
+	"github.com/zwirec/http_service_stat/config"
+)
+
+// certificate is the server certificate. It is read again on SIGHUP, so
+// renewed certificates are served without a restart.
+type certificate struct {
+	certFile string
+	keyFile  string
+	mu       sync.RWMutex
+	cert     *tls.Certificate
+}
+
+func loadCertificate(certFile, keyFile string) (*certificate, error) {
+	c := &certificate{certFile: certFile, keyFile: keyFile}
+
+	if err := c.reload(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// reload reads the certificate files. On error the current certificate is
+// kept.
+func (c *certificate) reload() error {
+	cert, err := tls.LoadX509KeyPair(c.certFile, c.keyFile)
+
+	if err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	c.cert = &cert
+	c.mu.Unlock()
+	return nil
+}
+
+func (c *certificate) get(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	return c.cert, nil
+}
+
+// tlsConfig returns the TLS settings of conf serving cert.
+func tlsConfig(conf config.TLS, cert *certificate) (*tls.Config, error) {
+	tlsConf := &tls.Config{
+		GetCertificate: cert.get,
+		MinVersion:     tls.VersionTLS12,
+	}
+
+	if conf.MinVersion == "1.3" {
+		tlsConf.MinVersion = tls.VersionTLS13
+	}
+
+	if conf.ClientCAFile == "" {
+		return tlsConf, nil
+	}
+
+	data, err := ioutil.ReadFile(conf.ClientCAFile)
+
+	if err != nil {
+		return nil, err
+	}
+
+	tlsConf.ClientCAs = x509.NewCertPool()
+
+	if !tlsConf.ClientCAs.AppendCertsFromPEM(data) {
+		return nil, errors.New("No certificates in " + conf.ClientCAFile)
+	}
+
+	if conf.RequireClientCert {
+		tlsConf.ClientAuth = tls.RequireAndVerifyClientCert
+	} else {
+		tlsConf.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+	return tlsConf, nil
+}
@@ -0,0 +1,111 @@
+package service
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/zwirec/http_service_stat/config"
+)
+
+// writeCertificate writes a self-signed certificate for name to dir.
+func writeCertificate(t *testing.T, dir, name string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keyDER, err := x509.MarshalECPrivateKey(key)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+
+	if err = ioutil.WriteFile(filepath.Join(dir, "cert.pem"), certPEM, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = ioutil.WriteFile(filepath.Join(dir, "key.pem"), keyPEM, 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func commonName(t *testing.T, c *certificate) string {
+	cert, _ := c.get(nil)
+
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+
+	if err != nil {
+		t.Fatal(err)
+	}
+	return leaf.Subject.CommonName
+}
+
+func TestCertificateReload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "service")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	writeCertificate(t, dir, "old")
+
+	c, err := loadCertificate(filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem"))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	writeCertificate(t, dir, "new")
+
+	if err = c.reload(); err != nil || commonName(t, c) != "new" {
+		t.Fatalf("certificate not reloaded: %v", err)
+	}
+
+	if err = ioutil.WriteFile(filepath.Join(dir, "key.pem"), []byte("garbage"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = c.reload(); err == nil || commonName(t, c) != "new" {
+		t.Fatal("invalid certificate files replaced the current certificate")
+	}
+
+	tlsConf, err := tlsConfig(config.TLS{MinVersion: "1.3"}, c)
+
+	if err != nil || tlsConf.MinVersion != tls.VersionTLS13 || tlsConf.ClientAuth != tls.NoClientCert {
+		t.Fatalf("unexpected TLS settings: %+v %v", tlsConf, err)
+	}
+
+	if _, err = tlsConfig(config.TLS{ClientCAFile: filepath.Join(dir, "key.pem")}, c); err == nil {
+		t.Fatal("client CA file without certificates accepted")
+	}
+}
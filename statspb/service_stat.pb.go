@@ -0,0 +1,867 @@
+// The gRPC API of service_stat. It shares the validation, authentication,
+// rate limits and storage of the HTTP API; API keys go in the "x-api-key"
+// or "authorization" (Bearer) metadata.
+//
+// Regenerate the Go code with
+//
+//	protoc --go_out=. --go_opt=paths=source_relative \
+//	  --go-grpc_out=. --go-grpc_opt=paths=source_relative service_stat.proto
+
+// Code generated by protoc-gen-go. DO NOT EDIT.
+// versions:
+// 	protoc-gen-go v1.36.10
+// 	protoc        v4.25.3
+// source: service_stat.proto
+
+package statspb
+
+import (
+	protoreflect "google.golang.org/protobuf/reflect/protoreflect"
+	protoimpl "google.golang.org/protobuf/runtime/protoimpl"
+	reflect "reflect"
+	sync "sync"
+	unsafe "unsafe"
+)
+
+const (
+	// Verify that this generated code is sufficiently up-to-date.
+	_ = protoimpl.EnforceVersion(20 - protoimpl.MinVersion)
+	// Verify that runtime/protoimpl is sufficiently up-to-date.
+	_ = protoimpl.EnforceVersion(protoimpl.MaxVersion - 20)
+)
+
+// RegisterUserRequest is the user RegisterUser creates.
+type RegisterUserRequest struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Id            int64                  `protobuf:"varint,1,opt,name=id,proto3" json:"id,omitempty"`
+	Age           int64                  `protobuf:"varint,2,opt,name=age,proto3" json:"age,omitempty"`
+	Sex           string                 `protobuf:"bytes,3,opt,name=sex,proto3" json:"sex,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *RegisterUserRequest) Reset() {
+	*x = RegisterUserRequest{}
+	mi := &file_service_stat_proto_msgTypes[0]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *RegisterUserRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*RegisterUserRequest) ProtoMessage() {}
+
+func (x *RegisterUserRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_service_stat_proto_msgTypes[0]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use RegisterUserRequest.ProtoReflect.Descriptor instead.
+func (*RegisterUserRequest) Descriptor() ([]byte, []int) {
+	return file_service_stat_proto_rawDescGZIP(), []int{0}
+}
+
+func (x *RegisterUserRequest) GetId() int64 {
+	if x != nil {
+		return x.Id
+	}
+	return 0
+}
+
+func (x *RegisterUserRequest) GetAge() int64 {
+	if x != nil {
+		return x.Age
+	}
+	return 0
+}
+
+func (x *RegisterUserRequest) GetSex() string {
+	if x != nil {
+		return x.Sex
+	}
+	return ""
+}
+
+type RegisterUserResponse struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *RegisterUserResponse) Reset() {
+	*x = RegisterUserResponse{}
+	mi := &file_service_stat_proto_msgTypes[1]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *RegisterUserResponse) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*RegisterUserResponse) ProtoMessage() {}
+
+func (x *RegisterUserResponse) ProtoReflect() protoreflect.Message {
+	mi := &file_service_stat_proto_msgTypes[1]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use RegisterUserResponse.ProtoReflect.Descriptor instead.
+func (*RegisterUserResponse) Descriptor() ([]byte, []int) {
+	return file_service_stat_proto_rawDescGZIP(), []int{1}
+}
+
+// AddStatRequest is an event, as in the body of POST /api/users/stats.
+type AddStatRequest struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	User          int64                  `protobuf:"varint,1,opt,name=user,proto3" json:"user,omitempty"`
+	Action        string                 `protobuf:"bytes,2,opt,name=action,proto3" json:"action,omitempty"`
+	Ts            string                 `protobuf:"bytes,3,opt,name=ts,proto3" json:"ts,omitempty"`
+	EventId       string                 `protobuf:"bytes,4,opt,name=event_id,json=eventId,proto3" json:"event_id,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *AddStatRequest) Reset() {
+	*x = AddStatRequest{}
+	mi := &file_service_stat_proto_msgTypes[2]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *AddStatRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*AddStatRequest) ProtoMessage() {}
+
+func (x *AddStatRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_service_stat_proto_msgTypes[2]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use AddStatRequest.ProtoReflect.Descriptor instead.
+func (*AddStatRequest) Descriptor() ([]byte, []int) {
+	return file_service_stat_proto_rawDescGZIP(), []int{2}
+}
+
+func (x *AddStatRequest) GetUser() int64 {
+	if x != nil {
+		return x.User
+	}
+	return 0
+}
+
+func (x *AddStatRequest) GetAction() string {
+	if x != nil {
+		return x.Action
+	}
+	return ""
+}
+
+func (x *AddStatRequest) GetTs() string {
+	if x != nil {
+		return x.Ts
+	}
+	return ""
+}
+
+func (x *AddStatRequest) GetEventId() string {
+	if x != nil {
+		return x.EventId
+	}
+	return ""
+}
+
+type AddStatResponse struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Applied       bool                   `protobuf:"varint,1,opt,name=applied,proto3" json:"applied,omitempty"`
+	Queued        bool                   `protobuf:"varint,2,opt,name=queued,proto3" json:"queued,omitempty"`
+	UserCreated   bool                   `protobuf:"varint,3,opt,name=user_created,json=userCreated,proto3" json:"user_created,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *AddStatResponse) Reset() {
+	*x = AddStatResponse{}
+	mi := &file_service_stat_proto_msgTypes[3]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *AddStatResponse) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*AddStatResponse) ProtoMessage() {}
+
+func (x *AddStatResponse) ProtoReflect() protoreflect.Message {
+	mi := &file_service_stat_proto_msgTypes[3]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use AddStatResponse.ProtoReflect.Descriptor instead.
+func (*AddStatResponse) Descriptor() ([]byte, []int) {
+	return file_service_stat_proto_rawDescGZIP(), []int{3}
+}
+
+func (x *AddStatResponse) GetApplied() bool {
+	if x != nil {
+		return x.Applied
+	}
+	return false
+}
+
+func (x *AddStatResponse) GetQueued() bool {
+	if x != nil {
+		return x.Queued
+	}
+	return false
+}
+
+func (x *AddStatResponse) GetUserCreated() bool {
+	if x != nil {
+		return x.UserCreated
+	}
+	return false
+}
+
+// AddStatsResponse sums up the events sent to AddStats.
+type AddStatsResponse struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Received      int64                  `protobuf:"varint,1,opt,name=received,proto3" json:"received,omitempty"`
+	Applied       int64                  `protobuf:"varint,2,opt,name=applied,proto3" json:"applied,omitempty"`
+	Queued        int64                  `protobuf:"varint,3,opt,name=queued,proto3" json:"queued,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *AddStatsResponse) Reset() {
+	*x = AddStatsResponse{}
+	mi := &file_service_stat_proto_msgTypes[4]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *AddStatsResponse) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*AddStatsResponse) ProtoMessage() {}
+
+func (x *AddStatsResponse) ProtoReflect() protoreflect.Message {
+	mi := &file_service_stat_proto_msgTypes[4]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use AddStatsResponse.ProtoReflect.Descriptor instead.
+func (*AddStatsResponse) Descriptor() ([]byte, []int) {
+	return file_service_stat_proto_rawDescGZIP(), []int{4}
+}
+
+func (x *AddStatsResponse) GetReceived() int64 {
+	if x != nil {
+		return x.Received
+	}
+	return 0
+}
+
+func (x *AddStatsResponse) GetApplied() int64 {
+	if x != nil {
+		return x.Applied
+	}
+	return 0
+}
+
+func (x *AddStatsResponse) GetQueued() int64 {
+	if x != nil {
+		return x.Queued
+	}
+	return 0
+}
+
+// GetTopStatsRequest has the parameters of GET /api/users/stats/top.
+type GetTopStatsRequest struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Date1         string                 `protobuf:"bytes,1,opt,name=date1,proto3" json:"date1,omitempty"`
+	Date2         string                 `protobuf:"bytes,2,opt,name=date2,proto3" json:"date2,omitempty"`
+	Action        string                 `protobuf:"bytes,3,opt,name=action,proto3" json:"action,omitempty"`
+	Limit         int32                  `protobuf:"varint,4,opt,name=limit,proto3" json:"limit,omitempty"`
+	Interval      string                 `protobuf:"bytes,5,opt,name=interval,proto3" json:"interval,omitempty"`
+	Tz            string                 `protobuf:"bytes,6,opt,name=tz,proto3" json:"tz,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *GetTopStatsRequest) Reset() {
+	*x = GetTopStatsRequest{}
+	mi := &file_service_stat_proto_msgTypes[5]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *GetTopStatsRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*GetTopStatsRequest) ProtoMessage() {}
+
+func (x *GetTopStatsRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_service_stat_proto_msgTypes[5]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use GetTopStatsRequest.ProtoReflect.Descriptor instead.
+func (*GetTopStatsRequest) Descriptor() ([]byte, []int) {
+	return file_service_stat_proto_rawDescGZIP(), []int{5}
+}
+
+func (x *GetTopStatsRequest) GetDate1() string {
+	if x != nil {
+		return x.Date1
+	}
+	return ""
+}
+
+func (x *GetTopStatsRequest) GetDate2() string {
+	if x != nil {
+		return x.Date2
+	}
+	return ""
+}
+
+func (x *GetTopStatsRequest) GetAction() string {
+	if x != nil {
+		return x.Action
+	}
+	return ""
+}
+
+func (x *GetTopStatsRequest) GetLimit() int32 {
+	if x != nil {
+		return x.Limit
+	}
+	return 0
+}
+
+func (x *GetTopStatsRequest) GetInterval() string {
+	if x != nil {
+		return x.Interval
+	}
+	return ""
+}
+
+func (x *GetTopStatsRequest) GetTz() string {
+	if x != nil {
+		return x.Tz
+	}
+	return ""
+}
+
+// StatRow is a row of the top users of a bucket.
+type StatRow struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Date          string                 `protobuf:"bytes,1,opt,name=date,proto3" json:"date,omitempty"`
+	Id            int64                  `protobuf:"varint,2,opt,name=id,proto3" json:"id,omitempty"`
+	Age           *int64                 `protobuf:"varint,3,opt,name=age,proto3,oneof" json:"age,omitempty"`
+	Sex           *string                `protobuf:"bytes,4,opt,name=sex,proto3,oneof" json:"sex,omitempty"`
+	Cnt           int64                  `protobuf:"varint,5,opt,name=cnt,proto3" json:"cnt,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *StatRow) Reset() {
+	*x = StatRow{}
+	mi := &file_service_stat_proto_msgTypes[6]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *StatRow) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*StatRow) ProtoMessage() {}
+
+func (x *StatRow) ProtoReflect() protoreflect.Message {
+	mi := &file_service_stat_proto_msgTypes[6]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use StatRow.ProtoReflect.Descriptor instead.
+func (*StatRow) Descriptor() ([]byte, []int) {
+	return file_service_stat_proto_rawDescGZIP(), []int{6}
+}
+
+func (x *StatRow) GetDate() string {
+	if x != nil {
+		return x.Date
+	}
+	return ""
+}
+
+func (x *StatRow) GetId() int64 {
+	if x != nil {
+		return x.Id
+	}
+	return 0
+}
+
+func (x *StatRow) GetAge() int64 {
+	if x != nil && x.Age != nil {
+		return *x.Age
+	}
+	return 0
+}
+
+func (x *StatRow) GetSex() string {
+	if x != nil && x.Sex != nil {
+		return *x.Sex
+	}
+	return ""
+}
+
+func (x *StatRow) GetCnt() int64 {
+	if x != nil {
+		return x.Cnt
+	}
+	return 0
+}
+
+// UserActivityRequest has the parameters of GET /api/users/activity.
+type UserActivityRequest struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	User          int64                  `protobuf:"varint,1,opt,name=user,proto3" json:"user,omitempty"`
+	Date1         string                 `protobuf:"bytes,2,opt,name=date1,proto3" json:"date1,omitempty"`
+	Date2         string                 `protobuf:"bytes,3,opt,name=date2,proto3" json:"date2,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *UserActivityRequest) Reset() {
+	*x = UserActivityRequest{}
+	mi := &file_service_stat_proto_msgTypes[7]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *UserActivityRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*UserActivityRequest) ProtoMessage() {}
+
+func (x *UserActivityRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_service_stat_proto_msgTypes[7]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use UserActivityRequest.ProtoReflect.Descriptor instead.
+func (*UserActivityRequest) Descriptor() ([]byte, []int) {
+	return file_service_stat_proto_rawDescGZIP(), []int{7}
+}
+
+func (x *UserActivityRequest) GetUser() int64 {
+	if x != nil {
+		return x.User
+	}
+	return 0
+}
+
+func (x *UserActivityRequest) GetDate1() string {
+	if x != nil {
+		return x.Date1
+	}
+	return ""
+}
+
+func (x *UserActivityRequest) GetDate2() string {
+	if x != nil {
+		return x.Date2
+	}
+	return ""
+}
+
+// ActivityRow is a daily counter of a user.
+type ActivityRow struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Date          string                 `protobuf:"bytes,1,opt,name=date,proto3" json:"date,omitempty"`
+	Action        string                 `protobuf:"bytes,2,opt,name=action,proto3" json:"action,omitempty"`
+	Cnt           int64                  `protobuf:"varint,3,opt,name=cnt,proto3" json:"cnt,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *ActivityRow) Reset() {
+	*x = ActivityRow{}
+	mi := &file_service_stat_proto_msgTypes[8]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *ActivityRow) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*ActivityRow) ProtoMessage() {}
+
+func (x *ActivityRow) ProtoReflect() protoreflect.Message {
+	mi := &file_service_stat_proto_msgTypes[8]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use ActivityRow.ProtoReflect.Descriptor instead.
+func (*ActivityRow) Descriptor() ([]byte, []int) {
+	return file_service_stat_proto_rawDescGZIP(), []int{8}
+}
+
+func (x *ActivityRow) GetDate() string {
+	if x != nil {
+		return x.Date
+	}
+	return ""
+}
+
+func (x *ActivityRow) GetAction() string {
+	if x != nil {
+		return x.Action
+	}
+	return ""
+}
+
+func (x *ActivityRow) GetCnt() int64 {
+	if x != nil {
+		return x.Cnt
+	}
+	return 0
+}
+
+type UserActivityResponse struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	User          int64                  `protobuf:"varint,1,opt,name=user,proto3" json:"user,omitempty"`
+	Activity      []*ActivityRow         `protobuf:"bytes,2,rep,name=activity,proto3" json:"activity,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *UserActivityResponse) Reset() {
+	*x = UserActivityResponse{}
+	mi := &file_service_stat_proto_msgTypes[9]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *UserActivityResponse) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*UserActivityResponse) ProtoMessage() {}
+
+func (x *UserActivityResponse) ProtoReflect() protoreflect.Message {
+	mi := &file_service_stat_proto_msgTypes[9]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use UserActivityResponse.ProtoReflect.Descriptor instead.
+func (*UserActivityResponse) Descriptor() ([]byte, []int) {
+	return file_service_stat_proto_rawDescGZIP(), []int{9}
+}
+
+func (x *UserActivityResponse) GetUser() int64 {
+	if x != nil {
+		return x.User
+	}
+	return 0
+}
+
+func (x *UserActivityResponse) GetActivity() []*ActivityRow {
+	if x != nil {
+		return x.Activity
+	}
+	return nil
+}
+
+type ActionsRequest struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *ActionsRequest) Reset() {
+	*x = ActionsRequest{}
+	mi := &file_service_stat_proto_msgTypes[10]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *ActionsRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*ActionsRequest) ProtoMessage() {}
+
+func (x *ActionsRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_service_stat_proto_msgTypes[10]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use ActionsRequest.ProtoReflect.Descriptor instead.
+func (*ActionsRequest) Descriptor() ([]byte, []int) {
+	return file_service_stat_proto_rawDescGZIP(), []int{10}
+}
+
+type ActionsResponse struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Actions       []string               `protobuf:"bytes,1,rep,name=actions,proto3" json:"actions,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *ActionsResponse) Reset() {
+	*x = ActionsResponse{}
+	mi := &file_service_stat_proto_msgTypes[11]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *ActionsResponse) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*ActionsResponse) ProtoMessage() {}
+
+func (x *ActionsResponse) ProtoReflect() protoreflect.Message {
+	mi := &file_service_stat_proto_msgTypes[11]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use ActionsResponse.ProtoReflect.Descriptor instead.
+func (*ActionsResponse) Descriptor() ([]byte, []int) {
+	return file_service_stat_proto_rawDescGZIP(), []int{11}
+}
+
+func (x *ActionsResponse) GetActions() []string {
+	if x != nil {
+		return x.Actions
+	}
+	return nil
+}
+
+var File_service_stat_proto protoreflect.FileDescriptor
+
+const file_service_stat_proto_rawDesc = "" +
+	"\n" +
+	"\x12service_stat.proto\x12\fservice_stat\"I\n" +
+	"\x13RegisterUserRequest\x12\x0e\n" +
+	"\x02id\x18\x01 \x01(\x03R\x02id\x12\x10\n" +
+	"\x03age\x18\x02 \x01(\x03R\x03age\x12\x10\n" +
+	"\x03sex\x18\x03 \x01(\tR\x03sex\"\x16\n" +
+	"\x14RegisterUserResponse\"g\n" +
+	"\x0eAddStatRequest\x12\x12\n" +
+	"\x04user\x18\x01 \x01(\x03R\x04user\x12\x16\n" +
+	"\x06action\x18\x02 \x01(\tR\x06action\x12\x0e\n" +
+	"\x02ts\x18\x03 \x01(\tR\x02ts\x12\x19\n" +
+	"\bevent_id\x18\x04 \x01(\tR\aeventId\"f\n" +
+	"\x0fAddStatResponse\x12\x18\n" +
+	"\aapplied\x18\x01 \x01(\bR\aapplied\x12\x16\n" +
+	"\x06queued\x18\x02 \x01(\bR\x06queued\x12!\n" +
+	"\fuser_created\x18\x03 \x01(\bR\vuserCreated\"`\n" +
+	"\x10AddStatsResponse\x12\x1a\n" +
+	"\breceived\x18\x01 \x01(\x03R\breceived\x12\x18\n" +
+	"\aapplied\x18\x02 \x01(\x03R\aapplied\x12\x16\n" +
+	"\x06queued\x18\x03 \x01(\x03R\x06queued\"\x9a\x01\n" +
+	"\x12GetTopStatsRequest\x12\x14\n" +
+	"\x05date1\x18\x01 \x01(\tR\x05date1\x12\x14\n" +
+	"\x05date2\x18\x02 \x01(\tR\x05date2\x12\x16\n" +
+	"\x06action\x18\x03 \x01(\tR\x06action\x12\x14\n" +
+	"\x05limit\x18\x04 \x01(\x05R\x05limit\x12\x1a\n" +
+	"\binterval\x18\x05 \x01(\tR\binterval\x12\x0e\n" +
+	"\x02tz\x18\x06 \x01(\tR\x02tz\"}\n" +
+	"\aStatRow\x12\x12\n" +
+	"\x04date\x18\x01 \x01(\tR\x04date\x12\x0e\n" +
+	"\x02id\x18\x02 \x01(\x03R\x02id\x12\x15\n" +
+	"\x03age\x18\x03 \x01(\x03H\x00R\x03age\x88\x01\x01\x12\x15\n" +
+	"\x03sex\x18\x04 \x01(\tH\x01R\x03sex\x88\x01\x01\x12\x10\n" +
+	"\x03cnt\x18\x05 \x01(\x03R\x03cntB\x06\n" +
+	"\x04_ageB\x06\n" +
+	"\x04_sex\"U\n" +
+	"\x13UserActivityRequest\x12\x12\n" +
+	"\x04user\x18\x01 \x01(\x03R\x04user\x12\x14\n" +
+	"\x05date1\x18\x02 \x01(\tR\x05date1\x12\x14\n" +
+	"\x05date2\x18\x03 \x01(\tR\x05date2\"K\n" +
+	"\vActivityRow\x12\x12\n" +
+	"\x04date\x18\x01 \x01(\tR\x04date\x12\x16\n" +
+	"\x06action\x18\x02 \x01(\tR\x06action\x12\x10\n" +
+	"\x03cnt\x18\x03 \x01(\x03R\x03cnt\"a\n" +
+	"\x14UserActivityResponse\x12\x12\n" +
+	"\x04user\x18\x01 \x01(\x03R\x04user\x125\n" +
+	"\bactivity\x18\x02 \x03(\v2\x19.service_stat.ActivityRowR\bactivity\"\x10\n" +
+	"\x0eActionsRequest\"+\n" +
+	"\x0fActionsResponse\x12\x18\n" +
+	"\aactions\x18\x01 \x03(\tR\aactions2\xdb\x03\n" +
+	"\x05Stats\x12U\n" +
+	"\fRegisterUser\x12!.service_stat.RegisterUserRequest\x1a\".service_stat.RegisterUserResponse\x12F\n" +
+	"\aAddStat\x12\x1c.service_stat.AddStatRequest\x1a\x1d.service_stat.AddStatResponse\x12J\n" +
+	"\bAddStats\x12\x1c.service_stat.AddStatRequest\x1a\x1e.service_stat.AddStatsResponse(\x01\x12H\n" +
+	"\vGetTopStats\x12 .service_stat.GetTopStatsRequest\x1a\x15.service_stat.StatRow0\x01\x12U\n" +
+	"\fUserActivity\x12!.service_stat.UserActivityRequest\x1a\".service_stat.UserActivityResponse\x12F\n" +
+	"\aActions\x12\x1c.service_stat.ActionsRequest\x1a\x1d.service_stat.ActionsResponseB-Z+github.com/zwirec/http_service_stat/statspbb\x06proto3"
+
+var (
+	file_service_stat_proto_rawDescOnce sync.Once
+	file_service_stat_proto_rawDescData []byte
+)
+
+func file_service_stat_proto_rawDescGZIP() []byte {
+	file_service_stat_proto_rawDescOnce.Do(func() {
+		file_service_stat_proto_rawDescData = protoimpl.X.CompressGZIP(unsafe.Slice(unsafe.StringData(file_service_stat_proto_rawDesc), len(file_service_stat_proto_rawDesc)))
+	})
+	return file_service_stat_proto_rawDescData
+}
+
+var file_service_stat_proto_msgTypes = make([]protoimpl.MessageInfo, 12)
+var file_service_stat_proto_goTypes = []any{
+	(*RegisterUserRequest)(nil),  // 0: service_stat.RegisterUserRequest
+	(*RegisterUserResponse)(nil), // 1: service_stat.RegisterUserResponse
+	(*AddStatRequest)(nil),       // 2: service_stat.AddStatRequest
+	(*AddStatResponse)(nil),      // 3: service_stat.AddStatResponse
+	(*AddStatsResponse)(nil),     // 4: service_stat.AddStatsResponse
+	(*GetTopStatsRequest)(nil),   // 5: service_stat.GetTopStatsRequest
+	(*StatRow)(nil),              // 6: service_stat.StatRow
+	(*UserActivityRequest)(nil),  // 7: service_stat.UserActivityRequest
+	(*ActivityRow)(nil),          // 8: service_stat.ActivityRow
+	(*UserActivityResponse)(nil), // 9: service_stat.UserActivityResponse
+	(*ActionsRequest)(nil),       // 10: service_stat.ActionsRequest
+	(*ActionsResponse)(nil),      // 11: service_stat.ActionsResponse
+}
+var file_service_stat_proto_depIdxs = []int32{
+	8,  // 0: service_stat.UserActivityResponse.activity:type_name -> service_stat.ActivityRow
+	0,  // 1: service_stat.Stats.RegisterUser:input_type -> service_stat.RegisterUserRequest
+	2,  // 2: service_stat.Stats.AddStat:input_type -> service_stat.AddStatRequest
+	2,  // 3: service_stat.Stats.AddStats:input_type -> service_stat.AddStatRequest
+	5,  // 4: service_stat.Stats.GetTopStats:input_type -> service_stat.GetTopStatsRequest
+	7,  // 5: service_stat.Stats.UserActivity:input_type -> service_stat.UserActivityRequest
+	10, // 6: service_stat.Stats.Actions:input_type -> service_stat.ActionsRequest
+	1,  // 7: service_stat.Stats.RegisterUser:output_type -> service_stat.RegisterUserResponse
+	3,  // 8: service_stat.Stats.AddStat:output_type -> service_stat.AddStatResponse
+	4,  // 9: service_stat.Stats.AddStats:output_type -> service_stat.AddStatsResponse
+	6,  // 10: service_stat.Stats.GetTopStats:output_type -> service_stat.StatRow
+	9,  // 11: service_stat.Stats.UserActivity:output_type -> service_stat.UserActivityResponse
+	11, // 12: service_stat.Stats.Actions:output_type -> service_stat.ActionsResponse
+	7,  // [7:13] is the sub-list for method output_type
+	1,  // [1:7] is the sub-list for method input_type
+	1,  // [1:1] is the sub-list for extension type_name
+	1,  // [1:1] is the sub-list for extension extendee
+	0,  // [0:1] is the sub-list for field type_name
+}
+
+func init() { file_service_stat_proto_init() }
+func file_service_stat_proto_init() {
+	if File_service_stat_proto != nil {
+		return
+	}
+	file_service_stat_proto_msgTypes[6].OneofWrappers = []any{}
+	type x struct{}
+	out := protoimpl.TypeBuilder{
+		File: protoimpl.DescBuilder{
+			GoPackagePath: reflect.TypeOf(x{}).PkgPath(),
+			RawDescriptor: unsafe.Slice(unsafe.StringData(file_service_stat_proto_rawDesc), len(file_service_stat_proto_rawDesc)),
+			NumEnums:      0,
+			NumMessages:   12,
+			NumExtensions: 0,
+			NumServices:   1,
+		},
+		GoTypes:           file_service_stat_proto_goTypes,
+		DependencyIndexes: file_service_stat_proto_depIdxs,
+		MessageInfos:      file_service_stat_proto_msgTypes,
+	}.Build()
+	File_service_stat_proto = out.File
+	file_service_stat_proto_goTypes = nil
+	file_service_stat_proto_depIdxs = nil
+}
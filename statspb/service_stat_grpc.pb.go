@@ -0,0 +1,333 @@
+// The gRPC API of service_stat. It shares the validation, authentication,
+// rate limits and storage of the HTTP API; API keys go in the "x-api-key"
+// or "authorization" (Bearer) metadata.
+//
+// Regenerate the Go code with
+//
+//	protoc --go_out=. --go_opt=paths=source_relative \
+//	  --go-grpc_out=. --go-grpc_opt=paths=source_relative service_stat.proto
+
+// Code generated by protoc-gen-go-grpc. DO NOT EDIT.
+// versions:
+// - protoc-gen-go-grpc v1.5.1
+// - protoc             v4.25.3
+// source: service_stat.proto
+
+package statspb
+
+import (
+	context "context"
+	grpc "google.golang.org/grpc"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+)
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the grpc package it is being compiled against.
+// Requires gRPC-Go v1.64.0 or later.
+const _ = grpc.SupportPackageIsVersion9
+
+const (
+	Stats_RegisterUser_FullMethodName = "/service_stat.Stats/RegisterUser"
+	Stats_AddStat_FullMethodName      = "/service_stat.Stats/AddStat"
+	Stats_AddStats_FullMethodName     = "/service_stat.Stats/AddStats"
+	Stats_GetTopStats_FullMethodName  = "/service_stat.Stats/GetTopStats"
+	Stats_UserActivity_FullMethodName = "/service_stat.Stats/UserActivity"
+	Stats_Actions_FullMethodName      = "/service_stat.Stats/Actions"
+)
+
+// StatsClient is the client API for Stats service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
+type StatsClient interface {
+	RegisterUser(ctx context.Context, in *RegisterUserRequest, opts ...grpc.CallOption) (*RegisterUserResponse, error)
+	AddStat(ctx context.Context, in *AddStatRequest, opts ...grpc.CallOption) (*AddStatResponse, error)
+	// AddStats records the events of a stream one by one. The first refused
+	// event ends the stream with its error; the events before it stay
+	// recorded.
+	AddStats(ctx context.Context, opts ...grpc.CallOption) (grpc.ClientStreamingClient[AddStatRequest, AddStatsResponse], error)
+	// GetTopStats sends the rows of GET /api/users/stats/top as they are
+	// read, in bucket order.
+	GetTopStats(ctx context.Context, in *GetTopStatsRequest, opts ...grpc.CallOption) (grpc.ServerStreamingClient[StatRow], error)
+	// UserActivity returns the daily counters of a user, as
+	// GET /api/users/activity.
+	UserActivity(ctx context.Context, in *UserActivityRequest, opts ...grpc.CallOption) (*UserActivityResponse, error)
+	// Actions returns the action catalogue of the tenant, as GET /api/actions.
+	Actions(ctx context.Context, in *ActionsRequest, opts ...grpc.CallOption) (*ActionsResponse, error)
+}
+
+type statsClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewStatsClient(cc grpc.ClientConnInterface) StatsClient {
+	return &statsClient{cc}
+}
+
+func (c *statsClient) RegisterUser(ctx context.Context, in *RegisterUserRequest, opts ...grpc.CallOption) (*RegisterUserResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(RegisterUserResponse)
+	err := c.cc.Invoke(ctx, Stats_RegisterUser_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *statsClient) AddStat(ctx context.Context, in *AddStatRequest, opts ...grpc.CallOption) (*AddStatResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(AddStatResponse)
+	err := c.cc.Invoke(ctx, Stats_AddStat_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *statsClient) AddStats(ctx context.Context, opts ...grpc.CallOption) (grpc.ClientStreamingClient[AddStatRequest, AddStatsResponse], error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	stream, err := c.cc.NewStream(ctx, &Stats_ServiceDesc.Streams[0], Stats_AddStats_FullMethodName, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &grpc.GenericClientStream[AddStatRequest, AddStatsResponse]{ClientStream: stream}
+	return x, nil
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type Stats_AddStatsClient = grpc.ClientStreamingClient[AddStatRequest, AddStatsResponse]
+
+func (c *statsClient) GetTopStats(ctx context.Context, in *GetTopStatsRequest, opts ...grpc.CallOption) (grpc.ServerStreamingClient[StatRow], error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	stream, err := c.cc.NewStream(ctx, &Stats_ServiceDesc.Streams[1], Stats_GetTopStats_FullMethodName, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &grpc.GenericClientStream[GetTopStatsRequest, StatRow]{ClientStream: stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type Stats_GetTopStatsClient = grpc.ServerStreamingClient[StatRow]
+
+func (c *statsClient) UserActivity(ctx context.Context, in *UserActivityRequest, opts ...grpc.CallOption) (*UserActivityResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(UserActivityResponse)
+	err := c.cc.Invoke(ctx, Stats_UserActivity_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *statsClient) Actions(ctx context.Context, in *ActionsRequest, opts ...grpc.CallOption) (*ActionsResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(ActionsResponse)
+	err := c.cc.Invoke(ctx, Stats_Actions_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// StatsServer is the server API for Stats service.
+// All implementations must embed UnimplementedStatsServer
+// for forward compatibility.
+type StatsServer interface {
+	RegisterUser(context.Context, *RegisterUserRequest) (*RegisterUserResponse, error)
+	AddStat(context.Context, *AddStatRequest) (*AddStatResponse, error)
+	// AddStats records the events of a stream one by one. The first refused
+	// event ends the stream with its error; the events before it stay
+	// recorded.
+	AddStats(grpc.ClientStreamingServer[AddStatRequest, AddStatsResponse]) error
+	// GetTopStats sends the rows of GET /api/users/stats/top as they are
+	// read, in bucket order.
+	GetTopStats(*GetTopStatsRequest, grpc.ServerStreamingServer[StatRow]) error
+	// UserActivity returns the daily counters of a user, as
+	// GET /api/users/activity.
+	UserActivity(context.Context, *UserActivityRequest) (*UserActivityResponse, error)
+	// Actions returns the action catalogue of the tenant, as GET /api/actions.
+	Actions(context.Context, *ActionsRequest) (*ActionsResponse, error)
+	mustEmbedUnimplementedStatsServer()
+}
+
+// UnimplementedStatsServer must be embedded to have
+// forward compatible implementations.
+//
+// NOTE: this should be embedded by value instead of pointer to avoid a nil
+// pointer dereference when methods are called.
+type UnimplementedStatsServer struct{}
+
+func (UnimplementedStatsServer) RegisterUser(context.Context, *RegisterUserRequest) (*RegisterUserResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method RegisterUser not implemented")
+}
+func (UnimplementedStatsServer) AddStat(context.Context, *AddStatRequest) (*AddStatResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method AddStat not implemented")
+}
+func (UnimplementedStatsServer) AddStats(grpc.ClientStreamingServer[AddStatRequest, AddStatsResponse]) error {
+	return status.Errorf(codes.Unimplemented, "method AddStats not implemented")
+}
+func (UnimplementedStatsServer) GetTopStats(*GetTopStatsRequest, grpc.ServerStreamingServer[StatRow]) error {
+	return status.Errorf(codes.Unimplemented, "method GetTopStats not implemented")
+}
+func (UnimplementedStatsServer) UserActivity(context.Context, *UserActivityRequest) (*UserActivityResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method UserActivity not implemented")
+}
+func (UnimplementedStatsServer) Actions(context.Context, *ActionsRequest) (*ActionsResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Actions not implemented")
+}
+func (UnimplementedStatsServer) mustEmbedUnimplementedStatsServer() {}
+func (UnimplementedStatsServer) testEmbeddedByValue()               {}
+
+// UnsafeStatsServer may be embedded to opt out of forward compatibility for this service.
+// Use of this interface is not recommended, as added methods to StatsServer will
+// result in compilation errors.
+type UnsafeStatsServer interface {
+	mustEmbedUnimplementedStatsServer()
+}
+
+func RegisterStatsServer(s grpc.ServiceRegistrar, srv StatsServer) {
+	// If the following call pancis, it indicates UnimplementedStatsServer was
+	// embedded by pointer and is nil.  This will cause panics if an
+	// unimplemented method is ever invoked, so we test this at initialization
+	// time to prevent it from happening at runtime later due to I/O.
+	if t, ok := srv.(interface{ testEmbeddedByValue() }); ok {
+		t.testEmbeddedByValue()
+	}
+	s.RegisterService(&Stats_ServiceDesc, srv)
+}
+
+func _Stats_RegisterUser_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(RegisterUserRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(StatsServer).RegisterUser(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Stats_RegisterUser_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(StatsServer).RegisterUser(ctx, req.(*RegisterUserRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Stats_AddStat_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(AddStatRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(StatsServer).AddStat(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Stats_AddStat_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(StatsServer).AddStat(ctx, req.(*AddStatRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Stats_AddStats_Handler(srv interface{}, stream grpc.ServerStream) error {
+	return srv.(StatsServer).AddStats(&grpc.GenericServerStream[AddStatRequest, AddStatsResponse]{ServerStream: stream})
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type Stats_AddStatsServer = grpc.ClientStreamingServer[AddStatRequest, AddStatsResponse]
+
+func _Stats_GetTopStats_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(GetTopStatsRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(StatsServer).GetTopStats(m, &grpc.GenericServerStream[GetTopStatsRequest, StatRow]{ServerStream: stream})
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type Stats_GetTopStatsServer = grpc.ServerStreamingServer[StatRow]
+
+func _Stats_UserActivity_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(UserActivityRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(StatsServer).UserActivity(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Stats_UserActivity_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(StatsServer).UserActivity(ctx, req.(*UserActivityRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Stats_Actions_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ActionsRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(StatsServer).Actions(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Stats_Actions_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(StatsServer).Actions(ctx, req.(*ActionsRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+// Stats_ServiceDesc is the grpc.ServiceDesc for Stats service.
+// It's only intended for direct use with grpc.RegisterService,
+// and not to be introspected or modified (even as a copy)
+var Stats_ServiceDesc = grpc.ServiceDesc{
+	ServiceName: "service_stat.Stats",
+	HandlerType: (*StatsServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "RegisterUser",
+			Handler:    _Stats_RegisterUser_Handler,
+		},
+		{
+			MethodName: "AddStat",
+			Handler:    _Stats_AddStat_Handler,
+		},
+		{
+			MethodName: "UserActivity",
+			Handler:    _Stats_UserActivity_Handler,
+		},
+		{
+			MethodName: "Actions",
+			Handler:    _Stats_Actions_Handler,
+		},
+	},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "AddStats",
+			Handler:       _Stats_AddStats_Handler,
+			ClientStreams: true,
+		},
+		{
+			StreamName:    "GetTopStats",
+			Handler:       _Stats_GetTopStats_Handler,
+			ServerStreams: true,
+		},
+	},
+	Metadata: "service_stat.proto",
+}
@@ -0,0 +1,229 @@
+// Package stream fans the events recorded out to the clients of the live
+// stream and keeps the recent ones for the clients that reconnect.
+//
+// Each instance of the service streams the events it recorded itself.
+package stream
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/zwirec/http_service_stat/dbManager"
+)
+
+// ErrTooManyClients is returned by Subscribe when the hub has as many
+// subscriptions as it allows.
+var ErrTooManyClients = errors.New("stream: too many clients")
+
+// Event is an event recorded, as streamed.
+type Event struct {
+	// ID orders the events. IDs start from the time the hub was made, in
+	// microseconds, so that they keep growing across restarts.
+	ID     uint64 `json:"id"`
+	User   int64  `json:"user"`
+	Action string `json:"action"`
+	TS     string `json:"ts"`
+}
+
+// Filter selects the events of a subscription. Empty Actions or Users
+// select every action or user.
+type Filter struct {
+	Tenant  int
+	Actions []string
+	Users   []int64
+}
+
+func (f *Filter) match(e *entry) bool {
+	if e.tenant != f.Tenant {
+		return false
+	}
+
+	if len(f.Actions) > 0 && !containsString(f.Actions, e.Action) {
+		return false
+	}
+	return len(f.Users) == 0 || containsInt64(f.Users, e.User)
+}
+
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+func containsInt64(list []int64, n int64) bool {
+	for _, v := range list {
+		if v == n {
+			return true
+		}
+	}
+	return false
+}
+
+type entry struct {
+	tenant int
+	Event
+}
+
+// Subscription is the events of a client.
+type Subscription struct {
+	filter Filter
+	events chan Event
+
+	// Replay are the events after the last one the client had, Missed
+	// whether some of them are no longer kept.
+	Replay []Event
+	Missed bool
+
+	// lagged is set, before events is closed, when the client fell behind.
+	lagged bool
+}
+
+// Events returns the events published since Subscribe. It is closed when
+// the client falls behind by more than the buffer of the hub, see Lagged,
+// or the subscription is closed.
+func (s *Subscription) Events() <-chan Event {
+	return s.events
+}
+
+// Lagged reports whether Events was closed because the client fell
+// behind. It is only meaningful once Events is closed.
+func (s *Subscription) Lagged() bool {
+	return s.lagged
+}
+
+// Hub publishes the events to the subscriptions matching them.
+type Hub struct {
+	mu sync.Mutex
+	// next is the ID of the next event.
+	next uint64
+	// history are the last events, oldest first from start.
+	history []entry
+	start   int
+	size    int
+	buffer  int
+	max     int
+	subs    map[*Subscription]struct{}
+	closed  bool
+}
+
+// NewHub returns a hub keeping history events for the clients that
+// reconnect, at most max subscriptions, each buffering up to buffer
+// events.
+func NewHub(history, buffer, max int) *Hub {
+	return &Hub{
+		next:    uint64(time.Now().UnixMicro()),
+		history: make([]entry, history),
+		buffer:  buffer,
+		max:     max,
+		subs:    map[*Subscription]struct{}{},
+	}
+}
+
+// Publish streams values, an event recorded for tenant. Events whose user
+// is not an integer are not streamed. Subscriptions that cannot take the
+// event are ended rather than holding up the event.
+func (h *Hub) Publish(tenant int, values map[string]interface{}) {
+	user, ok := dbManager.UserID(values["user"])
+
+	if !ok {
+		return
+	}
+
+	action, _ := values["action"].(string)
+	ts, _ := values["ts"].(string)
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.closed {
+		return
+	}
+
+	e := entry{tenant: tenant, Event: Event{ID: h.next, User: user, Action: action, TS: ts}}
+	h.next++
+
+	if len(h.history) > 0 {
+		if h.size < len(h.history) {
+			h.history[(h.start+h.size)%len(h.history)] = e
+			h.size++
+		} else {
+			h.history[h.start] = e
+			h.start = (h.start + 1) % len(h.history)
+		}
+	}
+
+	for s := range h.subs {
+		if !s.filter.match(&e) {
+			continue
+		}
+
+		select {
+		case s.events <- e.Event:
+		default:
+			s.lagged = true
+			h.remove(s)
+		}
+	}
+}
+
+// Subscribe returns the subscription of a client to the events filter
+// selects. A client that reconnects passes the ID of the last event it had
+// as lastID and resume true to get the kept events after it in Replay.
+func (h *Hub) Subscribe(filter Filter, lastID uint64, resume bool) (*Subscription, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.closed || len(h.subs) >= h.max {
+		return nil, ErrTooManyClients
+	}
+
+	s := &Subscription{filter: filter, events: make(chan Event, h.buffer)}
+
+	if resume && lastID+1 < h.next {
+		oldest := h.next - uint64(h.size)
+		s.Missed = lastID+1 < oldest
+
+		for i := 0; i < h.size; i++ {
+			e := &h.history[(h.start+i)%len(h.history)]
+
+			if e.ID > lastID && filter.match(e) {
+				s.Replay = append(s.Replay, e.Event)
+			}
+		}
+	}
+
+	h.subs[s] = struct{}{}
+	return s, nil
+}
+
+// Unsubscribe ends s. It can be called after s ended.
+func (h *Hub) Unsubscribe(s *Subscription) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.remove(s)
+}
+
+func (h *Hub) remove(s *Subscription) {
+	if _, ok := h.subs[s]; ok {
+		delete(h.subs, s)
+		close(s.events)
+	}
+}
+
+// Close ends every subscription and refuses new ones, so that streaming
+// responses finish on shutdown.
+func (h *Hub) Close() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.closed = true
+
+	for s := range h.subs {
+		h.remove(s)
+	}
+}
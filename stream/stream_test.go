@@ -0,0 +1,103 @@
+package stream
+
+import (
+	"testing"
+)
+
+func event(user int, action string) map[string]interface{} {
+	return map[string]interface{}{"user": float64(user), "action": action, "ts": "2012-02-02"}
+}
+
+func TestHub(t *testing.T) {
+	h := NewHub(3, 2, 2)
+
+	likes, err := h.Subscribe(Filter{Tenant: 3, Actions: []string{"like"}}, 0, false)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	user2, err := h.Subscribe(Filter{Tenant: 3, Users: []int64{2}}, 0, false)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = h.Subscribe(Filter{}, 0, false); err != ErrTooManyClients {
+		t.Errorf("third subscription: got %v want ErrTooManyClients", err)
+	}
+
+	h.Publish(3, event(1, "like"))
+	h.Publish(0, event(2, "like"))
+	h.Publish(3, event(2, "login"))
+	h.Publish(3, map[string]interface{}{"user": 2.5, "action": "like", "ts": "2012-02-02"})
+
+	if e := <-likes.Events(); e.User != 1 || e.Action != "like" {
+		t.Errorf("likes got %+v", e)
+	}
+
+	first := <-user2.Events()
+
+	if first.User != 2 || first.Action != "login" {
+		t.Errorf("user 2 got %+v", first)
+	}
+
+	if len(likes.Events()) != 0 || len(user2.Events()) != 0 {
+		t.Errorf("events of other tenants or users were published")
+	}
+
+	// user2 takes two more events, not a third.
+	h.Publish(3, event(2, "logout"))
+	h.Publish(3, event(2, "logout"))
+	h.Publish(3, event(2, "logout"))
+
+	n := 0
+
+	for range user2.Events() {
+		n++
+	}
+
+	if n != 2 || !user2.Lagged() {
+		t.Errorf("lagging subscription got %d events, lagged %v", n, user2.Lagged())
+	}
+
+	if likes.Lagged() {
+		t.Errorf("likes lagged")
+	}
+
+	h.Unsubscribe(likes)
+
+	// A client reconnecting gets the kept events after the last it had.
+	resumed, err := h.Subscribe(Filter{Tenant: 3, Users: []int64{2}}, first.ID, true)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(resumed.Replay) != 3 || resumed.Replay[0].ID != first.ID+1 || resumed.Missed {
+		t.Errorf("replay after %d: %+v, missed %v", first.ID, resumed.Replay, resumed.Missed)
+	}
+
+	h.Unsubscribe(resumed)
+
+	// The events before the last three are no longer kept.
+	resumed, err = h.Subscribe(Filter{Tenant: 3}, first.ID-3, true)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(resumed.Replay) != 3 || !resumed.Missed {
+		t.Errorf("replay after %d: %+v, missed %v", first.ID-3, resumed.Replay, resumed.Missed)
+	}
+
+	h.Close()
+
+	if _, ok := <-resumed.Events(); ok || resumed.Lagged() {
+		t.Errorf("subscription not ended by Close")
+	}
+
+	if _, err = h.Subscribe(Filter{}, 0, false); err != ErrTooManyClients {
+		t.Errorf("subscription after Close: got %v want ErrTooManyClients", err)
+	}
+}